@@ -2,6 +2,8 @@ package config
 
 import (
 	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -11,18 +13,197 @@ const (
 	RedisHost = "localhost:6379"
 	// HTTP server configuration
 	ServerPort = "8080"
+	// Run modes: OTPs are only ever returned over HTTP in development mode
+	RunModeProduction  = "production"
+	RunModeDevelopment = "development"
+	RunModeTest        = "test"
+	// Default interval at which the memory and file stores remove expired entries
+	DefaultStoreSweepInterval = time.Minute
 	// Default OTP TTL (e.g., 10 minutes)
 	DefaultOTPTTL = 10 * time.Minute
+	// Default time a verification session can be looked up after its OTP expires
+	DefaultSessionRetention = time.Hour
+	// Default OTP format
+	DefaultOTPLength    = 6
+	DefaultOTPAlphabet  = "numeric"
+	DefaultOTPGroupSize = 0
+	// Default brute-force protection settings
+	DefaultMaxOTPAttempts = 5
+	DefaultLockoutBase    = time.Minute
+	DefaultLockoutMax     = time.Hour
+	// Default rate limits for /otp/generate and /otp/resend
+	DefaultRateLimitWindow         = time.Hour
+	DefaultRateLimitPerUsername    = 10
+	DefaultRateLimitPerIP          = 50
+	DefaultRateLimitPerDestination = 10
+	DefaultRateLimitGlobal         = 10000
+	// Default TOTP settings; the defaults are what most authenticator apps support
+	DefaultTOTPIssuer    = "otp-generator"
+	DefaultTOTPAlgorithm = "SHA1"
+	DefaultTOTPDigits    = 6
+	DefaultTOTPPeriod    = 30 * time.Second
+	DefaultTOTPSkew      = 1
+	// Default HOTP settings
+	DefaultHOTPAlgorithm    = "SHA1"
+	DefaultHOTPDigits       = 6
+	DefaultHOTPLookAhead    = 10
+	DefaultHOTPResyncWindow = 100
+	// Default locale of messages, used when a request names none or one without templates
+	DefaultLocale = "en"
+	// Default number of codes in a recovery code set
+	DefaultRecoveryCodeCount = 10
+	// Delivery queues: inline sends during the request, memory and redis queue
+	// messages for a pool of workers, and redis keeps them in a Redis stream
+	DeliveryQueueInline = "inline"
+	DeliveryQueueMemory = "memory"
+	DeliveryQueueRedis  = "redis"
+	// Default delivery queue settings
+	DefaultDeliveryWorkers     = 4
+	DefaultDeliveryMaxAttempts = 5
+	DefaultDeliveryBackoffBase = 2 * time.Second
+	DefaultDeliveryBackoffMax  = time.Minute
+	DefaultDeliveryTimeout     = 10 * time.Second
 )
 
 var (
+	// Run mode: "production" (default), "development" or "test"
+	RunMode = getEnvOrDefault("APP_MODE", RunModeProduction)
+
 	// OTP TTL (can remain as a variable if you anticipate changes at runtime)
 	OTPTTL = DefaultOTPTTL
 
+	// How long a verification session's status can be looked up after its OTP expires
+	SessionRetention = getEnvDurationOrDefault("SESSION_RETENTION", DefaultSessionRetention)
+
+	// OTP format policy, used when a request does not specify its own format
+	OTPLength    = getEnvIntOrDefault("OTP_LENGTH", DefaultOTPLength)
+	OTPAlphabet  = getEnvOrDefault("OTP_ALPHABET", DefaultOTPAlphabet)
+	OTPGroupSize = getEnvIntOrDefault("OTP_GROUP_SIZE", DefaultOTPGroupSize)
+
+	// OTP store configuration: "redis", "memory" or "file"
+	OTPStoreBackend = getEnvOrDefault("OTP_STORE", "redis")
+	OTPStoreFile    = getEnvOrDefault("OTP_STORE_FILE", "otp-store.json")
+	// How often the memory and file stores remove expired entries that are never read again
+	StoreSweepInterval = getEnvDurationOrDefault("STORE_SWEEP_INTERVAL", DefaultStoreSweepInterval)
+
+	// HMAC keyring used to hash OTPs at rest, as "id:secret,id:secret".
+	// The first key hashes new OTPs; later keys only verify OTPs issued before a rotation.
+	OTPHMACKeys = getEnvOrDefault("OTP_HMAC_KEYS", "")
+
+	// Brute-force protection: failed attempts allowed per OTP, and the lockout
+	// window that doubles with every lockout up to LockoutMax
+	MaxOTPAttempts = getEnvIntOrDefault("OTP_MAX_ATTEMPTS", DefaultMaxOTPAttempts)
+	LockoutBase    = getEnvDurationOrDefault("OTP_LOCKOUT_BASE", DefaultLockoutBase)
+	LockoutMax     = getEnvDurationOrDefault("OTP_LOCKOUT_MAX", DefaultLockoutMax)
+
+	// Rate limiting: requests allowed per sliding window for each budget. A limit of 0 disables that budget.
+	RateLimitWindow         = getEnvDurationOrDefault("RATE_LIMIT_WINDOW", DefaultRateLimitWindow)
+	RateLimitPerUsername    = getEnvIntOrDefault("RATE_LIMIT_PER_USERNAME", DefaultRateLimitPerUsername)
+	RateLimitPerIP          = getEnvIntOrDefault("RATE_LIMIT_PER_IP", DefaultRateLimitPerIP)
+	RateLimitPerDestination = getEnvIntOrDefault("RATE_LIMIT_PER_DESTINATION", DefaultRateLimitPerDestination)
+	RateLimitGlobal         = getEnvIntOrDefault("RATE_LIMIT_GLOBAL", DefaultRateLimitGlobal)
+	// Trust the last X-Forwarded-For address, which the proxy appends, as the client IP (only behind a trusted proxy)
+	TrustForwardedFor = getEnvOrDefault("TRUST_FORWARDED_FOR", "") == "true"
+
+	// TOTP settings: the issuer shown in authenticator apps, the defaults for new
+	// enrollments, and how many time steps either side of the current one are accepted
+	TOTPIssuer    = getEnvOrDefault("TOTP_ISSUER", DefaultTOTPIssuer)
+	TOTPAlgorithm = getEnvOrDefault("TOTP_ALGORITHM", DefaultTOTPAlgorithm)
+	TOTPDigits    = getEnvIntOrDefault("TOTP_DIGITS", DefaultTOTPDigits)
+	TOTPPeriod    = getEnvDurationOrDefault("TOTP_PERIOD", DefaultTOTPPeriod)
+	TOTPSkew      = getEnvIntOrDefault("TOTP_SKEW", DefaultTOTPSkew)
+
+	// HOTP settings: the defaults for new tokens, how many counters ahead of the
+	// expected one a code may be, and how far a resync searches
+	HOTPAlgorithm    = getEnvOrDefault("HOTP_ALGORITHM", DefaultHOTPAlgorithm)
+	HOTPDigits       = getEnvIntOrDefault("HOTP_DIGITS", DefaultHOTPDigits)
+	HOTPLookAhead    = getEnvIntOrDefault("HOTP_LOOK_AHEAD", DefaultHOTPLookAhead)
+	HOTPResyncWindow = getEnvIntOrDefault("HOTP_RESYNC_WINDOW", DefaultHOTPResyncWindow)
+
+	// Number of recovery codes generated when a request does not specify it
+	RecoveryCodeCount = getEnvIntOrDefault("RECOVERY_CODE_COUNT", DefaultRecoveryCodeCount)
+
+	// Destination policy, as comma-separated lists. Empty allow lists allow everything not denied.
+	// Denied prefixes are rejected in addition to the built-in premium-rate ranges.
+	AllowedCountryCodes = getEnvListOrDefault("PHONE_ALLOWED_COUNTRY_CODES", nil)
+	DeniedCountryCodes  = getEnvListOrDefault("PHONE_DENIED_COUNTRY_CODES", nil)
+	DeniedPhonePrefixes = getEnvListOrDefault("PHONE_DENIED_PREFIXES", nil)
+	AllowedEmailDomains = getEnvListOrDefault("EMAIL_ALLOWED_DOMAINS", nil)
+	DeniedEmailDomains  = getEnvListOrDefault("EMAIL_DENIED_DOMAINS", nil)
+
+	// Delivery queue: "inline" (default), "memory" or "redis", the number of
+	// workers, and attempts per message with a doubling delay between them
+	DeliveryQueue       = getEnvOrDefault("DELIVERY_QUEUE", DeliveryQueueInline)
+	DeliveryWorkers     = getEnvIntOrDefault("DELIVERY_WORKERS", DefaultDeliveryWorkers)
+	DeliveryMaxAttempts = getEnvIntOrDefault("DELIVERY_MAX_ATTEMPTS", DefaultDeliveryMaxAttempts)
+	DeliveryBackoffBase = getEnvDurationOrDefault("DELIVERY_BACKOFF_BASE", DefaultDeliveryBackoffBase)
+	DeliveryBackoffMax  = getEnvDurationOrDefault("DELIVERY_BACKOFF_MAX", DefaultDeliveryBackoffMax)
+	// How long a send may take before the next channel is tried
+	DeliveryTimeout = getEnvDurationOrDefault("DELIVERY_TIMEOUT", DefaultDeliveryTimeout)
+	// Fallback chains such as "whatsapp:sms:email,sms:email", used when a
+	// request for the first channel of a chain does not name its own fallback
+	DeliveryFallbacks = getEnvListOrDefault("DELIVERY_FALLBACKS", nil)
+
+	// URL of a service that resolves user IDs to their registered destinations; empty disables the lookup
+	DestinationLookupURL = getEnvOrDefault("DESTINATION_LOOKUP_URL", "")
+
+	// Magic links: the public base URL links point at, and where the browser is
+	// redirected after a link is opened. Without redirect URLs the result is returned as JSON.
+	MagicLinkBaseURL    = getEnvOrDefault("MAGIC_LINK_BASE_URL", "http://localhost:"+ServerPort)
+	MagicLinkSuccessURL = getEnvOrDefault("MAGIC_LINK_SUCCESS_URL", "")
+	MagicLinkFailureURL = getEnvOrDefault("MAGIC_LINK_FAILURE_URL", "")
+
+	// Messages: the app name they use, a directory of templates replacing the built-in ones, and the default locale
+	AppName       = getEnvOrDefault("APP_NAME", TOTPIssuer)
+	TemplateDir   = getEnvOrDefault("TEMPLATE_DIR", "")
+	MessageLocale = getEnvOrDefault("DEFAULT_LOCALE", DefaultLocale)
+	// SMS auto-fill profiles requests can name, e.g. "android:sms_retriever:FA+9qCX9VSu,web:webotp:example.com"
+	AutoFillProfiles = getEnvListOrDefault("AUTOFILL_PROFILES", nil)
+	// Transliterate SMS messages to GSM-7 when that takes fewer segments than UCS-2
+	SMSTransliterate = getEnvOrDefault("SMS_TRANSLITERATE", "") == "true"
+	// Bearer token GET /metrics requires; empty does not serve metrics
+	MetricsToken = getEnvOrDefault("METRICS_TOKEN", "")
+
 	// Twilio configuration (loaded from environment variables)
 	TwilioAccountSID  = getEnvOrDefault("TWILIO_ACCOUNT_SID", "")
 	TwilioAuthToken   = getEnvOrDefault("TWILIO_AUTH_TOKEN", "")
 	TwilioPhoneNumber = getEnvOrDefault("TWILIO_PHONE_NUMBER", "")
+	// Voice and language voice calls read codes out in; empty uses Twilio's default voice
+	TwilioVoice         = getEnvOrDefault("TWILIO_VOICE", "")
+	TwilioVoiceLanguage = getEnvOrDefault("TWILIO_VOICE_LANGUAGE", "en-US")
+	// Public URL of /webhooks/twilio/status that Twilio reports message status to; empty disables the reports
+	TwilioStatusCallbackURL = getEnvOrDefault("TWILIO_STATUS_CALLBACK_URL", "")
+
+	// SMS providers tried in order until one accepts a message: twilio, vonage, sns or webhook
+	SMSProviders = getEnvListOrDefault("SMS_PROVIDERS", []string{"twilio"})
+
+	// Vonage configuration (loaded from environment variables)
+	VonageAPIKey    = getEnvOrDefault("VONAGE_API_KEY", "")
+	VonageAPISecret = getEnvOrDefault("VONAGE_API_SECRET", "")
+	VonageFrom      = getEnvOrDefault("VONAGE_FROM", "")
+
+	// AWS SNS configuration (loaded from environment variables)
+	AWSAccessKeyID     = getEnvOrDefault("AWS_ACCESS_KEY_ID", "")
+	AWSSecretAccessKey = getEnvOrDefault("AWS_SECRET_ACCESS_KEY", "")
+	AWSSessionToken    = getEnvOrDefault("AWS_SESSION_TOKEN", "")
+	AWSRegion          = getEnvOrDefault("AWS_REGION", "")
+	SNSSenderID        = getEnvOrDefault("SNS_SENDER_ID", "")
+	SNSSMSType         = getEnvOrDefault("SNS_SMS_TYPE", "Transactional")
+
+	// Generic HTTP webhook that SMS messages are POSTed to as JSON
+	SMSWebhookURL    = getEnvOrDefault("SMS_WEBHOOK_URL", "")
+	SMSWebhookSecret = getEnvOrDefault("SMS_WEBHOOK_SECRET", "")
+	// Extra request headers, e.g. "Authorization: Bearer abc123"
+	SMSWebhookHeaders = getEnvListOrDefault("SMS_WEBHOOK_HEADERS", nil)
+
+	// SMTP configuration (loaded from environment variables)
+	SMTPHost          = getEnvOrDefault("SMTP_HOST", "")
+	SMTPPort          = getEnvOrDefault("SMTP_PORT", "")
+	SMTPUsername      = getEnvOrDefault("SMTP_USERNAME", "")
+	SMTPPassword      = getEnvOrDefault("SMTP_PASSWORD", "")
+	SMTPFrom          = getEnvOrDefault("SMTP_FROM", "")
+	SMTPSecurity      = getEnvOrDefault("SMTP_SECURITY", "starttls")
+	SMTPAuthMechanism = getEnvOrDefault("SMTP_AUTH", "plain")
 )
 
 // getEnvOrDefault gets an environment variable or returns a default value if not set
@@ -33,3 +214,42 @@ func getEnvOrDefault(key, defaultValue string) string {
 	}
 	return value
 }
+
+// getEnvIntOrDefault gets an integer environment variable or returns a default value if not set or invalid
+func getEnvIntOrDefault(key string, defaultValue int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+// getEnvDurationOrDefault gets a duration environment variable (e.g. "90s") or returns a default value if not set or invalid
+func getEnvDurationOrDefault(key string, defaultValue time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+// getEnvListOrDefault gets a comma-separated environment variable as a list or returns a default value if not set
+func getEnvListOrDefault(key string, defaultValue []string) []string {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// ValidRunMode reports whether RunMode is one of the supported run modes
+func ValidRunMode() bool {
+	return RunMode == RunModeProduction || RunMode == RunModeDevelopment || RunMode == RunModeTest
+}
@@ -0,0 +1,114 @@
+package delivery
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// maxDeadLetters bounds the dead letters a backend keeps
+const maxDeadLetters = 1000
+
+// scheduledJob is a job in a MemoryBackend and when it is due
+type scheduledJob struct {
+	job Job
+	at  time.Time
+}
+
+// MemoryBackend keeps jobs in process. Jobs that are queued when the process
+// exits are lost; use a RedisStreamBackend when that matters.
+type MemoryBackend struct {
+	mu   sync.Mutex
+	jobs []scheduledJob
+	dead []DeadLetter
+	// changed is closed and replaced by every Push, waking every waiting Pop
+	changed chan struct{}
+}
+
+// NewMemoryBackend creates an empty MemoryBackend
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{changed: make(chan struct{})}
+}
+
+// Push implements Backend
+func (b *MemoryBackend) Push(ctx context.Context, job Job, at time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.jobs = append(b.jobs, scheduledJob{job: job, at: at})
+	close(b.changed)
+	b.changed = make(chan struct{})
+	return nil
+}
+
+// Pop implements Backend, handing out the job that has been due the longest
+func (b *MemoryBackend) Pop(ctx context.Context) (Job, error) {
+	for {
+		job, wait, changed, ok := b.next()
+		if ok {
+			return job, nil
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return Job{}, ctx.Err()
+		case <-changed:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// next removes and returns the earliest due job, or reports how long until
+// one could be due and the channel the next Push closes. The channel is taken
+// with the jobs, so a Push made after they were checked is never missed.
+func (b *MemoryBackend) next() (Job, time.Duration, <-chan struct{}, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	earliest := -1
+	for i, scheduled := range b.jobs {
+		if earliest < 0 || scheduled.at.Before(b.jobs[earliest].at) {
+			earliest = i
+		}
+	}
+	if earliest < 0 {
+		return Job{}, time.Minute, b.changed, false
+	}
+
+	if wait := time.Until(b.jobs[earliest].at); wait > 0 {
+		return Job{}, wait, b.changed, false
+	}
+	job := b.jobs[earliest].job
+	b.jobs = append(b.jobs[:earliest], b.jobs[earliest+1:]...)
+	return job, 0, nil, true
+}
+
+// Ack implements Backend. Popped jobs are already removed, so there is nothing to do.
+func (b *MemoryBackend) Ack(ctx context.Context, job Job) error {
+	return nil
+}
+
+// DeadLetter implements Backend
+func (b *MemoryBackend) DeadLetter(ctx context.Context, letter DeadLetter) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.dead = append(b.dead, letter)
+	if len(b.dead) > maxDeadLetters {
+		b.dead = b.dead[len(b.dead)-maxDeadLetters:]
+	}
+	return nil
+}
+
+// DeadLetters implements Backend
+func (b *MemoryBackend) DeadLetters(ctx context.Context, limit int) ([]DeadLetter, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var letters []DeadLetter
+	for i := len(b.dead) - 1; i >= 0 && len(letters) < limit; i-- {
+		letters = append(letters, b.dead[i])
+	}
+	return letters, nil
+}
@@ -0,0 +1,255 @@
+package delivery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Delivery statuses reported for a job
+const (
+	StatusQueued    = "queued"
+	StatusRetrying  = "retrying" // The last attempt failed and another is scheduled
+	StatusDelivered = "delivered"
+	StatusFailed    = "failed"    // Every attempt failed; the job was dead-lettered
+	StatusDiscarded = "discarded" // The message was no longer needed, e.g. its OTP expired
+)
+
+var (
+	// ErrDiscard is returned by a SendFunc for a job that no longer needs
+	// delivering. The job is dropped without being retried.
+	ErrDiscard = errors.New("message no longer needs delivering")
+	// ErrTimeout is returned by SendWithTimeout when a send takes too long
+	ErrTimeout = errors.New("delivery timed out")
+)
+
+// Target is a channel and the address to deliver to over it
+type Target struct {
+	Channel string `json:"channel"`
+	To      string `json:"to"`
+}
+
+// Job is one message waiting to be delivered
+type Job struct {
+	ID        string    `json:"id"`
+	Channel   string    `json:"channel"`
+	To        string    `json:"to"`
+	Payload   string    `json:"payload"`   // Opaque to the queue; the OTPService seals the code in it
+	Attempts  int       `json:"attempts"`  // Attempts over every channel so far
+	ExpiresAt time.Time `json:"expiresAt"` // The job is discarded once this has passed
+
+	// Fallback is tried in order once delivery over Channel fails
+	Fallback []Target `json:"fallback,omitempty"`
+	// ChannelAttempts counts the attempts over Channel, which MaxAttempts limits before falling back
+	ChannelAttempts int `json:"channelAttempts,omitempty"`
+
+	// Receipt identifies the job to the backend that returned it from Pop
+	Receipt string `json:"-"`
+}
+
+// DeadLetter is a job that failed every attempt. It keeps no payload.
+type DeadLetter struct {
+	ID       string    `json:"id"`
+	Channel  string    `json:"channel"`
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error"`
+	FailedAt time.Time `json:"failedAt"`
+}
+
+// Backend holds jobs until a worker takes them. Implementations must be safe
+// for concurrent use.
+type Backend interface {
+	// Push schedules a job to be handed out by Pop no earlier than at
+	Push(ctx context.Context, job Job, at time.Time) error
+	// Pop blocks until a job is due or ctx is done
+	Pop(ctx context.Context) (Job, error)
+	// Ack removes a job returned by Pop once it has been handled
+	Ack(ctx context.Context, job Job) error
+	// DeadLetter records a job that failed every attempt
+	DeadLetter(ctx context.Context, letter DeadLetter) error
+	// DeadLetters returns up to limit dead letters, newest first
+	DeadLetters(ctx context.Context, limit int) ([]DeadLetter, error)
+}
+
+// SendFunc delivers a job's message
+type SendFunc func(job Job) error
+
+// StatusFunc is told about every status change of a job; err is the last
+// delivery error, if any
+type StatusFunc func(job Job, status string, err error)
+
+// Queue delivers jobs from a Backend with a pool of workers. A failed attempt
+// is retried with exponential backoff until the job has made MaxAttempts
+// attempts over its channel. It then moves on to its next fallback target,
+// which gets MaxAttempts attempts of its own, and is dead-lettered once its
+// last target has used them up.
+type Queue struct {
+	Backend  Backend
+	Send     SendFunc
+	OnStatus StatusFunc
+
+	Workers     int
+	MaxAttempts int
+	BackoffBase time.Duration // Delay before the first retry, doubling for each one after
+	BackoffMax  time.Duration // Upper bound for the delay
+	Timeout     time.Duration // Longest an attempt may take before it counts as failed; zero waits forever
+
+	wg sync.WaitGroup
+}
+
+// NewQueue creates a Queue with the specified backend and retry policy
+func NewQueue(backend Backend, send SendFunc, onStatus StatusFunc, workers, maxAttempts int, backoffBase, backoffMax, timeout time.Duration) *Queue {
+	if workers < 1 {
+		workers = 1
+	}
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	return &Queue{
+		Backend:     backend,
+		Send:        send,
+		OnStatus:    onStatus,
+		Workers:     workers,
+		MaxAttempts: maxAttempts,
+		BackoffBase: backoffBase,
+		BackoffMax:  backoffMax,
+		Timeout:     timeout,
+	}
+}
+
+// Enqueue adds a job to be delivered as soon as a worker is free
+func (q *Queue) Enqueue(ctx context.Context, job Job) error {
+	// Report the status first, so it cannot overwrite that of a worker that is quicker
+	q.status(job, StatusQueued, nil)
+	return q.Backend.Push(ctx, job, time.Now())
+}
+
+// Start runs the workers until ctx is done
+func (q *Queue) Start(ctx context.Context) {
+	for i := 0; i < q.Workers; i++ {
+		q.wg.Add(1)
+		go func() {
+			defer q.wg.Done()
+			q.work(ctx)
+		}()
+	}
+}
+
+// Wait blocks until every worker has stopped after ctx is done
+func (q *Queue) Wait() {
+	q.wg.Wait()
+}
+
+// work delivers jobs until ctx is done
+func (q *Queue) work(ctx context.Context) {
+	for {
+		job, err := q.Backend.Pop(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("Delivery queue: failed to take a job: %v", err)
+			// Back off so an unreachable backend is not polled in a tight loop
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+
+		q.process(ctx, job)
+		if err := q.Backend.Ack(ctx, job); err != nil {
+			log.Printf("Delivery queue: failed to acknowledge job %s: %v", job.ID, err)
+		}
+	}
+}
+
+// process makes one delivery attempt and, if it fails, schedules a retry,
+// moves the job to its next fallback target or dead-letters it
+func (q *Queue) process(ctx context.Context, job Job) {
+	if !job.ExpiresAt.IsZero() && time.Now().After(job.ExpiresAt) {
+		q.status(job, StatusDiscarded, nil)
+		return
+	}
+
+	job.Attempts++
+	job.ChannelAttempts++
+	// A send that times out keeps running, so it gets a copy that rescheduling cannot change
+	attempt := job
+	err := SendWithTimeout(q.Timeout, func() error { return q.Send(attempt) })
+	switch {
+	case err == nil:
+		q.status(job, StatusDelivered, nil)
+		return
+	case errors.Is(err, ErrDiscard):
+		q.status(job, StatusDiscarded, nil)
+		return
+	}
+
+	if job.ChannelAttempts < q.MaxAttempts {
+		q.status(job, StatusRetrying, err)
+		pushErr := q.Backend.Push(ctx, job, time.Now().Add(q.backoff(job.ChannelAttempts)))
+		if pushErr == nil {
+			return
+		}
+		log.Printf("Delivery queue: failed to schedule a retry of job %s: %v", job.ID, pushErr)
+	} else if len(job.Fallback) > 0 {
+		job.Channel, job.To, job.Fallback = job.Fallback[0].Channel, job.Fallback[0].To, job.Fallback[1:]
+		job.ChannelAttempts = 0
+		q.status(job, StatusRetrying, err)
+		pushErr := q.Backend.Push(ctx, job, time.Now())
+		if pushErr == nil {
+			return
+		}
+		log.Printf("Delivery queue: failed to schedule job %s on its fallback channel: %v", job.ID, pushErr)
+	}
+
+	letter := DeadLetter{ID: job.ID, Channel: job.Channel, Attempts: job.Attempts, Error: err.Error(), FailedAt: time.Now()}
+	if dlErr := q.Backend.DeadLetter(ctx, letter); dlErr != nil {
+		log.Printf("Delivery queue: failed to dead-letter job %s: %v", job.ID, dlErr)
+	}
+	q.status(job, StatusFailed, err)
+}
+
+// backoff is the delay before the retry that follows the given attempt
+func (q *Queue) backoff(attempt int) time.Duration {
+	delay := q.BackoffBase
+	for i := 1; i < attempt; i++ {
+		delay *= 2
+		if q.BackoffMax > 0 && delay >= q.BackoffMax {
+			return q.BackoffMax
+		}
+	}
+	return delay
+}
+
+// SendWithTimeout calls send and returns its error, or ErrTimeout if it has
+// not returned within timeout. A send that times out is left to finish in the
+// background, since senders cannot be cancelled. A zero timeout waits forever.
+func SendWithTimeout(timeout time.Duration, send func() error) error {
+	if timeout <= 0 {
+		return send()
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- send() }()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		return fmt.Errorf("%w after %s", ErrTimeout, timeout)
+	}
+}
+
+func (q *Queue) status(job Job, status string, err error) {
+	if q.OnStatus != nil {
+		q.OnStatus(job, status, err)
+	}
+}
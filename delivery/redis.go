@@ -0,0 +1,233 @@
+package delivery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Redis keys used by a RedisStreamBackend, under its prefix
+const (
+	redisStreamKey    = "stream"
+	redisScheduledKey = "scheduled"
+	redisDeadKey      = "dead"
+	redisGroup        = "workers"
+)
+
+// redisClaimIdle is the default ClaimIdle, long enough that only jobs of a
+// consumer that stopped, e.g. after a crash, are taken over
+const redisClaimIdle = time.Minute
+
+// redisBlock is the longest a Pop waits on the stream before checking for
+// scheduled retries that have become due
+const redisBlock = time.Second
+
+// promoteScript moves scheduled jobs that are due onto the stream. Each job
+// is removed from the sorted set before it is added, so it is only promoted once.
+var promoteScript = redis.NewScript(`
+local due = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1], "LIMIT", 0, 100)
+for _, job in ipairs(due) do
+	if redis.call("ZREM", KEYS[1], job) == 1 then
+		redis.call("XADD", KEYS[2], "*", "job", job)
+	end
+end
+return #due
+`)
+
+// RedisStreamBackend keeps jobs in a Redis stream read by a consumer group,
+// so queued jobs survive a restart and are shared by every instance of the
+// service. Retries wait in a sorted set until they are due, and dead letters
+// are kept in a capped list.
+type RedisStreamBackend struct {
+	Client   *redis.Client
+	Prefix   string
+	Consumer string // Name of this process in the consumer group
+	// ClaimIdle is how long a job may sit unacknowledged with a consumer
+	// before another consumer takes it over
+	ClaimIdle time.Duration
+}
+
+// NewRedisStreamBackend creates a RedisStreamBackend with keys under "delivery:"
+// and creates its consumer group if it does not exist
+func NewRedisStreamBackend(ctx context.Context, client *redis.Client) (*RedisStreamBackend, error) {
+	hostname, _ := os.Hostname()
+	b := &RedisStreamBackend{
+		Client:    client,
+		Prefix:    "delivery:",
+		Consumer:  fmt.Sprintf("%s-%d", hostname, os.Getpid()),
+		ClaimIdle: redisClaimIdle,
+	}
+
+	err := client.XGroupCreateMkStream(ctx, b.key(redisStreamKey), redisGroup, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return nil, fmt.Errorf("failed to create delivery consumer group: %w", err)
+	}
+	return b, nil
+}
+
+func (b *RedisStreamBackend) key(name string) string {
+	return b.Prefix + name
+}
+
+// Push implements Backend
+func (b *RedisStreamBackend) Push(ctx context.Context, job Job, at time.Time) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	if !at.After(time.Now()) {
+		return b.Client.XAdd(ctx, &redis.XAddArgs{
+			Stream: b.key(redisStreamKey),
+			Values: map[string]interface{}{"job": string(data)},
+		}).Err()
+	}
+	return b.Client.ZAdd(ctx, b.key(redisScheduledKey), &redis.Z{
+		Score:  float64(at.UnixMilli()),
+		Member: string(data),
+	}).Err()
+}
+
+// Pop implements Backend. Jobs left unacknowledged by a consumer that stopped
+// are taken over first, then due retries are moved onto the stream before it is read.
+func (b *RedisStreamBackend) Pop(ctx context.Context) (Job, error) {
+	for {
+		claimed, err := b.autoClaim(ctx)
+		if err != nil {
+			return Job{}, err
+		}
+		if len(claimed) > 0 {
+			if job, ok := b.decode(ctx, claimed[0]); ok {
+				return job, nil
+			}
+			continue
+		}
+
+		err = promoteScript.Run(ctx, b.Client,
+			[]string{b.key(redisScheduledKey), b.key(redisStreamKey)},
+			strconv.FormatInt(time.Now().UnixMilli(), 10)).Err()
+		if err != nil {
+			return Job{}, err
+		}
+
+		streams, err := b.Client.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    redisGroup,
+			Consumer: b.Consumer,
+			Streams:  []string{b.key(redisStreamKey), ">"},
+			Count:    1,
+			Block:    redisBlock,
+		}).Result()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			return Job{}, err
+		}
+		if len(streams) > 0 && len(streams[0].Messages) > 0 {
+			if job, ok := b.decode(ctx, streams[0].Messages[0]); ok {
+				return job, nil
+			}
+		}
+	}
+}
+
+// autoClaim takes over at most one job that has been left unacknowledged
+// for ClaimIdle. XAUTOCLAIM replies with two elements before Redis 7 and
+// three from then on, which go-redis v8 cannot parse, so the reply is read here.
+func (b *RedisStreamBackend) autoClaim(ctx context.Context) ([]redis.XMessage, error) {
+	reply, err := b.Client.Do(ctx, "XAUTOCLAIM", b.key(redisStreamKey), redisGroup, b.Consumer,
+		b.ClaimIdle.Milliseconds(), "0", "COUNT", 1).Slice()
+	if err != nil {
+		return nil, err
+	}
+	if len(reply) < 2 {
+		return nil, fmt.Errorf("unexpected XAUTOCLAIM reply with %d elements", len(reply))
+	}
+	entries, _ := reply[1].([]interface{})
+
+	var messages []redis.XMessage
+	for _, entry := range entries {
+		// Before Redis 7, entries deleted from the stream are returned without fields
+		fields, _ := entry.([]interface{})
+		if len(fields) != 2 {
+			continue
+		}
+		id, _ := fields[0].(string)
+		pairs, _ := fields[1].([]interface{})
+		if id == "" || pairs == nil {
+			continue
+		}
+		values := make(map[string]interface{}, len(pairs)/2)
+		for i := 0; i+1 < len(pairs); i += 2 {
+			if name, ok := pairs[i].(string); ok {
+				values[name] = pairs[i+1]
+			}
+		}
+		messages = append(messages, redis.XMessage{ID: id, Values: values})
+	}
+	return messages, nil
+}
+
+// decode reads the job from a stream message, keeping its ID as the receipt.
+// A message that is not a job is removed so it is not handed out again.
+func (b *RedisStreamBackend) decode(ctx context.Context, message redis.XMessage) (Job, bool) {
+	var job Job
+	data, _ := message.Values["job"].(string)
+	if err := json.Unmarshal([]byte(data), &job); err != nil {
+		log.Printf("Delivery queue: dropping invalid job %s: %v", message.ID, err)
+		_ = b.Ack(ctx, Job{Receipt: message.ID})
+		return Job{}, false
+	}
+	job.Receipt = message.ID
+	return job, true
+}
+
+// Ack implements Backend, acknowledging the stream message and deleting it so
+// the sealed payload does not linger in the stream
+func (b *RedisStreamBackend) Ack(ctx context.Context, job Job) error {
+	pipe := b.Client.TxPipeline()
+	pipe.XAck(ctx, b.key(redisStreamKey), redisGroup, job.Receipt)
+	pipe.XDel(ctx, b.key(redisStreamKey), job.Receipt)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// DeadLetter implements Backend
+func (b *RedisStreamBackend) DeadLetter(ctx context.Context, letter DeadLetter) error {
+	data, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+	pipe := b.Client.TxPipeline()
+	pipe.LPush(ctx, b.key(redisDeadKey), string(data))
+	pipe.LTrim(ctx, b.key(redisDeadKey), 0, maxDeadLetters-1)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// DeadLetters implements Backend
+func (b *RedisStreamBackend) DeadLetters(ctx context.Context, limit int) ([]DeadLetter, error) {
+	if limit <= 0 {
+		return nil, nil
+	}
+	values, err := b.Client.LRange(ctx, b.key(redisDeadKey), 0, int64(limit-1)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	letters := make([]DeadLetter, 0, len(values))
+	for _, value := range values {
+		var letter DeadLetter
+		if err := json.Unmarshal([]byte(value), &letter); err == nil {
+			letters = append(letters, letter)
+		}
+	}
+	return letters, nil
+}
@@ -0,0 +1,123 @@
+package handler
+
+import (
+	"errors"
+	"github.com/RoMalms10/otp-generator/service"
+	"github.com/go-chi/render"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Machine-readable error codes returned in ErrResponse.Code. They are part of
+// the API: clients match on them instead of the error text.
+const (
+	CodeInvalidRequest       = "invalid_request"
+	CodeInvalidFormat        = "invalid_format"
+	CodeUnsupportedChannel   = "unsupported_channel"
+	CodeChannelUnavailable   = "channel_unavailable"
+	CodeDeliveryFailed       = "delivery_failed"
+	CodeInvalidDestination   = "invalid_destination"
+	CodeDestinationDenied    = "destination_not_allowed"
+	CodeRateLimited          = "rate_limited"
+	CodeOTPLocked            = "otp_locked"
+	CodeOTPAttemptsExceeded  = "otp_attempts_exceeded"
+	CodeOTPMismatch          = "otp_mismatch"
+	CodeOTPAlreadyUsed       = "otp_already_used"
+	CodeOTPExpired           = "otp_expired"
+	CodeSessionNotFound      = "session_not_found"
+	CodeNotEnrolled          = "not_enrolled"
+	CodeNoDestination        = "no_destination"
+	CodeRecoveryCodesExist   = "recovery_codes_exist"
+	CodeVerificationRequired = "verification_required"
+	CodeInvalidLink          = "invalid_link"
+	CodeInvalidSignature     = "invalid_signature"
+	CodeUnauthorized         = "unauthorized"
+	CodeInternalError        = "internal_error"
+)
+
+// ErrResponse is the body of every error response
+type ErrResponse struct {
+	HTTPStatusCode int    `json:"-"`
+	StatusText     string `json:"status"`
+	Code           string `json:"code"`
+	ErrorText      string `json:"error,omitempty"`
+}
+
+func (e *ErrResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	render.Status(r, e.HTTPStatusCode)
+	return nil
+}
+
+func NewErrResponse(statusCode int, code, errorText string) *ErrResponse {
+	return &ErrResponse{
+		HTTPStatusCode: statusCode,
+		StatusText:     http.StatusText(statusCode),
+		Code:           code,
+		ErrorText:      errorText,
+	}
+}
+
+// errorStatuses maps the service's sentinel errors to a status and code
+var errorStatuses = []struct {
+	err    error
+	status int
+	code   string
+}{
+	{service.ErrInvalidFormat, http.StatusBadRequest, CodeInvalidFormat},
+	{service.ErrUnsupportedChannel, http.StatusBadRequest, CodeUnsupportedChannel},
+	{service.ErrChannelUnavailable, http.StatusServiceUnavailable, CodeChannelUnavailable},
+	{service.ErrDeliveryFailed, http.StatusBadGateway, CodeDeliveryFailed},
+	{service.ErrInvalidDestination, http.StatusBadRequest, CodeInvalidDestination},
+	{service.ErrDestinationNotAllowed, http.StatusForbidden, CodeDestinationDenied},
+	{service.ErrOTPMismatch, http.StatusUnauthorized, CodeOTPMismatch},
+	{service.ErrInvalidLink, http.StatusUnauthorized, CodeInvalidLink},
+	{service.ErrOTPAlreadyUsed, http.StatusConflict, CodeOTPAlreadyUsed},
+	{service.ErrOTPExpired, http.StatusGone, CodeOTPExpired},
+	{service.ErrSessionNotFound, http.StatusNotFound, CodeSessionNotFound},
+	{service.ErrNotEnrolled, http.StatusNotFound, CodeNotEnrolled},
+	{service.ErrNoDestination, http.StatusNotFound, CodeNoDestination},
+	{service.ErrRecoveryCodesExist, http.StatusConflict, CodeRecoveryCodesExist},
+	{service.ErrVerificationRequired, http.StatusForbidden, CodeVerificationRequired},
+}
+
+// ErrorResponse maps an error from the service to an error response, setting
+// Retry-After when the caller is locked out or rate limited. Unknown errors
+// are internal errors: they are logged, and the client only gets a generic
+// message, since they can describe the store or a provider.
+func ErrorResponse(w http.ResponseWriter, err error) *ErrResponse {
+	var locked *service.LockedError
+	var limited *service.RateLimitedError
+
+	switch {
+	case errors.As(err, &locked):
+		setRetryAfter(w, locked.RetryAfter)
+		code := CodeOTPLocked
+		if locked.Burned {
+			code = CodeOTPAttemptsExceeded
+		}
+		return NewErrResponse(http.StatusTooManyRequests, code, err.Error())
+	case errors.As(err, &limited):
+		setRetryAfter(w, limited.RetryAfter)
+		return NewErrResponse(http.StatusTooManyRequests, CodeRateLimited, err.Error())
+	}
+
+	for _, mapping := range errorStatuses {
+		if errors.Is(err, mapping.err) {
+			return NewErrResponse(mapping.status, mapping.code, err.Error())
+		}
+	}
+	log.Printf("Internal error: %v", err)
+	return NewErrResponse(http.StatusInternalServerError, CodeInternalError, "Internal server error")
+}
+
+// invalidRequest returns a 400 response for a malformed or incomplete request body
+func invalidRequest(errorText string) *ErrResponse {
+	return NewErrResponse(http.StatusBadRequest, CodeInvalidRequest, errorText)
+}
+
+func setRetryAfter(w http.ResponseWriter, d time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(d.Seconds()))))
+}
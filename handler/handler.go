@@ -2,134 +2,212 @@ package handler
 
 import (
 	"encoding/json"
+	"fmt"
+	"github.com/RoMalms10/otp-generator/config"
+	"github.com/RoMalms10/otp-generator/delivery"
 	"github.com/RoMalms10/otp-generator/models"
 	"github.com/RoMalms10/otp-generator/service"
 	"github.com/go-chi/render"
+	"github.com/gorilla/mux"
 	"net/http"
+	"time"
 )
 
 type Handler struct {
 	OTPService *service.OTPService
+	// ExposeOTP includes generated codes in responses; only ever set in development mode
+	ExposeOTP bool
+	// Where opened magic links redirect to; empty returns the result as JSON
+	MagicLinkSuccessURL string
+	MagicLinkFailureURL string
+	// Verifies Twilio's status callbacks, which are signed for the URL Twilio was given
+	TwilioAuthToken         string
+	TwilioStatusCallbackURL string
+	// Bearer token that GET /metrics requires; empty does not serve metrics
+	MetricsToken string
 }
 
-type ErrResponse struct {
-	HTTPStatusCode int    `json:"-"`
-	StatusText     string `json:"status"`
-	ErrorText      string `json:"error,omitempty"`
-}
+func NewHandler(otpService *service.OTPService) *Handler {
+	return &Handler{
+		OTPService: otpService,
+		ExposeOTP:  config.RunMode == config.RunModeDevelopment,
 
-func (e *ErrResponse) Render(w http.ResponseWriter, r *http.Request) error {
-	render.Status(r, e.HTTPStatusCode)
-	return nil
-}
+		MagicLinkSuccessURL: config.MagicLinkSuccessURL,
+		MagicLinkFailureURL: config.MagicLinkFailureURL,
 
-func NewErrResponse(statusCode int, statusText, errorText string) *ErrResponse {
-	return &ErrResponse{
-		HTTPStatusCode: statusCode,
-		StatusText:     statusText,
-		ErrorText:      errorText,
-	}
-}
+		TwilioAuthToken:         config.TwilioAuthToken,
+		TwilioStatusCallbackURL: config.TwilioStatusCallbackURL,
 
-func NewHandler(otpService *service.OTPService) *Handler {
-	return &Handler{OTPService: otpService}
+		MetricsToken: config.MetricsToken,
+	}
 }
 
 func (h *Handler) GenerateOTPHandler(w http.ResponseWriter, r *http.Request) {
 	var req models.GenerateRequest
 	err := json.NewDecoder(r.Body).Decode(&req)
-	if err != nil || req.Username == "" {
-		render.Render(w, r, NewErrResponse(http.StatusBadRequest, "Bad Request", "Username is required"))
+	if err != nil || req.User() == "" {
+		render.Render(w, r, invalidRequest("UserID or Username is required"))
 		return
 	}
 
-	// Validate message type
-	if !isValidMessageType(req.MessageType) {
-		render.Render(w, r, NewErrResponse(http.StatusBadRequest, "Bad Request",
-			"Unsupported MessageType. Use 'sms', 'whatsapp', or 'email'"))
+	// Validate message type against the registered channels
+	if err := h.OTPService.CheckChannel(req.MessageType); err != nil {
+		render.Render(w, r, ErrorResponse(w, err))
 		return
 	}
 
-	// First, generate the OTP
-	otp, err := h.OTPService.GenerateOTP(req.Username)
+	// First, start a verification session with a new OTP
+	session, otp, err := h.OTPService.GenerateOTP(req)
 	if err != nil {
-		render.Render(w, r, NewErrResponse(http.StatusInternalServerError, "Internal Server Error",
-			"Failed to generate OTP: "+err.Error()))
+		render.Render(w, r, ErrorResponse(w, fmt.Errorf("failed to generate OTP: %w", err)))
 		return
 	}
 
-	// Then, send the OTP
-	err = h.OTPService.SendOTP(req.Username, otp, req.MessageType)
+	// Then, send the OTP or queue it for delivery
+	status, err := h.OTPService.Deliver(session, otp)
 	if err != nil {
 		// Note: OTP was generated but not sent
-		render.Render(w, r, NewErrResponse(http.StatusInternalServerError, "Internal Server Error",
-			"OTP generated but sending failed: "+err.Error()))
+		render.Render(w, r, ErrorResponse(w, fmt.Errorf("OTP generated but sending failed: %w", err)))
 		return
 	}
 
-	// Return the OTP in the response (in production, you might just return a success message)
-	render.JSON(w, r, map[string]string{
-		"status":  "success",
-		"message": "OTP generated and sent successfully via " + req.MessageType,
-		"otp":     otp, // Note: In production, you might not want to include this
-	})
+	resp := map[string]string{
+		"status":      "success",
+		"message":     deliveryMessage("OTP generated and sent successfully", status),
+		"sessionId":   session.ID,
+		"destination": service.MaskDestination(session.Destination),
+		"channel":     status.Channel,
+		"delivery":    status.Status,
+		"expiresAt":   session.ExpiresAt.Format(time.RFC3339),
+	}
+	// The code is only returned in development mode; otherwise it would defeat the second factor
+	if h.ExposeOTP {
+		resp["otp"] = otp
+	}
+	render.JSON(w, r, resp)
 }
 
-// ResendOTPHandler handles requests to resend an existing OTP
+// ResendOTPHandler handles requests to resend a pending OTP as a new code
 func (h *Handler) ResendOTPHandler(w http.ResponseWriter, r *http.Request) {
-	var req models.GenerateRequest
-	err := json.NewDecoder(r.Body).Decode(&req)
-	if err != nil || req.Username == "" {
-		render.Render(w, r, NewErrResponse(http.StatusBadRequest, "Bad Request", "Username is required"))
+	var req models.ResendRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		render.Render(w, r, invalidRequest("Invalid request payload"))
 		return
 	}
 
-	// Validate message type
-	if !isValidMessageType(req.MessageType) {
-		render.Render(w, r, NewErrResponse(http.StatusBadRequest, "Bad Request",
-			"Unsupported MessageType. Use 'sms', 'whatsapp', or 'email'"))
+	sessionID, errResp := h.resolveSessionID(w, req.SessionID, req.User(), req.Purpose)
+	if errResp != nil {
+		render.Render(w, r, errResp)
 		return
 	}
 
-	// Get the existing OTP
-	otp, err := h.OTPService.GetStoredOTP(req.Username)
+	// Validate a new message type against the registered channels
+	if req.MessageType != "" {
+		if err := h.OTPService.CheckChannel(req.MessageType); err != nil {
+			render.Render(w, r, ErrorResponse(w, err))
+			return
+		}
+	}
+
+	// Replace the pending OTP with a new code; only its hash is stored
+	session, otp, err := h.OTPService.ResendOTP(sessionID, req.MessageType, req.Destination, req.Locale, req.Format)
 	if err != nil {
-		render.Render(w, r, NewErrResponse(http.StatusNotFound, "Not Found", "No valid OTP exists for this user"))
+		render.Render(w, r, ErrorResponse(w, fmt.Errorf("failed to resend OTP: %w", err)))
 		return
 	}
 
 	// Resend the OTP
-	err = h.OTPService.SendOTP(req.Username, otp, req.MessageType)
+	status, err := h.OTPService.Deliver(session, otp)
 	if err != nil {
-		render.Render(w, r, NewErrResponse(http.StatusInternalServerError, "Internal Server Error",
-			"Failed to send OTP: "+err.Error()))
+		render.Render(w, r, ErrorResponse(w, fmt.Errorf("failed to send OTP: %w", err)))
 		return
 	}
 
 	render.JSON(w, r, map[string]string{
-		"status":  "success",
-		"message": "OTP resent successfully via " + req.MessageType,
+		"status":      "success",
+		"message":     deliveryMessage("OTP resent successfully", status),
+		"sessionId":   session.ID,
+		"destination": service.MaskDestination(session.Destination),
+		"channel":     status.Channel,
+		"delivery":    status.Status,
+		"expiresAt":   session.ExpiresAt.Format(time.RFC3339),
 	})
 }
 
 func (h *Handler) ValidateOTPHandler(w http.ResponseWriter, r *http.Request) {
 	var req models.ValidationRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		render.Render(w, r, NewErrResponse(http.StatusBadRequest, "Bad Request", "Invalid request payload"))
+		render.Render(w, r, invalidRequest("Invalid request payload"))
+		return
+	}
+
+	if req.Recovery {
+		h.validateRecoveryCode(w, r, req)
+		return
+	}
+
+	sessionID, errResp := h.resolveSessionID(w, req.SessionID, req.User(), req.Purpose)
+	if errResp != nil && errResp.Code == CodeSessionNotFound {
+		// A user without a session is reported the same way as an expired OTP
+		render.Render(w, r, ErrorResponse(w, service.ErrOTPExpired))
+		return
+	} else if errResp != nil {
+		render.Render(w, r, errResp)
 		return
 	}
+
 	// Validate OTP using the service
-	success, err := h.OTPService.ValidateOTP(req.Username, req.OTP)
+	success, err := h.OTPService.ValidateOTP(sessionID, req.OTP)
 	if err != nil {
-		render.Render(w, r, NewErrResponse(http.StatusUnauthorized, "Unauthorized", err.Error()))
+		render.Render(w, r, ErrorResponse(w, err))
 		return
 	}
 	render.JSON(w, r, map[string]string{"status": success})
 }
 
-// Helper function to validate message type
-func isValidMessageType(messageType string) bool {
-	return messageType == models.MessageTypeSMS ||
-		messageType == models.MessageTypeWhatsApp ||
-		messageType == models.MessageTypeEmail
+// SessionStatusHandler returns the state of a verification session
+func (h *Handler) SessionStatusHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := h.OTPService.GetSession(mux.Vars(r)["sessionId"])
+	if err != nil {
+		render.Render(w, r, ErrorResponse(w, err))
+		return
+	}
+	// The destination may come from the lookup, so it is never shown in full
+	session.Destination = service.MaskDestination(session.Destination)
+	render.JSON(w, r, session)
+}
+
+// DeliveryStatusHandler returns how far delivery of a session's latest code has got
+func (h *Handler) DeliveryStatusHandler(w http.ResponseWriter, r *http.Request) {
+	status, err := h.OTPService.GetDeliveryStatus(mux.Vars(r)["sessionId"])
+	if err != nil {
+		render.Render(w, r, ErrorResponse(w, err))
+		return
+	}
+	render.JSON(w, r, status)
+}
+
+// deliveryMessage is the sent message for the channel that delivered the code, unless it was only queued
+func deliveryMessage(sent string, status *models.DeliveryStatus) string {
+	if status.Status == delivery.StatusQueued {
+		return "OTP queued for delivery via " + status.Channel
+	}
+	return sent + " via " + status.Channel
+}
+
+// resolveSessionID returns the session ID from the request, falling back to
+// the latest session for the username and purpose
+func (h *Handler) resolveSessionID(w http.ResponseWriter, sessionID, username, purpose string) (string, *ErrResponse) {
+	if sessionID != "" {
+		return sessionID, nil
+	}
+	if username == "" {
+		return "", invalidRequest("SessionID, UserID or Username is required")
+	}
+
+	sessionID, err := h.OTPService.FindSession(username, purpose)
+	if err != nil {
+		return "", ErrorResponse(w, err)
+	}
+	return sessionID, nil
 }
@@ -0,0 +1,57 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/RoMalms10/otp-generator/models"
+	"github.com/go-chi/render"
+	"net/http"
+	"strconv"
+)
+
+// RegisterHOTPHandler registers a counter-based token for a user
+func (h *Handler) RegisterHOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var req models.HOTPRegisterRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Username == "" || req.Secret == "" {
+		render.Render(w, r, invalidRequest("Username and Secret are required"))
+		return
+	}
+
+	token, err := h.OTPService.RegisterHOTP(req)
+	if err != nil {
+		render.Render(w, r, ErrorResponse(w, fmt.Errorf("failed to register token: %w", err)))
+		return
+	}
+
+	render.JSON(w, r, map[string]string{
+		"status":    "success",
+		"algorithm": token.Algorithm,
+		"digits":    strconv.Itoa(token.Digits),
+		"counter":   strconv.FormatUint(token.Counter, 10),
+	})
+}
+
+// VerifyHOTPHandler checks a token code for a user
+func (h *Handler) VerifyHOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var req models.HOTPVerifyRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Username == "" {
+		render.Render(w, r, invalidRequest("Username is required"))
+		return
+	}
+
+	h.renderFactorResult(w, r, h.OTPService.VerifyHOTP(req.Username, req.Code))
+}
+
+// ResyncHOTPHandler recovers a drifted token counter from two consecutive codes
+func (h *Handler) ResyncHOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var req models.HOTPResyncRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Username == "" || req.Code == "" || req.NextCode == "" {
+		render.Render(w, r, invalidRequest("Username, Code and NextCode are required"))
+		return
+	}
+
+	h.renderFactorResult(w, r, h.OTPService.ResyncHOTP(req.Username, req.Code, req.NextCode))
+}
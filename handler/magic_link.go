@@ -0,0 +1,43 @@
+package handler
+
+import (
+	"github.com/go-chi/render"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/url"
+)
+
+// MagicLinkHandler consumes the token of an opened magic link and redirects
+// the browser to the success or failure URL. Without redirect URLs the result
+// is returned as JSON.
+func (h *Handler) MagicLinkHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := h.OTPService.VerifyMagicLink(mux.Vars(r)["token"])
+	if err != nil {
+		errResp := ErrorResponse(w, err)
+		if h.MagicLinkFailureURL != "" && errResp.Code != CodeInternalError {
+			redirectWithQuery(w, r, h.MagicLinkFailureURL, "error", errResp.Code)
+			return
+		}
+		render.Render(w, r, errResp)
+		return
+	}
+
+	if h.MagicLinkSuccessURL != "" {
+		redirectWithQuery(w, r, h.MagicLinkSuccessURL, "sessionId", session.ID)
+		return
+	}
+	render.JSON(w, r, map[string]string{"status": "valid", "sessionId": session.ID})
+}
+
+// redirectWithQuery redirects to target with the query parameter added
+func redirectWithQuery(w http.ResponseWriter, r *http.Request, target, key, value string) {
+	u, err := url.Parse(target)
+	if err != nil {
+		render.Render(w, r, NewErrResponse(http.StatusInternalServerError, CodeInternalError, "Invalid redirect URL"))
+		return
+	}
+	query := u.Query()
+	query.Set(key, value)
+	u.RawQuery = query.Encode()
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
@@ -0,0 +1,64 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"github.com/go-chi/render"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// defaultDeadLetterLimit is how many dead letters are listed without a limit parameter
+const defaultDeadLetterLimit = 100
+
+// MetricsHandler returns the SMS counters as {"sms": {...}} to requests with
+// the metrics bearer token. Without a configured token there are no metrics.
+func (h *Handler) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	if !h.authorizeMetrics(w, r) {
+		return
+	}
+
+	render.JSON(w, r, map[string]map[string]int64{"sms": h.OTPService.SMSMetrics()})
+}
+
+// DeadLettersHandler lists the codes that failed every delivery attempt,
+// newest first, as {"deadLetters": [...]}. The limit query parameter caps the
+// list. It needs the metrics bearer token, like MetricsHandler.
+func (h *Handler) DeadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	if !h.authorizeMetrics(w, r) {
+		return
+	}
+
+	limit := defaultDeadLetterLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			render.Render(w, r, invalidRequest("limit must be a positive integer"))
+			return
+		}
+		limit = parsed
+	}
+
+	letters, err := h.OTPService.DeadLetters(limit)
+	if err != nil {
+		render.Render(w, r, ErrorResponse(w, err))
+		return
+	}
+	render.JSON(w, r, map[string]interface{}{"deadLetters": letters})
+}
+
+// authorizeMetrics reports whether the request carries the metrics bearer
+// token, answering it with an error if not
+func (h *Handler) authorizeMetrics(w http.ResponseWriter, r *http.Request) bool {
+	if h.MetricsToken == "" {
+		http.NotFound(w, r)
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(h.MetricsToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		render.Render(w, r, NewErrResponse(http.StatusUnauthorized, CodeUnauthorized, "A valid metrics token is required"))
+		return false
+	}
+	return true
+}
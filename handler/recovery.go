@@ -0,0 +1,67 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/RoMalms10/otp-generator/models"
+	"github.com/RoMalms10/otp-generator/service"
+	"github.com/go-chi/render"
+	"net/http"
+)
+
+// GenerateRecoveryCodesHandler creates a user's first set of recovery codes
+func (h *Handler) GenerateRecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	h.recoveryCodes(w, r, false)
+}
+
+// RegenerateRecoveryCodesHandler replaces a user's recovery codes, invalidating the old set
+func (h *Handler) RegenerateRecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	h.recoveryCodes(w, r, true)
+}
+
+// recoveryCodes generates a set of recovery codes and returns them; they are never shown again
+func (h *Handler) recoveryCodes(w http.ResponseWriter, r *http.Request, replace bool) {
+	var req models.RecoveryCodesRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Username == "" {
+		render.Render(w, r, invalidRequest("Username is required"))
+		return
+	}
+
+	codes, err := h.OTPService.GenerateRecoveryCodes(req.Username, req.SessionID, req.Count, replace)
+	if errors.Is(err, service.ErrRecoveryCodesExist) {
+		render.Render(w, r, ErrorResponse(w, fmt.Errorf("%w; use /recovery/regenerate to replace them", err)))
+		return
+	} else if err != nil {
+		render.Render(w, r, ErrorResponse(w, fmt.Errorf("failed to generate recovery codes: %w", err)))
+		return
+	}
+
+	render.JSON(w, r, map[string]interface{}{
+		"status": "success",
+		"codes":  codes,
+	})
+}
+
+// validateRecoveryCode handles /otp/validate requests flagged as recovery codes
+func (h *Handler) validateRecoveryCode(w http.ResponseWriter, r *http.Request, req models.ValidationRequest) {
+	if req.User() == "" {
+		render.Render(w, r, invalidRequest("UserID or Username is required for recovery codes"))
+		return
+	}
+
+	remaining, err := h.OTPService.ValidateRecoveryCode(req.User(), req.OTP)
+	if errors.Is(err, service.ErrNotEnrolled) {
+		render.Render(w, r, NewErrResponse(http.StatusNotFound, CodeNotEnrolled, "No recovery codes exist for this user"))
+		return
+	} else if err != nil {
+		render.Render(w, r, ErrorResponse(w, err))
+		return
+	}
+
+	render.JSON(w, r, map[string]interface{}{
+		"status":    "valid",
+		"remaining": remaining,
+	})
+}
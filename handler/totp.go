@@ -0,0 +1,86 @@
+package handler
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/RoMalms10/otp-generator/models"
+	"github.com/RoMalms10/otp-generator/qrcode"
+	"github.com/go-chi/render"
+	"net/http"
+	"strconv"
+)
+
+// qrCodeScale is the width in pixels of one QR code module
+const qrCodeScale = 6
+
+// EnrollTOTPHandler creates a pending authenticator secret for a user and
+// returns it as an otpauth:// URI and a QR code PNG
+func (h *Handler) EnrollTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var req models.TOTPEnrollRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Username == "" {
+		render.Render(w, r, invalidRequest("Username is required"))
+		return
+	}
+
+	enrollment, uri, err := h.OTPService.EnrollTOTP(req)
+	if err != nil {
+		render.Render(w, r, ErrorResponse(w, fmt.Errorf("failed to enroll authenticator: %w", err)))
+		return
+	}
+
+	code, err := qrcode.Encode([]byte(uri))
+	if err != nil {
+		render.Render(w, r, ErrorResponse(w, fmt.Errorf("failed to render QR code: %w", err)))
+		return
+	}
+	png, err := code.PNG(qrCodeScale)
+	if err != nil {
+		render.Render(w, r, ErrorResponse(w, fmt.Errorf("failed to render QR code: %w", err)))
+		return
+	}
+
+	render.JSON(w, r, map[string]string{
+		"status":    "success",
+		"secret":    enrollment.Secret,
+		"uri":       uri,
+		"algorithm": enrollment.Algorithm,
+		"digits":    strconv.Itoa(enrollment.Digits),
+		"period":    strconv.Itoa(enrollment.Period),
+		"qrCode":    "data:image/png;base64," + base64.StdEncoding.EncodeToString(png),
+	})
+}
+
+// ConfirmTOTPHandler activates a user's pending authenticator with its first code
+func (h *Handler) ConfirmTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var req models.TOTPVerifyRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Username == "" {
+		render.Render(w, r, invalidRequest("Username is required"))
+		return
+	}
+
+	h.renderFactorResult(w, r, h.OTPService.ConfirmTOTP(req.Username, req.Code))
+}
+
+// VerifyTOTPHandler checks an authenticator code for a user
+func (h *Handler) VerifyTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var req models.TOTPVerifyRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Username == "" {
+		render.Render(w, r, invalidRequest("Username is required"))
+		return
+	}
+
+	h.renderFactorResult(w, r, h.OTPService.VerifyTOTP(req.Username, req.Code))
+}
+
+// renderFactorResult writes the outcome of verifying an authenticator or token code
+func (h *Handler) renderFactorResult(w http.ResponseWriter, r *http.Request, err error) {
+	if err != nil {
+		render.Render(w, r, ErrorResponse(w, err))
+		return
+	}
+	render.JSON(w, r, map[string]string{"status": "valid"})
+}
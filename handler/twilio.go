@@ -0,0 +1,40 @@
+package handler
+
+import (
+	"errors"
+	"github.com/RoMalms10/otp-generator/messaging"
+	"github.com/RoMalms10/otp-generator/service"
+	"github.com/go-chi/render"
+	"log"
+	"net/http"
+)
+
+// TwilioStatusHandler records the status Twilio reports for a message it was
+// asked to send. Only requests signed with the account's auth token for the
+// configured callback URL are accepted. Reports about messages of sessions
+// that have since been removed are acknowledged so Twilio does not retry them.
+func (h *Handler) TwilioStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		render.Render(w, r, invalidRequest("Invalid form body"))
+		return
+	}
+	if !messaging.ValidateTwilioSignature(h.TwilioAuthToken, h.TwilioStatusCallbackURL, r.PostForm, r.Header.Get("X-Twilio-Signature")) {
+		render.Render(w, r, NewErrResponse(http.StatusForbidden, CodeInvalidSignature, "Invalid Twilio signature"))
+		return
+	}
+
+	messageID, status := r.PostForm.Get("MessageSid"), r.PostForm.Get("MessageStatus")
+	if messageID == "" || status == "" {
+		render.Render(w, r, invalidRequest("MessageSid and MessageStatus are required"))
+		return
+	}
+
+	err := h.OTPService.RecordProviderStatus(messageID, status, r.PostForm.Get("ErrorCode"))
+	if errors.Is(err, service.ErrSessionNotFound) {
+		log.Printf("Ignoring Twilio status %s of unknown message %s", status, messageID)
+	} else if err != nil {
+		render.Render(w, r, ErrorResponse(w, err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -2,45 +2,157 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"github.com/RoMalms10/otp-generator/config"
 	"github.com/RoMalms10/otp-generator/messaging"
+	"github.com/RoMalms10/otp-generator/models"
 	"github.com/RoMalms10/otp-generator/server"
+	"github.com/RoMalms10/otp-generator/service"
 	"github.com/go-redis/redis/v8"
 	"log"
 	"net/http"
+	"strings"
 )
 
 func main() {
 	// Create a context
 	ctx := context.Background()
 
-	// Create Redis client
-	redisClient := redis.NewClient(&redis.Options{
-		Addr: config.RedisHost,
-	})
+	if !config.ValidRunMode() {
+		log.Fatalf("Invalid APP_MODE %q", config.RunMode)
+	}
+	log.Printf("Running in %s mode", config.RunMode)
+
+	switch config.DeliveryQueue {
+	case config.DeliveryQueueInline, config.DeliveryQueueMemory, config.DeliveryQueueRedis:
+		log.Printf("Using %s delivery", config.DeliveryQueue)
+	default:
+		log.Fatalf("Invalid DELIVERY_QUEUE %q", config.DeliveryQueue)
+	}
+
+	// With no attempts allowed the first mismatch would burn the OTP and lock the user out
+	if config.MaxOTPAttempts <= 0 {
+		log.Fatalf("Invalid OTP_MAX_ATTEMPTS %d", config.MaxOTPAttempts)
+	}
+
+	// Rate limit buckets are aligned to the window, so it must be positive
+	if config.RateLimitWindow <= 0 {
+		log.Fatalf("Invalid RATE_LIMIT_WINDOW %s", config.RateLimitWindow)
+	}
 
-	// Test Redis connection
-	_, err := redisClient.Ping(ctx).Result()
+	// Expired entries are swept on a ticker, which needs a positive interval
+	if config.StoreSweepInterval <= 0 {
+		log.Fatalf("Invalid STORE_SWEEP_INTERVAL %s", config.StoreSweepInterval)
+	}
+
+	// Check the HMAC keyring before anything is hashed with it. Recovery codes and
+	// factor secrets never expire, so production needs a key that survives a restart.
+	if config.OTPHMACKeys == "" {
+		if config.RunMode == config.RunModeProduction {
+			log.Fatal("OTP_HMAC_KEYS is required in production mode")
+		}
+		log.Println("Warning: OTP_HMAC_KEYS not provided. OTPs, recovery codes and enrolled factors will not survive a restart.")
+	} else if _, err := service.ParseOTPHasher(config.OTPHMACKeys); err != nil {
+		log.Fatalf("Invalid OTP_HMAC_KEYS: %v", err)
+	}
+
+	// Create the OTP store
+	store, err := newOTPStore(ctx)
 	if err != nil {
-		log.Fatalf("Failed to connect to Redis: %v", err)
+		log.Fatalf("Failed to create OTP store: %v", err)
+	}
+	// Redis expires keys itself; the memory and file stores need sweeping
+	if sweeper, ok := store.(service.Sweeper); ok {
+		go service.SweepExpired(ctx, sweeper, config.StoreSweepInterval)
 	}
 
-	// Create Twilio service if credentials are provided
+	// Build the sender registry from the configured channels
+	senders := messaging.NewRegistry()
+
+	// In development, unconfigured channels deliver to a capture sink instead of being disabled
+	var captureSink *messaging.CaptureSink
+	if config.RunMode == config.RunModeDevelopment {
+		captureSink = messaging.NewCaptureSink()
+	}
+	unconfigured := func(channel string) {
+		if captureSink != nil {
+			senders.Register(channel, captureSink.Sender(channel))
+			return
+		}
+		senders.Disable(channel)
+	}
+
+	// Register Twilio channels if credentials are provided
 	var twilioService *messaging.TwilioService
 	if config.TwilioAccountSID != "" && config.TwilioAuthToken != "" && config.TwilioPhoneNumber != "" {
 		twilioConfig := messaging.TwilioConfig{
 			AccountSID:  config.TwilioAccountSID,
 			AuthToken:   config.TwilioAuthToken,
 			PhoneNumber: config.TwilioPhoneNumber,
+
+			StatusCallbackURL: config.TwilioStatusCallbackURL,
+			Voice:             config.TwilioVoice,
+			VoiceLanguage:     config.TwilioVoiceLanguage,
 		}
 		twilioService = messaging.NewTwilioService(twilioConfig)
+		senders.Register(models.MessageTypeWhatsApp, twilioService.WhatsAppSender())
+		senders.Register(models.MessageTypeVoice, twilioService.VoiceSender())
 		log.Println("Twilio service initialized")
 	} else {
-		log.Println("Warning: Twilio credentials not provided. SMS functionality will not work.")
+		unconfigured(models.MessageTypeWhatsApp)
+		unconfigured(models.MessageTypeVoice)
+		log.Println("Warning: Twilio credentials not provided. WhatsApp and voice functionality will not work.")
+	}
+
+	// Register the SMS channel with the configured providers, tried in order
+	smsProviders, err := newSMSProviders(twilioService)
+	if err != nil {
+		log.Fatalf("Failed to configure SMS providers: %v", err)
+	}
+	switch len(smsProviders) {
+	case 0:
+		unconfigured(models.MessageTypeSMS)
+		log.Println("Warning: no SMS provider configured. SMS functionality will not work.")
+	case 1:
+		senders.Register(models.MessageTypeSMS, smsProviders[0].Sender)
+		log.Printf("SMS provider initialized: %s", smsProviders[0].Name)
+	default:
+		senders.Register(models.MessageTypeSMS, messaging.NewFailoverSender(smsProviders...))
+		names := make([]string, len(smsProviders))
+		for i, provider := range smsProviders {
+			names[i] = provider.Name
+		}
+		log.Printf("SMS providers initialized with failover: %s", strings.Join(names, ", "))
+	}
+
+	// Register the email channel if an SMTP server is provided
+	if config.SMTPHost != "" && config.SMTPFrom != "" {
+		emailConfig := messaging.EmailConfig{
+			Host:          config.SMTPHost,
+			Port:          config.SMTPPort,
+			Username:      config.SMTPUsername,
+			Password:      config.SMTPPassword,
+			From:          config.SMTPFrom,
+			Security:      config.SMTPSecurity,
+			AuthMechanism: config.SMTPAuthMechanism,
+		}
+		emailService := messaging.NewEmailService(emailConfig)
+		senders.Register(models.MessageTypeEmail, emailService)
+		senders.Register(models.MessageTypeMagicLink, emailService.MagicLinkSender())
+		log.Println("Email service initialized")
+	} else {
+		unconfigured(models.MessageTypeEmail)
+		unconfigured(models.MessageTypeMagicLink)
+		log.Println("Warning: SMTP settings not provided. Email functionality will not work.")
 	}
 
-	// Create router with Redis and Twilio service
-	router := server.NewRouter(redisClient, ctx, config.OTPTTL, twilioService)
+	// Create the OTP service and start delivering codes in the background if a queue is configured
+	otpService := service.NewOTPService(store, ctx, config.OTPTTL, senders)
+	otpService.StartDelivery()
+	defer otpService.Close()
+
+	// Create router with the OTP service
+	router := server.NewServiceRouter(otpService)
 
 	// Start the server
 	log.Printf("Starting server on port %s", config.ServerPort)
@@ -48,3 +160,103 @@ func main() {
 		log.Fatalf("Failed to start server: %v", err)
 	}
 }
+
+// newOTPStore creates the OTP store selected by config.OTPStoreBackend
+func newOTPStore(ctx context.Context) (service.OTPStore, error) {
+	switch config.OTPStoreBackend {
+	case "memory":
+		log.Println("Using in-memory OTP store")
+		return service.NewMemoryStore(), nil
+
+	case "file":
+		log.Printf("Using file OTP store at %s", config.OTPStoreFile)
+		return service.NewFileStore(config.OTPStoreFile)
+
+	default:
+		// Create Redis client
+		redisClient := redis.NewClient(&redis.Options{
+			Addr: config.RedisHost,
+		})
+
+		// Test Redis connection
+		_, err := redisClient.Ping(ctx).Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to Redis: %w", err)
+		}
+		return service.NewRedisStore(redisClient), nil
+	}
+}
+
+// newSMSProviders creates the SMS providers named by config.SMSProviders, in
+// order. Named providers without credentials are skipped with a warning.
+func newSMSProviders(twilioService *messaging.TwilioService) ([]messaging.Provider, error) {
+	var providers []messaging.Provider
+	for _, name := range config.SMSProviders {
+		var sender messaging.MessageSender
+		switch name {
+		case "twilio":
+			if twilioService != nil {
+				sender = twilioService.SMSSender()
+			}
+
+		case "vonage":
+			if config.VonageAPIKey != "" && config.VonageAPISecret != "" && config.VonageFrom != "" {
+				sender = messaging.NewVonageService(messaging.VonageConfig{
+					APIKey:    config.VonageAPIKey,
+					APISecret: config.VonageAPISecret,
+					From:      config.VonageFrom,
+				})
+			}
+
+		case "sns":
+			if config.AWSAccessKeyID != "" && config.AWSSecretAccessKey != "" && config.AWSRegion != "" {
+				sender = messaging.NewSNSService(messaging.SNSConfig{
+					AccessKeyID:     config.AWSAccessKeyID,
+					SecretAccessKey: config.AWSSecretAccessKey,
+					SessionToken:    config.AWSSessionToken,
+					Region:          config.AWSRegion,
+					SenderID:        config.SNSSenderID,
+					SMSType:         config.SNSSMSType,
+				})
+			}
+
+		case "webhook":
+			if config.SMSWebhookURL != "" {
+				headers, err := parseHeaders(config.SMSWebhookHeaders)
+				if err != nil {
+					return nil, err
+				}
+				sender = messaging.NewWebhookService(messaging.WebhookConfig{
+					URL:     config.SMSWebhookURL,
+					Channel: models.MessageTypeSMS,
+					Secret:  config.SMSWebhookSecret,
+					Headers: headers,
+				})
+			}
+
+		default:
+			return nil, fmt.Errorf("unknown SMS provider %q", name)
+		}
+
+		if sender == nil {
+			log.Printf("Warning: SMS provider %s is not configured and will not be used", name)
+			continue
+		}
+		providers = append(providers, messaging.Provider{Name: name, Sender: sender})
+	}
+	return providers, nil
+}
+
+// parseHeaders parses "Name: value" request headers
+func parseHeaders(list []string) (map[string]string, error) {
+	headers := make(map[string]string, len(list))
+	for _, header := range list {
+		name, value, ok := strings.Cut(header, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid header %q, expected \"Name: value\"", header)
+		}
+		headers[name] = strings.TrimSpace(value)
+	}
+	return headers, nil
+}
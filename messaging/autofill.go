@@ -0,0 +1,80 @@
+package messaging
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Auto-fill kinds: the Android SMS Retriever API, which matches messages by
+// the app's hash, and WebOTP, which browsers match by the site's domain
+const (
+	AutoFillSMSRetriever = "sms_retriever"
+	AutoFillWebOTP       = "webotp"
+)
+
+// ErrInvalidSMS is returned when an SMS would break the rules of its auto-fill kind
+var ErrInvalidSMS = errors.New("invalid SMS")
+
+var (
+	appHashPattern = regexp.MustCompile(`^[A-Za-z0-9+/]{11}$`)
+	domainPattern  = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)*[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+)
+
+// AutoFillProfile formats SMS bodies so a client can read the code from the
+// message itself. Value is the app hash for SMS Retriever and the domain for WebOTP.
+type AutoFillProfile struct {
+	Name  string
+	Kind  string
+	Value string
+}
+
+// ParseAutoFillProfile reads a profile of the form "name:kind:value", e.g.
+// "android:sms_retriever:FA+9qCX9VSu" or "web:webotp:example.com"
+func ParseAutoFillProfile(entry string) (AutoFillProfile, error) {
+	parts := strings.Split(strings.TrimSpace(entry), ":")
+	if len(parts) != 3 || parts[0] == "" {
+		return AutoFillProfile{}, fmt.Errorf("auto-fill profile %q must be name:kind:value", entry)
+	}
+	profile := AutoFillProfile{Name: parts[0], Kind: parts[1], Value: parts[2]}
+
+	switch profile.Kind {
+	case AutoFillSMSRetriever:
+		if !appHashPattern.MatchString(profile.Value) {
+			return AutoFillProfile{}, fmt.Errorf("auto-fill profile %s: app hash must be 11 base64 characters", profile.Name)
+		}
+	case AutoFillWebOTP:
+		profile.Value = strings.ToLower(profile.Value)
+		if !domainPattern.MatchString(profile.Value) {
+			return AutoFillProfile{}, fmt.Errorf("auto-fill profile %s: %q is not a domain", profile.Name, profile.Value)
+		}
+	default:
+		return AutoFillProfile{}, fmt.Errorf("auto-fill profile %s: kind must be %s or %s", profile.Name, AutoFillSMSRetriever, AutoFillWebOTP)
+	}
+	return profile, nil
+}
+
+// Format appends the profile's line to an SMS body carrying code: the app
+// hash for SMS Retriever, or "@domain #code" for WebOTP. Both must be the
+// last line of the message, and the body must contain the code.
+// Returns ErrInvalidSMS otherwise. The result must also fit in a single SMS,
+// which the caller checks once it knows how the message is encoded.
+func (p AutoFillProfile) Format(body, code string) (string, error) {
+	if !strings.Contains(body, code) {
+		return "", fmt.Errorf("%w: the message does not contain the code", ErrInvalidSMS)
+	}
+	if strings.ContainsAny(code, " \t\r\n") {
+		return "", fmt.Errorf("%w: the code contains whitespace", ErrInvalidSMS)
+	}
+
+	body = strings.TrimRight(body, " \t\r\n")
+	switch p.Kind {
+	case AutoFillSMSRetriever:
+		return body + "\n\n" + p.Value, nil
+	case AutoFillWebOTP:
+		return body + "\n\n@" + p.Value + " #" + code, nil
+	default:
+		return "", fmt.Errorf("%w: unknown auto-fill kind %s", ErrInvalidSMS, p.Kind)
+	}
+}
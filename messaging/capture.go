@@ -0,0 +1,93 @@
+package messaging
+
+import (
+	"sync"
+	"time"
+)
+
+// CapturedMessage is an OTP recorded by a CaptureSink instead of being delivered
+type CapturedMessage struct {
+	Channel string
+	To      string
+	OTP     string
+	Subject string // The rendered message, when the OTP was sent with a template
+	Text    string
+	HTML    string
+	SentAt  time.Time
+}
+
+// MaxCapturedMessages is how many messages a CaptureSink keeps; older ones are dropped
+const MaxCapturedMessages = 1000
+
+// CaptureSink records OTPs in memory instead of delivering them. It is meant
+// for development and tests, where codes must be readable without a real
+// SMS or email account and must not be returned over HTTP. Only the latest
+// MaxCapturedMessages messages are kept.
+type CaptureSink struct {
+	mu       sync.Mutex
+	messages []CapturedMessage
+}
+
+// NewCaptureSink creates an empty CaptureSink
+func NewCaptureSink() *CaptureSink {
+	return &CaptureSink{}
+}
+
+// Sender returns a MessageSender that records OTPs under the given channel name
+func (c *CaptureSink) Sender(channel string) MessageSender {
+	return captureSender{sink: c, channel: channel}
+}
+
+func (c *CaptureSink) capture(message CapturedMessage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	message.SentAt = time.Now()
+	if len(c.messages) >= MaxCapturedMessages {
+		c.messages = append(c.messages[:0], c.messages[len(c.messages)-MaxCapturedMessages+1:]...)
+	}
+	c.messages = append(c.messages, message)
+}
+
+// captureSender records the OTPs sent over one channel in its sink
+type captureSender struct {
+	sink    *CaptureSink
+	channel string
+}
+
+// SendOTP implements Sender
+func (s captureSender) SendOTP(to, otp string) error {
+	s.sink.capture(CapturedMessage{Channel: s.channel, To: to, OTP: otp})
+	return nil
+}
+
+// SendMessage implements MessageSender
+func (s captureSender) SendMessage(msg Message) (string, error) {
+	s.sink.capture(CapturedMessage{
+		Channel: s.channel,
+		To:      msg.To,
+		OTP:     msg.Code,
+		Subject: msg.Subject,
+		Text:    msg.Text,
+		HTML:    msg.HTML,
+	})
+	return "", nil
+}
+
+// Messages returns a copy of the messages still kept by the sink
+func (c *CaptureSink) Messages() []CapturedMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]CapturedMessage(nil), c.messages...)
+}
+
+// LastOTP returns the most recent OTP captured for the recipient
+func (c *CaptureSink) LastOTP(to string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := len(c.messages) - 1; i >= 0; i-- {
+		if c.messages[i].To == to {
+			return c.messages[i].OTP, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,309 @@
+package messaging
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Supported connection security modes for EmailConfig.Security
+const (
+	EmailSecurityNone     = "none"
+	EmailSecuritySTARTTLS = "starttls"
+	EmailSecurityTLS      = "tls"
+)
+
+// Supported authentication mechanisms for EmailConfig.AuthMechanism
+const (
+	EmailAuthPlain = "plain"
+	EmailAuthLogin = "login"
+)
+
+// EmailConfig holds configuration for an SMTP server
+type EmailConfig struct {
+	Host          string
+	Port          string
+	Username      string
+	Password      string
+	From          string
+	Security      string
+	AuthMechanism string
+	// TLSConfig overrides the TLS settings used for STARTTLS and implicit TLS
+	TLSConfig *tls.Config
+	Timeout   time.Duration
+}
+
+// EmailService implements email sending functionality over SMTP
+type EmailService struct {
+	Config EmailConfig
+}
+
+// NewEmailService creates a new EmailService with the specified configuration
+func NewEmailService(config EmailConfig) *EmailService {
+	// Set defaults if not specified
+	if config.Security == "" {
+		config.Security = EmailSecuritySTARTTLS
+	}
+	if config.Port == "" {
+		if config.Security == EmailSecurityTLS {
+			config.Port = "465"
+		} else {
+			config.Port = "587"
+		}
+	}
+	if config.AuthMechanism == "" {
+		config.AuthMechanism = EmailAuthPlain
+	}
+	if config.Timeout == 0 {
+		config.Timeout = 30 * time.Second
+	}
+
+	return &EmailService{
+		Config: config,
+	}
+}
+
+// SendEmail sends a multipart/alternative email with a plain text and an HTML body
+func (s *EmailService) SendEmail(to, subject, textBody, htmlBody string) error {
+	message, err := s.buildMessage(to, subject, textBody, htmlBody)
+	if err != nil {
+		return fmt.Errorf("failed to build email: %w", err)
+	}
+
+	client, err := s.dial()
+	if err != nil {
+		return fmt.Errorf("failed to connect to SMTP server: %w", err)
+	}
+	defer client.Close()
+
+	if s.Config.Security == EmailSecuritySTARTTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("SMTP server does not support STARTTLS")
+		}
+		if err := client.StartTLS(s.tlsConfig()); err != nil {
+			return fmt.Errorf("failed to start TLS: %w", err)
+		}
+	}
+
+	if s.Config.Username != "" {
+		if err := client.Auth(s.auth()); err != nil {
+			return fmt.Errorf("failed to authenticate: %w", err)
+		}
+	}
+
+	if err := client.Mail(s.fromAddress()); err != nil {
+		return fmt.Errorf("failed to set sender: %w", err)
+	}
+	if err := client.Rcpt(to); err != nil {
+		return fmt.Errorf("failed to set recipient: %w", err)
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+	if _, err := w.Write(message); err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+
+	return client.Quit()
+}
+
+// SendOTP sends a one-time password via email
+func (s *EmailService) SendOTP(to, otp string) error {
+	subject := "Your verification code"
+	textBody := fmt.Sprintf("Your verification code is: %s", otp)
+	htmlBody := fmt.Sprintf("<p>Your verification code is: <strong>%s</strong></p>", html.EscapeString(otp))
+	return s.SendEmail(to, subject, textBody, htmlBody)
+}
+
+// SendMagicLink sends a single-use sign-in link via email
+func (s *EmailService) SendMagicLink(to, link string) error {
+	subject := "Your sign-in link"
+	textBody := fmt.Sprintf("Open this link to sign in: %s\n\nIt can only be used once.", link)
+	htmlBody := fmt.Sprintf("<p><a href=\"%s\">Click here to sign in</a></p><p>The link can only be used once.</p>",
+		html.EscapeString(link))
+	return s.SendEmail(to, subject, textBody, htmlBody)
+}
+
+// SendMessage implements MessageSender. A message without an HTML body is
+// sent with its text as the HTML part.
+func (s *EmailService) SendMessage(msg Message) (string, error) {
+	htmlBody := msg.HTML
+	if htmlBody == "" {
+		htmlBody = "<p>" + strings.ReplaceAll(html.EscapeString(msg.Text), "\n", "<br>") + "</p>"
+	}
+	return "", s.SendEmail(msg.To, msg.Subject, msg.Text, htmlBody)
+}
+
+// MagicLinkSender returns a MessageSender that sends magic links via email
+func (s *EmailService) MagicLinkSender() MessageSender {
+	return magicLinkSender{s}
+}
+
+// magicLinkSender sends magic links instead of codes; rendered messages are sent as they are
+type magicLinkSender struct {
+	*EmailService
+}
+
+// SendOTP implements Sender, sending the link as a magic link email
+func (m magicLinkSender) SendOTP(to, link string) error {
+	return m.SendMagicLink(to, link)
+}
+
+// dial opens a connection to the SMTP server, using implicit TLS if configured
+func (s *EmailService) dial() (*smtp.Client, error) {
+	addr := net.JoinHostPort(s.Config.Host, s.Config.Port)
+	dialer := &net.Dialer{Timeout: s.Config.Timeout}
+
+	var conn net.Conn
+	var err error
+	if s.Config.Security == EmailSecurityTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, s.tlsConfig())
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(s.Config.Timeout))
+
+	client, err := smtp.NewClient(conn, s.Config.Host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// tlsConfig returns the TLS configuration for the SMTP connection
+func (s *EmailService) tlsConfig() *tls.Config {
+	if s.Config.TLSConfig != nil {
+		return s.Config.TLSConfig
+	}
+	return &tls.Config{ServerName: s.Config.Host}
+}
+
+// auth returns the smtp.Auth for the configured mechanism
+func (s *EmailService) auth() smtp.Auth {
+	if s.Config.AuthMechanism == EmailAuthLogin {
+		return &loginAuth{username: s.Config.Username, password: s.Config.Password}
+	}
+	return smtp.PlainAuth("", s.Config.Username, s.Config.Password, s.Config.Host)
+}
+
+// fromAddress returns the bare address part of the configured sender
+func (s *EmailService) fromAddress() string {
+	if addr, err := mail.ParseAddress(s.Config.From); err == nil {
+		return addr.Address
+	}
+	return s.Config.From
+}
+
+// buildMessage renders the headers and multipart body of an email
+func (s *EmailService) buildMessage(to, subject, textBody, htmlBody string) ([]byte, error) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+
+	headers := []string{
+		"From: " + s.Config.From,
+		"To: " + to,
+		"Subject: " + mime.QEncoding.Encode("utf-8", subject),
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"Message-ID: " + messageID(s.Config.Host),
+		"MIME-Version: 1.0",
+		"Content-Type: multipart/alternative; boundary=" + mw.Boundary(),
+	}
+	for _, header := range headers {
+		if strings.ContainsAny(header, "\r\n") {
+			return nil, errors.New("email headers must not contain line breaks")
+		}
+	}
+	buf.WriteString(strings.Join(headers, "\r\n") + "\r\n\r\n")
+
+	parts := []struct {
+		contentType string
+		body        string
+	}{
+		{"text/plain; charset=utf-8", textBody},
+		{"text/html; charset=utf-8", htmlBody},
+	}
+	for _, part := range parts {
+		w, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write([]byte(part.body)); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// messageID generates a unique Message-ID header value
+func messageID(host string) string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return fmt.Sprintf("<%s@%s>", hex.EncodeToString(b), host)
+}
+
+// loginAuth implements the LOGIN SMTP authentication mechanism
+type loginAuth struct {
+	username string
+	password string
+}
+
+// Start begins the LOGIN exchange, refusing to send credentials over an unencrypted connection
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	return "LOGIN", nil, nil
+}
+
+// Next answers the server's username and password challenges
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.username), nil
+	case "password:":
+		return []byte(a.password), nil
+	default:
+		return nil, fmt.Errorf("unexpected LOGIN challenge: %s", fromServer)
+	}
+}
+
+// isLocalhost reports whether name refers to the local machine
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
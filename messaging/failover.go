@@ -0,0 +1,51 @@
+package messaging
+
+import (
+	"errors"
+	"fmt"
+)
+
+// FailoverSender sends through the first of several providers that accepts
+// a message, so that an outage at one provider does not stop delivery over
+// the channel. Providers are tried in order for every message.
+type FailoverSender struct {
+	Providers []Provider
+}
+
+// Provider is a named MessageSender, such as "twilio", used by a FailoverSender
+type Provider struct {
+	Name   string
+	Sender MessageSender
+}
+
+// NewFailoverSender creates a FailoverSender that tries the providers in order
+func NewFailoverSender(providers ...Provider) *FailoverSender {
+	return &FailoverSender{Providers: providers}
+}
+
+// SendOTP implements Sender
+func (f *FailoverSender) SendOTP(to, otp string) error {
+	var errs []error
+	for _, provider := range f.Providers {
+		err := provider.Sender.SendOTP(to, otp)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", provider.Name, err))
+	}
+	return errors.Join(errs...)
+}
+
+// SendMessage implements MessageSender, returning the ID given by the
+// provider that sent the message
+func (f *FailoverSender) SendMessage(msg Message) (string, error) {
+	var errs []error
+	for _, provider := range f.Providers {
+		id, err := provider.Sender.SendMessage(msg)
+		if err == nil {
+			return id, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", provider.Name, err))
+	}
+	return "", errors.Join(errs...)
+}
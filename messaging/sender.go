@@ -0,0 +1,104 @@
+package messaging
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+var (
+	// ErrUnknownChannel is returned when no channel with the requested name exists
+	ErrUnknownChannel = errors.New("unknown channel")
+	// ErrChannelUnavailable is returned when a channel exists but is not configured
+	ErrChannelUnavailable = errors.New("channel unavailable")
+)
+
+// Sender delivers a one-time password to a recipient over a single channel
+type Sender interface {
+	SendOTP(to, otp string) error
+}
+
+// Message is a rendered message carrying a code
+type Message struct {
+	To      string
+	Code    string // The code, or the link for magic links
+	Subject string // The subject line, for channels that have one
+	Text    string
+	HTML    string // The HTML body, for channels that support it
+	// SMS is how Text is encoded and split, for SMS messages
+	SMS *SMSInfo
+}
+
+// MessageSender is a Sender that can deliver a message rendered from a
+// template. SendMessage returns the provider's ID for the message when the
+// provider reports later whether it arrived, which those reports refer to,
+// or else an empty ID.
+type MessageSender interface {
+	Sender
+	SendMessage(msg Message) (string, error)
+}
+
+// SenderFunc adapts an ordinary function to the Sender interface
+type SenderFunc func(to, otp string) error
+
+// SendOTP calls f(to, otp)
+func (f SenderFunc) SendOTP(to, otp string) error {
+	return f(to, otp)
+}
+
+// Registry maps channel names to the Sender that delivers over them. A
+// channel can be registered as disabled so that clients are told it is
+// unavailable rather than unsupported.
+type Registry struct {
+	mu      sync.RWMutex
+	senders map[string]Sender
+}
+
+// NewRegistry creates an empty Registry
+func NewRegistry() *Registry {
+	return &Registry{senders: make(map[string]Sender)}
+}
+
+// Register makes sender available under the channel name, replacing any previous sender
+func (r *Registry) Register(channel string, sender Sender) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.senders[channel] = sender
+}
+
+// Disable marks the channel as known but unavailable
+func (r *Registry) Disable(channel string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.senders[channel] = nil
+}
+
+// Sender returns the Sender for the channel. It returns ErrUnknownChannel if
+// the channel was never registered and ErrChannelUnavailable if it is disabled.
+func (r *Registry) Sender(channel string) (Sender, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	sender, ok := r.senders[channel]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownChannel, channel)
+	}
+	if sender == nil {
+		return nil, fmt.Errorf("%w: %s", ErrChannelUnavailable, channel)
+	}
+	return sender, nil
+}
+
+// Channels returns the sorted names of every known channel, enabled or not
+func (r *Registry) Channels() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	channels := make([]string, 0, len(r.senders))
+	for channel := range r.senders {
+		channels = append(channels, channel)
+	}
+	sort.Strings(channels)
+	return channels
+}
@@ -0,0 +1,164 @@
+package messaging
+
+import (
+	"strings"
+	"unicode/utf16"
+)
+
+// SMS encodings. A body is sent in GSM-7 if every character is in the GSM
+// 03.38 alphabet, and in UCS-2 otherwise.
+const (
+	EncodingGSM7 = "GSM-7"
+	EncodingUCS2 = "UCS-2"
+)
+
+// MaxSMSBytes is the payload of a single SMS: 160 GSM-7 or 70 UCS-2 characters
+const MaxSMSBytes = 140
+
+// Characters per segment of a single SMS and of a concatenated one, whose
+// segments give up room for the header that joins them
+const (
+	gsm7Single  = 160
+	gsm7Segment = 153
+	ucs2Single  = 70
+	ucs2Segment = 67
+)
+
+// gsm7Basic is the GSM 03.38 default alphabet; each character takes one septet
+var gsm7Basic = makeCharset("@£$¥èéùìòÇ\nØø\rÅåΔ_ΦΓΛΩΠΨΣΘΞÆæßÉ !\"#¤%&'()*+,-./0123456789:;<=>?" +
+	"¡ABCDEFGHIJKLMNOPQRSTUVWXYZÄÖÑÜ§¿abcdefghijklmnopqrstuvwxyzäöñüà")
+
+// gsm7Extended is the GSM 03.38 extension table; each character takes an escape and a septet
+var gsm7Extended = makeCharset("\f^{}\\[~]|€")
+
+// transliterations replace common characters outside GSM-7 with the closest GSM-7 ones
+var transliterations = map[rune]string{
+	'‘': "'", '’': "'", '‚': "'", '′': "'", '´': "'", '`': "'",
+	'“': "\"", '”': "\"", '„': "\"", '″': "\"", '«': "\"", '»': "\"",
+	'‐': "-", '‑': "-", '–': "-", '—': "-", '−': "-",
+	'…': "...", '•': "*", '\t': " ",
+	' ': " ", ' ': " ", ' ': " ", ' ': " ",
+	'á': "a", 'â': "a", 'ã': "a", 'ā': "a", 'ă': "a", 'ą': "a",
+	'Á': "A", 'À': "A", 'Â': "A", 'Ã': "A", 'Ā': "A", 'Ă': "A", 'Ą': "A",
+	'ç': "c", 'ć': "c", 'č': "c", 'Ć': "C", 'Č': "C",
+	'ď': "d", 'Ď': "D", 'đ': "d", 'Đ': "D",
+	'ê': "e", 'ë': "e", 'ē': "e", 'ę': "e", 'ě': "e",
+	'Ê': "E", 'Ë': "E", 'È': "E", 'Ē': "E", 'Ę': "E", 'Ě': "E",
+	'ğ': "g", 'Ğ': "G",
+	'í': "i", 'î': "i", 'ï': "i", 'ī': "i", 'ı': "i",
+	'Í': "I", 'Ì': "I", 'Î': "I", 'Ï': "I", 'Ī': "I", 'İ': "I",
+	'ł': "l", 'Ł': "L", 'ľ': "l", 'Ľ': "L",
+	'ń': "n", 'ň': "n", 'Ń': "N", 'Ň': "N",
+	'ó': "o", 'ô': "o", 'õ': "o", 'ō': "o", 'ő': "o",
+	'Ó': "O", 'Ò': "O", 'Ô': "O", 'Õ': "O", 'Ō': "O", 'Ő': "O",
+	'œ': "oe", 'Œ': "OE",
+	'ř': "r", 'Ř': "R",
+	'ś': "s", 'š': "s", 'ş': "s", 'ș': "s", 'Ś': "S", 'Š': "S", 'Ş': "S", 'Ș': "S",
+	'ť': "t", 'ţ': "t", 'ț': "t", 'Ť': "T", 'Ţ': "T", 'Ț': "T",
+	'ú': "u", 'û': "u", 'ū': "u", 'ů': "u", 'ű': "u",
+	'Ú': "U", 'Ù': "U", 'Û': "U", 'Ū': "U", 'Ů': "U", 'Ű': "U",
+	'ý': "y", 'ÿ': "y", 'Ý': "Y",
+	'ź': "z", 'ż': "z", 'ž': "z", 'Ź': "Z", 'Ż': "Z", 'Ž': "Z",
+}
+
+func makeCharset(chars string) map[rune]bool {
+	charset := make(map[rune]bool)
+	for _, c := range chars {
+		charset[c] = true
+	}
+	return charset
+}
+
+// SMSInfo is how an SMS body is encoded and into how many segments it is
+// split, each of which is billed as a message of its own
+type SMSInfo struct {
+	Encoding       string `json:"encoding"`
+	Characters     int    `json:"characters"` // Septets in GSM-7, UTF-16 code units in UCS-2
+	Segments       int    `json:"segments"`
+	Transliterated bool   `json:"transliterated,omitempty"`
+}
+
+// SMSEncoding returns the encoding an SMS body is sent in
+func SMSEncoding(body string) string {
+	for _, c := range body {
+		if !gsm7Basic[c] && !gsm7Extended[c] {
+			return EncodingUCS2
+		}
+	}
+	return EncodingGSM7
+}
+
+// SMSSize returns the number of bytes an SMS body takes in its encoding
+func SMSSize(body string) int {
+	info := AnalyzeSMS(body)
+	if info.Encoding == EncodingUCS2 {
+		return 2 * info.Characters
+	}
+	return (info.Characters*7 + 7) / 8
+}
+
+// AnalyzeSMS returns how an SMS body is encoded and split into segments. A
+// character is never split across segments: neither a GSM-7 escape and the
+// character it escapes, nor the surrogate pair of a UCS-2 character.
+func AnalyzeSMS(body string) SMSInfo {
+	info := SMSInfo{Encoding: SMSEncoding(body)}
+	single, segment := gsm7Single, gsm7Segment
+	if info.Encoding == EncodingUCS2 {
+		single, segment = ucs2Single, ucs2Segment
+	}
+
+	var sizes []int
+	for _, c := range body {
+		size := 1
+		if info.Encoding == EncodingGSM7 && gsm7Extended[c] {
+			size = 2
+		} else if info.Encoding == EncodingUCS2 {
+			size = utf16.RuneLen(c)
+		}
+		sizes = append(sizes, size)
+		info.Characters += size
+	}
+
+	switch {
+	case info.Characters == 0:
+		info.Segments = 0
+	case info.Characters <= single:
+		info.Segments = 1
+	default:
+		info.Segments = 1
+		used := 0
+		for _, size := range sizes {
+			if used+size > segment {
+				info.Segments++
+				used = 0
+			}
+			used += size
+		}
+	}
+	return info
+}
+
+// EncodeSMS returns the body to send and how it is encoded. With
+// transliterate, a body that needs UCS-2 is sent transliterated to GSM-7
+// instead if every character has a replacement and it takes fewer segments.
+func EncodeSMS(body string, transliterate bool) (string, SMSInfo) {
+	info := AnalyzeSMS(body)
+	if !transliterate || info.Encoding != EncodingUCS2 {
+		return body, info
+	}
+
+	var replaced strings.Builder
+	for _, c := range body {
+		if replacement, ok := transliterations[c]; ok {
+			replaced.WriteString(replacement)
+		} else {
+			replaced.WriteRune(c)
+		}
+	}
+	transliterated := replaced.String()
+	if translitInfo := AnalyzeSMS(transliterated); translitInfo.Encoding == EncodingGSM7 && translitInfo.Segments < info.Segments {
+		translitInfo.Transliterated = true
+		return transliterated, translitInfo
+	}
+	return body, info
+}
@@ -0,0 +1,224 @@
+package messaging
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SNSConfig holds configuration for sending SMS through AWS SNS
+type SNSConfig struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	// SessionToken is needed only for temporary credentials
+	SessionToken string
+	Region       string
+	// SenderID is the alphanumeric sender ID, in countries that support one
+	SenderID string
+	// SMSType is "Transactional" or "Promotional"; empty uses the account default
+	SMSType string
+	BaseURL string
+}
+
+// AWSCredentials are the credentials a request is signed with
+type AWSCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// SNSService implements SMS sending through AWS SNS
+type SNSService struct {
+	Config SNSConfig
+}
+
+// NewSNSService creates a new SNSService with the specified configuration
+func NewSNSService(config SNSConfig) *SNSService {
+	// Set default API endpoint if not specified
+	if config.BaseURL == "" {
+		config.BaseURL = fmt.Sprintf("https://sns.%s.amazonaws.com", config.Region)
+	}
+
+	return &SNSService{
+		Config: config,
+	}
+}
+
+// SendSMS publishes an SMS message to a phone number and returns its message ID
+func (s *SNSService) SendSMS(to, message string) (string, error) {
+	formData := url.Values{}
+	formData.Set("Action", "Publish")
+	formData.Set("Version", "2010-03-31")
+	formData.Set("PhoneNumber", to)
+	formData.Set("Message", message)
+
+	attributes := []struct{ name, value string }{
+		{"AWS.SNS.SMS.SenderID", s.Config.SenderID},
+		{"AWS.SNS.SMS.SMSType", s.Config.SMSType},
+	}
+	entry := 0
+	for _, attribute := range attributes {
+		if attribute.value == "" {
+			continue
+		}
+		entry++
+		prefix := fmt.Sprintf("MessageAttributes.entry.%d.", entry)
+		formData.Set(prefix+"Name", attribute.name)
+		formData.Set(prefix+"Value.DataType", "String")
+		formData.Set(prefix+"Value.StringValue", attribute.value)
+	}
+
+	id, err := s.post(formData)
+	if err != nil {
+		return "", fmt.Errorf("failed to send SMS: %w", err)
+	}
+	return id, nil
+}
+
+// post calls the SNS query API with the form and returns the message ID
+func (s *SNSService) post(formData url.Values) (string, error) {
+	body := []byte(formData.Encode())
+	req, err := http.NewRequest("POST", s.Config.BaseURL+"/", bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+
+	credentials := AWSCredentials{
+		AccessKeyID:     s.Config.AccessKeyID,
+		SecretAccessKey: s.Config.SecretAccessKey,
+		SessionToken:    s.Config.SessionToken,
+	}
+	SignAWSRequest(req, body, credentials, s.Config.Region, "sns", time.Now())
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	data, readErr := io.ReadAll(resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		var failure struct {
+			Code    string `xml:"Error>Code"`
+			Message string `xml:"Error>Message"`
+		}
+		if readErr == nil && xml.Unmarshal(data, &failure) == nil && failure.Code != "" {
+			return "", fmt.Errorf("SNS API returned %s: %s", failure.Code, failure.Message)
+		}
+		return "", fmt.Errorf("SNS API returned non-success status code: %d", resp.StatusCode)
+	}
+
+	// The message was published even if its ID cannot be read, and failing would send it again
+	var published struct {
+		MessageID string `xml:"PublishResult>MessageId"`
+	}
+	if readErr == nil {
+		readErr = xml.Unmarshal(data, &published)
+	}
+	if readErr != nil {
+		log.Printf("SNS published a message but its response could not be read: %v", readErr)
+		return "", nil
+	}
+	return published.MessageID, nil
+}
+
+// SendOTP sends a one-time password via SMS
+func (s *SNSService) SendOTP(to, otp string) error {
+	_, err := s.SendSMS(to, otpMessage(otp))
+	return err
+}
+
+// SendMessage implements MessageSender. SNS reports delivery only to
+// CloudWatch, so no ID is returned.
+func (s *SNSService) SendMessage(msg Message) (string, error) {
+	_, err := s.SendSMS(msg.To, msg.Text)
+	return "", err
+}
+
+// SignAWSRequest signs the request for the AWS service in the region with
+// Signature Version 4, setting its X-Amz-Date, X-Amz-Security-Token and
+// Authorization headers. body must be the request's body. The Host header
+// and every header already set on the request are signed.
+func SignAWSRequest(req *http.Request, body []byte, credentials AWSCredentials, region, service string, at time.Time) {
+	at = at.UTC()
+	amzDate := at.Format("20060102T150405Z")
+	date := at.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if credentials.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", credentials.SessionToken)
+	}
+
+	// Canonical headers are lowercased, sorted and include the host
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	// The query is sorted by name, with spaces encoded as %20 rather than "+"
+	canonicalQuery := strings.ReplaceAll(req.URL.Query().Encode(), "+", "%20")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		canonicalQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		sha256Hex(body),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+credentials.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		credentials.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,217 @@
+package messaging
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"math"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+// ErrNoTemplate is returned when no template exists for a channel in any of the tried locales
+var ErrNoTemplate = errors.New("no template")
+
+//go:embed templates
+var defaultTemplates embed.FS
+
+// Template file extensions: the plain text body, the HTML body and the subject line
+const (
+	templateText    = ".txt"
+	templateHTML    = ".html"
+	templateSubject = ".subject"
+)
+
+var localePattern = regexp.MustCompile(`^[a-z]{2,8}(-[a-z0-9]{1,8})*$`)
+
+// TemplateData is what message templates can use
+type TemplateData struct {
+	AppName    string
+	Code       string // The code, or the link for magic links
+	Link       string // The link, for magic links only
+	SpokenCode string // The code spelled out for voice calls, e.g. "1, 2, 3"
+	Channel    string
+	Purpose    string
+	Locale     string        // The locale of the template being rendered
+	TTL        time.Duration // How long until the code expires
+	TTLMinutes int           // TTL in whole minutes, rounded up
+}
+
+// Templates renders the messages that carry codes. Templates are kept per
+// locale in files named <locale>/<channel>.<ext>, or
+// <locale>/<channel>.<purpose>.<ext> for a single purpose, where ext is
+// "txt" for the text body, "html" for the HTML body of an email and
+// "subject" for its subject line. Text and subjects use text/template and
+// HTML uses html/template, so codes and links are escaped.
+type Templates struct {
+	DefaultLocale string
+	text          map[string]*texttemplate.Template
+	html          map[string]*htmltemplate.Template
+}
+
+// LoadTemplates loads the built-in English templates, then the templates in
+// dir, which replace built-in ones with the same name. An empty dir loads
+// only the built-in templates.
+func LoadTemplates(dir, defaultLocale string) (*Templates, error) {
+	locale, ok := NormalizeLocale(defaultLocale)
+	if !ok {
+		return nil, fmt.Errorf("invalid default locale %q", defaultLocale)
+	}
+	t := &Templates{
+		DefaultLocale: locale,
+		text:          make(map[string]*texttemplate.Template),
+		html:          make(map[string]*htmltemplate.Template),
+	}
+
+	builtIn, err := fs.Sub(defaultTemplates, "templates")
+	if err != nil {
+		return nil, err
+	}
+	if err := t.load(builtIn); err != nil {
+		return nil, err
+	}
+	if dir != "" {
+		if err := t.load(os.DirFS(dir)); err != nil {
+			return nil, fmt.Errorf("failed to load templates from %s: %w", dir, err)
+		}
+	}
+	return t, nil
+}
+
+// load parses every template file in the locale directories of fsys
+func (t *Templates) load(fsys fs.FS) error {
+	return fs.WalkDir(fsys, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		ext := path.Ext(name)
+		if ext != templateText && ext != templateHTML && ext != templateSubject {
+			return nil
+		}
+		locale, ok := NormalizeLocale(path.Dir(name))
+		if !ok {
+			return fmt.Errorf("template %s is not in a locale directory", name)
+		}
+		key := locale + "/" + strings.TrimSuffix(path.Base(name), ext) + ext
+
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		body := strings.TrimRight(string(data), "\n")
+		if ext == templateHTML {
+			tmpl, err := htmltemplate.New(key).Parse(body)
+			if err != nil {
+				return fmt.Errorf("invalid template %s: %w", name, err)
+			}
+			t.html[key] = tmpl
+			return nil
+		}
+		tmpl, err := texttemplate.New(key).Parse(body)
+		if err != nil {
+			return fmt.Errorf("invalid template %s: %w", name, err)
+		}
+		t.text[key] = tmpl
+		return nil
+	})
+}
+
+// Render renders the message for the channel and purpose in the first of
+// the locale's fallbacks that has a text template for the channel: the
+// locale itself, its language, then the default locale. Templates for the
+// purpose are preferred over the channel's general ones.
+// Returns ErrNoTemplate if no locale has a template for the channel.
+func (t *Templates) Render(to string, data TemplateData) (Message, error) {
+	if data.TTL > 0 {
+		data.TTLMinutes = int(math.Ceil(data.TTL.Minutes()))
+	}
+
+	for _, locale := range t.Locales(data.Locale) {
+		text, ok := t.lookup(locale, data.Channel, data.Purpose, templateText)
+		if !ok {
+			continue
+		}
+		data.Locale = locale
+
+		msg := Message{To: to, Code: data.Code}
+		var err error
+		if msg.Text, err = executeText(t.text[text], data); err != nil {
+			return Message{}, err
+		}
+		if subject, ok := t.lookup(locale, data.Channel, data.Purpose, templateSubject); ok {
+			if msg.Subject, err = executeText(t.text[subject], data); err != nil {
+				return Message{}, err
+			}
+		}
+		if html, ok := t.lookup(locale, data.Channel, data.Purpose, templateHTML); ok {
+			var buf bytes.Buffer
+			if err := t.html[html].Execute(&buf, data); err != nil {
+				return Message{}, fmt.Errorf("failed to render template %s: %w", html, err)
+			}
+			msg.HTML = buf.String()
+		}
+		return msg, nil
+	}
+	return Message{}, fmt.Errorf("%w for channel %s", ErrNoTemplate, data.Channel)
+}
+
+// lookup returns the name of the locale's template for the purpose, or else
+// for the channel, with the extension
+func (t *Templates) lookup(locale, channel, purpose, ext string) (string, bool) {
+	for _, name := range []string{channel + "." + purpose, channel} {
+		key := locale + "/" + name + ext
+		if _, ok := t.text[key]; ok {
+			return key, true
+		}
+		if _, ok := t.html[key]; ok {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// Locales returns the locales tried for a requested locale, most specific
+// first: "pt-BR" tries "pt-br", "pt" and then the default locale and its
+// language. An empty or invalid locale tries only the default.
+func (t *Templates) Locales(requested string) []string {
+	var locales []string
+	seen := make(map[string]bool)
+	for _, tag := range []string{requested, t.DefaultLocale} {
+		locale, ok := NormalizeLocale(tag)
+		for ok && !seen[locale] {
+			seen[locale] = true
+			locales = append(locales, locale)
+			i := strings.LastIndex(locale, "-")
+			ok = i > 0
+			if ok {
+				locale = locale[:i]
+			}
+		}
+	}
+	return locales
+}
+
+// NormalizeLocale lowercases a BCP 47 language tag such as "pt-BR" or
+// "pt_BR" to "pt-br", and reports whether it is a well-formed tag
+func NormalizeLocale(locale string) (string, bool) {
+	locale = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(locale), "_", "-"))
+	if len(locale) > 35 || !localePattern.MatchString(locale) {
+		return "", false
+	}
+	return locale, true
+}
+
+func executeText(tmpl *texttemplate.Template, data TemplateData) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("failed to render template %s: %w", tmpl.Name(), err)
+	}
+	return buf.String(), nil
+}
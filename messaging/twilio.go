@@ -1,10 +1,18 @@
 package messaging
 
 import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
 	"fmt"
+	"log"
 	"net/http"
 	"net/url"
+	"sort"
 	"strings"
+	"unicode"
 )
 
 // TwilioConfig holds configuration for Twilio API
@@ -13,6 +21,11 @@ type TwilioConfig struct {
 	AuthToken   string
 	PhoneNumber string
 	BaseURL     string
+	// Public URL Twilio posts message status changes to; empty sends no status callbacks
+	StatusCallbackURL string
+	// Voice and language calls read codes out in, e.g. "alice" and "en-US"; empty uses Twilio's defaults
+	Voice         string
+	VoiceLanguage string
 }
 
 // TwilioService implements SMS and WhatsApp sending functionality
@@ -32,62 +45,64 @@ func NewTwilioService(config TwilioConfig) *TwilioService {
 	}
 }
 
-// SendSMS sends an SMS message through Twilio
-func (s *TwilioService) SendSMS(to, message string) error {
-	// Format the API URL
-	apiURL := fmt.Sprintf("%s/Accounts/%s/Messages.json", s.Config.BaseURL, s.Config.AccountSID)
-
-	// Create form data
-	formData := url.Values{}
-	formData.Set("To", to)
-	formData.Set("From", s.Config.PhoneNumber)
-	formData.Set("Body", message)
-
-	// Create HTTP request
-	req, err := http.NewRequest("POST", apiURL, strings.NewReader(formData.Encode()))
+// SendSMS sends an SMS message through Twilio and returns its message SID
+func (s *TwilioService) SendSMS(to, message string) (string, error) {
+	sid, err := s.sendMessage(to, s.Config.PhoneNumber, message)
 	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+		return "", fmt.Errorf("failed to send SMS: %w", err)
 	}
+	return sid, nil
+}
 
-	// Set headers
-	req.SetBasicAuth(s.Config.AccountSID, s.Config.AuthToken)
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+// SendWhatsApp sends a WhatsApp message through Twilio and returns its message SID
+func (s *TwilioService) SendWhatsApp(to, message string) (string, error) {
+	// Format WhatsApp numbers (prefixed with "whatsapp:" for Twilio)
+	fromWhatsApp := fmt.Sprintf("whatsapp:%s", s.Config.PhoneNumber)
+	toWhatsApp := fmt.Sprintf("whatsapp:%s", to)
 
-	// Send request
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	sid, err := s.sendMessage(toWhatsApp, fromWhatsApp, message)
 	if err != nil {
-		return fmt.Errorf("failed to send SMS: %w", err)
+		return "", fmt.Errorf("failed to send WhatsApp message: %w", err)
 	}
-	defer resp.Body.Close()
+	return sid, nil
+}
 
-	// Check response status
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return fmt.Errorf("twilio API returned non-success status code: %d", resp.StatusCode)
+// sendMessage creates a message with the Messages API and returns its SID
+func (s *TwilioService) sendMessage(to, from, body string) (string, error) {
+	// Create form data
+	formData := url.Values{}
+	formData.Set("To", to)
+	formData.Set("From", from)
+	formData.Set("Body", body)
+	if s.Config.StatusCallbackURL != "" {
+		formData.Set("StatusCallback", s.Config.StatusCallbackURL)
 	}
-
-	return nil
+	return s.post("Messages.json", formData)
 }
 
-// SendWhatsApp sends a WhatsApp message through Twilio
-func (s *TwilioService) SendWhatsApp(to, message string) error {
-	// Format the API URL
-	apiURL := fmt.Sprintf("%s/Accounts/%s/Messages.json", s.Config.BaseURL, s.Config.AccountSID)
+// Call places a voice call that plays the TwiML and returns the call's SID
+func (s *TwilioService) Call(to, twiml string) (string, error) {
+	formData := url.Values{}
+	formData.Set("To", to)
+	formData.Set("From", s.Config.PhoneNumber)
+	formData.Set("Twiml", twiml)
 
-	// Format WhatsApp number (prefixed with "whatsapp:" for Twilio)
-	fromWhatsApp := fmt.Sprintf("whatsapp:%s", s.Config.PhoneNumber)
-	toWhatsApp := fmt.Sprintf("whatsapp:%s", to)
+	sid, err := s.post("Calls.json", formData)
+	if err != nil {
+		return "", fmt.Errorf("failed to place call: %w", err)
+	}
+	return sid, nil
+}
 
-	// Create form data
-	formData := url.Values{}
-	formData.Set("To", toWhatsApp)
-	formData.Set("From", fromWhatsApp)
-	formData.Set("Body", message)
+// post creates a resource of the account, such as a message or a call, and returns its SID
+func (s *TwilioService) post(resource string, formData url.Values) (string, error) {
+	// Format the API URL
+	apiURL := fmt.Sprintf("%s/Accounts/%s/%s", s.Config.BaseURL, s.Config.AccountSID, resource)
 
 	// Create HTTP request
 	req, err := http.NewRequest("POST", apiURL, strings.NewReader(formData.Encode()))
 	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+		return "", fmt.Errorf("failed to create request: %w", err)
 	}
 
 	// Set headers
@@ -98,26 +113,159 @@ func (s *TwilioService) SendWhatsApp(to, message string) error {
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
-		return fmt.Errorf("failed to send WhatsApp message: %w", err)
+		return "", err
 	}
 	defer resp.Body.Close()
 
 	// Check response status
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return fmt.Errorf("twilio API returned non-success status code: %d", resp.StatusCode)
+		return "", fmt.Errorf("twilio API returned non-success status code: %d", resp.StatusCode)
 	}
 
-	return nil
+	// The resource was created; its SID is what status callbacks refer to.
+	// Without a SID it was still created, and failing would send it again.
+	var created struct {
+		SID string `json:"sid"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		log.Printf("Twilio created %s but its response could not be read: %v", resource, err)
+		return "", nil
+	}
+	return created.SID, nil
 }
 
 // SendOTP sends a one-time password via SMS
 func (s *TwilioService) SendOTP(to, otp string) error {
-	message := fmt.Sprintf("Your verification code is: %s. It will expire in 10 minutes.", otp)
-	return s.SendSMS(to, message)
+	_, err := s.SendSMS(to, otpMessage(otp))
+	return err
 }
 
 // SendOTPWhatsApp sends a one-time password via WhatsApp
 func (s *TwilioService) SendOTPWhatsApp(to, otp string) error {
-	message := fmt.Sprintf("Your verification code is: %s. It will expire in 10 minutes.", otp)
-	return s.SendWhatsApp(to, message)
+	_, err := s.SendWhatsApp(to, otpMessage(otp))
+	return err
+}
+
+// SMSSender returns a MessageSender that sends one-time passwords via SMS
+func (s *TwilioService) SMSSender() MessageSender {
+	return twilioSender{send: s.SendSMS}
+}
+
+// WhatsAppSender returns a MessageSender that sends one-time passwords via WhatsApp
+func (s *TwilioService) WhatsAppSender() MessageSender {
+	return twilioSender{send: s.SendWhatsApp}
+}
+
+// VoiceSender returns a MessageSender that reads one-time passwords out in a voice call
+func (s *TwilioService) VoiceSender() MessageSender {
+	return twilioVoiceSender{s}
+}
+
+// ValidateSignature reports whether signature is Twilio's signature of a
+// request to the URL with the POST params, signed with the account's auth token
+func (s *TwilioService) ValidateSignature(url string, params url.Values, signature string) bool {
+	return ValidateTwilioSignature(s.Config.AuthToken, url, params, signature)
+}
+
+// otpMessage is the message sent by SendOTP, which knows nothing of templates or the code's TTL
+func otpMessage(otp string) string {
+	return fmt.Sprintf("Your verification code is: %s", otp)
+}
+
+// twilioSender sends one-time passwords over a single Twilio channel
+type twilioSender struct {
+	send func(to, message string) (string, error)
+}
+
+// SendOTP implements Sender
+func (t twilioSender) SendOTP(to, otp string) error {
+	_, err := t.send(to, otpMessage(otp))
+	return err
+}
+
+// SendMessage implements MessageSender, returning the message SID
+func (t twilioSender) SendMessage(msg Message) (string, error) {
+	return t.send(msg.To, msg.Text)
+}
+
+// twilioVoiceSender reads one-time passwords out in Twilio voice calls
+type twilioVoiceSender struct {
+	*TwilioService
+}
+
+// SendOTP implements Sender
+func (v twilioVoiceSender) SendOTP(to, otp string) error {
+	_, err := v.Call(to, v.VoiceTwiML("Your verification code is: "+SpokenCode(otp)+"."))
+	return err
+}
+
+// SendMessage implements MessageSender. Calls report no status, so no ID is returned.
+func (v twilioVoiceSender) SendMessage(msg Message) (string, error) {
+	_, err := v.Call(msg.To, v.VoiceTwiML(msg.Text))
+	return "", err
+}
+
+// VoiceTwiML returns TwiML that reads the text out twice in the configured
+// voice and language, with a pause before the repeat
+func (s *TwilioService) VoiceTwiML(text string) string {
+	var say strings.Builder
+	say.WriteString("<Say")
+	if s.Config.Voice != "" {
+		say.WriteString(` voice="` + xmlEscape(s.Config.Voice) + `"`)
+	}
+	if s.Config.VoiceLanguage != "" {
+		say.WriteString(` language="` + xmlEscape(s.Config.VoiceLanguage) + `"`)
+	}
+	say.WriteString(">" + xmlEscape(text) + "</Say>")
+
+	return `<?xml version="1.0" encoding="UTF-8"?><Response>` +
+		say.String() + `<Pause length="1"/>` + say.String() + `</Response>`
+}
+
+// SpokenCode spells a code out one character at a time, e.g. "1, 2, 3, 4"
+// for "12-34", so a voice reads it digit by digit rather than as a number
+func SpokenCode(code string) string {
+	var chars []string
+	for _, c := range code {
+		if unicode.IsLetter(c) || unicode.IsDigit(c) {
+			chars = append(chars, string(c))
+		}
+	}
+	return strings.Join(chars, ", ")
+}
+
+func xmlEscape(s string) string {
+	var buf strings.Builder
+	_ = xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+// ValidateTwilioSignature reports whether signature, the X-Twilio-Signature
+// header, matches a request to the URL with the POST params. Twilio signs the
+// full URL it called followed by each param name and value, sorted by name,
+// with HMAC-SHA1 keyed by the auth token. Without an auth token nothing is valid.
+func ValidateTwilioSignature(authToken, url string, params url.Values, signature string) bool {
+	if authToken == "" || signature == "" {
+		return false
+	}
+
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var data strings.Builder
+	data.WriteString(url)
+	for _, name := range names {
+		for _, value := range params[name] {
+			data.WriteString(name)
+			data.WriteString(value)
+		}
+	}
+
+	mac := hmac.New(sha1.New, []byte(authToken))
+	mac.Write([]byte(data.String()))
+	expected := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(expected), []byte(signature))
 }
@@ -0,0 +1,114 @@
+package messaging
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// VonageConfig holds configuration for the Vonage (formerly Nexmo) SMS API
+type VonageConfig struct {
+	APIKey    string
+	APISecret string
+	// From is the number or alphanumeric sender ID messages are sent from
+	From    string
+	BaseURL string
+}
+
+// VonageService implements SMS sending through Vonage
+type VonageService struct {
+	Config VonageConfig
+}
+
+// NewVonageService creates a new VonageService with the specified configuration
+func NewVonageService(config VonageConfig) *VonageService {
+	// Set default API endpoint if not specified
+	if config.BaseURL == "" {
+		config.BaseURL = "https://rest.nexmo.com"
+	}
+
+	return &VonageService{
+		Config: config,
+	}
+}
+
+// SendSMS sends an SMS message through Vonage and returns the ID of its
+// first part. Messages that need UCS-2 are sent as unicode, which Vonage
+// would otherwise mangle.
+func (s *VonageService) SendSMS(to, message string) (string, error) {
+	formData := url.Values{}
+	formData.Set("api_key", s.Config.APIKey)
+	formData.Set("api_secret", s.Config.APISecret)
+	formData.Set("from", s.Config.From)
+	// Vonage takes numbers in international format without the leading "+"
+	formData.Set("to", strings.TrimPrefix(to, "+"))
+	formData.Set("text", message)
+	if SMSEncoding(message) == EncodingUCS2 {
+		formData.Set("type", "unicode")
+	}
+
+	id, err := s.post(formData)
+	if err != nil {
+		return "", fmt.Errorf("failed to send SMS: %w", err)
+	}
+	return id, nil
+}
+
+// post sends an SMS with the form and returns the ID of its first part
+func (s *VonageService) post(formData url.Values) (string, error) {
+	req, err := http.NewRequest("POST", s.Config.BaseURL+"/sms/json", strings.NewReader(formData.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", fmt.Errorf("vonage API returned non-success status code: %d", resp.StatusCode)
+	}
+
+	// Vonage reports failures per part with a 200 response; status "0" is success
+	var result struct {
+		Messages []struct {
+			Status    string `json:"status"`
+			MessageID string `json:"message-id"`
+			ErrorText string `json:"error-text"`
+		} `json:"messages"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		// The request was accepted even if its response cannot be read, and failing would send it again
+		log.Printf("Vonage accepted a message but its response could not be read: %v", err)
+		return "", nil
+	}
+	if len(result.Messages) == 0 {
+		return "", fmt.Errorf("vonage API returned no messages")
+	}
+	for _, part := range result.Messages {
+		if part.Status != "0" {
+			return "", fmt.Errorf("vonage API rejected the message with status %s: %s", part.Status, part.ErrorText)
+		}
+	}
+	return result.Messages[0].MessageID, nil
+}
+
+// SendOTP sends a one-time password via SMS
+func (s *VonageService) SendOTP(to, otp string) error {
+	_, err := s.SendSMS(to, otpMessage(otp))
+	return err
+}
+
+// SendMessage implements MessageSender. Vonage delivery receipts are not
+// received by this service, so no ID is returned.
+func (s *VonageService) SendMessage(msg Message) (string, error) {
+	_, err := s.SendSMS(msg.To, msg.Text)
+	return "", err
+}
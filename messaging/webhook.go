@@ -0,0 +1,126 @@
+package messaging
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// WebhookSignatureHeader carries the HMAC-SHA256 signature of webhook requests
+const WebhookSignatureHeader = "X-OTP-Signature"
+
+// WebhookConfig holds configuration for delivering messages to an HTTP endpoint
+type WebhookConfig struct {
+	// URL messages are POSTed to
+	URL string
+	// Channel is reported in each request, e.g. "sms"
+	Channel string
+	// Secret signs each request when set; see WebhookSignature
+	Secret string
+	// Headers are added to each request, e.g. for an Authorization header
+	Headers map[string]string
+}
+
+// WebhookPayload is the JSON body POSTed for each message
+type WebhookPayload struct {
+	Channel   string `json:"channel"`
+	To        string `json:"to"`
+	Code      string `json:"code"`
+	Subject   string `json:"subject,omitempty"`
+	Text      string `json:"text"`
+	HTML      string `json:"html,omitempty"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// WebhookService delivers messages by POSTing them as JSON to a URL, for
+// providers without a built-in implementation. The endpoint accepts a
+// message with any 2xx status and may return {"id": "..."} to name it.
+type WebhookService struct {
+	Config WebhookConfig
+}
+
+// NewWebhookService creates a new WebhookService with the specified configuration
+func NewWebhookService(config WebhookConfig) *WebhookService {
+	return &WebhookService{
+		Config: config,
+	}
+}
+
+// Send POSTs the message to the webhook and returns the ID it was given, if any
+func (s *WebhookService) Send(msg Message) (string, error) {
+	body, err := json.Marshal(WebhookPayload{
+		Channel:   s.Config.Channel,
+		To:        msg.To,
+		Code:      msg.Code,
+		Subject:   msg.Subject,
+		Text:      msg.Text,
+		HTML:      msg.HTML,
+		Timestamp: time.Now().Unix(),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode webhook request: %w", err)
+	}
+
+	req, err := http.NewRequest("POST", s.Config.URL, bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+	for name, value := range s.Config.Headers {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.Config.Secret != "" {
+		req.Header.Set(WebhookSignatureHeader, WebhookSignature(s.Config.Secret, body))
+	}
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to call webhook: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", fmt.Errorf("webhook returned non-success status code: %d", resp.StatusCode)
+	}
+
+	// The ID is optional, so an empty or non-JSON response is still a success
+	var accepted struct {
+		ID json.RawMessage `json:"id"`
+	}
+	if json.NewDecoder(resp.Body).Decode(&accepted) != nil || len(accepted.ID) == 0 {
+		return "", nil
+	}
+	if id, err := strconv.Unquote(string(accepted.ID)); err == nil {
+		return id, nil
+	}
+	return string(accepted.ID), nil
+}
+
+// SendOTP sends a one-time password with the default message
+func (s *WebhookService) SendOTP(to, otp string) error {
+	_, err := s.Send(Message{To: to, Code: otp, Text: otpMessage(otp)})
+	return err
+}
+
+// SendMessage implements MessageSender. The webhook's delivery reports are
+// not received by this service, so no ID is returned.
+func (s *WebhookService) SendMessage(msg Message) (string, error) {
+	_, err := s.Send(msg)
+	return "", err
+}
+
+// WebhookSignature returns the X-OTP-Signature of a webhook request body:
+// "sha256=" followed by the hex HMAC-SHA256 of the body keyed by the secret.
+// The body's timestamp lets receivers reject replayed requests.
+func WebhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,30 @@
+package models
+
+import "time"
+
+// DeliveryStatus is how far delivery of a session's latest code has got.
+// Status is one of "queued", "retrying", "delivered", "failed" or "discarded".
+type DeliveryStatus struct {
+	Status    string    `json:"status"`
+	Channel   string    `json:"channel"`
+	Attempts  int       `json:"attempts"`
+	Error     string    `json:"error,omitempty"` // The last delivery error, while retrying or once failed
+	UpdatedAt time.Time `json:"updatedAt"`
+	// How the sent SMS was encoded and how many segments it was billed as
+	Encoding       string `json:"encoding,omitempty"`
+	Segments       int    `json:"segments,omitempty"`
+	Transliterated bool   `json:"transliterated,omitempty"`
+	// What the provider reported about the message, for channels that report delivery
+	Provider *ProviderStatus `json:"provider,omitempty"`
+}
+
+// ProviderStatus is what the provider last reported about the message
+// carrying a session's latest code. Status is one of "queued", "sending",
+// "sent", "delivered", "read", "undelivered" or "failed".
+type ProviderStatus struct {
+	MessageID string    `json:"messageId"`
+	Channel   string    `json:"channel"`
+	Status    string    `json:"status"`
+	ErrorCode string    `json:"errorCode,omitempty"` // The provider's error code once undelivered or failed
+	UpdatedAt time.Time `json:"updatedAt"`
+}
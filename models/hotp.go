@@ -0,0 +1,41 @@
+package models
+
+// HOTPRegisterRequest registers a counter-based token, such as a hardware
+// token, for a user. Zero fields fall back to the configured defaults.
+type HOTPRegisterRequest struct {
+	Username  string `json:"username"`
+	SessionID string `json:"sessionId"`           // A session recently verified for the user
+	Secret    string `json:"secret"`              // Base32, as printed on or exported from the token
+	Counter   uint64 `json:"counter,omitempty"`   // Counter of the next code the token will show
+	Algorithm string `json:"algorithm,omitempty"` // One of the Algorithm constants
+	Digits    int    `json:"digits,omitempty"`    // 6 to 8
+}
+
+// HOTPVerifyRequest submits a token code for a user
+type HOTPVerifyRequest struct {
+	Username string `json:"username"`
+	Code     string `json:"code"`
+}
+
+// HOTPResyncRequest submits two consecutive token codes to recover a counter
+// that has drifted beyond the look-ahead window
+type HOTPResyncRequest struct {
+	Username string `json:"username"`
+	Code     string `json:"code"`
+	NextCode string `json:"nextCode"`
+}
+
+// HOTPToken is the stored secret and counter of a user's token
+type HOTPToken struct {
+	Secret    string `json:"secret"`
+	Algorithm string `json:"algorithm"`
+	Digits    int    `json:"digits"`
+	Counter   uint64 `json:"counter"` // Counter of the next code that will be accepted
+}
+
+// Supported HOTP and TOTP hash algorithms, named as in otpauth:// URIs
+const (
+	AlgorithmSHA1   = "SHA1"
+	AlgorithmSHA256 = "SHA256"
+	AlgorithmSHA512 = "SHA512"
+)
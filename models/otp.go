@@ -1,18 +1,106 @@
 package models
 
+// GenerateRequest starts a verification session for a user. Destination is
+// the phone number or email address to deliver to; it can be left out when a
+// destination lookup is configured, which then picks a registered one.
+// Older clients send only Username, which is then both the user and the destination.
 type GenerateRequest struct {
-	Username    string `json:"username"`
-	MessageType string `json:"messageType"`
+	UserID      string     `json:"userId,omitempty"`
+	Destination string     `json:"destination,omitempty"`
+	Username    string     `json:"username,omitempty"`
+	MessageType string     `json:"messageType"`
+	Purpose     string     `json:"purpose,omitempty"` // e.g. "login" or "password_reset"; one pending session per purpose
+	Format      *OTPFormat `json:"format,omitempty"`
+	// Fallback lists channels to try in order if delivery over MessageType fails.
+	// When empty, the configured fallback chain for MessageType is used.
+	Fallback []string `json:"fallback,omitempty"`
+	// Locale is the language of the message, e.g. "pt-BR". Without a template
+	// for it, its language and then the default locale are used.
+	Locale string `json:"locale,omitempty"`
+	// AutoFill names a configured auto-fill profile that formats SMS messages
+	// for the Android SMS Retriever API or WebOTP
+	AutoFill string `json:"autofill,omitempty"`
 }
 
+// User returns the user the session is for: UserID, or Username for older clients
+func (r GenerateRequest) User() string {
+	if r.UserID != "" {
+		return r.UserID
+	}
+	return r.Username
+}
+
+// ResendRequest identifies the session to resend by its ID or, for older
+// clients, by user and purpose. MessageType and Locale optionally switch
+// channel and language.
+type ResendRequest struct {
+	SessionID   string     `json:"sessionId,omitempty"`
+	UserID      string     `json:"userId,omitempty"`
+	Username    string     `json:"username,omitempty"`
+	Purpose     string     `json:"purpose,omitempty"`
+	MessageType string     `json:"messageType,omitempty"`
+	Destination string     `json:"destination,omitempty"` // Where to send the new code, e.g. for a new messageType
+	Locale      string     `json:"locale,omitempty"`
+	Format      *OTPFormat `json:"format,omitempty"`
+}
+
+// OTPFormat controls how a code is generated and displayed.
+// Zero fields fall back to the configured defaults.
+type OTPFormat struct {
+	Length    int    `json:"length,omitempty"`    // Number of characters, 4 to 12
+	Alphabet  string `json:"alphabet,omitempty"`  // One of the Alphabet constants
+	GroupSize int    `json:"groupSize,omitempty"` // Split into groups joined by "-" for display, e.g. 3 gives "123-456"
+}
+
+// User returns UserID, or Username for older clients
+func (r ResendRequest) User() string {
+	if r.UserID != "" {
+		return r.UserID
+	}
+	return r.Username
+}
+
+// ValidationRequest identifies the session by its ID or, for older clients,
+// by user and purpose. With Recovery set, OTP is one of the user's
+// recovery codes instead and no session is involved.
 type ValidationRequest struct {
-	Username string `json:"username"`
-	OTP      string `json:"otp"`
+	SessionID string `json:"sessionId,omitempty"`
+	UserID    string `json:"userId,omitempty"`
+	Username  string `json:"username,omitempty"`
+	Purpose   string `json:"purpose,omitempty"`
+	OTP       string `json:"otp"`
+	Recovery  bool   `json:"recovery,omitempty"`
 }
 
-// Valid message types constant
+// User returns UserID, or Username for older clients
+func (r ValidationRequest) User() string {
+	if r.UserID != "" {
+		return r.UserID
+	}
+	return r.Username
+}
+
+// RecoveryCodesRequest generates a set of recovery codes for a user
+type RecoveryCodesRequest struct {
+	Username  string `json:"username"`
+	SessionID string `json:"sessionId"`       // A session recently verified for the user
+	Count     int    `json:"count,omitempty"` // Number of codes; zero uses the configured default
+}
+
+// Built-in message types; each is the name of a channel in the messaging.Registry
 const (
 	MessageTypeEmail    = "email"
 	MessageTypeSMS      = "sms"
 	MessageTypeWhatsApp = "whatsapp"
+	// MessageTypeVoice reads the code out in a phone call, for landlines and phones without SMS
+	MessageTypeVoice = "voice"
+	// MessageTypeMagicLink emails a single-use sign-in link instead of a code
+	MessageTypeMagicLink = "magic_link"
+)
+
+// Supported OTP alphabets
+const (
+	AlphabetNumeric      = "numeric"
+	AlphabetAlphanumeric = "alphanumeric" // Upper case letters and digits without 0/O, 1/I/L
+	AlphabetHex          = "hex"
 )
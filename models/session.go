@@ -0,0 +1,35 @@
+package models
+
+import "time"
+
+// Session is a single verification started by /otp/generate. Clients refer to
+// it by its random ID, so a user can have several sessions at once, one per purpose.
+type Session struct {
+	ID           string     `json:"sessionId"`
+	Username     string     `json:"username"`
+	Purpose      string     `json:"purpose"`
+	Channel      string     `json:"channel"`
+	Fallback     []string   `json:"fallback,omitempty"`     // Channels tried in order if delivery over Channel fails
+	DeliveredVia string     `json:"deliveredVia,omitempty"` // The channel the latest code was delivered over
+	Destination  string     `json:"destination"`
+	Locale       string     `json:"locale,omitempty"`   // The language messages are sent in; empty uses the default
+	AutoFill     string     `json:"autofill,omitempty"` // The auto-fill profile that formats SMS messages
+	Status       string     `json:"status"`
+	Attempts     int        `json:"attempts"`
+	Format       OTPFormat  `json:"format"`
+	CreatedAt    time.Time  `json:"createdAt"`
+	ExpiresAt    time.Time  `json:"expiresAt"`
+	VerifiedAt   *time.Time `json:"verifiedAt,omitempty"`
+}
+
+// Session statuses
+const (
+	SessionStatusPending    = "pending"
+	SessionStatusVerified   = "verified"
+	SessionStatusFailed     = "failed"     // Too many failed attempts
+	SessionStatusSuperseded = "superseded" // Replaced by a newer session for the same purpose
+	SessionStatusExpired    = "expired"
+)
+
+// DefaultPurpose is used when a request does not name a purpose
+const DefaultPurpose = "default"
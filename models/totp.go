@@ -0,0 +1,29 @@
+package models
+
+import "time"
+
+// TOTPEnrollRequest enrolls an authenticator app for a user. Zero fields fall
+// back to the configured defaults.
+type TOTPEnrollRequest struct {
+	Username  string `json:"username"`
+	SessionID string `json:"sessionId"`           // A session recently verified for the user
+	Algorithm string `json:"algorithm,omitempty"` // One of the Algorithm constants
+	Digits    int    `json:"digits,omitempty"`    // 6 to 8
+	Period    int    `json:"period,omitempty"`    // Time step in seconds
+}
+
+// TOTPVerifyRequest submits an authenticator code for a user, to verify it or
+// to confirm a pending enrollment
+type TOTPVerifyRequest struct {
+	Username string `json:"username"`
+	Code     string `json:"code"`
+}
+
+// TOTPEnrollment is the stored authenticator secret of a user
+type TOTPEnrollment struct {
+	Secret    string    `json:"secret"` // Base32 without padding, as shown to authenticator apps
+	Algorithm string    `json:"algorithm"`
+	Digits    int       `json:"digits"`
+	Period    int       `json:"period"`
+	CreatedAt time.Time `json:"createdAt"`
+}
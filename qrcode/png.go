@@ -0,0 +1,42 @@
+package qrcode
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+)
+
+// quietZone is the light border, in modules, required around a symbol
+const quietZone = 4
+
+// Image renders the code with each module drawn as a scale x scale square
+func (c *Code) Image(scale int) image.Image {
+	if scale < 1 {
+		scale = 1
+	}
+	width := (c.Size + 2*quietZone) * scale
+	img := image.NewGray(image.Rect(0, 0, width, width))
+
+	for py := 0; py < width; py++ {
+		for px := 0; px < width; px++ {
+			x, y := px/scale-quietZone, py/scale-quietZone
+			dark := x >= 0 && y >= 0 && x < c.Size && y < c.Size && c.modules[y][x]
+			if dark {
+				img.SetGray(px, py, color.Gray{Y: 0})
+			} else {
+				img.SetGray(px, py, color.Gray{Y: 255})
+			}
+		}
+	}
+	return img
+}
+
+// PNG renders the code as a PNG image with each module scale pixels wide
+func (c *Code) PNG(scale int) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, c.Image(scale)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,488 @@
+// Package qrcode encodes data as a QR code (ISO/IEC 18004) in byte mode with
+// error correction level M, and renders it as a PNG image. It supports
+// versions 1 to 20, which holds up to 666 bytes, enough for otpauth:// URIs.
+package qrcode
+
+import (
+	"errors"
+)
+
+// ErrTooLong is returned when the data does not fit in the largest supported version
+var ErrTooLong = errors.New("data too long for a QR code")
+
+// blockLayout describes the error correction blocks of one version at level M
+type blockLayout struct {
+	ecPerBlock   int
+	group1Blocks int
+	group1Data   int
+	group2Blocks int
+	group2Data   int
+}
+
+func (l blockLayout) dataCodewords() int {
+	return l.group1Blocks*l.group1Data + l.group2Blocks*l.group2Data
+}
+
+// layouts holds the level M block layout for versions 1 to 20, indexed by version
+var layouts = [...]blockLayout{
+	{},
+	{10, 1, 16, 0, 0},
+	{16, 1, 28, 0, 0},
+	{26, 1, 44, 0, 0},
+	{18, 2, 32, 0, 0},
+	{24, 2, 43, 0, 0},
+	{16, 4, 27, 0, 0},
+	{18, 4, 31, 0, 0},
+	{22, 2, 38, 2, 39},
+	{22, 3, 36, 2, 37},
+	{26, 4, 43, 1, 44},
+	{30, 1, 50, 4, 51},
+	{22, 6, 36, 2, 37},
+	{22, 8, 37, 1, 38},
+	{24, 4, 40, 5, 41},
+	{24, 5, 41, 5, 42},
+	{28, 7, 45, 3, 46},
+	{28, 10, 46, 1, 47},
+	{26, 9, 43, 4, 44},
+	{26, 3, 44, 11, 45},
+	{26, 3, 41, 13, 42},
+}
+
+// alignmentPositions holds the alignment pattern centre coordinates, indexed by version
+var alignmentPositions = [...][]int{
+	{}, {},
+	{6, 18}, {6, 22}, {6, 26}, {6, 30}, {6, 34},
+	{6, 22, 38}, {6, 24, 42}, {6, 26, 46}, {6, 28, 50}, {6, 30, 54}, {6, 32, 58}, {6, 34, 62},
+	{6, 26, 46, 66}, {6, 26, 48, 70}, {6, 26, 50, 74}, {6, 30, 54, 78}, {6, 30, 56, 82}, {6, 30, 58, 86}, {6, 34, 62, 90},
+}
+
+// maxVersion is the largest supported version
+const maxVersion = 20
+
+// formatBitsM is the two-bit error correction indicator for level M
+const formatBitsM = 0
+
+// Code is an encoded QR code symbol
+type Code struct {
+	// Version is the QR code version, from 1 to 20
+	Version int
+	// Size is the width and height in modules
+	Size int
+
+	modules  [][]bool
+	function [][]bool
+}
+
+// Encode encodes data in the smallest version that holds it
+func Encode(data []byte) (*Code, error) {
+	version := 0
+	for v := 1; v <= maxVersion; v++ {
+		if dataBits(v, len(data)) <= layouts[v].dataCodewords()*8 {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, ErrTooLong
+	}
+
+	size := version*4 + 17
+	c := &Code{
+		Version:  version,
+		Size:     size,
+		modules:  make([][]bool, size),
+		function: make([][]bool, size),
+	}
+	for i := range c.modules {
+		c.modules[i] = make([]bool, size)
+		c.function[i] = make([]bool, size)
+	}
+
+	c.drawFunctionPatterns()
+	c.drawCodewords(addErrorCorrection(version, encodeData(version, data)))
+
+	// Pick the mask with the lowest penalty
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		c.applyMask(mask)
+		c.drawFormatBits(mask)
+		if penalty := c.penalty(); bestPenalty < 0 || penalty < bestPenalty {
+			best, bestPenalty = mask, penalty
+		}
+		c.applyMask(mask) // masking is its own inverse
+	}
+	c.applyMask(best)
+	c.drawFormatBits(best)
+
+	return c, nil
+}
+
+// Dark reports whether the module at column x and row y is dark
+func (c *Code) Dark(x, y int) bool {
+	return c.modules[y][x]
+}
+
+// characterCountBits returns the width of the byte mode length field
+func characterCountBits(version int) int {
+	if version <= 9 {
+		return 8
+	}
+	return 16
+}
+
+// dataBits returns the number of bits needed to encode n bytes in byte mode
+func dataBits(version, n int) int {
+	if n >= 1<<characterCountBits(version) {
+		return 1 << 30
+	}
+	return 4 + characterCountBits(version) + 8*n
+}
+
+// bitBuffer accumulates bits most significant first
+type bitBuffer []bool
+
+func (b *bitBuffer) append(value, length int) {
+	for i := length - 1; i >= 0; i-- {
+		*b = append(*b, (value>>i)&1 == 1)
+	}
+}
+
+// encodeData builds the padded data codewords for byte mode
+func encodeData(version int, data []byte) []byte {
+	capacity := layouts[version].dataCodewords() * 8
+
+	var bits bitBuffer
+	bits.append(0x4, 4) // byte mode
+	bits.append(len(data), characterCountBits(version))
+	for _, b := range data {
+		bits.append(int(b), 8)
+	}
+
+	// Terminator, then pad to a whole byte
+	terminator := capacity - len(bits)
+	if terminator > 4 {
+		terminator = 4
+	}
+	bits.append(0, terminator)
+	bits.append(0, (8-len(bits)%8)%8)
+
+	codewords := make([]byte, len(bits)/8, capacity/8)
+	for i, bit := range bits {
+		if bit {
+			codewords[i/8] |= 1 << (7 - i%8)
+		}
+	}
+
+	// Alternate pad bytes until the capacity is reached
+	for pad := byte(0xEC); len(codewords) < capacity/8; pad ^= 0xEC ^ 0x11 {
+		codewords = append(codewords, pad)
+	}
+	return codewords
+}
+
+// addErrorCorrection splits the data into blocks, appends Reed-Solomon error
+// correction to each and interleaves the result
+func addErrorCorrection(version int, data []byte) []byte {
+	layout := layouts[version]
+	divisor := reedSolomonDivisor(layout.ecPerBlock)
+
+	var dataBlocks, ecBlocks [][]byte
+	offset := 0
+	for i := 0; i < layout.group1Blocks+layout.group2Blocks; i++ {
+		length := layout.group1Data
+		if i >= layout.group1Blocks {
+			length = layout.group2Data
+		}
+		block := data[offset : offset+length]
+		offset += length
+
+		dataBlocks = append(dataBlocks, block)
+		ecBlocks = append(ecBlocks, reedSolomonRemainder(block, divisor))
+	}
+
+	var result []byte
+	for i := 0; i < layout.group2Data || i < layout.group1Data; i++ {
+		for _, block := range dataBlocks {
+			if i < len(block) {
+				result = append(result, block[i])
+			}
+		}
+	}
+	for i := 0; i < layout.ecPerBlock; i++ {
+		for _, block := range ecBlocks {
+			result = append(result, block[i])
+		}
+	}
+	return result
+}
+
+// drawFunctionPatterns draws the finder, timing and alignment patterns, the
+// dark module and the version information, and reserves the format areas
+func (c *Code) drawFunctionPatterns() {
+	size := c.Size
+
+	for i := 0; i < size; i++ {
+		c.setFunction(6, i, i%2 == 0)
+		c.setFunction(i, 6, i%2 == 0)
+	}
+
+	c.drawFinder(3, 3)
+	c.drawFinder(size-4, 3)
+	c.drawFinder(3, size-4)
+
+	positions := alignmentPositions[c.Version]
+	last := len(positions) - 1
+	for i, x := range positions {
+		for j, y := range positions {
+			// Skip the three corners occupied by finder patterns
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			c.drawAlignment(x, y)
+		}
+	}
+
+	// Reserve the format areas; the real bits are drawn with the mask
+	c.drawFormatBits(0)
+	c.drawVersionBits()
+}
+
+// drawFinder draws a finder pattern with its separator centred on (x, y)
+func (c *Code) drawFinder(x, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			xx, yy := x+dx, y+dy
+			if xx < 0 || xx >= c.Size || yy < 0 || yy >= c.Size {
+				continue
+			}
+			dist := max(abs(dx), abs(dy))
+			c.setFunction(xx, yy, dist != 2 && dist != 4)
+		}
+	}
+}
+
+// drawAlignment draws an alignment pattern centred on (x, y)
+func (c *Code) drawAlignment(x, y int) {
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			c.setFunction(x+dx, y+dy, max(abs(dx), abs(dy)) != 1)
+		}
+	}
+}
+
+// drawFormatBits draws both copies of the format information for the mask
+func (c *Code) drawFormatBits(mask int) {
+	data := formatBitsM<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return (bits>>i)&1 == 1 }
+
+	size := c.Size
+	for i := 0; i <= 5; i++ {
+		c.setFunction(8, i, bit(i))
+	}
+	c.setFunction(8, 7, bit(6))
+	c.setFunction(8, 8, bit(7))
+	c.setFunction(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		c.setFunction(14-i, 8, bit(i))
+	}
+
+	for i := 0; i < 8; i++ {
+		c.setFunction(size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		c.setFunction(8, size-15+i, bit(i))
+	}
+	c.setFunction(8, size-8, true) // dark module
+}
+
+// drawVersionBits draws both copies of the version information for versions 7 and up
+func (c *Code) drawVersionBits() {
+	if c.Version < 7 {
+		return
+	}
+
+	rem := c.Version
+	for i := 0; i < 12; i++ {
+		rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+	}
+	bits := c.Version<<12 | rem
+
+	for i := 0; i < 18; i++ {
+		dark := (bits>>i)&1 == 1
+		a, b := c.Size-11+i%3, i/3
+		c.setFunction(a, b, dark)
+		c.setFunction(b, a, dark)
+	}
+}
+
+// drawCodewords places the codewords in the zigzag pattern over the non-function modules
+func (c *Code) drawCodewords(codewords []byte) {
+	i := 0
+	for right := c.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5 // skip the vertical timing pattern
+		}
+		upward := (right+1)&2 == 0
+		for vert := 0; vert < c.Size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if upward {
+					y = c.Size - 1 - vert
+				}
+				if c.function[y][x] || i >= len(codewords)*8 {
+					continue
+				}
+				c.modules[y][x] = (codewords[i/8]>>(7-i%8))&1 == 1
+				i++
+			}
+		}
+	}
+}
+
+// applyMask XORs the data modules with the mask pattern
+func (c *Code) applyMask(mask int) {
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if c.function[y][x] {
+				continue
+			}
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert {
+				c.modules[y][x] = !c.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores the symbol with the four rules used to choose a mask
+func (c *Code) penalty() int {
+	size := c.Size
+	score := 0
+
+	// Rule 1: runs of five or more modules of the same colour
+	// Rule 3: finder-like 1:1:3:1:1 patterns with four light modules on one side
+	line := make([]bool, size)
+	for pass := 0; pass < 2; pass++ {
+		for i := 0; i < size; i++ {
+			for j := 0; j < size; j++ {
+				if pass == 0 {
+					line[j] = c.modules[i][j]
+				} else {
+					line[j] = c.modules[j][i]
+				}
+			}
+			score += runPenalty(line) + finderLikePenalty(line)
+		}
+	}
+
+	// Rule 2: 2x2 blocks of the same colour
+	for y := 0; y < size-1; y++ {
+		for x := 0; x < size-1; x++ {
+			m := c.modules[y][x]
+			if m == c.modules[y][x+1] && m == c.modules[y+1][x] && m == c.modules[y+1][x+1] {
+				score += 3
+			}
+		}
+	}
+
+	// Rule 4: deviation of the proportion of dark modules from 50%
+	dark := 0
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			if c.modules[y][x] {
+				dark++
+			}
+		}
+	}
+	total := size * size
+	k := (abs(dark*20-total*10) + total - 1) / total
+	score += (k - 1) * 10
+	if k == 0 {
+		score += 10
+	}
+
+	return score
+}
+
+func runPenalty(line []bool) int {
+	score := 0
+	run := 1
+	for i := 1; i <= len(line); i++ {
+		if i < len(line) && line[i] == line[i-1] {
+			run++
+			continue
+		}
+		if run >= 5 {
+			score += 3 + run - 5
+		}
+		run = 1
+	}
+	return score
+}
+
+func finderLikePenalty(line []bool) int {
+	pattern := []bool{true, false, true, true, true, false, true}
+	score := 0
+	for i := 0; i+7 <= len(line); i++ {
+		match := true
+		for j, p := range pattern {
+			if line[i+j] != p {
+				match = false
+				break
+			}
+		}
+		if !match {
+			continue
+		}
+		if lightRun(line, i-4, i) || lightRun(line, i+7, i+11) {
+			score += 40
+		}
+	}
+	return score
+}
+
+// lightRun reports whether line[from:to] is light, treating modules outside the symbol as light
+func lightRun(line []bool, from, to int) bool {
+	for i := from; i < to; i++ {
+		if i >= 0 && i < len(line) && line[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Code) setFunction(x, y int, dark bool) {
+	c.modules[y][x] = dark
+	c.function[y][x] = true
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,262 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/RoMalms10/otp-generator/config"
+	"github.com/RoMalms10/otp-generator/handler"
+	"github.com/RoMalms10/otp-generator/models"
+	"github.com/RoMalms10/otp-generator/service"
+	"github.com/go-chi/render"
+	"golang.org/x/net/context"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxRequestBodySize bounds the body the rate limiter reads from a request
+const maxRequestBodySize = 64 << 10
+
+// RateLimitSubject is who and where a rate limited request would send an OTP to
+type RateLimitSubject struct {
+	Username    string
+	Channel     string
+	Destination string
+}
+
+// RateLimitRule is a single budget of Limit requests per sliding Window.
+// Key returns the bucket a request counts against; an empty key skips the rule.
+type RateLimitRule struct {
+	Name   string
+	Limit  int
+	Window time.Duration
+	Key    func(r *http.Request, subject RateLimitSubject) string
+}
+
+// RateLimiter is middleware that enforces a set of RateLimitRules using
+// sliding window counters kept in the OTP store
+type RateLimiter struct {
+	Store   service.OTPStore
+	Context context.Context
+	Rules   []RateLimitRule
+	// Sessions resolves requests that name a session ID instead of a username
+	Sessions *service.OTPService
+}
+
+// NewRateLimiter creates a RateLimiter with the specified rules
+func NewRateLimiter(store service.OTPStore, ctx context.Context, rules []RateLimitRule, sessions *service.OTPService) *RateLimiter {
+	return &RateLimiter{
+		Store:    store,
+		Context:  ctx,
+		Rules:    rules,
+		Sessions: sessions,
+	}
+}
+
+// DefaultRateLimitRules returns the per-username, per-IP, per-destination and
+// global budgets from config, skipping any whose limit is not positive
+func DefaultRateLimitRules() []RateLimitRule {
+	rules := []RateLimitRule{
+		{
+			Name:  "username",
+			Limit: config.RateLimitPerUsername,
+			Key: func(r *http.Request, subject RateLimitSubject) string {
+				return subject.Username
+			},
+		},
+		{
+			Name:  "ip",
+			Limit: config.RateLimitPerIP,
+			Key: func(r *http.Request, subject RateLimitSubject) string {
+				return clientIP(r)
+			},
+		},
+		{
+			Name:  "destination",
+			Limit: config.RateLimitPerDestination,
+			Key: func(r *http.Request, subject RateLimitSubject) string {
+				if subject.Destination == "" {
+					return ""
+				}
+				return subject.Channel + ":" + strings.ToLower(subject.Destination)
+			},
+		},
+		{
+			Name:  "global",
+			Limit: config.RateLimitGlobal,
+			Key: func(r *http.Request, subject RateLimitSubject) string {
+				return "all"
+			},
+		},
+	}
+
+	enabled := rules[:0]
+	for _, rule := range rules {
+		if rule.Limit > 0 {
+			rule.Window = config.RateLimitWindow
+			enabled = append(enabled, rule)
+		}
+	}
+	return enabled
+}
+
+// Middleware rejects requests that exceed any rule with 429 and a Retry-After
+// header. Rules are checked in order and a denied request is not counted
+// against the rules after the one that denied it, so flooding one username
+// cannot use up the budgets it shares with other requests.
+func (l *RateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Read the body so the rules can see it, then restore it for the next handler
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBodySize))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			render.Render(w, r, handler.NewErrResponse(http.StatusRequestEntityTooLarge, handler.CodeInvalidRequest, "Request payload too large"))
+			return
+		} else if err != nil {
+			render.Render(w, r, handler.NewErrResponse(http.StatusBadRequest, handler.CodeInvalidRequest, "Invalid request payload"))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		subject := l.subject(body)
+
+		var retryAfter time.Duration
+		for _, rule := range l.Rules {
+			key := rule.Key(r, subject)
+			if key == "" {
+				continue
+			}
+
+			allowed, wait, err := l.allow(rule, key)
+			if err != nil {
+				render.Render(w, r, handler.ErrorResponse(w, fmt.Errorf("failed to check rate limit: %w", err)))
+				return
+			}
+			if !allowed {
+				retryAfter = wait
+				break
+			}
+		}
+
+		if retryAfter > 0 {
+			render.Render(w, r, handler.ErrorResponse(w, &service.RateLimitedError{RetryAfter: retryAfter}))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// subject works out the username and destination of a generate or resend
+// request body, looking up the session when the body names one
+func (l *RateLimiter) subject(body []byte) RateLimitSubject {
+	var req struct {
+		models.GenerateRequest
+		SessionID string `json:"sessionId"`
+	}
+	_ = json.Unmarshal(body, &req)
+
+	if req.SessionID != "" && l.Sessions != nil {
+		session, err := l.Sessions.GetSession(req.SessionID)
+		if err != nil {
+			return RateLimitSubject{}
+		}
+		channel := session.Channel
+		if req.MessageType != "" {
+			channel = req.MessageType
+		}
+		// A resend to a new destination counts against that destination
+		destination := session.Destination
+		if req.Destination != "" {
+			destination = req.Destination
+			if normalized, err := l.Sessions.Destinations.Normalize(channel, destination); err == nil {
+				destination = normalized
+			}
+		}
+		return RateLimitSubject{Username: session.Username, Channel: channel, Destination: destination}
+	}
+
+	// Older clients send the destination as the username. Destinations the
+	// lookup resolves are registered ones and are not known here.
+	destination := req.Destination
+	if destination == "" && req.UserID == "" {
+		destination = req.Username
+	}
+	// Count equivalent spellings of a destination together
+	if l.Sessions != nil && destination != "" {
+		if normalized, err := l.Sessions.Destinations.Normalize(req.MessageType, destination); err == nil {
+			destination = normalized
+		}
+	}
+	return RateLimitSubject{Username: req.User(), Channel: req.MessageType, Destination: destination}
+}
+
+// allow counts a request against the rule's bucket for key. It uses a sliding
+// window counter: the previous window's count is weighted by how much of it
+// still overlaps the sliding window and added to the current window's count.
+// When the request is denied it also returns how long until it would be allowed.
+func (l *RateLimiter) allow(rule RateLimitRule, key string) (bool, time.Duration, error) {
+	now := time.Now()
+	start := now.Truncate(rule.Window)
+	elapsed := now.Sub(start)
+
+	current, err := l.Store.Incr(l.Context, rateLimitKey(rule.Name, key, start), 2*rule.Window)
+	if err != nil {
+		return false, 0, err
+	}
+
+	var previous int64
+	value, err := l.Store.Get(l.Context, rateLimitKey(rule.Name, key, start.Add(-rule.Window)))
+	if err == nil {
+		previous, _ = strconv.ParseInt(value, 10, 64)
+	} else if !errors.Is(err, service.ErrNotFound) {
+		return false, 0, err
+	}
+
+	overlap := 1 - float64(elapsed)/float64(rule.Window)
+	limit := float64(rule.Limit)
+	if float64(previous)*overlap+float64(current) <= limit {
+		return true, 0, nil
+	}
+
+	// The current window alone is over the limit: wait for it to start sliding out
+	if float64(current) > limit || previous == 0 {
+		return false, rule.Window - elapsed, nil
+	}
+
+	// Otherwise wait until enough of the previous window has slid out
+	wait := time.Duration(float64(rule.Window)*(1-(limit-float64(current))/float64(previous))) - elapsed
+	if wait < time.Second {
+		wait = time.Second
+	}
+	return false, wait, nil
+}
+
+// rateLimitKey is the store key for a rule's bucket in the window starting at start.
+// The bucket key is digested so usernames and destinations do not appear in the store.
+func rateLimitKey(rule, key string, start time.Time) string {
+	return fmt.Sprintf("ratelimit:%s:%s:%d", rule, service.KeyDigest(key), start.UnixMilli())
+}
+
+// clientIP returns the address of the client, honouring X-Forwarded-For only when configured.
+// The last address is the one the trusted proxy appended; the client controls any before it.
+func clientIP(r *http.Request) string {
+	if config.TrustForwardedFor {
+		if values := r.Header.Values("X-Forwarded-For"); len(values) > 0 {
+			addresses := strings.Split(values[len(values)-1], ",")
+			if address := strings.TrimSpace(addresses[len(addresses)-1]); address != "" {
+				return address
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
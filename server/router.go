@@ -4,20 +4,44 @@ import (
 	"github.com/RoMalms10/otp-generator/handler"
 	"github.com/RoMalms10/otp-generator/messaging"
 	"github.com/RoMalms10/otp-generator/service"
-	"github.com/go-redis/redis/v8"
 	"github.com/gorilla/mux"
 	"golang.org/x/net/context"
+	"net/http"
 	"time"
 )
 
-func NewRouter(redisClient *redis.Client, ctx context.Context, otpTTL time.Duration, twilioService *messaging.TwilioService) *mux.Router {
-	otpService := service.NewOTPService(redisClient, ctx, otpTTL, twilioService)
+// NewRouter creates an OTPService for the store and senders and routes
+// requests to it. The service delivers codes inline; use NewServiceRouter
+// with a service whose delivery queue was started to deliver in the background.
+func NewRouter(store service.OTPStore, ctx context.Context, otpTTL time.Duration, senders *messaging.Registry) *mux.Router {
+	return NewServiceRouter(service.NewOTPService(store, ctx, otpTTL, senders))
+}
+
+// NewServiceRouter routes requests to the OTPService
+func NewServiceRouter(otpService *service.OTPService) *mux.Router {
 	otpHandler := handler.NewHandler(otpService)
 
+	// Requests that send a message are rate limited
+	limiter := NewRateLimiter(otpService.Store, otpService.Context, DefaultRateLimitRules(), otpService)
+
 	r := mux.NewRouter()
-	r.HandleFunc("/otp/generate", otpHandler.GenerateOTPHandler).Methods("POST")
-	r.HandleFunc("/otp/resend", otpHandler.ResendOTPHandler).Methods("POST")
+	r.Handle("/otp/generate", limiter.Middleware(http.HandlerFunc(otpHandler.GenerateOTPHandler))).Methods("POST")
+	r.Handle("/otp/resend", limiter.Middleware(http.HandlerFunc(otpHandler.ResendOTPHandler))).Methods("POST")
 	r.HandleFunc("/otp/validate", otpHandler.ValidateOTPHandler).Methods("POST")
+	r.HandleFunc("/otp/sessions/{sessionId}", otpHandler.SessionStatusHandler).Methods("GET")
+	r.HandleFunc("/otp/sessions/{sessionId}/delivery", otpHandler.DeliveryStatusHandler).Methods("GET")
+	r.HandleFunc("/otp/verify/{token}", otpHandler.MagicLinkHandler).Methods("GET")
+	r.HandleFunc("/webhooks/twilio/status", otpHandler.TwilioStatusHandler).Methods("POST")
+	r.HandleFunc("/recovery/generate", otpHandler.GenerateRecoveryCodesHandler).Methods("POST")
+	r.HandleFunc("/recovery/regenerate", otpHandler.RegenerateRecoveryCodesHandler).Methods("POST")
+	r.HandleFunc("/totp/enroll", otpHandler.EnrollTOTPHandler).Methods("POST")
+	r.HandleFunc("/totp/confirm", otpHandler.ConfirmTOTPHandler).Methods("POST")
+	r.HandleFunc("/totp/verify", otpHandler.VerifyTOTPHandler).Methods("POST")
+	r.HandleFunc("/hotp/register", otpHandler.RegisterHOTPHandler).Methods("POST")
+	r.HandleFunc("/hotp/verify", otpHandler.VerifyHOTPHandler).Methods("POST")
+	r.HandleFunc("/hotp/resync", otpHandler.ResyncHOTPHandler).Methods("POST")
+	r.HandleFunc("/metrics", otpHandler.MetricsHandler).Methods("GET")
+	r.HandleFunc("/delivery/dead-letters", otpHandler.DeadLettersHandler).Methods("GET")
 
 	return r
 }
@@ -0,0 +1,234 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/RoMalms10/otp-generator/config"
+	"github.com/RoMalms10/otp-generator/delivery"
+	"github.com/RoMalms10/otp-generator/models"
+	"log"
+	"time"
+)
+
+// StartDelivery starts the delivery queue selected by config.DeliveryQueue.
+// Its workers run until Close is called or the service's context is done.
+// Until then, and with DELIVERY_QUEUE=inline, codes are delivered inline.
+func (s *OTPService) StartDelivery() {
+	if s.Queue != nil {
+		return
+	}
+	queue := s.newDeliveryQueue()
+	if queue == nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(s.Context)
+	queue.Start(ctx)
+	s.Queue, s.stopDelivery = queue, cancel
+}
+
+// Close stops the delivery queue's workers and waits for them to finish the
+// jobs they are sending. Jobs still queued stay in a durable backend.
+func (s *OTPService) Close() {
+	if s.stopDelivery == nil {
+		return
+	}
+	s.stopDelivery()
+	s.Queue.Wait()
+}
+
+// DeadLetters returns up to limit codes that failed every delivery attempt,
+// newest first. Codes delivered inline are never dead-lettered.
+func (s *OTPService) DeadLetters(limit int) ([]delivery.DeadLetter, error) {
+	if s.Queue == nil {
+		return []delivery.DeadLetter{}, nil
+	}
+	letters, err := s.Queue.Backend.DeadLetters(s.Context, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dead letters: %w", err)
+	}
+	if letters == nil {
+		letters = []delivery.DeadLetter{}
+	}
+	return letters, nil
+}
+
+// newDeliveryQueue creates the delivery queue selected by
+// config.DeliveryQueue, or returns nil to deliver inline
+func (s *OTPService) newDeliveryQueue() *delivery.Queue {
+	var backend delivery.Backend
+	switch config.DeliveryQueue {
+	case config.DeliveryQueueInline:
+		return nil
+
+	case config.DeliveryQueueRedis:
+		// The stream lives next to the OTPs, so it needs the Redis store's client
+		redisStore, ok := s.Store.(*RedisStore)
+		if !ok {
+			log.Println("Warning: DELIVERY_QUEUE=redis needs the Redis OTP store, using an in-memory queue")
+			backend = delivery.NewMemoryBackend()
+			break
+		}
+		streamBackend, err := delivery.NewRedisStreamBackend(s.Context, redisStore.Client)
+		if err != nil {
+			log.Printf("Warning: %v, using an in-memory queue", err)
+			backend = delivery.NewMemoryBackend()
+			break
+		}
+		backend = streamBackend
+
+	default:
+		backend = delivery.NewMemoryBackend()
+	}
+
+	return delivery.NewQueue(backend, s.sendJob, s.recordDelivery,
+		config.DeliveryWorkers, config.DeliveryMaxAttempts, config.DeliveryBackoffBase, config.DeliveryBackoffMax, s.DeliveryTimeout)
+}
+
+// Deliver sends a session's new code, or queues it when a delivery queue is
+// configured, and returns the delivery status. If delivery over the session's
+// channel fails or times out, its fallback channels are tried in order.
+// Without a queue, the failure of the last channel is returned wrapped in ErrDeliveryFailed.
+func (s *OTPService) Deliver(session *models.Session, otp string) (*models.DeliveryStatus, error) {
+	job := delivery.Job{
+		ID:        session.ID,
+		Channel:   session.Channel,
+		To:        session.Destination,
+		ExpiresAt: session.ExpiresAt,
+		Fallback:  s.fallbackTargets(session),
+	}
+	// What was recorded about the message carrying the previous code no longer applies
+	s.Store.Delete(s.Context, providerStatusKey(session.ID))
+	s.Store.Delete(s.Context, smsInfoKey(session.ID))
+
+	if s.Queue == nil {
+		return s.deliverInline(job, session, otp)
+	}
+
+	// The code waits in the queue, which may be durable, so it is sealed rather than kept in plain text
+	payload, err := s.Hasher.Seal(otp)
+	if err != nil {
+		return nil, err
+	}
+	job.Payload = payload
+	if err := s.Queue.Enqueue(s.Context, job); err != nil {
+		s.recordDelivery(job, delivery.StatusFailed, err)
+		return nil, fmt.Errorf("failed to queue OTP: %w", err)
+	}
+	return newDeliveryStatus(job, delivery.StatusQueued, nil), nil
+}
+
+// deliverInline sends a code before returning, trying each fallback channel once
+func (s *OTPService) deliverInline(job delivery.Job, session *models.Session, otp string) (*models.DeliveryStatus, error) {
+	for {
+		job.Attempts++
+		// A send that times out keeps running, so it gets a copy that falling back cannot change
+		attempt := job
+		err := delivery.SendWithTimeout(s.DeliveryTimeout, func() error { return s.send(attempt, session, otp) })
+		if err == nil {
+			s.recordDelivery(job, delivery.StatusDelivered, nil)
+			status := newDeliveryStatus(job, delivery.StatusDelivered, nil)
+			if err := s.addSMSInfo(status, job.ID); err != nil {
+				log.Printf("Failed to read the SMS encoding of session %s: %v", job.ID, err)
+			}
+			return status, nil
+		}
+		if errors.Is(err, delivery.ErrTimeout) {
+			err = fmt.Errorf("%w: %v", ErrDeliveryFailed, err)
+		}
+
+		if len(job.Fallback) == 0 {
+			s.recordDelivery(job, delivery.StatusFailed, err)
+			return nil, err
+		}
+		log.Printf("Delivery of session %s via %s failed, falling back to %s: %v", job.ID, job.Channel, job.Fallback[0].Channel, err)
+		job.Channel, job.To, job.Fallback = job.Fallback[0].Channel, job.Fallback[0].To, job.Fallback[1:]
+	}
+}
+
+// sendJob delivers a queued code, discarding it once its session no longer
+// needs it: after the session ended or the code was replaced by a resend
+func (s *OTPService) sendJob(job delivery.Job) error {
+	session, err := s.GetSession(job.ID)
+	if err == ErrSessionNotFound {
+		return delivery.ErrDiscard
+	} else if err != nil {
+		return err
+	}
+	if session.Status != models.SessionStatusPending || !session.ExpiresAt.Equal(job.ExpiresAt) {
+		return delivery.ErrDiscard
+	}
+
+	otp, err := s.Hasher.Open(job.Payload)
+	if err != nil {
+		// Sealed with a key that has since left the keyring; it can never be sent
+		return fmt.Errorf("%w: %v", delivery.ErrDiscard, err)
+	}
+	return s.send(job, session, otp)
+}
+
+// recordDelivery stores a job's delivery status for as long as its session
+// can be looked up. A job for a code that a resend replaced reports nothing,
+// so it cannot overwrite the status of the new code.
+// The channel that delivered the code is also recorded in the session.
+func (s *OTPService) recordDelivery(job delivery.Job, status string, deliveryErr error) {
+	session, err := s.GetSession(job.ID)
+	if err != nil || !session.ExpiresAt.Equal(job.ExpiresAt) {
+		return
+	}
+
+	data, err := json.Marshal(newDeliveryStatus(job, status, deliveryErr))
+	if err == nil {
+		err = s.Store.Set(s.Context, deliveryKey(job.ID), string(data), time.Until(job.ExpiresAt)+s.SessionRetention)
+	}
+	if err == nil && status == delivery.StatusDelivered && session.Status == models.SessionStatusPending {
+		session.DeliveredVia = job.Channel
+		err = s.saveSession(session)
+	}
+	if err != nil {
+		log.Printf("Failed to record delivery status of session %s: %v", job.ID, err)
+	}
+}
+
+func newDeliveryStatus(job delivery.Job, status string, deliveryErr error) *models.DeliveryStatus {
+	record := &models.DeliveryStatus{
+		Status:    status,
+		Channel:   job.Channel,
+		Attempts:  job.Attempts,
+		UpdatedAt: time.Now(),
+	}
+	if deliveryErr != nil {
+		record.Error = deliveryErr.Error()
+	}
+	return record
+}
+
+// GetDeliveryStatus returns the delivery status of a session's latest code,
+// with how it was encoded if it was sent by SMS and what the provider
+// reported about it if its channel reports delivery.
+// Returns ErrSessionNotFound if the session has none.
+func (s *OTPService) GetDeliveryStatus(sessionID string) (*models.DeliveryStatus, error) {
+	data, err := s.Store.Get(s.Context, deliveryKey(sessionID))
+	if errors.Is(err, ErrNotFound) {
+		return nil, ErrSessionNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	var status models.DeliveryStatus
+	if err := json.Unmarshal([]byte(data), &status); err != nil {
+		return nil, err
+	}
+	if err := s.addSMSInfo(&status, sessionID); err != nil {
+		return nil, err
+	}
+	if status.Provider, err = s.providerStatus(sessionID); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+func deliveryKey(sessionID string) string {
+	return fmt.Sprintf("delivery-status:%s", sessionID)
+}
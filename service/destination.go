@@ -0,0 +1,225 @@
+package service
+
+import (
+	"fmt"
+	"github.com/RoMalms10/otp-generator/models"
+	"net/mail"
+	"strings"
+	"unicode/utf8"
+)
+
+// Length limits for E.164 numbers, in digits including the country calling code
+const (
+	minPhoneDigits = 7
+	maxPhoneDigits = 15
+)
+
+// premiumRatePrefixes are well-known premium-rate and international premium
+// ranges, as E.164 digits. Codes sent there cost the sender money and are a
+// common target of toll fraud, so they are always rejected.
+var premiumRatePrefixes = []string{
+	// North America
+	"1900",
+	// United Kingdom
+	"4470", "4490", "4491", "44871", "44872", "44873",
+	// Germany
+	"49137", "49900",
+	// France
+	"3389",
+	// Italy
+	"39892", "39894", "39895", "39899",
+	// Spain
+	"34803", "34806", "34807", "34905",
+	// Netherlands
+	"31906", "31909",
+	// Australia
+	"6119",
+	// International networks and international premium rate
+	"881", "882", "979",
+}
+
+// destinationKinds maps the built-in channels to the kind of address they deliver to
+var destinationKinds = map[string]string{
+	models.MessageTypeSMS:       destinationPhone,
+	models.MessageTypeWhatsApp:  destinationPhone,
+	models.MessageTypeVoice:     destinationPhone,
+	models.MessageTypeEmail:     destinationEmail,
+	models.MessageTypeMagicLink: destinationEmail,
+}
+
+const (
+	destinationPhone = "phone"
+	destinationEmail = "email"
+)
+
+// DestinationPolicy validates and normalizes the address an OTP is delivered
+// to. Empty allow lists allow everything that is not denied.
+type DestinationPolicy struct {
+	// Country calling codes, e.g. "1" or "44"
+	AllowedCountryCodes []string
+	DeniedCountryCodes  []string
+	// Number prefixes rejected in addition to the built-in premium-rate ranges, e.g. "4487"
+	DeniedPrefixes []string
+	// Email domains; each also matches its subdomains
+	AllowedEmailDomains []string
+	DeniedEmailDomains  []string
+}
+
+// Normalize checks a destination for the channel and returns its canonical
+// form: E.164 for phone channels and a bare address with a lower case domain
+// for email. Channels without a known address kind are passed through.
+// Returns ErrInvalidDestination for malformed addresses and
+// ErrDestinationNotAllowed for addresses the policy rejects.
+func (p DestinationPolicy) Normalize(channel, destination string) (string, error) {
+	switch destinationKinds[channel] {
+	case destinationPhone:
+		return p.normalizePhone(destination)
+	case destinationEmail:
+		return p.normalizeEmail(destination)
+	default:
+		return destination, nil
+	}
+}
+
+// normalizePhone converts a number to E.164, accepting common separators and a 00 international prefix
+func (p DestinationPolicy) normalizePhone(destination string) (string, error) {
+	number := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(destination), "whatsapp:"))
+	if strings.HasPrefix(number, "00") {
+		number = "+" + number[2:]
+	}
+	if !strings.HasPrefix(number, "+") {
+		return "", fmt.Errorf("%w: phone numbers must be in international format, e.g. +14155550100", ErrInvalidDestination)
+	}
+
+	var digits strings.Builder
+	for _, r := range number[1:] {
+		switch {
+		case r >= '0' && r <= '9':
+			digits.WriteRune(r)
+		case strings.ContainsRune(" -.()", r):
+		default:
+			return "", fmt.Errorf("%w: phone number contains %q", ErrInvalidDestination, r)
+		}
+	}
+	e164 := digits.String()
+	if len(e164) < minPhoneDigits || len(e164) > maxPhoneDigits || e164[0] == '0' {
+		return "", fmt.Errorf("%w: not a valid E.164 phone number", ErrInvalidDestination)
+	}
+
+	if len(p.AllowedCountryCodes) > 0 && !hasAnyPrefix(e164, p.AllowedCountryCodes) {
+		return "", fmt.Errorf("%w: phone numbers in this country are not accepted", ErrDestinationNotAllowed)
+	}
+	if hasAnyPrefix(e164, p.DeniedCountryCodes) {
+		return "", fmt.Errorf("%w: phone numbers in this country are not accepted", ErrDestinationNotAllowed)
+	}
+	if hasAnyPrefix(e164, premiumRatePrefixes) || hasAnyPrefix(e164, p.DeniedPrefixes) {
+		return "", fmt.Errorf("%w: premium-rate numbers are not accepted", ErrDestinationNotAllowed)
+	}
+
+	return "+" + e164, nil
+}
+
+// normalizeEmail checks the RFC 5322 syntax of a bare address and lower cases its domain
+func (p DestinationPolicy) normalizeEmail(destination string) (string, error) {
+	destination = strings.TrimSpace(destination)
+	addr, err := mail.ParseAddress(destination)
+	// Reject display names and angle brackets; the destination must be the address itself
+	if err != nil || addr.Name != "" || addr.Address != destination {
+		return "", fmt.Errorf("%w: not a valid email address", ErrInvalidDestination)
+	}
+
+	at := strings.LastIndex(addr.Address, "@")
+	local, domain := addr.Address[:at], strings.ToLower(addr.Address[at+1:])
+
+	if len(p.AllowedEmailDomains) > 0 && !matchesAnyDomain(domain, p.AllowedEmailDomains) {
+		return "", fmt.Errorf("%w: email addresses at %s are not accepted", ErrDestinationNotAllowed, domain)
+	}
+	if matchesAnyDomain(domain, p.DeniedEmailDomains) {
+		return "", fmt.Errorf("%w: email addresses at %s are not accepted", ErrDestinationNotAllowed, domain)
+	}
+
+	return local + "@" + domain, nil
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if prefix = strings.TrimPrefix(strings.TrimSpace(prefix), "+"); prefix != "" && strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesAnyDomain reports whether domain is one of domains or a subdomain of one
+func matchesAnyDomain(domain string, domains []string) bool {
+	for _, d := range domains {
+		d = strings.ToLower(strings.TrimSpace(d))
+		if d != "" && (domain == d || strings.HasSuffix(domain, "."+d)) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveDestination works out where a generate request is delivered to.
+// With a lookup, the destination must be one the user registered for the
+// channel; without one the request names it, or older clients send it as
+// the username.
+func (s *OTPService) resolveDestination(req models.GenerateRequest) (string, error) {
+	if s.Lookup == nil {
+		destination := req.Destination
+		if destination == "" && req.UserID == "" {
+			destination = req.Username
+		}
+		if destination == "" {
+			return "", fmt.Errorf("%w: destination is required", ErrInvalidDestination)
+		}
+		return s.Destinations.Normalize(req.MessageType, destination)
+	}
+
+	registered, err := s.Lookup.LookupDestinations(s.Context, req.User(), req.MessageType)
+	if err != nil {
+		return "", err
+	}
+
+	var requested string
+	if req.Destination != "" {
+		if requested, err = s.Destinations.Normalize(req.MessageType, req.Destination); err != nil {
+			return "", err
+		}
+	}
+
+	for _, destination := range registered {
+		// Registered destinations are still subject to the policy
+		normalized, err := s.Destinations.Normalize(req.MessageType, destination)
+		if err != nil {
+			continue
+		}
+		if requested == "" || normalized == requested {
+			return normalized, nil
+		}
+	}
+
+	if requested != "" {
+		return "", fmt.Errorf("%w: destination is not registered for this user", ErrDestinationNotAllowed)
+	}
+	return "", ErrNoDestination
+}
+
+// MaskDestination hides most of a destination so it can be shown to a client,
+// e.g. "+*******0100" or "u***@example.com"
+func MaskDestination(destination string) string {
+	if at := strings.LastIndex(destination, "@"); at > 0 {
+		_, size := utf8.DecodeRuneInString(destination)
+		return destination[:size] + "***" + destination[at:]
+	}
+
+	prefix := ""
+	if strings.HasPrefix(destination, "+") {
+		prefix, destination = "+", destination[1:]
+	}
+	if len(destination) <= 4 {
+		return prefix + strings.Repeat("*", len(destination))
+	}
+	return prefix + strings.Repeat("*", len(destination)-4) + destination[len(destination)-4:]
+}
@@ -0,0 +1,85 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// DestinationLookup resolves a user ID to the verified destinations the user
+// has registered for a channel, so clients can start a session without
+// knowing the user's phone number or email address
+type DestinationLookup interface {
+	// LookupDestinations returns the user's destinations for the channel,
+	// preferred first. A user without any returns an empty list.
+	LookupDestinations(ctx context.Context, userID, channel string) ([]string, error)
+}
+
+// DestinationLookupFunc adapts a function to the DestinationLookup interface
+type DestinationLookupFunc func(ctx context.Context, userID, channel string) ([]string, error)
+
+// LookupDestinations calls f(ctx, userID, channel)
+func (f DestinationLookupFunc) LookupDestinations(ctx context.Context, userID, channel string) ([]string, error) {
+	return f(ctx, userID, channel)
+}
+
+// destinationLookupTimeout bounds each call to an HTTPDestinationLookup
+const destinationLookupTimeout = 5 * time.Second
+
+// HTTPDestinationLookup asks another service for a user's destinations with
+// GET URL?userId=...&channel=..., which answers {"destinations": ["+14155550100"]}.
+// A 404 response means the user has no destinations.
+type HTTPDestinationLookup struct {
+	URL    string
+	Client *http.Client
+}
+
+// NewHTTPDestinationLookup creates an HTTPDestinationLookup for the specified URL
+func NewHTTPDestinationLookup(lookupURL string) *HTTPDestinationLookup {
+	return &HTTPDestinationLookup{
+		URL:    lookupURL,
+		Client: &http.Client{Timeout: destinationLookupTimeout},
+	}
+}
+
+// LookupDestinations implements DestinationLookup
+func (l *HTTPDestinationLookup) LookupDestinations(ctx context.Context, userID, channel string) ([]string, error) {
+	lookupURL, err := url.Parse(l.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid destination lookup URL: %w", err)
+	}
+	query := lookupURL.Query()
+	query.Set("userId", userID)
+	query.Set("channel", channel)
+	lookupURL.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", lookupURL.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := l.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up destinations: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("destination lookup returned non-success status code: %d", resp.StatusCode)
+	}
+
+	var body struct {
+		Destinations []string `json:"destinations"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("failed to decode destination lookup response: %w", err)
+	}
+	return body.Destinations, nil
+}
@@ -0,0 +1,74 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrSessionNotFound is returned when no verification session matches the request
+	ErrSessionNotFound = errors.New("verification session not found")
+	// ErrOTPExpired is returned when no OTP is stored for the user
+	ErrOTPExpired = errors.New("OTP has expired or does not exist")
+	// ErrOTPMismatch is returned when the submitted OTP does not match the stored one
+	ErrOTPMismatch = errors.New("Incorrect OTP entered")
+	// ErrOTPAlreadyUsed is returned when a code that was already consumed is submitted again
+	ErrOTPAlreadyUsed = errors.New("OTP has already been used")
+	// ErrInvalidFormat is returned when a requested OTP format is out of range
+	ErrInvalidFormat = errors.New("invalid OTP format")
+	// ErrOTPLocked is returned while a user is locked out after too many failed attempts
+	ErrOTPLocked = errors.New("too many failed attempts")
+	// ErrNotEnrolled is returned when a user has no authenticator or token registered
+	ErrNotEnrolled = errors.New("no authenticator or token registered for this user")
+	// ErrRecoveryCodesExist is returned when generating recovery codes for a user who already has a set
+	ErrRecoveryCodesExist = errors.New("recovery codes already exist for this user")
+	// ErrVerificationRequired is returned when issuing or replacing a factor without a recently verified session for the user
+	ErrVerificationRequired = errors.New("a recently verified session for this user is required")
+	// ErrInvalidLink is returned for a malformed or forged magic link token
+	ErrInvalidLink = errors.New("invalid sign-in link")
+	// ErrRateLimited is returned when a request exceeds a rate limit
+	ErrRateLimited = errors.New("rate limit exceeded")
+	// ErrUnsupportedChannel is returned for a message type with no registered channel
+	ErrUnsupportedChannel = errors.New("unsupported message type")
+	// ErrChannelUnavailable is returned for a known channel that is not configured
+	ErrChannelUnavailable = errors.New("channel unavailable")
+	// ErrDeliveryFailed is returned when a channel fails to deliver a message
+	ErrDeliveryFailed = errors.New("delivery failed")
+	// ErrInvalidDestination is returned for a phone number or email address that is malformed
+	ErrInvalidDestination = errors.New("invalid destination")
+	// ErrDestinationNotAllowed is returned for a destination rejected by the destination policy
+	ErrDestinationNotAllowed = errors.New("destination not allowed")
+	// ErrNoDestination is returned when a user has no registered destination for the channel
+	ErrNoDestination = errors.New("no destination registered for this user")
+)
+
+// LockedError reports that validation is locked for a user and when it may be retried.
+// It wraps ErrOTPLocked.
+type LockedError struct {
+	RetryAfter time.Duration
+	// Burned is true when this attempt exhausted the OTP and started the lockout
+	Burned bool
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("%v, try again in %s", ErrOTPLocked, e.RetryAfter.Round(time.Second))
+}
+
+func (e *LockedError) Unwrap() error {
+	return ErrOTPLocked
+}
+
+// RateLimitedError reports that a request exceeded a rate limit and when it may be retried.
+// It wraps ErrRateLimited.
+type RateLimitedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitedError) Error() string {
+	return fmt.Sprintf("%v, try again in %s", ErrRateLimited, e.RetryAfter.Round(time.Second))
+}
+
+func (e *RateLimitedError) Unwrap() error {
+	return ErrRateLimited
+}
@@ -0,0 +1,97 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"github.com/RoMalms10/otp-generator/delivery"
+	"github.com/RoMalms10/otp-generator/models"
+	"strings"
+)
+
+// parseFallbackChains reads chains of the form "whatsapp:sms:email" into the
+// channels to fall back to, keyed by the first channel of each chain
+func parseFallbackChains(entries []string) map[string][]string {
+	chains := make(map[string][]string)
+	for _, entry := range entries {
+		var channels []string
+		for _, channel := range strings.Split(entry, ":") {
+			if channel = strings.TrimSpace(channel); channel != "" {
+				channels = append(channels, channel)
+			}
+		}
+		if len(channels) > 1 {
+			chains[channels[0]] = channels[1:]
+		}
+	}
+	return chains
+}
+
+// fallbackChain returns the channels to fall back to after channel: the
+// requested ones, or else the configured chain for the channel. The channel
+// itself and repeats are dropped. Requested channels must be known, and
+// magic links cannot be part of a chain since they are not codes.
+// Returns ErrUnsupportedChannel otherwise.
+func (s *OTPService) fallbackChain(channel string, requested []string) ([]string, error) {
+	chain := requested
+	if len(chain) == 0 {
+		chain = s.FallbackChains[channel]
+	}
+	if len(chain) == 0 {
+		return nil, nil
+	}
+	if channel == models.MessageTypeMagicLink {
+		if len(requested) > 0 {
+			return nil, fmt.Errorf("%w: %s cannot fall back to other channels", ErrUnsupportedChannel, channel)
+		}
+		return nil, nil
+	}
+
+	seen := map[string]bool{channel: true}
+	var fallback []string
+	for _, next := range chain {
+		if seen[next] {
+			continue
+		}
+		seen[next] = true
+
+		if next == models.MessageTypeMagicLink {
+			return nil, fmt.Errorf("%w: %s cannot be a fallback channel", ErrUnsupportedChannel, next)
+		}
+		// Unavailable channels are skipped when the OTP is delivered, so only unknown ones are refused
+		if err := s.CheckChannel(next); err != nil && !errors.Is(err, ErrChannelUnavailable) {
+			return nil, err
+		}
+		fallback = append(fallback, next)
+	}
+	return fallback, nil
+}
+
+// fallbackTargets resolves a session's fallback channels to the addresses to
+// deliver to, skipping channels that are unavailable or where the user has no destination
+func (s *OTPService) fallbackTargets(session *models.Session) []delivery.Target {
+	var targets []delivery.Target
+	for _, channel := range session.Fallback {
+		if s.CheckChannel(channel) != nil {
+			continue
+		}
+		destination, err := s.fallbackDestination(session, channel)
+		if err != nil {
+			continue
+		}
+		targets = append(targets, delivery.Target{Channel: channel, To: destination})
+	}
+	return targets
+}
+
+// fallbackDestination resolves where to deliver on a fallback channel. The
+// session's own destination is used if it suits the channel, e.g. an SMS
+// number for WhatsApp; otherwise the lookup picks the user's preferred one.
+func (s *OTPService) fallbackDestination(session *models.Session, channel string) (string, error) {
+	req := models.GenerateRequest{UserID: session.Username, Destination: session.Destination, MessageType: channel}
+	destination, err := s.resolveDestination(req)
+	if err == nil || s.Lookup == nil {
+		return destination, err
+	}
+	req.Destination = ""
+	return s.resolveDestination(req)
+}
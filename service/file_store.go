@@ -0,0 +1,146 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// FileStore implements OTPStore by keeping entries in memory and persisting
+// them to a JSON file after every change, so stored OTPs survive a restart.
+type FileStore struct {
+	MemoryStore
+	Path string
+}
+
+// NewFileStore creates a FileStore backed by the file at path, loading any
+// entries that were previously saved there
+func NewFileStore(path string) (*FileStore, error) {
+	s := &FileStore{
+		MemoryStore: MemoryStore{entries: make(map[string]memoryEntry)},
+		Path:        path,
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &s.entries); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Set stores value under key with the specified TTL and saves the file
+func (s *FileStore) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries[key] = memoryEntry{Value: value, ExpiresAt: expiryFor(time.Now(), ttl)}
+	return s.save()
+}
+
+// Get returns the value stored under key, or ErrNotFound if it is missing or expired
+func (s *FileStore) Get(ctx context.Context, key string) (string, error) {
+	return s.MemoryStore.Get(ctx, key)
+}
+
+// Delete removes key and saves the file
+func (s *FileStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.entries, key)
+	return s.save()
+}
+
+// CompareAndDelete deletes key if it still holds value and saves the file
+func (s *FileStore) CompareAndDelete(ctx context.Context, key, value string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.compareAndDelete(key, value) {
+		return false, nil
+	}
+	return true, s.save()
+}
+
+// SetIfAbsent stores value under key if key does not exist and saves the file
+func (s *FileStore) SetIfAbsent(ctx context.Context, key, value string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.setIfAbsent(key, value, ttl) {
+		return false, nil
+	}
+	return true, s.save()
+}
+
+// CompareAndSwap replaces the value of key if it still holds old and saves the file
+func (s *FileStore) CompareAndSwap(ctx context.Context, key, old, value string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.compareAndSwap(key, old, value, ttl) {
+		return false, nil
+	}
+	return true, s.save()
+}
+
+// Incr increments the counter under key and saves the file
+func (s *FileStore) Incr(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n, err := s.incr(key, ttl)
+	if err != nil {
+		return 0, err
+	}
+	return n, s.save()
+}
+
+// Sweep removes every expired entry and saves the file if any were removed
+func (s *FileStore) Sweep() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed := s.sweep(time.Now())
+	if removed == 0 {
+		return 0, nil
+	}
+	return removed, s.save()
+}
+
+// save writes all live entries to a temporary file and renames it over Path.
+// The caller must hold s.mu.
+func (s *FileStore) save() error {
+	s.sweep(time.Now())
+
+	data, err := json.Marshal(s.entries)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.Path), filepath.Base(s.Path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.Path)
+}
@@ -0,0 +1,81 @@
+package service
+
+import (
+	"crypto/rand"
+	"fmt"
+	"github.com/RoMalms10/otp-generator/models"
+	"math/big"
+	"strings"
+	"unicode"
+)
+
+// Limits for OTPFormat.Length
+const (
+	MinOTPLength = 4
+	MaxOTPLength = 12
+)
+
+// alphabets maps each supported alphabet to the characters codes are drawn from
+var alphabets = map[string]string{
+	models.AlphabetNumeric:      "0123456789",
+	models.AlphabetAlphanumeric: "23456789ABCDEFGHJKMNPQRSTUVWXYZ",
+	models.AlphabetHex:          "0123456789abcdef",
+}
+
+// resolveFormat fills the zero fields of format from the defaults and checks the result
+func resolveFormat(format *models.OTPFormat, defaults models.OTPFormat) (models.OTPFormat, error) {
+	resolved := defaults
+	if format != nil {
+		if format.Length != 0 {
+			resolved.Length = format.Length
+		}
+		if format.Alphabet != "" {
+			resolved.Alphabet = format.Alphabet
+		}
+		if format.GroupSize != 0 {
+			resolved.GroupSize = format.GroupSize
+		}
+	}
+
+	if resolved.Length < MinOTPLength || resolved.Length > MaxOTPLength {
+		return resolved, fmt.Errorf("%w: length must be between %d and %d", ErrInvalidFormat, MinOTPLength, MaxOTPLength)
+	}
+	if _, ok := alphabets[resolved.Alphabet]; !ok {
+		return resolved, fmt.Errorf("%w: unsupported alphabet %q", ErrInvalidFormat, resolved.Alphabet)
+	}
+	if resolved.GroupSize < 0 || resolved.GroupSize >= resolved.Length {
+		resolved.GroupSize = 0
+	}
+	return resolved, nil
+}
+
+// newCode generates a random code in the format. Every character is drawn
+// uniformly from the alphabet using crypto/rand.
+func newCode(format models.OTPFormat) (string, error) {
+	alphabet := alphabets[format.Alphabet]
+	max := big.NewInt(int64(len(alphabet)))
+
+	var code strings.Builder
+	for i := 0; i < format.Length; i++ {
+		if i > 0 && format.GroupSize > 0 && i%format.GroupSize == 0 {
+			code.WriteByte('-')
+		}
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code.WriteByte(alphabet[n.Int64()])
+	}
+	return code.String(), nil
+}
+
+// normalizeCode strips separators and whitespace and folds case, so a code is
+// hashed and compared the same way however the user typed it
+func normalizeCode(code string) string {
+	return strings.ToUpper(strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) || r == '-' || r == '.' {
+			return -1
+		}
+		return r
+	}, code))
+}
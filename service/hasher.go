@@ -0,0 +1,206 @@
+package service
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// saltSize is the length in bytes of the random salt stored with every hash
+const saltSize = 16
+
+// OTPHasher hashes OTPs with HMAC-SHA256 before they are stored, so the store
+// never holds a live code. Each record names the key it was hashed with, which
+// lets the current key be rotated while OTPs hashed with older keys in the
+// keyring stay valid until they expire.
+type OTPHasher struct {
+	currentID string
+	keys      map[string][]byte
+}
+
+// NewOTPHasher creates an OTPHasher that hashes with the key currentID and
+// verifies records hashed with any key in keys
+func NewOTPHasher(currentID string, keys map[string][]byte) (*OTPHasher, error) {
+	if _, ok := keys[currentID]; !ok {
+		return nil, fmt.Errorf("current HMAC key %q is not in the keyring", currentID)
+	}
+	for id, key := range keys {
+		if id == "" || strings.ContainsAny(id, "$:,") {
+			return nil, fmt.Errorf("invalid HMAC key ID %q", id)
+		}
+		if len(key) < 16 {
+			return nil, fmt.Errorf("HMAC key %q must be at least 16 bytes", id)
+		}
+	}
+	return &OTPHasher{currentID: currentID, keys: keys}, nil
+}
+
+// ParseOTPHasher creates an OTPHasher from a keyring of the form
+// "id:secret,id:secret". The first key is the current one; the rest are
+// older keys that are only used to verify and open existing records. Recovery
+// codes and factor secrets do not expire, so a key must stay in the keyring
+// while any of them made with it remain.
+func ParseOTPHasher(keyring string) (*OTPHasher, error) {
+	keys := make(map[string][]byte)
+	var currentID string
+
+	for _, entry := range strings.Split(keyring, ",") {
+		id, secret, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok {
+			return nil, errors.New("HMAC keyring entries must have the form id:secret")
+		}
+		if _, exists := keys[id]; exists {
+			return nil, fmt.Errorf("duplicate HMAC key ID %q", id)
+		}
+		if currentID == "" {
+			currentID = id
+		}
+		keys[id] = []byte(secret)
+	}
+
+	return NewOTPHasher(currentID, keys)
+}
+
+// NewEphemeralOTPHasher creates an OTPHasher with a random key. Records it
+// produces cannot be verified by any other process or after a restart.
+func NewEphemeralOTPHasher() *OTPHasher {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return &OTPHasher{currentID: "ephemeral", keys: map[string][]byte{"ephemeral": key}}
+}
+
+// Hash returns a storable record of the form "keyID$salt$mac" for the code
+func (h *OTPHasher) Hash(code string) (string, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	mac := h.mac(h.keys[h.currentID], salt, code)
+	return strings.Join([]string{
+		h.currentID,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(mac),
+	}, "$"), nil
+}
+
+// Verify reports whether code matches the record, comparing in constant time
+func (h *OTPHasher) Verify(record, code string) bool {
+	parts := strings.Split(record, "$")
+	if len(parts) != 3 {
+		return false
+	}
+
+	key, ok := h.keys[parts[0]]
+	if !ok {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+	expected, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+
+	return hmac.Equal(h.mac(key, salt, code), expected)
+}
+
+// Sign returns a URL-safe signature over the parts with the current key
+func (h *OTPHasher) Sign(parts ...string) string {
+	return base64.RawURLEncoding.EncodeToString(h.signature(h.keys[h.currentID], parts))
+}
+
+// VerifySignature reports whether signature was made over the parts with any
+// key in the keyring, comparing in constant time
+func (h *OTPHasher) VerifySignature(signature string, parts ...string) bool {
+	sig, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	for _, key := range h.keys {
+		if hmac.Equal(h.signature(key, parts), sig) {
+			return true
+		}
+	}
+	return false
+}
+
+// Seal encrypts a code with AES-GCM under a key derived from the current HMAC
+// key. It is used where a code must be kept in a recoverable form, such as
+// while it waits to be delivered. The result has the form "keyID$sealed".
+func (h *OTPHasher) Seal(code string) (string, error) {
+	aead, err := h.aead(h.keys[h.currentID])
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := aead.Seal(nonce, nonce, []byte(code), []byte(h.currentID))
+	return h.currentID + "$" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a value made by Seal with any key in the keyring
+func (h *OTPHasher) Open(value string) (string, error) {
+	id, encoded, ok := strings.Cut(value, "$")
+	key, known := h.keys[id]
+	if !ok || !known {
+		return "", errors.New("sealed value was not made with a key in the keyring")
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+
+	aead, err := h.aead(key)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("sealed value is too short")
+	}
+	code, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(id))
+	if err != nil {
+		return "", err
+	}
+	return string(code), nil
+}
+
+// aead returns AES-256-GCM keyed with a subkey of the HMAC key, so the HMAC
+// key itself never encrypts. Signatures always end in a separator, so Sign
+// can never produce the subkey.
+func (h *OTPHasher) aead(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(h.mac(key, []byte("seal"), ""))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (h *OTPHasher) signature(key []byte, parts []string) []byte {
+	m := hmac.New(sha256.New, key)
+	for _, part := range parts {
+		m.Write([]byte(part))
+		m.Write([]byte{0})
+	}
+	return m.Sum(nil)
+}
+
+func (h *OTPHasher) mac(key, salt []byte, code string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write(salt)
+	m.Write([]byte(code))
+	return m.Sum(nil)
+}
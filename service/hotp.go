@@ -0,0 +1,269 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/RoMalms10/otp-generator/models"
+	"hash"
+	"strings"
+)
+
+// MinHOTPSecretSize is the shortest secret RFC 4226 allows, in bytes
+const MinHOTPSecretSize = 16
+
+// hashAlgorithms maps each supported algorithm to its hash and the secret size
+// recommended by RFC 6238
+var hashAlgorithms = map[string]struct {
+	hash       func() hash.Hash
+	secretSize int
+}{
+	models.AlgorithmSHA1:   {sha1.New, 20},
+	models.AlgorithmSHA256: {sha256.New, 32},
+	models.AlgorithmSHA512: {sha512.New, 64},
+}
+
+// base32NoPadding is the secret encoding used by otpauth:// URIs
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// RegisterHOTP stores a token's secret and counter for the user, replacing any
+// previously registered token. Zero fields fall back to the configured
+// defaults. The request's session must have been verified for the user
+// recently, and is used up.
+func (s *OTPService) RegisterHOTP(req models.HOTPRegisterRequest) (*models.HOTPToken, error) {
+	token := &models.HOTPToken{
+		Secret:    strings.ToUpper(strings.Join(strings.Fields(req.Secret), "")),
+		Algorithm: strings.ToUpper(req.Algorithm),
+		Digits:    req.Digits,
+		Counter:   req.Counter,
+	}
+	if token.Algorithm == "" {
+		token.Algorithm = strings.ToUpper(s.HOTPAlgorithm)
+	}
+	if token.Digits == 0 {
+		token.Digits = s.HOTPDigits
+	}
+
+	if _, ok := hashAlgorithms[token.Algorithm]; !ok {
+		return nil, fmt.Errorf("%w: unsupported HOTP algorithm %q", ErrInvalidFormat, token.Algorithm)
+	}
+	if token.Digits < MinTOTPDigits || token.Digits > MaxTOTPDigits {
+		return nil, fmt.Errorf("%w: digits must be between %d and %d", ErrInvalidFormat, MinTOTPDigits, MaxTOTPDigits)
+	}
+	key, err := decodeSecret(token.Secret)
+	if err != nil {
+		return nil, fmt.Errorf("%w: secret must be base32", ErrInvalidFormat)
+	}
+	if len(key) < MinHOTPSecretSize {
+		return nil, fmt.Errorf("%w: secret must be at least %d bytes", ErrInvalidFormat, MinHOTPSecretSize)
+	}
+
+	if err := s.useVerifiedSession(req.SessionID, req.Username); err != nil {
+		return nil, err
+	}
+
+	// The secret is stored sealed, since it must be recovered to check codes
+	stored := *token
+	if stored.Secret, err = s.Hasher.Seal(token.Secret); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Store.Set(s.Context, hotpKey(req.Username), string(data), 0); err != nil {
+		return nil, err
+	}
+	s.Store.Delete(s.Context, hotpAttemptsKey(req.Username))
+
+	return token, nil
+}
+
+// VerifyHOTP checks a token code for the user against the next HOTPLookAhead
+// counters and, on a match, advances the stored counter past it atomically,
+// so every code can only be used once. Mismatches count towards the same
+// lockout as OTPs.
+func (s *OTPService) VerifyHOTP(username, code string) error {
+	data, token, err := s.getHOTPToken(username)
+	if err != nil {
+		return err
+	}
+
+	if retryAfter, err := s.lockoutRemaining(username); err != nil {
+		return fmt.Errorf("Server error: %v", err)
+	} else if retryAfter > 0 {
+		return &LockedError{RetryAfter: retryAfter}
+	}
+
+	code = normalizeCode(code)
+	counter, ok, err := matchHOTP(token, token.Counter, s.HOTPLookAhead, code)
+	if err != nil {
+		return fmt.Errorf("Server error: %v", err)
+	}
+	if !ok {
+		// The last accepted code gets a specific error
+		if token.Counter > 0 {
+			if _, used, _ := matchHOTP(token, token.Counter-1, 0, code); used {
+				return ErrOTPAlreadyUsed
+			}
+		}
+		return s.recordFailedFactorAttempt(hotpAttemptsKey(username), username)
+	}
+
+	return s.advanceHOTP(username, data, counter+1)
+}
+
+// ResyncHOTP recovers a token whose counter has drifted beyond the look-ahead
+// window. The two codes must be consecutive and within HOTPResyncWindow
+// counters of the stored one; the counter then continues after the second.
+func (s *OTPService) ResyncHOTP(username, code, nextCode string) error {
+	data, token, err := s.getHOTPToken(username)
+	if err != nil {
+		return err
+	}
+
+	if retryAfter, err := s.lockoutRemaining(username); err != nil {
+		return fmt.Errorf("Server error: %v", err)
+	} else if retryAfter > 0 {
+		return &LockedError{RetryAfter: retryAfter}
+	}
+
+	code, nextCode = normalizeCode(code), normalizeCode(nextCode)
+	end := token.Counter + s.HOTPResyncWindow
+	for from := token.Counter; from <= end; {
+		counter, ok, err := matchHOTP(token, from, end-from, code)
+		if err != nil {
+			return fmt.Errorf("Server error: %v", err)
+		}
+		if !ok {
+			break
+		}
+		if _, next, _ := matchHOTP(token, counter+1, 0, nextCode); next {
+			return s.advanceHOTP(username, data, counter+2)
+		}
+		from = counter + 1
+	}
+	return s.recordFailedFactorAttempt(hotpAttemptsKey(username), username)
+}
+
+// advanceHOTP stores the token with its counter moved to next, unless another
+// request changed the token since it was read
+func (s *OTPService) advanceHOTP(username, data string, next uint64) error {
+	// Update the stored form, which keeps the secret sealed
+	var stored models.HOTPToken
+	if err := json.Unmarshal([]byte(data), &stored); err != nil {
+		return fmt.Errorf("Server error: %v", err)
+	}
+	stored.Counter = next
+	updated, err := json.Marshal(stored)
+	if err != nil {
+		return fmt.Errorf("Server error: %v", err)
+	}
+
+	swapped, err := s.Store.CompareAndSwap(s.Context, hotpKey(username), data, string(updated), 0)
+	if err != nil {
+		return fmt.Errorf("Server error: %v", err)
+	} else if !swapped {
+		// A concurrent request advanced the counter first
+		return ErrOTPAlreadyUsed
+	}
+
+	// Success clears the attempt counter and the lockout backoff
+	s.Store.Delete(s.Context, hotpAttemptsKey(username))
+	s.Store.Delete(s.Context, lockoutCountKey(username))
+
+	return nil
+}
+
+// getHOTPToken returns the user's token with its secret opened, along with
+// its stored form for compare-and-swap updates. Returns ErrNotEnrolled if the
+// user has no token.
+func (s *OTPService) getHOTPToken(username string) (string, *models.HOTPToken, error) {
+	data, err := s.Store.Get(s.Context, hotpKey(username))
+	if err == ErrNotFound {
+		return "", nil, ErrNotEnrolled
+	} else if err != nil {
+		return "", nil, err
+	}
+
+	var token models.HOTPToken
+	if err := json.Unmarshal([]byte(data), &token); err != nil {
+		return "", nil, err
+	}
+	if token.Secret, err = s.Hasher.Open(token.Secret); err != nil {
+		return "", nil, err
+	}
+	return data, &token, nil
+}
+
+// matchHOTP returns the first counter from from to from+window whose code matches
+func matchHOTP(token *models.HOTPToken, from, window uint64, code string) (uint64, bool, error) {
+	algorithm, ok := hashAlgorithms[token.Algorithm]
+	if !ok {
+		return 0, false, fmt.Errorf("%w: unsupported HOTP algorithm %q", ErrInvalidFormat, token.Algorithm)
+	}
+	key, err := decodeSecret(token.Secret)
+	if err != nil {
+		return 0, false, err
+	}
+
+	for counter := from; counter <= from+window; counter++ {
+		expected := hotpCode(algorithm.hash, key, counter, token.Digits)
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return counter, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// HOTPCode returns the code of a token for a counter
+func HOTPCode(token models.HOTPToken, counter uint64) (string, error) {
+	algorithm, ok := hashAlgorithms[strings.ToUpper(token.Algorithm)]
+	if !ok {
+		return "", fmt.Errorf("%w: unsupported HOTP algorithm %q", ErrInvalidFormat, token.Algorithm)
+	}
+	key, err := decodeSecret(token.Secret)
+	if err != nil {
+		return "", err
+	}
+	return hotpCode(algorithm.hash, key, counter, token.Digits), nil
+}
+
+// hotpCode computes an RFC 4226 code: the dynamically truncated HMAC of the
+// counter, reduced to the given number of decimal digits
+func hotpCode(h func() hash.Hash, key []byte, counter uint64, digits int) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+
+	mac := hmac.New(h, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, value%mod)
+}
+
+// decodeSecret decodes a base32 secret, with or without padding
+func decodeSecret(secret string) ([]byte, error) {
+	return base32NoPadding.DecodeString(strings.TrimRight(secret, "="))
+}
+
+func hotpKey(username string) string {
+	return fmt.Sprintf("hotp:%s", KeyDigest(username))
+}
+
+func hotpAttemptsKey(username string) string {
+	return fmt.Sprintf("hotp-attempts:%s", KeyDigest(username))
+}
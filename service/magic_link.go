@@ -0,0 +1,78 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"github.com/RoMalms10/otp-generator/models"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// magicLinkSecretSize is the length in bytes of the random secret in a magic link
+const magicLinkSecretSize = 32
+
+// magicLinkPurpose separates magic link signatures from any other use of the keyring
+const magicLinkPurpose = "magic-link"
+
+// storeNewMagicLink stores the hash of a new random secret for the session and
+// returns the link that carries it. The link's token is "sessionID.secret.signature",
+// so it is bound to the issuing session and forged tokens are rejected before
+// the store is consulted.
+func (s *OTPService) storeNewMagicLink(session *models.Session) (string, error) {
+	b := make([]byte, magicLinkSecretSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	secret := base64.RawURLEncoding.EncodeToString(b)
+
+	record, err := s.Hasher.Hash(secret)
+	if err != nil {
+		return "", err
+	}
+	err = s.Store.Set(s.Context, otpKey(session.ID), record, time.Until(session.ExpiresAt))
+	if err != nil {
+		return "", err
+	}
+
+	token := strings.Join([]string{session.ID, secret, s.Hasher.Sign(magicLinkPurpose, session.ID, secret)}, ".")
+	return strings.TrimRight(s.MagicLinkBaseURL, "/") + "/otp/verify/" + url.PathEscape(token), nil
+}
+
+// VerifyMagicLink consumes the token of a magic link and returns its session.
+// Returns ErrInvalidLink for a malformed or forged token, ErrOTPAlreadyUsed
+// if the link was already opened, and ErrOTPExpired once the link's session
+// is no longer pending.
+func (s *OTPService) VerifyMagicLink(token string) (*models.Session, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || !s.Hasher.VerifySignature(parts[2], magicLinkPurpose, parts[0], parts[1]) {
+		return nil, ErrInvalidLink
+	}
+	sessionID, secret := parts[0], parts[1]
+
+	session, err := s.GetSession(sessionID)
+	if err == ErrSessionNotFound {
+		return nil, ErrOTPExpired
+	} else if err != nil {
+		return nil, err
+	}
+	if session.Channel != models.MessageTypeMagicLink {
+		return nil, ErrInvalidLink
+	}
+
+	record, err := s.GetStoredOTP(sessionID)
+	if err == ErrNotFound {
+		return nil, s.missingOTPError(sessionID, secret)
+	} else if err != nil {
+		return nil, err
+	}
+	// A signed token whose secret does not match was superseded by a resend
+	if !s.Hasher.Verify(record, secret) {
+		return nil, ErrOTPExpired
+	}
+
+	if err := s.consumeOTP(session, record); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
@@ -0,0 +1,186 @@
+package service
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// memoryEntry is a single value held by MemoryStore
+type memoryEntry struct {
+	Value     string    `json:"value"`
+	ExpiresAt time.Time `json:"expiresAt,omitempty"`
+}
+
+// expired reports whether the entry has passed its expiry time
+func (e memoryEntry) expired(now time.Time) bool {
+	return !e.ExpiresAt.IsZero() && !now.Before(e.ExpiresAt)
+}
+
+// expiryFor returns the absolute expiry time for a TTL; a zero TTL never expires
+func expiryFor(now time.Time, ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return now.Add(ttl)
+}
+
+// MemoryStore implements OTPStore in process memory. Expired entries are
+// removed when they are accessed or swept; see Sweep.
+type MemoryStore struct {
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+}
+
+// NewMemoryStore creates an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{entries: make(map[string]memoryEntry)}
+}
+
+// Set stores value under key with the specified TTL
+func (s *MemoryStore) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries[key] = memoryEntry{Value: value, ExpiresAt: expiryFor(time.Now(), ttl)}
+	return nil
+}
+
+// Get returns the value stored under key, or ErrNotFound if it is missing or expired
+func (s *MemoryStore) Get(ctx context.Context, key string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.lookup(key, time.Now())
+	if !ok {
+		return "", ErrNotFound
+	}
+	return entry.Value, nil
+}
+
+// Delete removes key from the store
+func (s *MemoryStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.entries, key)
+	return nil
+}
+
+// CompareAndDelete deletes key if it still holds value
+func (s *MemoryStore) CompareAndDelete(ctx context.Context, key, value string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.compareAndDelete(key, value), nil
+}
+
+// compareAndDelete deletes key if it still holds value. The caller must hold s.mu.
+func (s *MemoryStore) compareAndDelete(key, value string) bool {
+	entry, ok := s.lookup(key, time.Now())
+	if !ok || entry.Value != value {
+		return false
+	}
+	delete(s.entries, key)
+	return true
+}
+
+// SetIfAbsent stores value under key if key does not exist
+func (s *MemoryStore) SetIfAbsent(ctx context.Context, key, value string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.setIfAbsent(key, value, ttl), nil
+}
+
+// setIfAbsent stores value under key if key does not exist. The caller must hold s.mu.
+func (s *MemoryStore) setIfAbsent(key, value string, ttl time.Duration) bool {
+	now := time.Now()
+	if _, ok := s.lookup(key, now); ok {
+		return false
+	}
+	s.entries[key] = memoryEntry{Value: value, ExpiresAt: expiryFor(now, ttl)}
+	return true
+}
+
+// CompareAndSwap replaces the value of key if it still holds old
+func (s *MemoryStore) CompareAndSwap(ctx context.Context, key, old, value string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.compareAndSwap(key, old, value, ttl), nil
+}
+
+// compareAndSwap replaces the value of key if it still holds old. The caller must hold s.mu.
+func (s *MemoryStore) compareAndSwap(key, old, value string, ttl time.Duration) bool {
+	now := time.Now()
+	entry, ok := s.lookup(key, now)
+	if !ok || entry.Value != old {
+		return false
+	}
+	s.entries[key] = memoryEntry{Value: value, ExpiresAt: expiryFor(now, ttl)}
+	return true
+}
+
+// Incr increments the counter under key, setting the TTL when the counter is created
+func (s *MemoryStore) Incr(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.incr(key, ttl)
+}
+
+// incr increments the counter under key. The caller must hold s.mu.
+func (s *MemoryStore) incr(key string, ttl time.Duration) (int64, error) {
+	now := time.Now()
+	entry, ok := s.lookup(key, now)
+	if !ok {
+		s.entries[key] = memoryEntry{Value: "1", ExpiresAt: expiryFor(now, ttl)}
+		return 1, nil
+	}
+
+	n, err := strconv.ParseInt(entry.Value, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	n++
+	entry.Value = strconv.FormatInt(n, 10)
+	s.entries[key] = entry
+	return n, nil
+}
+
+// Sweep removes every expired entry and returns how many were removed, so
+// entries that are never read again do not accumulate
+func (s *MemoryStore) Sweep() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.sweep(time.Now()), nil
+}
+
+// sweep removes every expired entry. The caller must hold s.mu.
+func (s *MemoryStore) sweep(now time.Time) int {
+	removed := 0
+	for key, entry := range s.entries {
+		if entry.expired(now) {
+			delete(s.entries, key)
+			removed++
+		}
+	}
+	return removed
+}
+
+// lookup returns the live entry for key, evicting it if it has expired.
+// The caller must hold s.mu.
+func (s *MemoryStore) lookup(key string, now time.Time) (memoryEntry, bool) {
+	entry, ok := s.entries[key]
+	if !ok {
+		return memoryEntry{}, false
+	}
+	if entry.expired(now) {
+		delete(s.entries, key)
+		return memoryEntry{}, false
+	}
+	return entry, true
+}
@@ -0,0 +1,206 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"github.com/RoMalms10/otp-generator/delivery"
+	"github.com/RoMalms10/otp-generator/messaging"
+	"github.com/RoMalms10/otp-generator/models"
+	"log"
+	"slices"
+	"time"
+)
+
+// send delivers a job's code over its channel in a message rendered from the
+// templates for the session's locale and purpose. Senders that only take a
+// code, and channels without templates, are sent the code as it is. When the
+// channel's provider reports later whether the message arrived, the message
+// is tracked so its reports are recorded against the session.
+func (s *OTPService) send(job delivery.Job, session *models.Session, otp string) error {
+	sender, err := s.sender(job.Channel)
+	if err != nil {
+		return err
+	}
+	messageSender, ok := sender.(messaging.MessageSender)
+	if !ok {
+		return s.SendOTP(job.To, otp, job.Channel)
+	}
+
+	msg, err := s.renderMessage(job, session, otp)
+	if errors.Is(err, messaging.ErrNoTemplate) {
+		return s.SendOTP(job.To, otp, job.Channel)
+	} else if err != nil {
+		return err
+	}
+
+	messageID, err := messageSender.SendMessage(msg)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrDeliveryFailed, err)
+	}
+	if msg.SMS != nil {
+		s.recordSMS(job, *msg.SMS)
+	}
+	if messageID != "" {
+		s.trackMessage(job, messageID)
+	}
+	return nil
+}
+
+// renderMessage renders the message carrying a job's code. The TTL is the
+// time left until the code expires, so a retried message does not overstate it.
+// SMS messages are formatted for the session's auto-fill profile, then
+// encoded, transliterated if that saves segments and TransliterateSMS is set.
+// One that would break the auto-fill profile's rules returns ErrInvalidFormat.
+func (s *OTPService) renderMessage(job delivery.Job, session *models.Session, otp string) (messaging.Message, error) {
+	data := messaging.TemplateData{
+		AppName: s.AppName,
+		Code:    otp,
+		Channel: job.Channel,
+		Purpose: session.Purpose,
+		Locale:  session.Locale,
+		TTL:     time.Until(job.ExpiresAt).Round(time.Second),
+	}
+	switch job.Channel {
+	case models.MessageTypeMagicLink:
+		data.Link = otp
+	case models.MessageTypeVoice:
+		data.SpokenCode = messaging.SpokenCode(otp)
+	}
+	msg, err := s.Templates.Render(job.To, data)
+	if err != nil || job.Channel != models.MessageTypeSMS {
+		return msg, err
+	}
+
+	if session.AutoFill != "" {
+		profile, ok := s.AutoFillProfiles[session.AutoFill]
+		if !ok {
+			return messaging.Message{}, fmt.Errorf("%w: unknown auto-fill profile %q", ErrInvalidFormat, session.AutoFill)
+		}
+		if msg.Text, err = profile.Format(msg.Text, otp); err != nil {
+			return messaging.Message{}, fmt.Errorf("%w: %v", ErrInvalidFormat, err)
+		}
+	}
+
+	text, info := messaging.EncodeSMS(msg.Text, s.TransliterateSMS)
+	// Auto-fill only works on a message that arrives whole
+	if session.AutoFill != "" && info.Segments > 1 {
+		return messaging.Message{}, fmt.Errorf("%w: the %s message takes %d bytes in %s, more than the %d of a single SMS",
+			ErrInvalidFormat, session.AutoFill, messaging.SMSSize(text), info.Encoding, messaging.MaxSMSBytes)
+	}
+	msg.Text, msg.SMS = text, &info
+	return msg, nil
+}
+
+// checkAutoFill returns ErrInvalidFormat if the session names an unknown
+// auto-fill profile, or if its SMS template, rendered with a code in the
+// session's format, would break the profile's rules. Sessions that never
+// send an SMS are not checked.
+func (s *OTPService) checkAutoFill(session *models.Session) error {
+	if session.AutoFill == "" {
+		return nil
+	}
+	if _, ok := s.AutoFillProfiles[session.AutoFill]; !ok {
+		return fmt.Errorf("%w: unknown auto-fill profile %q", ErrInvalidFormat, session.AutoFill)
+	}
+	if session.Channel != models.MessageTypeSMS && !slices.Contains(session.Fallback, models.MessageTypeSMS) {
+		return nil
+	}
+
+	sample, err := newCode(session.Format)
+	if err != nil {
+		return err
+	}
+	job := delivery.Job{ID: session.ID, Channel: models.MessageTypeSMS, To: session.Destination, ExpiresAt: session.ExpiresAt}
+	_, err = s.renderMessage(job, session, sample)
+	if errors.Is(err, messaging.ErrNoTemplate) {
+		return nil
+	}
+	return err
+}
+
+// parseAutoFillProfiles reads the configured auto-fill profiles, skipping invalid ones
+func parseAutoFillProfiles(entries []string) map[string]messaging.AutoFillProfile {
+	profiles := make(map[string]messaging.AutoFillProfile)
+	for _, entry := range entries {
+		profile, err := messaging.ParseAutoFillProfile(entry)
+		if err != nil {
+			log.Printf("Warning: ignoring %v", err)
+			continue
+		}
+		profiles[profile.Name] = profile
+	}
+	return profiles
+}
+
+// smsMetrics counts the SMS messages sent and the segments they were billed as.
+// It is not published to expvar, whose other variables include the command line.
+var smsMetrics = new(expvar.Map)
+
+// SMSMetrics returns the running totals of SMS messages sent, segments billed,
+// messages sent in UCS-2 and messages transliterated
+func (s *OTPService) SMSMetrics() map[string]int64 {
+	metrics := map[string]int64{"messages": 0, "segments": 0, "ucs2_messages": 0, "transliterated": 0}
+	smsMetrics.Do(func(kv expvar.KeyValue) {
+		if counter, ok := kv.Value.(*expvar.Int); ok {
+			metrics[kv.Key] = counter.Value()
+		}
+	})
+	return metrics
+}
+
+// recordSMS counts a sent SMS in smsMetrics and records its encoding for the
+// session's delivery status
+func (s *OTPService) recordSMS(job delivery.Job, info messaging.SMSInfo) {
+	smsMetrics.Add("messages", 1)
+	smsMetrics.Add("segments", int64(info.Segments))
+	if info.Encoding == messaging.EncodingUCS2 {
+		smsMetrics.Add("ucs2_messages", 1)
+	}
+	if info.Transliterated {
+		smsMetrics.Add("transliterated", 1)
+	}
+
+	data, err := json.Marshal(info)
+	if err == nil {
+		err = s.Store.Set(s.Context, smsInfoKey(job.ID), string(data), time.Until(job.ExpiresAt)+s.SessionRetention)
+	}
+	if err != nil {
+		log.Printf("Failed to record the SMS encoding of session %s: %v", job.ID, err)
+	}
+}
+
+// addSMSInfo adds how the session's latest SMS was encoded to its delivery status
+func (s *OTPService) addSMSInfo(status *models.DeliveryStatus, sessionID string) error {
+	data, err := s.Store.Get(s.Context, smsInfoKey(sessionID))
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var info messaging.SMSInfo
+	if err := json.Unmarshal([]byte(data), &info); err != nil {
+		return err
+	}
+	status.Encoding, status.Segments, status.Transliterated = info.Encoding, info.Segments, info.Transliterated
+	return nil
+}
+
+func smsInfoKey(sessionID string) string {
+	return fmt.Sprintf("sms-info:%s", sessionID)
+}
+
+// resolveLocale normalizes a requested locale, where empty means the default.
+// Returns ErrInvalidFormat if it is not a well-formed language tag.
+func resolveLocale(locale string) (string, error) {
+	if locale == "" {
+		return "", nil
+	}
+	normalized, ok := messaging.NormalizeLocale(locale)
+	if !ok {
+		return "", fmt.Errorf("%w: invalid locale %q", ErrInvalidFormat, locale)
+	}
+	return normalized, nil
+}
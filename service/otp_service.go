@@ -2,95 +2,536 @@ package service
 
 import (
 	"context"
-	"crypto/rand"
+	"errors"
 	"fmt"
+	"github.com/RoMalms10/otp-generator/config"
+	"github.com/RoMalms10/otp-generator/delivery"
 	"github.com/RoMalms10/otp-generator/messaging"
 	"github.com/RoMalms10/otp-generator/models"
-	"github.com/go-redis/redis/v8"
-	"math/big"
+	"log"
+	"strconv"
+	"strings"
 	"time"
 )
 
 type OTPService struct {
-	RedisClient   *redis.Client
-	Context       context.Context
-	OTPTTL        time.Duration // Configurable TTL
-	TwilioService *messaging.TwilioService
+	Store   OTPStore
+	Context context.Context
+	OTPTTL  time.Duration // Configurable TTL
+	Senders *messaging.Registry
+	Hasher  *OTPHasher // Hashes codes before they are stored
+
+	// Queue delivers codes in the background once StartDelivery has started
+	// it; nil delivers them inline
+	Queue *delivery.Queue
+	// stopDelivery stops the Queue's workers
+	stopDelivery context.CancelFunc
+	// DeliveryTimeout is how long a send may take before the next channel is tried
+	DeliveryTimeout time.Duration
+	// FallbackChains maps a channel to the channels tried after it fails,
+	// for requests that do not name their own
+	FallbackChains map[string][]string
+
+	// SessionRetention is how long a session can be looked up after its OTP expires
+	SessionRetention time.Duration
+
+	// DefaultFormat is used for the fields a request's format leaves unset
+	DefaultFormat models.OTPFormat
+
+	// Destinations validates and normalizes the address every OTP is delivered to
+	Destinations DestinationPolicy
+	// Lookup resolves user IDs to their registered destinations; nil means
+	// requests must name the destination themselves
+	Lookup DestinationLookup
+
+	// RecoveryCodeCount is the number of codes in a recovery set when a request does not specify it
+	RecoveryCodeCount int
+
+	// MagicLinkBaseURL is the public URL that magic links point at
+	MagicLinkBaseURL string
+
+	// Templates renders the messages that carry codes, naming the app as AppName
+	Templates *messaging.Templates
+	AppName   string
+	// AutoFillProfiles are the SMS auto-fill profiles requests can name, keyed by name
+	AutoFillProfiles map[string]messaging.AutoFillProfile
+	// TransliterateSMS sends SMS messages that need UCS-2 in GSM-7 when that takes fewer segments
+	TransliterateSMS bool
+
+	// Brute-force protection settings
+	MaxAttempts int           // Failed attempts allowed before an OTP is burned
+	LockoutBase time.Duration // Lockout after the first burned OTP
+	LockoutMax  time.Duration // Upper bound for the doubling lockout
+
+	// TOTP settings; the algorithm, digits and period are defaults for new enrollments
+	TOTPIssuer    string
+	TOTPAlgorithm string
+	TOTPDigits    int
+	TOTPPeriod    time.Duration
+	TOTPSkew      int // Time steps accepted either side of the current one
+
+	// HOTP settings; the algorithm and digits are defaults for new tokens
+	HOTPAlgorithm    string
+	HOTPDigits       int
+	HOTPLookAhead    uint64 // Counters past the expected one that are accepted
+	HOTPResyncWindow uint64 // Counters searched for a resync
 }
 
-func NewOTPService(redisClient *redis.Client, ctx context.Context, ttl time.Duration, twilioService *messaging.TwilioService) *OTPService {
-	return &OTPService{
-		RedisClient:   redisClient,
-		Context:       ctx,
-		OTPTTL:        ttl,
-		TwilioService: twilioService,
+// lockoutMemory is how long previous lockouts count towards the backoff
+const lockoutMemory = 24 * time.Hour
+
+func NewOTPService(store OTPStore, ctx context.Context, ttl time.Duration, senders *messaging.Registry) *OTPService {
+	// Use the configured HMAC keyring, or a random key if none is configured
+	hasher, err := ParseOTPHasher(config.OTPHMACKeys)
+	if err != nil {
+		if config.OTPHMACKeys != "" {
+			log.Printf("Warning: invalid OTP_HMAC_KEYS (%v), using a random HMAC key", err)
+		}
+		hasher = NewEphemeralOTPHasher()
+	}
+
+	// Use the configured message templates, or only the built-in ones if they cannot be loaded
+	templates, err := messaging.LoadTemplates(config.TemplateDir, config.MessageLocale)
+	if err != nil {
+		log.Printf("Warning: %v, using the built-in templates", err)
+		templates, _ = messaging.LoadTemplates("", config.DefaultLocale)
+	}
+
+	// Resolve user IDs through the lookup service if one is configured
+	var lookup DestinationLookup
+	if config.DestinationLookupURL != "" {
+		lookup = NewHTTPDestinationLookup(config.DestinationLookupURL)
+	}
+
+	s := &OTPService{
+		Store:   store,
+		Context: ctx,
+		OTPTTL:  ttl,
+		Senders: senders,
+		Hasher:  hasher,
+
+		DeliveryTimeout: config.DeliveryTimeout,
+		FallbackChains:  parseFallbackChains(config.DeliveryFallbacks),
+
+		SessionRetention: config.SessionRetention,
+
+		DefaultFormat: models.OTPFormat{
+			Length:    config.OTPLength,
+			Alphabet:  config.OTPAlphabet,
+			GroupSize: config.OTPGroupSize,
+		},
+
+		Destinations: DestinationPolicy{
+			AllowedCountryCodes: config.AllowedCountryCodes,
+			DeniedCountryCodes:  config.DeniedCountryCodes,
+			DeniedPrefixes:      config.DeniedPhonePrefixes,
+			AllowedEmailDomains: config.AllowedEmailDomains,
+			DeniedEmailDomains:  config.DeniedEmailDomains,
+		},
+		Lookup: lookup,
+
+		RecoveryCodeCount: config.RecoveryCodeCount,
+
+		MagicLinkBaseURL: config.MagicLinkBaseURL,
+
+		Templates:        templates,
+		AppName:          config.AppName,
+		AutoFillProfiles: parseAutoFillProfiles(config.AutoFillProfiles),
+		TransliterateSMS: config.SMSTransliterate,
+
+		MaxAttempts: config.MaxOTPAttempts,
+		LockoutBase: config.LockoutBase,
+		LockoutMax:  config.LockoutMax,
+
+		TOTPIssuer:    config.TOTPIssuer,
+		TOTPAlgorithm: config.TOTPAlgorithm,
+		TOTPDigits:    config.TOTPDigits,
+		TOTPPeriod:    config.TOTPPeriod,
+		TOTPSkew:      config.TOTPSkew,
+
+		HOTPAlgorithm:    config.HOTPAlgorithm,
+		HOTPDigits:       config.HOTPDigits,
+		HOTPLookAhead:    uint64(config.HOTPLookAhead),
+		HOTPResyncWindow: uint64(config.HOTPResyncWindow),
 	}
+	return s
 }
 
-// GenerateOTP creates a new OTP for the specified username and stores it in Redis
-func (s *OTPService) GenerateOTP(username string) (string, error) {
-	// Set the maximum value for a 6-digit number (999999)
-	const max = 1000000
-	
-	// Generate a random number in the range [0, 999999]
-	n, err := rand.Int(rand.Reader, big.NewInt(max))
+// GenerateOTP starts a verification session for the request and returns it
+// with a new OTP in the requested format. Only the hash of the OTP is stored.
+// A pending session for the same user and purpose is superseded.
+func (s *OTPService) GenerateOTP(req models.GenerateRequest) (*models.Session, string, error) {
+	user := req.User()
+
+	purpose := req.Purpose
+	if purpose == "" {
+		purpose = models.DefaultPurpose
+	} else if len(purpose) > maxPurposeLength {
+		return nil, "", fmt.Errorf("%w: purpose must be at most %d characters", ErrInvalidFormat, maxPurposeLength)
+	}
+
+	format, err := resolveFormat(req.Format, s.DefaultFormat)
 	if err != nil {
-		return "", err
+		return nil, "", err
 	}
 
-	otp := fmt.Sprintf("%06d", n.Int64())
-	otpKey := fmt.Sprintf("otp:%s", username)
-	err = s.RedisClient.Set(s.Context, otpKey, otp, s.OTPTTL).Err()
+	locale, err := resolveLocale(req.Locale)
 	if err != nil {
-		return "", err
+		return nil, "", err
 	}
 
-	return otp, nil
+	destination, err := s.resolveDestination(req)
+	if err != nil {
+		return nil, "", err
+	}
+
+	fallback, err := s.fallbackChain(req.MessageType, req.Fallback)
+	if err != nil {
+		return nil, "", err
+	}
+
+	sessionID, err := newSessionID()
+	if err != nil {
+		return nil, "", err
+	}
+
+	now := time.Now()
+	session := &models.Session{
+		ID:          sessionID,
+		Username:    user,
+		Purpose:     purpose,
+		Channel:     req.MessageType,
+		Fallback:    fallback,
+		Destination: destination,
+		Locale:      locale,
+		AutoFill:    req.AutoFill,
+		Status:      models.SessionStatusPending,
+		Format:      format,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(s.OTPTTL),
+	}
+	if err := s.checkAutoFill(session); err != nil {
+		return nil, "", err
+	}
+
+	if err := s.supersedeSession(user, purpose); err != nil {
+		return nil, "", err
+	}
+
+	otp, err := s.storeNewOTP(session)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := s.saveSession(session); err != nil {
+		return nil, "", err
+	}
+	err = s.Store.Set(s.Context, latestSessionKey(user, purpose), sessionID, s.OTPTTL)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return session, otp, nil
 }
 
-// GetStoredOTP retrieves the current stored OTP for a user
-// Returns empty string and redis.Nil error if not found
-func (s *OTPService) GetStoredOTP(username string) (string, error) {
-	otpKey := fmt.Sprintf("otp:%s", username)
-	return s.RedisClient.Get(s.Context, otpKey).Result()
+// ResendOTP replaces a pending session's OTP with a new code for resending.
+// Only the hash of the pending code is stored, so the original cannot be sent
+// again. The failed attempt count carries over to the new code. A non-empty
+// channel, locale or format replaces the session's own. A non-empty
+// destination replaces the session's after the same checks as a new
+// session's; a new channel without one uses the session's destination if it
+// suits the channel, or else the user's registered one, as fallbacks do.
+// Returns ErrSessionNotFound or ErrOTPExpired if there is no pending OTP.
+func (s *OTPService) ResendOTP(sessionID, channel, destination, locale string, format *models.OTPFormat) (*models.Session, string, error) {
+	session, err := s.GetSession(sessionID)
+	if err != nil {
+		return nil, "", err
+	}
+	if session.Status != models.SessionStatusPending {
+		return nil, "", ErrOTPExpired
+	}
+	if _, err := s.GetStoredOTP(sessionID); err == ErrNotFound {
+		return nil, "", ErrOTPExpired
+	} else if err != nil {
+		return nil, "", err
+	}
+
+	if format != nil {
+		resolved, err := resolveFormat(format, session.Format)
+		if err != nil {
+			return nil, "", err
+		}
+		session.Format = resolved
+	}
+	if locale != "" {
+		if session.Locale, err = resolveLocale(locale); err != nil {
+			return nil, "", err
+		}
+	}
+	newChannel := channel != "" && channel != session.Channel
+	if newChannel {
+		// A new channel gets its own fallback chain
+		fallback, err := s.fallbackChain(channel, nil)
+		if err != nil {
+			return nil, "", err
+		}
+		session.Channel = channel
+		session.Fallback = fallback
+	}
+	session.DeliveredVia = ""
+
+	// The destination must suit the channel
+	switch {
+	case destination != "":
+		req := models.GenerateRequest{UserID: session.Username, Destination: destination, MessageType: session.Channel}
+		destination, err = s.resolveDestination(req)
+	case newChannel:
+		destination, err = s.fallbackDestination(session, session.Channel)
+	default:
+		destination, err = s.Destinations.Normalize(session.Channel, session.Destination)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	session.Destination = destination
+	session.ExpiresAt = time.Now().Add(s.OTPTTL)
+	if err := s.checkAutoFill(session); err != nil {
+		return nil, "", err
+	}
+
+	otp, err := s.storeNewOTP(session)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := s.saveSession(session); err != nil {
+		return nil, "", err
+	}
+
+	return session, otp, nil
 }
 
-// SendOTP sends an OTP via the specified message type
-func (s *OTPService) SendOTP(recipient, otp, messageType string) error {
-	if s.TwilioService == nil {
-		return fmt.Errorf("twilio service not configured")
+// GetStoredOTP retrieves the current stored OTP record (a keyed hash, not the code) for a session
+// Returns empty string and ErrNotFound if not found
+func (s *OTPService) GetStoredOTP(sessionID string) (string, error) {
+	return s.Store.Get(s.Context, otpKey(sessionID))
+}
+
+// storeNewOTP generates a random code in the session's format and stores the
+// hash of its normalized form. Magic link sessions get a sign-in link instead.
+func (s *OTPService) storeNewOTP(session *models.Session) (string, error) {
+	if session.Channel == models.MessageTypeMagicLink {
+		return s.storeNewMagicLink(session)
 	}
 
-	switch messageType {
-	case models.MessageTypeSMS:
-		// Send OTP via SMS
-		return s.TwilioService.SendOTP(recipient, otp)
+	otp, err := newCode(session.Format)
+	if err != nil {
+		return "", err
+	}
 
-	case models.MessageTypeWhatsApp:
-		// Send OTP via WhatsApp
-		return s.TwilioService.SendOTPWhatsApp(recipient, otp)
+	record, err := s.Hasher.Hash(normalizeCode(otp))
+	if err != nil {
+		return "", err
+	}
+	err = s.Store.Set(s.Context, otpKey(session.ID), record, time.Until(session.ExpiresAt))
+	if err != nil {
+		return "", err
+	}
+
+	return otp, nil
+}
+
+// SendOTP sends an OTP via the sender registered for the message type.
+// A failure of the channel itself is wrapped in ErrDeliveryFailed.
+func (s *OTPService) SendOTP(recipient, otp, messageType string) error {
+	sender, err := s.sender(messageType)
+	if err != nil {
+		return err
+	}
+	if err := sender.SendOTP(recipient, otp); err != nil {
+		return fmt.Errorf("%w: %v", ErrDeliveryFailed, err)
+	}
+	return nil
+}
 
-	case models.MessageTypeEmail:
-		// Email sending would be implemented here
-		return nil
+// CheckChannel returns ErrUnsupportedChannel or ErrChannelUnavailable if
+// messages cannot be sent with the message type
+func (s *OTPService) CheckChannel(messageType string) error {
+	_, err := s.sender(messageType)
+	return err
+}
 
+// sender returns the sender registered for the message type, translating registry errors
+func (s *OTPService) sender(messageType string) (messaging.Sender, error) {
+	sender, err := s.Senders.Sender(messageType)
+	switch {
+	case err == nil:
+		return sender, nil
+	case errors.Is(err, messaging.ErrChannelUnavailable):
+		return nil, fmt.Errorf("%w: MessageType '%s' is currently unavailable", ErrChannelUnavailable, messageType)
+	case errors.Is(err, messaging.ErrUnknownChannel):
+		return nil, fmt.Errorf("%w '%s', use one of: %s",
+			ErrUnsupportedChannel, messageType, strings.Join(s.Senders.Channels(), ", "))
 	default:
-		return fmt.Errorf("unsupported message type: %s", messageType)
+		return nil, err
 	}
 }
 
-// ValidateOTP checks if the provided OTP matches the stored OTP for the user
-func (s *OTPService) ValidateOTP(username, otp string) (string, error) {
-	storedOTP, err := s.GetStoredOTP(username)
-	if err == redis.Nil {
-		return "invalid", fmt.Errorf("OTP has expired or does not exist")
+// ValidateOTP checks if the provided OTP matches the stored OTP for the session.
+// Separators, whitespace and case in the submitted code are ignored.
+// Every mismatch counts against the OTP; once MaxAttempts is reached the OTP
+// is deleted and the session's user is locked out with a *LockedError. A
+// matching OTP is consumed atomically, so it can only be validated once.
+func (s *OTPService) ValidateOTP(sessionID, otp string) (string, error) {
+	otp = normalizeCode(otp)
+
+	session, err := s.GetSession(sessionID)
+	if err == ErrSessionNotFound {
+		return "invalid", ErrOTPExpired
+	} else if err != nil {
+		return "invalid", fmt.Errorf("Server error: %v", err)
+	}
+
+	if retryAfter, err := s.lockoutRemaining(session.Username); err != nil {
+		return "invalid", fmt.Errorf("Server error: %v", err)
+	} else if retryAfter > 0 {
+		return "invalid", &LockedError{RetryAfter: retryAfter}
+	}
+
+	record, err := s.GetStoredOTP(sessionID)
+	if err == ErrNotFound {
+		return "invalid", s.missingOTPError(sessionID, otp)
 	} else if err != nil {
 		return "invalid", fmt.Errorf("Server error: %v", err)
 	}
 
-	if storedOTP != otp {
-		return "invalid", fmt.Errorf("Incorrect OTP entered")
+	if !s.Hasher.Verify(record, otp) {
+		return "invalid", s.recordFailedAttempt(session)
 	}
 
+	if err := s.consumeOTP(session, record); err != nil {
+		return "invalid", err
+	}
 	return "valid", nil
 }
+
+// consumeOTP deletes the session's verified OTP record and marks the session
+// verified. Only one of several concurrent validations can delete the record;
+// the others get ErrOTPAlreadyUsed. If the session cannot be marked verified
+// the validation fails, although the OTP is used up.
+func (s *OTPService) consumeOTP(session *models.Session, record string) error {
+	consumed, err := s.Store.CompareAndDelete(s.Context, otpKey(session.ID), record)
+	if err != nil {
+		return fmt.Errorf("Server error: %v", err)
+	} else if !consumed {
+		return ErrOTPAlreadyUsed
+	}
+
+	// Remember the consumed code so a replay gets a specific error
+	if err := s.Store.Set(s.Context, consumedKey(session.ID), record, s.OTPTTL); err != nil {
+		return fmt.Errorf("Server error: %v", err)
+	}
+
+	now := time.Now()
+	session.Status = models.SessionStatusVerified
+	session.VerifiedAt = &now
+	if err := s.saveSession(session); err != nil {
+		return fmt.Errorf("Server error: %v", err)
+	}
+
+	// Success clears the attempt counter and the lockout backoff
+	if err := s.Store.Delete(s.Context, attemptsKey(session.ID)); err != nil {
+		log.Printf("Failed to clear the attempts of session %s: %v", session.ID, err)
+	}
+	if err := s.Store.Delete(s.Context, lockoutCountKey(session.Username)); err != nil {
+		log.Printf("Failed to clear the lockout backoff of session %s: %v", session.ID, err)
+	}
+
+	return nil
+}
+
+// missingOTPError distinguishes a replay of the last consumed code from an expired OTP
+func (s *OTPService) missingOTPError(sessionID, otp string) error {
+	record, err := s.Store.Get(s.Context, consumedKey(sessionID))
+	if err == nil && s.Hasher.Verify(record, otp) {
+		return ErrOTPAlreadyUsed
+	}
+	return ErrOTPExpired
+}
+
+// recordFailedAttempt counts a mismatch and burns the OTP once the limit is reached
+func (s *OTPService) recordFailedAttempt(session *models.Session) error {
+	attempts, err := s.Store.Incr(s.Context, attemptsKey(session.ID), s.OTPTTL)
+	if err != nil {
+		return fmt.Errorf("Server error: %v", err)
+	}
+	if attempts < int64(s.MaxAttempts) {
+		return ErrOTPMismatch
+	}
+
+	// Burn the OTP so the remaining codes cannot be tried
+	s.Store.Delete(s.Context, otpKey(session.ID))
+	s.Store.Delete(s.Context, attemptsKey(session.ID))
+	session.Status = models.SessionStatusFailed
+	session.Attempts = int(attempts)
+	s.saveSession(session)
+
+	return s.lockOut(session.Username)
+}
+
+// recordFailedFactorAttempt counts a mismatched authenticator or token code
+// under key and locks the user out once the limit is reached
+func (s *OTPService) recordFailedFactorAttempt(key, username string) error {
+	attempts, err := s.Store.Incr(s.Context, key, s.OTPTTL)
+	if err != nil {
+		return fmt.Errorf("Server error: %v", err)
+	}
+	if attempts < int64(s.MaxAttempts) {
+		return ErrOTPMismatch
+	}
+
+	s.Store.Delete(s.Context, key)
+	return s.lockOut(username)
+}
+
+// lockOut starts a lockout for the user and returns it as a *LockedError
+func (s *OTPService) lockOut(username string) error {
+	// Each lockout within lockoutMemory doubles the window, up to LockoutMax
+	lockouts, err := s.Store.Incr(s.Context, lockoutCountKey(username), lockoutMemory)
+	if err != nil {
+		return fmt.Errorf("Server error: %v", err)
+	}
+	duration := s.LockoutBase
+	for i := int64(1); i < lockouts && duration < s.LockoutMax; i++ {
+		duration *= 2
+	}
+	if duration > s.LockoutMax {
+		duration = s.LockoutMax
+	}
+
+	until := time.Now().Add(duration)
+	err = s.Store.Set(s.Context, lockoutKey(username), strconv.FormatInt(until.UnixMilli(), 10), duration)
+	if err != nil {
+		return fmt.Errorf("Server error: %v", err)
+	}
+
+	return &LockedError{RetryAfter: duration, Burned: true}
+}
+
+// lockoutRemaining returns how long the user remains locked out, or zero
+func (s *OTPService) lockoutRemaining(username string) (time.Duration, error) {
+	value, err := s.Store.Get(s.Context, lockoutKey(username))
+	if err == ErrNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	untilMillis, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	remaining := time.Until(time.UnixMilli(untilMillis))
+	if remaining < 0 {
+		return 0, nil
+	}
+	return remaining, nil
+}
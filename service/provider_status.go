@@ -0,0 +1,127 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/RoMalms10/otp-generator/delivery"
+	"github.com/RoMalms10/otp-generator/models"
+	"log"
+	"time"
+)
+
+// providerStatusRanks orders the statuses a provider reports for a message.
+// Reports can arrive out of order, so one that ranks below the recorded
+// status is ignored. Statuses not listed here are not recorded.
+var providerStatusRanks = map[string]int{
+	"accepted":    0,
+	"scheduled":   0,
+	"queued":      0,
+	"sending":     1,
+	"sent":        2,
+	"delivered":   3,
+	"undelivered": 3,
+	"failed":      3,
+	"read":        4,
+}
+
+// trackMessage remembers which session a provider's message belongs to and
+// records it as queued, replacing the status of any earlier message
+func (s *OTPService) trackMessage(job delivery.Job, messageID string) {
+	data, err := json.Marshal(models.ProviderStatus{
+		MessageID: messageID,
+		Channel:   job.Channel,
+		Status:    "queued",
+		UpdatedAt: time.Now(),
+	})
+	ttl := time.Until(job.ExpiresAt) + s.SessionRetention
+	if err == nil {
+		err = s.Store.Set(s.Context, providerMessageKey(messageID), job.ID, ttl)
+	}
+	if err == nil {
+		err = s.Store.Set(s.Context, providerStatusKey(job.ID), string(data), ttl)
+	}
+	if err != nil {
+		log.Printf("Failed to track message %s of session %s: %v", messageID, job.ID, err)
+	}
+}
+
+// RecordProviderStatus records a provider's report of a message's status
+// against the session it belongs to. Reports about a message that has since
+// been replaced by a resend, reports that arrive after a later status and
+// unknown statuses are ignored.
+// Returns ErrSessionNotFound if the message belongs to no session.
+func (s *OTPService) RecordProviderStatus(messageID, status, errorCode string) error {
+	rank, known := providerStatusRanks[status]
+	if !known {
+		return nil
+	}
+
+	sessionID, err := s.Store.Get(s.Context, providerMessageKey(messageID))
+	if errors.Is(err, ErrNotFound) {
+		return ErrSessionNotFound
+	} else if err != nil {
+		return err
+	}
+	session, err := s.GetSession(sessionID)
+	if err != nil {
+		return err
+	}
+	ttl := time.Until(session.ExpiresAt) + s.SessionRetention
+
+	for {
+		data, err := s.Store.Get(s.Context, providerStatusKey(sessionID))
+		if errors.Is(err, ErrNotFound) {
+			return ErrSessionNotFound
+		} else if err != nil {
+			return err
+		}
+
+		var record models.ProviderStatus
+		if err := json.Unmarshal([]byte(data), &record); err != nil {
+			return err
+		}
+		if record.MessageID != messageID || rank < providerStatusRanks[record.Status] {
+			return nil
+		}
+
+		record.Status, record.ErrorCode, record.UpdatedAt = status, errorCode, time.Now()
+		updated, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+
+		// Only write the report if no other arrived meanwhile; otherwise compare again
+		swapped, err := s.Store.CompareAndSwap(s.Context, providerStatusKey(sessionID), data, string(updated), ttl)
+		if err != nil {
+			return err
+		} else if swapped {
+			return nil
+		}
+	}
+}
+
+// providerStatus returns what the provider last reported for a session's
+// latest message, or nil if its channel does not report delivery
+func (s *OTPService) providerStatus(sessionID string) (*models.ProviderStatus, error) {
+	data, err := s.Store.Get(s.Context, providerStatusKey(sessionID))
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var record models.ProviderStatus
+	if err := json.Unmarshal([]byte(data), &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+func providerMessageKey(messageID string) string {
+	return fmt.Sprintf("provider-message:%s", messageID)
+}
+
+func providerStatusKey(sessionID string) string {
+	return fmt.Sprintf("provider-status:%s", sessionID)
+}
@@ -0,0 +1,142 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/RoMalms10/otp-generator/models"
+)
+
+// Limits for the number of recovery codes in a set
+const (
+	MinRecoveryCodes = 1
+	MaxRecoveryCodes = 20
+)
+
+// recoveryCodeFormat is the format of recovery codes, e.g. "7KQ2M-XW9PD"
+var recoveryCodeFormat = models.OTPFormat{Length: 10, Alphabet: models.AlphabetAlphanumeric, GroupSize: 5}
+
+// recoveryConsumeRetries bounds how often consuming a code is retried when
+// another code of the same set is consumed concurrently
+const recoveryConsumeRetries = 5
+
+// GenerateRecoveryCodes creates a set of count one-time recovery codes for the
+// user and returns them. Only their hashes are stored, so they cannot be shown
+// again. sessionID must name a session recently verified for the user, and is
+// used up. A zero count uses RecoveryCodeCount. Unless replace is set, returns
+// ErrRecoveryCodesExist if the user already has a set; replacing invalidates
+// every code of the old set.
+func (s *OTPService) GenerateRecoveryCodes(username, sessionID string, count int, replace bool) ([]string, error) {
+	if count == 0 {
+		count = s.RecoveryCodeCount
+	}
+	if count < MinRecoveryCodes || count > MaxRecoveryCodes {
+		return nil, fmt.Errorf("%w: count must be between %d and %d", ErrInvalidFormat, MinRecoveryCodes, MaxRecoveryCodes)
+	}
+
+	if err := s.useVerifiedSession(sessionID, username); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, count)
+	records := make([]string, count)
+	for i := range codes {
+		code, err := newCode(recoveryCodeFormat)
+		if err != nil {
+			return nil, err
+		}
+		record, err := s.Hasher.Hash(normalizeCode(code))
+		if err != nil {
+			return nil, err
+		}
+		codes[i], records[i] = code, record
+	}
+
+	data, err := json.Marshal(records)
+	if err != nil {
+		return nil, err
+	}
+	if replace {
+		if err := s.Store.Set(s.Context, recoveryKey(username), string(data), 0); err != nil {
+			return nil, err
+		}
+	} else {
+		// Store the set only if the user has none, in one step so concurrent requests cannot both succeed
+		stored, err := s.Store.SetIfAbsent(s.Context, recoveryKey(username), string(data), 0)
+		if err != nil {
+			return nil, err
+		} else if !stored {
+			return nil, ErrRecoveryCodesExist
+		}
+	}
+	s.Store.Delete(s.Context, recoveryAttemptsKey(username))
+
+	return codes, nil
+}
+
+// ValidateRecoveryCode consumes one of the user's recovery codes and returns
+// how many remain. Separators, whitespace and case are ignored. Mismatches
+// count towards the same lockout as OTPs. Returns ErrNotEnrolled if the user
+// has no recovery codes.
+func (s *OTPService) ValidateRecoveryCode(username, code string) (int, error) {
+	if retryAfter, err := s.lockoutRemaining(username); err != nil {
+		return 0, fmt.Errorf("Server error: %v", err)
+	} else if retryAfter > 0 {
+		return 0, &LockedError{RetryAfter: retryAfter}
+	}
+
+	code = normalizeCode(code)
+	for i := 0; i < recoveryConsumeRetries; i++ {
+		data, err := s.Store.Get(s.Context, recoveryKey(username))
+		if err == ErrNotFound {
+			return 0, ErrNotEnrolled
+		} else if err != nil {
+			return 0, fmt.Errorf("Server error: %v", err)
+		}
+
+		var records []string
+		if err := json.Unmarshal([]byte(data), &records); err != nil {
+			return 0, fmt.Errorf("Server error: %v", err)
+		}
+
+		match := -1
+		for j, record := range records {
+			if s.Hasher.Verify(record, code) {
+				match = j
+				break
+			}
+		}
+		if match < 0 {
+			return 0, s.recordFailedFactorAttempt(recoveryAttemptsKey(username), username)
+		}
+
+		remaining := append(records[:match:match], records[match+1:]...)
+		updated, err := json.Marshal(remaining)
+		if err != nil {
+			return 0, fmt.Errorf("Server error: %v", err)
+		}
+
+		// Only remove the code if the set is unchanged; otherwise read it again
+		swapped, err := s.Store.CompareAndSwap(s.Context, recoveryKey(username), data, string(updated), 0)
+		if err != nil {
+			return 0, fmt.Errorf("Server error: %v", err)
+		} else if !swapped {
+			continue
+		}
+
+		// Success clears the attempt counter and the lockout backoff
+		s.Store.Delete(s.Context, recoveryAttemptsKey(username))
+		s.Store.Delete(s.Context, lockoutCountKey(username))
+
+		return len(remaining), nil
+	}
+
+	return 0, ErrOTPAlreadyUsed
+}
+
+func recoveryKey(username string) string {
+	return fmt.Sprintf("recovery:%s", KeyDigest(username))
+}
+
+func recoveryAttemptsKey(username string) string {
+	return fmt.Sprintf("recovery-attempts:%s", KeyDigest(username))
+}
@@ -0,0 +1,89 @@
+package service
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"time"
+)
+
+// incrScript increments a counter and sets its expiry only when it is first
+// created. A TTL of zero keeps the counter, as PEXPIRE 0 would delete it.
+var incrScript = redis.NewScript(`
+local n = redis.call("INCR", KEYS[1])
+if n == 1 and tonumber(ARGV[1]) > 0 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return n
+`)
+
+// compareAndDeleteScript deletes a key only if it still holds the expected value
+var compareAndDeleteScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// compareAndSwapScript replaces a key's value only if it still holds the expected value
+var compareAndSwapScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+if tonumber(ARGV[3]) > 0 then
+	redis.call("SET", KEYS[1], ARGV[2], "PX", ARGV[3])
+else
+	redis.call("SET", KEYS[1], ARGV[2])
+end
+return 1
+`)
+
+// RedisStore implements OTPStore on top of a Redis client
+type RedisStore struct {
+	Client *redis.Client
+}
+
+// NewRedisStore creates a new RedisStore using the specified client
+func NewRedisStore(client *redis.Client) *RedisStore {
+	return &RedisStore{Client: client}
+}
+
+// Set stores value under key with the specified TTL
+func (s *RedisStore) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	return s.Client.Set(ctx, key, value, ttl).Err()
+}
+
+// Get returns the value stored under key, translating redis.Nil into ErrNotFound
+func (s *RedisStore) Get(ctx context.Context, key string) (string, error) {
+	value, err := s.Client.Get(ctx, key).Result()
+	if err == redis.Nil {
+		return "", ErrNotFound
+	}
+	return value, err
+}
+
+// Delete removes key from Redis
+func (s *RedisStore) Delete(ctx context.Context, key string) error {
+	return s.Client.Del(ctx, key).Err()
+}
+
+// CompareAndDelete deletes key if it still holds value, in a single script so concurrent callers cannot both succeed
+func (s *RedisStore) CompareAndDelete(ctx context.Context, key, value string) (bool, error) {
+	n, err := compareAndDeleteScript.Run(ctx, s.Client, []string{key}, value).Int64()
+	return n == 1, err
+}
+
+// SetIfAbsent stores value under key if key does not exist, using SET NX
+func (s *RedisStore) SetIfAbsent(ctx context.Context, key, value string, ttl time.Duration) (bool, error) {
+	return s.Client.SetNX(ctx, key, value, ttl).Result()
+}
+
+// CompareAndSwap replaces the value of key if it still holds old, in a single script so concurrent callers cannot both succeed
+func (s *RedisStore) CompareAndSwap(ctx context.Context, key, old, value string, ttl time.Duration) (bool, error) {
+	n, err := compareAndSwapScript.Run(ctx, s.Client, []string{key}, old, value, ttl.Milliseconds()).Int64()
+	return n == 1, err
+}
+
+// Incr increments the counter under key, setting the TTL when the counter is created
+func (s *RedisStore) Incr(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	return incrScript.Run(ctx, s.Client, []string{key}, ttl.Milliseconds()).Int64()
+}
@@ -0,0 +1,180 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/RoMalms10/otp-generator/models"
+	"strconv"
+	"time"
+)
+
+// maxPurposeLength bounds the purpose a client may name for a session
+const maxPurposeLength = 64
+
+// verifiedSessionMaxAge is how recently a session must have been verified to
+// authorize issuing or replacing one of the user's factors
+const verifiedSessionMaxAge = 10 * time.Minute
+
+// GetSession returns the verification session with the given ID, or ErrSessionNotFound
+func (s *OTPService) GetSession(sessionID string) (*models.Session, error) {
+	if sessionID == "" {
+		return nil, ErrSessionNotFound
+	}
+
+	data, err := s.Store.Get(s.Context, sessionKey(sessionID))
+	if err == ErrNotFound {
+		return nil, ErrSessionNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	var session models.Session
+	if err := json.Unmarshal([]byte(data), &session); err != nil {
+		return nil, err
+	}
+
+	if session.Status == models.SessionStatusPending {
+		// Pending sessions count attempts in a separate counter
+		if value, err := s.Store.Get(s.Context, attemptsKey(sessionID)); err == nil {
+			session.Attempts, _ = strconv.Atoi(value)
+		}
+		if time.Now().After(session.ExpiresAt) {
+			session.Status = models.SessionStatusExpired
+		}
+	}
+	return &session, nil
+}
+
+// FindSession returns the ID of the user's most recent session for the purpose,
+// for clients that identify sessions by username
+func (s *OTPService) FindSession(username, purpose string) (string, error) {
+	if username == "" {
+		return "", ErrSessionNotFound
+	}
+	if purpose == "" {
+		purpose = models.DefaultPurpose
+	}
+
+	sessionID, err := s.Store.Get(s.Context, latestSessionKey(username, purpose))
+	if err == ErrNotFound {
+		return "", ErrSessionNotFound
+	}
+	return sessionID, err
+}
+
+// saveSession stores the session until SessionRetention after it expires
+func (s *OTPService) saveSession(session *models.Session) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	ttl := time.Until(session.ExpiresAt) + s.SessionRetention
+	return s.Store.Set(s.Context, sessionKey(session.ID), string(data), ttl)
+}
+
+// useVerifiedSession checks that the session was verified for username within
+// verifiedSessionMaxAge and uses it up, so that each verification authorizes
+// one change to the user's factors. Returns ErrVerificationRequired otherwise.
+func (s *OTPService) useVerifiedSession(sessionID, username string) error {
+	session, err := s.GetSession(sessionID)
+	if err == ErrSessionNotFound {
+		return ErrVerificationRequired
+	} else if err != nil {
+		return err
+	}
+	if session.Status != models.SessionStatusVerified || session.Username != username ||
+		session.VerifiedAt == nil || time.Since(*session.VerifiedAt) > verifiedSessionMaxAge {
+		return ErrVerificationRequired
+	}
+
+	// Only the first use of the session succeeds
+	used, err := s.Store.SetIfAbsent(s.Context, sessionUsedKey(sessionID), "1", verifiedSessionMaxAge)
+	if err != nil {
+		return err
+	} else if !used {
+		return fmt.Errorf("%w: the session was already used", ErrVerificationRequired)
+	}
+	return nil
+}
+
+// supersedeSession ends the user's previous pending session for the purpose, if any
+func (s *OTPService) supersedeSession(username, purpose string) error {
+	sessionID, err := s.FindSession(username, purpose)
+	if err == ErrSessionNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	session, err := s.GetSession(sessionID)
+	if err == ErrSessionNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if session.Status != models.SessionStatusPending {
+		return nil
+	}
+
+	if err := s.Store.Delete(s.Context, otpKey(sessionID)); err != nil {
+		return err
+	}
+	session.Status = models.SessionStatusSuperseded
+	return s.saveSession(session)
+}
+
+// newSessionID returns a random, URL-safe session ID
+func newSessionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// KeyDigest returns a short SHA-256 digest of the parts, so that usernames and
+// destinations never appear in store keys
+func KeyDigest(parts ...string) string {
+	h := sha256.New()
+	for _, part := range parts {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+func sessionKey(sessionID string) string {
+	return fmt.Sprintf("session:%s", sessionID)
+}
+
+func otpKey(sessionID string) string {
+	return fmt.Sprintf("otp:%s", sessionID)
+}
+
+func attemptsKey(sessionID string) string {
+	return fmt.Sprintf("attempts:%s", sessionID)
+}
+
+func consumedKey(sessionID string) string {
+	return fmt.Sprintf("consumed:%s", sessionID)
+}
+
+func sessionUsedKey(sessionID string) string {
+	return fmt.Sprintf("session-used:%s", sessionID)
+}
+
+func latestSessionKey(username, purpose string) string {
+	return fmt.Sprintf("latest:%s", KeyDigest(username, purpose))
+}
+
+func lockoutKey(username string) string {
+	return fmt.Sprintf("lockout:%s", KeyDigest(username))
+}
+
+func lockoutCountKey(username string) string {
+	return fmt.Sprintf("lockouts:%s", KeyDigest(username))
+}
@@ -0,0 +1,58 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+// ErrNotFound is returned by an OTPStore when a key does not exist or has expired
+var ErrNotFound = errors.New("key not found")
+
+// OTPStore is the storage backend used by OTPService. Implementations must be
+// safe for concurrent use and must honour the TTL passed to Set and Incr.
+type OTPStore interface {
+	// Set stores value under key, replacing any existing value, and expires it after ttl
+	Set(ctx context.Context, key, value string, ttl time.Duration) error
+	// Get returns the value stored under key, or ErrNotFound
+	Get(ctx context.Context, key string) (string, error)
+	// Delete removes key. Deleting a missing key is not an error
+	Delete(ctx context.Context, key string) error
+	// CompareAndDelete atomically deletes key only if it still holds value and
+	// reports whether it was deleted
+	CompareAndDelete(ctx context.Context, key, value string) (bool, error)
+	// SetIfAbsent atomically stores value under key only if key does not exist,
+	// expiring it after ttl, and reports whether it was stored
+	SetIfAbsent(ctx context.Context, key, value string, ttl time.Duration) (bool, error)
+	// CompareAndSwap atomically replaces the value of key with value only if it
+	// still holds old, expiring it after ttl, and reports whether it was replaced
+	CompareAndSwap(ctx context.Context, key, old, value string, ttl time.Duration) (bool, error)
+	// Incr atomically increments the counter stored under key and returns the new value.
+	// The ttl is applied only when the counter is created.
+	Incr(ctx context.Context, key string, ttl time.Duration) (int64, error)
+}
+
+// Sweeper is implemented by stores that keep expired entries until they are
+// read again, such as MemoryStore and FileStore
+type Sweeper interface {
+	// Sweep removes every expired entry and returns how many were removed
+	Sweep() (int, error)
+}
+
+// SweepExpired sweeps the store every interval until ctx is done
+func SweepExpired(ctx context.Context, store Sweeper, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := store.Sweep(); err != nil {
+				log.Printf("Warning: failed to remove expired store entries: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"github.com/RoMalms10/otp-generator/models"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limits for TOTP enrollments
+const (
+	MinTOTPDigits = 6
+	MaxTOTPDigits = 8
+	MinTOTPPeriod = 15 * time.Second
+	MaxTOTPPeriod = 5 * time.Minute
+)
+
+// totpPendingTTL is how long a new enrollment waits for its first code
+const totpPendingTTL = 10 * time.Minute
+
+// EnrollTOTP creates a new authenticator secret for the user and returns the
+// enrollment with its otpauth:// URI. Zero fields in the request fall back to
+// the configured defaults. The request's session must have been verified for
+// the user recently, and is used up. The new secret is pending until
+// ConfirmTOTP accepts a code from it, and then replaces any previous secret.
+func (s *OTPService) EnrollTOTP(req models.TOTPEnrollRequest) (*models.TOTPEnrollment, string, error) {
+	enrollment := &models.TOTPEnrollment{
+		Algorithm: strings.ToUpper(req.Algorithm),
+		Digits:    req.Digits,
+		Period:    req.Period,
+		CreatedAt: time.Now(),
+	}
+	if enrollment.Algorithm == "" {
+		enrollment.Algorithm = strings.ToUpper(s.TOTPAlgorithm)
+	}
+	if enrollment.Digits == 0 {
+		enrollment.Digits = s.TOTPDigits
+	}
+	if enrollment.Period == 0 {
+		enrollment.Period = int(s.TOTPPeriod / time.Second)
+	}
+
+	algorithm, ok := hashAlgorithms[enrollment.Algorithm]
+	if !ok {
+		return nil, "", fmt.Errorf("%w: unsupported TOTP algorithm %q", ErrInvalidFormat, enrollment.Algorithm)
+	}
+	if enrollment.Digits < MinTOTPDigits || enrollment.Digits > MaxTOTPDigits {
+		return nil, "", fmt.Errorf("%w: digits must be between %d and %d", ErrInvalidFormat, MinTOTPDigits, MaxTOTPDigits)
+	}
+	period := time.Duration(enrollment.Period) * time.Second
+	if period < MinTOTPPeriod || period > MaxTOTPPeriod {
+		return nil, "", fmt.Errorf("%w: period must be between %d and %d seconds",
+			ErrInvalidFormat, int(MinTOTPPeriod/time.Second), int(MaxTOTPPeriod/time.Second))
+	}
+
+	if err := s.useVerifiedSession(req.SessionID, req.Username); err != nil {
+		return nil, "", err
+	}
+
+	secret := make([]byte, algorithm.secretSize)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return nil, "", err
+	}
+	enrollment.Secret = base32NoPadding.EncodeToString(secret)
+
+	// The secret is stored sealed, since it must be recovered to check codes
+	stored := *enrollment
+	if stored.Secret, err = s.Hasher.Seal(enrollment.Secret); err != nil {
+		return nil, "", err
+	}
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := s.Store.Set(s.Context, totpPendingKey(req.Username), string(data), totpPendingTTL); err != nil {
+		return nil, "", err
+	}
+
+	return enrollment, s.totpURI(req.Username, enrollment), nil
+}
+
+// GetTOTPEnrollment returns the user's confirmed authenticator enrollment.
+// Returns ErrNotEnrolled if the user has not enrolled.
+func (s *OTPService) GetTOTPEnrollment(username string) (*models.TOTPEnrollment, error) {
+	data, err := s.Store.Get(s.Context, totpKey(username))
+	if err == ErrNotFound {
+		return nil, ErrNotEnrolled
+	} else if err != nil {
+		return nil, err
+	}
+	return s.openTOTPEnrollment(data)
+}
+
+// ConfirmTOTP activates the user's pending enrollment once a code from it is
+// submitted, replacing any previous secret. The confirming time step counts
+// as used. Mismatches count towards the same lockout as OTPs. Returns
+// ErrNotEnrolled if no enrollment is pending.
+func (s *OTPService) ConfirmTOTP(username, code string) error {
+	data, err := s.Store.Get(s.Context, totpPendingKey(username))
+	if err == ErrNotFound {
+		return fmt.Errorf("%w: no enrollment is pending", ErrNotEnrolled)
+	} else if err != nil {
+		return fmt.Errorf("Server error: %v", err)
+	}
+	enrollment, err := s.openTOTPEnrollment(data)
+	if err != nil {
+		return fmt.Errorf("Server error: %v", err)
+	}
+
+	if retryAfter, err := s.lockoutRemaining(username); err != nil {
+		return fmt.Errorf("Server error: %v", err)
+	} else if retryAfter > 0 {
+		return &LockedError{RetryAfter: retryAfter}
+	}
+
+	step, err := s.matchTOTPStep(enrollment, code)
+	if err != nil {
+		return fmt.Errorf("Server error: %v", err)
+	} else if step < 0 {
+		return s.recordFailedFactorAttempt(totpAttemptsKey(username), username)
+	}
+
+	// Only one of several concurrent confirmations activates the enrollment
+	confirmed, err := s.Store.CompareAndDelete(s.Context, totpPendingKey(username), data)
+	if err != nil {
+		return fmt.Errorf("Server error: %v", err)
+	} else if !confirmed {
+		return ErrOTPAlreadyUsed
+	}
+
+	// A new secret starts a new sequence of time steps, from the confirming one
+	if err := s.Store.Set(s.Context, totpStepKey(username), strconv.FormatInt(step, 10), 0); err != nil {
+		return fmt.Errorf("Server error: %v", err)
+	}
+	if err := s.Store.Set(s.Context, totpKey(username), data, 0); err != nil {
+		return fmt.Errorf("Server error: %v", err)
+	}
+
+	// Success clears the attempt counter and the lockout backoff
+	s.Store.Delete(s.Context, totpAttemptsKey(username))
+	s.Store.Delete(s.Context, lockoutCountKey(username))
+
+	return nil
+}
+
+// VerifyTOTP checks an authenticator code for the user. Codes from up to
+// TOTPSkew time steps either side of the current one are accepted to allow
+// for clock drift. A time step can only be used once, and never one at or
+// before the last step used. Mismatches count towards the same lockout as OTPs.
+func (s *OTPService) VerifyTOTP(username, code string) error {
+	enrollment, err := s.GetTOTPEnrollment(username)
+	if err != nil {
+		return err
+	}
+
+	if retryAfter, err := s.lockoutRemaining(username); err != nil {
+		return fmt.Errorf("Server error: %v", err)
+	} else if retryAfter > 0 {
+		return &LockedError{RetryAfter: retryAfter}
+	}
+
+	step, err := s.matchTOTPStep(enrollment, code)
+	if err != nil {
+		return fmt.Errorf("Server error: %v", err)
+	} else if step < 0 {
+		return s.recordFailedFactorAttempt(totpAttemptsKey(username), username)
+	}
+
+	// Move the last used step forward only if no other verification moved it since it was read
+	for {
+		value, err := s.Store.Get(s.Context, totpStepKey(username))
+		if err != nil {
+			return fmt.Errorf("Server error: %v", err)
+		}
+		lastStep, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("Server error: %v", err)
+		}
+		if step <= lastStep {
+			return ErrOTPAlreadyUsed
+		}
+
+		swapped, err := s.Store.CompareAndSwap(s.Context, totpStepKey(username), value, strconv.FormatInt(step, 10), 0)
+		if err != nil {
+			return fmt.Errorf("Server error: %v", err)
+		} else if swapped {
+			break
+		}
+	}
+
+	// Success clears the attempt counter and the lockout backoff
+	s.Store.Delete(s.Context, totpAttemptsKey(username))
+	s.Store.Delete(s.Context, lockoutCountKey(username))
+
+	return nil
+}
+
+// matchTOTPStep returns the time step within TOTPSkew of the current one whose
+// code is code, or -1. It looks for the newest matching step, so an old step
+// cannot shadow a fresh one.
+func (s *OTPService) matchTOTPStep(enrollment *models.TOTPEnrollment, code string) (int64, error) {
+	code = normalizeCode(code)
+	current := time.Now().Unix() / int64(enrollment.Period)
+	for i := current + int64(s.TOTPSkew); i >= current-int64(s.TOTPSkew) && i >= 0; i-- {
+		expected, err := totpCodeAt(enrollment, i)
+		if err != nil {
+			return -1, err
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return i, nil
+		}
+	}
+	return -1, nil
+}
+
+// openTOTPEnrollment decodes a stored enrollment and opens its sealed secret
+func (s *OTPService) openTOTPEnrollment(data string) (*models.TOTPEnrollment, error) {
+	var enrollment models.TOTPEnrollment
+	if err := json.Unmarshal([]byte(data), &enrollment); err != nil {
+		return nil, err
+	}
+	secret, err := s.Hasher.Open(enrollment.Secret)
+	if err != nil {
+		return nil, err
+	}
+	enrollment.Secret = secret
+	return &enrollment, nil
+}
+
+// TOTPCode returns the code of an enrollment for the time step containing t
+func TOTPCode(enrollment models.TOTPEnrollment, t time.Time) (string, error) {
+	if enrollment.Period <= 0 {
+		return "", fmt.Errorf("%w: period must be positive", ErrInvalidFormat)
+	}
+	return totpCodeAt(&enrollment, t.Unix()/int64(enrollment.Period))
+}
+
+// totpCodeAt returns the code of an enrollment for a time step
+func totpCodeAt(enrollment *models.TOTPEnrollment, step int64) (string, error) {
+	algorithm, ok := hashAlgorithms[enrollment.Algorithm]
+	if !ok {
+		return "", fmt.Errorf("%w: unsupported TOTP algorithm %q", ErrInvalidFormat, enrollment.Algorithm)
+	}
+	key, err := decodeSecret(enrollment.Secret)
+	if err != nil {
+		return "", err
+	}
+	return hotpCode(algorithm.hash, key, uint64(step), enrollment.Digits), nil
+}
+
+// totpURI returns the otpauth:// URI that authenticator apps import
+func (s *OTPService) totpURI(username string, enrollment *models.TOTPEnrollment) string {
+	query := url.Values{}
+	query.Set("secret", enrollment.Secret)
+	query.Set("issuer", s.TOTPIssuer)
+	query.Set("algorithm", enrollment.Algorithm)
+	query.Set("digits", strconv.Itoa(enrollment.Digits))
+	query.Set("period", strconv.Itoa(enrollment.Period))
+
+	uri := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + s.TOTPIssuer + ":" + username,
+		RawQuery: query.Encode(),
+	}
+	return uri.String()
+}
+
+func totpKey(username string) string {
+	return fmt.Sprintf("totp:%s", KeyDigest(username))
+}
+
+func totpPendingKey(username string) string {
+	return fmt.Sprintf("totp-pending:%s", KeyDigest(username))
+}
+
+func totpStepKey(username string) string {
+	return fmt.Sprintf("totp-step:%s", KeyDigest(username))
+}
+
+func totpAttemptsKey(username string) string {
+	return fmt.Sprintf("totp-attempts:%s", KeyDigest(username))
+}
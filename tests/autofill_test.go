@@ -0,0 +1,128 @@
+package tests
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RoMalms10/otp-generator/config"
+	"github.com/RoMalms10/otp-generator/messaging"
+	"github.com/RoMalms10/otp-generator/models"
+	"github.com/RoMalms10/otp-generator/server"
+	"github.com/RoMalms10/otp-generator/service"
+	"github.com/gorilla/mux"
+)
+
+// setupAutoFillServer creates a router with Android and web auto-fill
+// profiles, rendering messages from the templates in dir
+func setupAutoFillServer(t *testing.T, dir string) *mux.Router {
+	defer func(profiles []string, dir string) {
+		config.AutoFillProfiles, config.TemplateDir = profiles, dir
+	}(config.AutoFillProfiles, config.TemplateDir)
+	config.AutoFillProfiles = []string{"android:sms_retriever:FA+9qCX9VSu", "web:webotp:Example.com", "broken:webotp:not a domain"}
+	config.TemplateDir = dir
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	senders := newTestSenders()
+	senders.Register(models.MessageTypeSMS, testSink.Sender(models.MessageTypeSMS))
+	return server.NewRouter(service.NewMemoryStore(), ctx, 10*time.Minute, senders)
+}
+
+func TestSMSAutoFill(t *testing.T) {
+	t.Run("SMS Retriever", func(t *testing.T) {
+		r := setupAutoFillServer(t, "")
+
+		rec := postJSON(r, "/otp/generate", models.GenerateRequest{Username: "+14155550141", MessageType: "sms", AutoFill: "android"})
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		msg := lastMessage("+14155550141")
+		assert.True(t, strings.HasSuffix(msg.Text, "\n\nFA+9qCX9VSu"), "Expected the message to end with the app hash")
+		assert.Contains(t, msg.Text, msg.OTP)
+		assert.LessOrEqual(t, messaging.SMSSize(msg.Text), messaging.MaxSMSBytes)
+	})
+
+	t.Run("WebOTP", func(t *testing.T) {
+		r := setupAutoFillServer(t, "")
+
+		rec := postJSON(r, "/otp/generate", models.GenerateRequest{
+			Username: "+14155550142", MessageType: "sms", AutoFill: "web",
+			Format: &models.OTPFormat{Length: 8, Alphabet: "alphanumeric", GroupSize: 4},
+		})
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		msg := lastMessage("+14155550142")
+		lines := strings.Split(msg.Text, "\n")
+		assert.Equal(t, "@example.com #"+msg.OTP, lines[len(lines)-1])
+	})
+
+	t.Run("Other Channels Are Unchanged", func(t *testing.T) {
+		r := setupAutoFillServer(t, "")
+
+		rec := postJSON(r, "/otp/generate", models.GenerateRequest{Username: "autofill@example.com", MessageType: "email", AutoFill: "web"})
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.NotContains(t, lastMessage("autofill@example.com").Text, "@example.com #")
+	})
+
+	t.Run("Unknown Profile", func(t *testing.T) {
+		r := setupAutoFillServer(t, "")
+
+		for _, profile := range []string{"ios", "broken"} {
+			rec := postJSON(r, "/otp/generate", models.GenerateRequest{Username: "+14155550143", MessageType: "sms", AutoFill: profile})
+			assert.Equal(t, http.StatusBadRequest, rec.Code, profile)
+			assert.Contains(t, rec.Body.String(), `"code":"invalid_format"`)
+		}
+	})
+
+	t.Run("Rejects Templates That Do Not Fit", func(t *testing.T) {
+		dir := writeTemplates(t, map[string]string{
+			"en/sms.txt":       "Your code is {{.Code}}. " + strings.Repeat("Never share it with anyone. ", 6),
+			"ru/sms.txt":       "Ваш код подтверждения {{.AppName}}: {{.Code}}. Никому его не сообщайте.",
+			"fr/sms.txt":       "Bienvenue !",
+			"de/sms.login.txt": "Ihr Code lautet {{.Code}}",
+		})
+		r := setupAutoFillServer(t, dir)
+
+		for _, req := range []models.GenerateRequest{
+			{Username: "+14155550144", MessageType: "sms", AutoFill: "android"},                                  // Too long in GSM-7
+			{Username: "+14155550144", MessageType: "sms", AutoFill: "android", Locale: "ru"},                    // Too long in UCS-2
+			{Username: "+14155550144", MessageType: "sms", AutoFill: "android", Locale: "fr"},                    // No code
+			{Username: "autofill@example.com", MessageType: "email", Fallback: []string{"sms"}, AutoFill: "web"}, // Checked for the fallback
+		} {
+			rec := postJSON(r, "/otp/generate", req)
+			assert.Equal(t, http.StatusBadRequest, rec.Code, req.Locale)
+			assert.Contains(t, rec.Body.String(), `"code":"invalid_format"`)
+		}
+
+		// The same templates are fine without auto-fill, and a short one fits
+		rec := postJSON(r, "/otp/generate", models.GenerateRequest{Username: "+14155550145", MessageType: "sms", Locale: "ru"})
+		assert.Equal(t, http.StatusOK, rec.Code)
+		rec = postJSON(r, "/otp/generate", models.GenerateRequest{
+			Username: "+14155550145", MessageType: "sms", Locale: "de", Purpose: "login", AutoFill: "android",
+		})
+		assert.Equal(t, http.StatusOK, rec.Code)
+	})
+}
+
+func TestParseAutoFillProfile(t *testing.T) {
+	profile, err := messaging.ParseAutoFillProfile("web:webotp:Login.Example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, messaging.AutoFillProfile{Name: "web", Kind: messaging.AutoFillWebOTP, Value: "login.example.com"}, profile)
+
+	for _, entry := range []string{
+		"android:sms_retriever:short",
+		"web:webotp:https://example.com",
+		"web:push:example.com",
+		"android",
+	} {
+		_, err := messaging.ParseAutoFillProfile(entry)
+		assert.Error(t, err, entry)
+	}
+
+	_, err = profile.Format("Your code is 123456", "654321")
+	assert.ErrorIs(t, err, messaging.ErrInvalidSMS)
+}
@@ -0,0 +1,94 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/RoMalms10/otp-generator/config"
+	"github.com/RoMalms10/otp-generator/models"
+	"github.com/gorilla/mux"
+)
+
+// generateTestOTP requests a new OTP for the user and returns the code captured by testSink
+func generateTestOTP(t *testing.T, r *mux.Router, username string) string {
+	body, _ := json.Marshal(models.GenerateRequest{Username: username, MessageType: "email"})
+	req, _ := http.NewRequest("POST", "/otp/generate", bytes.NewBuffer(body))
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code, "Expected status 200 generating OTP")
+
+	return lastSentOTP(username)
+}
+
+// validateTestOTP submits an OTP for the user and returns the recorded response
+func validateTestOTP(r *mux.Router, username, otp string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(models.ValidationRequest{Username: username, OTP: otp})
+	req, _ := http.NewRequest("POST", "/otp/validate", bytes.NewBuffer(body))
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	return rec
+}
+
+// wrongOTP returns a code of the same length that differs from otp
+func wrongOTP(otp string) string {
+	if otp == "000000" {
+		return "111111"
+	}
+	return "000000"
+}
+
+func TestBruteForceProtection(t *testing.T) {
+	lockoutBase := config.LockoutBase
+	config.LockoutBase = time.Second
+	defer func() { config.LockoutBase = lockoutBase }()
+
+	r, _, _ := setupTestServerWithTTL(time.Minute)
+
+	t.Run("Attempts Exhausted Burns OTP", func(t *testing.T) {
+		otp := generateTestOTP(t, r, "bruteforce@example.com")
+
+		for i := 1; i < config.MaxOTPAttempts; i++ {
+			rec := validateTestOTP(r, "bruteforce@example.com", wrongOTP(otp))
+			assert.Equal(t, http.StatusUnauthorized, rec.Code, "Expected status 401 for incorrect OTP")
+			assert.Contains(t, rec.Body.String(), `"code":"otp_mismatch"`)
+		}
+
+		rec := validateTestOTP(r, "bruteforce@example.com", wrongOTP(otp))
+		assert.Equal(t, http.StatusTooManyRequests, rec.Code, "Expected status 429 once attempts are exhausted")
+		assert.Contains(t, rec.Body.String(), `"code":"otp_attempts_exceeded"`)
+		assert.Equal(t, "1", rec.Header().Get("Retry-After"))
+
+		rec = validateTestOTP(r, "bruteforce@example.com", otp)
+		assert.Equal(t, http.StatusTooManyRequests, rec.Code, "Expected correct OTP to be rejected while locked")
+		assert.Contains(t, rec.Body.String(), `"code":"otp_locked"`)
+	})
+
+	t.Run("Lockout Expires And Backs Off", func(t *testing.T) {
+		time.Sleep(1100 * time.Millisecond)
+
+		// A fresh OTP can be attempted again once the lockout ends
+		otp := generateTestOTP(t, r, "bruteforce@example.com")
+		for i := 1; i < config.MaxOTPAttempts; i++ {
+			validateTestOTP(r, "bruteforce@example.com", wrongOTP(otp))
+		}
+
+		rec := validateTestOTP(r, "bruteforce@example.com", wrongOTP(otp))
+		assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+		assert.Equal(t, "2", rec.Header().Get("Retry-After"), "Expected second lockout to double")
+	})
+
+	t.Run("Success Resets Attempts", func(t *testing.T) {
+		otp := generateTestOTP(t, r, "resetuser@example.com")
+		for i := 1; i < config.MaxOTPAttempts; i++ {
+			validateTestOTP(r, "resetuser@example.com", wrongOTP(otp))
+		}
+
+		rec := validateTestOTP(r, "resetuser@example.com", otp)
+		assert.Equal(t, http.StatusOK, rec.Code, "Expected status 200 for correct OTP within the limit")
+	})
+}
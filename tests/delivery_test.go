@@ -0,0 +1,456 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/RoMalms10/otp-generator/config"
+	"github.com/RoMalms10/otp-generator/delivery"
+	"github.com/RoMalms10/otp-generator/messaging"
+	"github.com/RoMalms10/otp-generator/models"
+	"github.com/RoMalms10/otp-generator/server"
+	"github.com/RoMalms10/otp-generator/service"
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+)
+
+// flakySender fails its first failures sends to each recipient, then delivers to testSink
+type flakySender struct {
+	mu       sync.Mutex
+	failures int
+	attempts map[string]int
+}
+
+func (f *flakySender) SendOTP(to, otp string) error {
+	f.mu.Lock()
+	f.attempts[to]++
+	attempt := f.attempts[to]
+	f.mu.Unlock()
+
+	if attempt <= f.failures {
+		return errors.New("provider timed out")
+	}
+	return testSink.Sender(models.MessageTypeEmail).SendOTP(to, otp)
+}
+
+// setupQueuedServer creates a router that queues email for a flaky sender, retrying quickly
+func setupQueuedServer(t *testing.T, failures, maxAttempts int) *mux.Router {
+	defer func(queue string, attempts int, base time.Duration) {
+		config.DeliveryQueue, config.DeliveryMaxAttempts, config.DeliveryBackoffBase = queue, attempts, base
+	}(config.DeliveryQueue, config.DeliveryMaxAttempts, config.DeliveryBackoffBase)
+	config.DeliveryQueue = config.DeliveryQueueMemory
+	config.DeliveryMaxAttempts = maxAttempts
+	config.DeliveryBackoffBase = 10 * time.Millisecond
+
+	senders := messaging.NewRegistry()
+	senders.Register(models.MessageTypeEmail, &flakySender{failures: failures, attempts: make(map[string]int)})
+	return newQueuedRouter(t, senders)
+}
+
+// newQueuedRouter creates a router whose service delivers from a started
+// delivery queue, which is closed when the test ends
+func newQueuedRouter(t *testing.T, senders *messaging.Registry) *mux.Router {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	otpService := service.NewOTPService(service.NewMemoryStore(), ctx, time.Minute, senders)
+	otpService.StartDelivery()
+	t.Cleanup(otpService.Close)
+	return server.NewServiceRouter(otpService)
+}
+
+// waitForDelivery polls a session's delivery status until it is final
+func waitForDelivery(t *testing.T, r *mux.Router, sessionID string) models.DeliveryStatus {
+	var status models.DeliveryStatus
+	assert.Eventually(t, func() bool {
+		req, _ := http.NewRequest("GET", "/otp/sessions/"+sessionID+"/delivery", nil)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			return false
+		}
+		_ = json.Unmarshal(rec.Body.Bytes(), &status)
+		return status.Status == delivery.StatusDelivered || status.Status == delivery.StatusFailed
+	}, 2*time.Second, 10*time.Millisecond)
+	return status
+}
+
+func TestDeliveryQueue(t *testing.T) {
+	t.Run("Retries Until Delivered", func(t *testing.T) {
+		r := setupQueuedServer(t, 2, 5)
+
+		rec := postJSON(r, "/otp/generate", models.GenerateRequest{Username: "queued@example.com", MessageType: "email"})
+		assert.Equal(t, http.StatusOK, rec.Code)
+		var resp map[string]string
+		_ = json.Unmarshal(rec.Body.Bytes(), &resp)
+		assert.Equal(t, delivery.StatusQueued, resp["delivery"], "Expected the request not to wait for delivery")
+
+		status := waitForDelivery(t, r, resp["sessionId"])
+		assert.Equal(t, delivery.StatusDelivered, status.Status)
+		assert.Equal(t, 3, status.Attempts)
+
+		rec = validateSession(r, resp["sessionId"], lastSentOTP("queued@example.com"))
+		assert.Equal(t, http.StatusOK, rec.Code, "Expected the delivered code to validate")
+	})
+
+	t.Run("Fails After Max Attempts", func(t *testing.T) {
+		r := setupQueuedServer(t, 10, 3)
+
+		rec := postJSON(r, "/otp/generate", models.GenerateRequest{Username: "undeliverable@example.com", MessageType: "email"})
+		assert.Equal(t, http.StatusOK, rec.Code)
+		var resp map[string]string
+		_ = json.Unmarshal(rec.Body.Bytes(), &resp)
+
+		status := waitForDelivery(t, r, resp["sessionId"])
+		assert.Equal(t, delivery.StatusFailed, status.Status)
+		assert.Equal(t, 3, status.Attempts)
+		assert.Contains(t, status.Error, "provider timed out")
+	})
+
+	t.Run("Unknown Session", func(t *testing.T) {
+		r := setupQueuedServer(t, 0, 1)
+
+		req, _ := http.NewRequest("GET", "/otp/sessions/does-not-exist/delivery", nil)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	})
+}
+
+func TestDeadLettersEndpoint(t *testing.T) {
+	defer func(token string) { config.MetricsToken = token }(config.MetricsToken)
+	config.MetricsToken = testMetricsToken
+	r := setupQueuedServer(t, 10, 2)
+
+	get := func(target, authorization string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", target, nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := postJSON(r, "/otp/generate", models.GenerateRequest{Username: "dead-letter@example.com", MessageType: "email"})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var resp map[string]string
+	_ = json.Unmarshal(rec.Body.Bytes(), &resp)
+	assert.Equal(t, delivery.StatusFailed, waitForDelivery(t, r, resp["sessionId"]).Status)
+
+	rec = get("/delivery/dead-letters", "Bearer "+testMetricsToken)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var body struct {
+		DeadLetters []delivery.DeadLetter `json:"deadLetters"`
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	if assert.Len(t, body.DeadLetters, 1) {
+		assert.Equal(t, models.MessageTypeEmail, body.DeadLetters[0].Channel)
+		assert.Equal(t, 2, body.DeadLetters[0].Attempts)
+		assert.Contains(t, body.DeadLetters[0].Error, "provider timed out")
+	}
+	assert.NotContains(t, rec.Body.String(), "dead-letter@example.com", "Expected no recipient in dead letters")
+
+	assert.Equal(t, http.StatusUnauthorized, get("/delivery/dead-letters", "").Code)
+	assert.Equal(t, http.StatusBadRequest, get("/delivery/dead-letters?limit=0", "Bearer "+testMetricsToken).Code)
+}
+
+func TestQueueBackoffAndDeadLetters(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mu sync.Mutex
+	var attemptTimes []time.Time
+	statuses := make(chan string, 10)
+
+	backend := delivery.NewMemoryBackend()
+	send := func(job delivery.Job) error {
+		mu.Lock()
+		attemptTimes = append(attemptTimes, time.Now())
+		mu.Unlock()
+		return errors.New("provider down")
+	}
+	onStatus := func(job delivery.Job, status string, err error) { statuses <- status }
+	queue := delivery.NewQueue(backend, send, onStatus, 2, 3, 20*time.Millisecond, time.Second, 0)
+	queue.Start(ctx)
+
+	assert.NoError(t, queue.Enqueue(ctx, delivery.Job{ID: "job-1", Channel: "sms", To: "+14155550100", Payload: "sealed"}))
+	for _, expected := range []string{delivery.StatusQueued, delivery.StatusRetrying, delivery.StatusRetrying, delivery.StatusFailed} {
+		select {
+		case status := <-statuses:
+			assert.Equal(t, expected, status)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Timed out waiting for status %s", expected)
+		}
+	}
+
+	mu.Lock()
+	assert.Len(t, attemptTimes, 3)
+	// The delay doubles: 20ms before the second attempt, 40ms before the third
+	assert.GreaterOrEqual(t, attemptTimes[1].Sub(attemptTimes[0]), 20*time.Millisecond)
+	assert.GreaterOrEqual(t, attemptTimes[2].Sub(attemptTimes[1]), 40*time.Millisecond)
+	mu.Unlock()
+
+	letters, err := backend.DeadLetters(ctx, 10)
+	assert.NoError(t, err)
+	assert.Len(t, letters, 1)
+	assert.Equal(t, "job-1", letters[0].ID)
+	assert.Equal(t, 3, letters[0].Attempts)
+	assert.Equal(t, "provider down", letters[0].Error)
+
+	// Expired jobs are discarded without an attempt
+	assert.NoError(t, queue.Enqueue(ctx, delivery.Job{ID: "job-2", ExpiresAt: time.Now().Add(-time.Second)}))
+	assert.Equal(t, delivery.StatusQueued, <-statuses)
+	assert.Equal(t, delivery.StatusDiscarded, <-statuses)
+}
+
+func TestQueueFallbackAttempts(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mu sync.Mutex
+	var channels []string
+	failed := make(chan delivery.Job, 1)
+
+	backend := delivery.NewMemoryBackend()
+	send := func(job delivery.Job) error {
+		mu.Lock()
+		channels = append(channels, job.Channel)
+		mu.Unlock()
+		return errors.New("provider down")
+	}
+	onStatus := func(job delivery.Job, status string, err error) {
+		if status == delivery.StatusFailed {
+			failed <- job
+		}
+	}
+	queue := delivery.NewQueue(backend, send, onStatus, 1, 2, time.Millisecond, time.Millisecond, 0)
+	queue.Start(ctx)
+
+	assert.NoError(t, queue.Enqueue(ctx, delivery.Job{ID: "job-1", Channel: "whatsapp", To: "+14155550100", Fallback: []delivery.Target{
+		{Channel: "sms", To: "+14155550100"}, {Channel: "voice", To: "+14155550100"}, {Channel: "email", To: "chain@example.com"},
+	}}))
+	select {
+	case job := <-failed:
+		assert.Equal(t, 8, job.Attempts)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for the job to fail")
+	}
+
+	// Every channel gets every attempt before the job falls back
+	mu.Lock()
+	assert.Equal(t, []string{"whatsapp", "whatsapp", "sms", "sms", "voice", "voice", "email", "email"}, channels)
+	mu.Unlock()
+}
+
+func TestDeliveryQueueLifecycle(t *testing.T) {
+	defer func(queue string) { config.DeliveryQueue = queue }(config.DeliveryQueue)
+	config.DeliveryQueue = config.DeliveryQueueMemory
+
+	t.Run("Delivers Inline Until Started", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		r := server.NewRouter(service.NewMemoryStore(), ctx, time.Minute, newTestSenders())
+
+		rec := postJSON(r, "/otp/generate", models.GenerateRequest{Username: "lifecycle-1@example.com", MessageType: "email"})
+		assert.Equal(t, http.StatusOK, rec.Code)
+		var resp map[string]string
+		_ = json.Unmarshal(rec.Body.Bytes(), &resp)
+		assert.Equal(t, delivery.StatusDelivered, resp["delivery"])
+	})
+
+	t.Run("Close Stops The Workers", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		otpService := service.NewOTPService(service.NewMemoryStore(), ctx, time.Minute, newTestSenders())
+		otpService.StartDelivery()
+		r := server.NewServiceRouter(otpService)
+
+		closed := make(chan struct{})
+		go func() {
+			otpService.Close()
+			close(closed)
+		}()
+		select {
+		case <-closed:
+		case <-time.After(2 * time.Second):
+			t.Fatal("Timed out waiting for the workers to stop")
+		}
+
+		// Nothing takes the code from the queue any more
+		rec := postJSON(r, "/otp/generate", models.GenerateRequest{Username: "lifecycle-2@example.com", MessageType: "email"})
+		var resp map[string]string
+		_ = json.Unmarshal(rec.Body.Bytes(), &resp)
+		assert.Equal(t, delivery.StatusQueued, resp["delivery"])
+		time.Sleep(50 * time.Millisecond)
+		assert.Empty(t, lastSentOTP("lifecycle-2@example.com"))
+	})
+}
+
+func TestMemoryBackendWakesEveryWorker(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Each send waits until all four are in flight, which needs every idle worker awake
+	const workers = 4
+	var inFlight sync.WaitGroup
+	inFlight.Add(workers)
+	delivered := make(chan string, workers)
+	send := func(job delivery.Job) error {
+		inFlight.Done()
+		inFlight.Wait()
+		delivered <- job.ID
+		return nil
+	}
+	queue := delivery.NewQueue(delivery.NewMemoryBackend(), send, nil, workers, 1, time.Millisecond, time.Millisecond, 0)
+	queue.Start(ctx)
+	// Let every worker block waiting for a job
+	time.Sleep(50 * time.Millisecond)
+
+	for i := 0; i < workers; i++ {
+		assert.NoError(t, queue.Enqueue(ctx, delivery.Job{ID: fmt.Sprintf("job-%d", i), Channel: "email"}))
+	}
+	for i := 0; i < workers; i++ {
+		select {
+		case <-delivered:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Only %d of %d jobs were delivered; idle workers were not woken", i, workers)
+		}
+	}
+}
+
+// newTestRedisClient connects to the Redis server at REDIS_TEST_ADDR, using a
+// database that is emptied before and after the test. The test is skipped
+// without one.
+func newTestRedisClient(t *testing.T, ctx context.Context) *redis.Client {
+	addr := os.Getenv("REDIS_TEST_ADDR")
+	if addr == "" {
+		t.Skip("REDIS_TEST_ADDR is not set")
+	}
+	client := redis.NewClient(&redis.Options{Addr: addr, DB: 15})
+	t.Cleanup(func() {
+		client.FlushDB(context.Background())
+		client.Close()
+	})
+	if err := client.FlushDB(ctx).Err(); err != nil {
+		t.Fatalf("Failed to reach the test Redis: %v", err)
+	}
+	return client
+}
+
+// newTestRedisBackend creates a RedisStreamBackend on the test Redis; see newTestRedisClient
+func newTestRedisBackend(t *testing.T, ctx context.Context) *delivery.RedisStreamBackend {
+	backend, err := delivery.NewRedisStreamBackend(ctx, newTestRedisClient(t, ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return backend
+}
+
+func TestRedisStreamBackend(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	pop := func(backend *delivery.RedisStreamBackend, timeout time.Duration) (delivery.Job, error) {
+		popCtx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		return backend.Pop(popCtx)
+	}
+
+	t.Run("Push Pop Ack", func(t *testing.T) {
+		backend := newTestRedisBackend(t, ctx)
+		job := delivery.Job{ID: "job-1", Channel: "sms", To: "+14155550100", Payload: "sealed", Attempts: 1,
+			Fallback: []delivery.Target{{Channel: "email", To: "user@example.com"}}}
+		assert.NoError(t, backend.Push(ctx, job, time.Now()))
+
+		popped, err := pop(backend, 5*time.Second)
+		assert.NoError(t, err)
+		assert.NotEmpty(t, popped.Receipt)
+		job.Receipt = popped.Receipt
+		assert.Equal(t, job, popped)
+
+		// Acknowledged jobs are deleted, so the sealed payload does not linger
+		assert.NoError(t, backend.Ack(ctx, popped))
+
+		length, err := backend.Client.XLen(ctx, backend.Prefix+"stream").Result()
+		assert.NoError(t, err)
+		assert.Zero(t, length)
+		pending, err := backend.Client.XPending(ctx, backend.Prefix+"stream", "workers").Result()
+		assert.NoError(t, err)
+		assert.Zero(t, pending.Count)
+	})
+
+	t.Run("Promotes Scheduled Jobs When Due", func(t *testing.T) {
+		backend := newTestRedisBackend(t, ctx)
+		pushed := time.Now()
+		assert.NoError(t, backend.Push(ctx, delivery.Job{ID: "job-3"}, pushed.Add(300*time.Millisecond)))
+
+		scheduled, err := backend.Client.ZCard(ctx, backend.Prefix+"scheduled").Result()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), scheduled, "Expected the job to wait in the scheduled set")
+
+		popped, err := pop(backend, 5*time.Second)
+		assert.NoError(t, err)
+		assert.Equal(t, "job-3", popped.ID)
+		assert.GreaterOrEqual(t, time.Since(pushed), 300*time.Millisecond, "Expected the job to be handed out once due")
+
+		scheduled, err = backend.Client.ZCard(ctx, backend.Prefix+"scheduled").Result()
+		assert.NoError(t, err)
+		assert.Zero(t, scheduled)
+		assert.NoError(t, backend.Ack(ctx, popped))
+	})
+
+	t.Run("Claims Jobs Of A Stopped Consumer", func(t *testing.T) {
+		backend := newTestRedisBackend(t, ctx)
+		assert.NoError(t, backend.Push(ctx, delivery.Job{ID: "job-4"}, time.Now()))
+		abandoned, err := pop(backend, 5*time.Second)
+		assert.NoError(t, err)
+
+		other := *backend
+		other.Consumer = "other-consumer"
+		other.ClaimIdle = 50 * time.Millisecond
+		time.Sleep(100 * time.Millisecond)
+
+		claimed, err := pop(&other, 5*time.Second)
+		assert.NoError(t, err)
+		assert.Equal(t, "job-4", claimed.ID)
+		assert.Equal(t, abandoned.Receipt, claimed.Receipt)
+		assert.NoError(t, other.Ack(ctx, claimed))
+	})
+
+	t.Run("Drops Invalid Messages", func(t *testing.T) {
+		backend := newTestRedisBackend(t, ctx)
+		assert.NoError(t, backend.Client.XAdd(ctx, &redis.XAddArgs{
+			Stream: backend.Prefix + "stream",
+			Values: map[string]interface{}{"job": "not a job"},
+		}).Err())
+		assert.NoError(t, backend.Push(ctx, delivery.Job{ID: "job-5"}, time.Now()))
+
+		popped, err := pop(backend, 5*time.Second)
+		assert.NoError(t, err)
+		assert.Equal(t, "job-5", popped.ID)
+	})
+
+	t.Run("Dead Letters", func(t *testing.T) {
+		backend := newTestRedisBackend(t, ctx)
+		for _, id := range []string{"job-6", "job-7"} {
+			assert.NoError(t, backend.DeadLetter(ctx, delivery.DeadLetter{ID: id, Channel: "sms", Attempts: 5, Error: "provider down"}))
+		}
+
+		letters, err := backend.DeadLetters(ctx, 10)
+		assert.NoError(t, err)
+		if assert.Len(t, letters, 2) {
+			assert.Equal(t, "job-7", letters[0].ID, "Expected the newest first")
+			assert.Equal(t, "provider down", letters[1].Error)
+		}
+	})
+}
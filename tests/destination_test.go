@@ -0,0 +1,113 @@
+package tests
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/RoMalms10/otp-generator/config"
+	"github.com/RoMalms10/otp-generator/models"
+	"github.com/RoMalms10/otp-generator/server"
+	"github.com/RoMalms10/otp-generator/service"
+	"github.com/gorilla/mux"
+)
+
+// setupDestinationServer creates a router whose SMS channel also delivers to testSink
+func setupDestinationServer() *mux.Router {
+	senders := newTestSenders()
+	senders.Register(models.MessageTypeSMS, testSink.Sender(models.MessageTypeSMS))
+	return server.NewRouter(service.NewMemoryStore(), context.Background(), time.Minute, senders)
+}
+
+func TestDestinationValidation(t *testing.T) {
+	t.Run("Phone Numbers Are Normalized", func(t *testing.T) {
+		r := setupDestinationServer()
+
+		rec := postJSON(r, "/otp/generate", models.GenerateRequest{Username: "00 1 (415) 555-0134", MessageType: "sms"})
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.NotEmpty(t, lastSentOTP("+14155550134"), "Expected the OTP to be sent to the E.164 number")
+	})
+
+	t.Run("Email Domains Are Lower Cased", func(t *testing.T) {
+		r := setupDestinationServer()
+
+		rec := postJSON(r, "/otp/generate", models.GenerateRequest{Username: "Mixed.Case@Example.COM", MessageType: "email"})
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.NotEmpty(t, lastSentOTP("Mixed.Case@example.com"))
+	})
+
+	t.Run("Malformed Destinations", func(t *testing.T) {
+		r := setupDestinationServer()
+
+		for _, req := range []models.GenerateRequest{
+			{Username: "4155550134", MessageType: "sms"},
+			{Username: "+1 415 CALL NOW", MessageType: "sms"},
+			{Username: "+123", MessageType: "sms"},
+			{Username: "not-an-email", MessageType: "email"},
+			{Username: "Mallory <mallory@example.com>", MessageType: "email"},
+			{Username: "a@example.com, b@example.com", MessageType: "magic_link"},
+		} {
+			rec := postJSON(r, "/otp/generate", req)
+			assert.Equal(t, http.StatusBadRequest, rec.Code, req.Username)
+			assert.Contains(t, rec.Body.String(), `"code":"invalid_destination"`, req.Username)
+		}
+	})
+
+	t.Run("Premium Rate Numbers", func(t *testing.T) {
+		r := setupDestinationServer()
+
+		for _, number := range []string{"+1 900 555 0134", "+44 906 000 0000", "+882 1234 5678"} {
+			rec := postJSON(r, "/otp/generate", models.GenerateRequest{Username: number, MessageType: "sms"})
+			assert.Equal(t, http.StatusForbidden, rec.Code, number)
+			assert.Contains(t, rec.Body.String(), `"code":"destination_not_allowed"`, number)
+		}
+	})
+
+	t.Run("Allow And Deny Lists", func(t *testing.T) {
+		defer func(countries, domains, denied []string) {
+			config.AllowedCountryCodes, config.AllowedEmailDomains, config.DeniedEmailDomains = countries, domains, denied
+		}(config.AllowedCountryCodes, config.AllowedEmailDomains, config.DeniedEmailDomains)
+		config.AllowedCountryCodes = []string{"1", "+44"}
+		config.AllowedEmailDomains = []string{"example.com"}
+		config.DeniedEmailDomains = []string{"blocked.example.com"}
+		r := setupDestinationServer()
+
+		cases := []struct {
+			req    models.GenerateRequest
+			status int
+		}{
+			{models.GenerateRequest{Username: "+44 20 7946 0018", MessageType: "sms"}, http.StatusOK},
+			{models.GenerateRequest{Username: "+33 1 23 45 67 89", MessageType: "sms"}, http.StatusForbidden},
+			{models.GenerateRequest{Username: "user@mail.example.com", MessageType: "email"}, http.StatusOK},
+			{models.GenerateRequest{Username: "user@blocked.example.com", MessageType: "email"}, http.StatusForbidden},
+			{models.GenerateRequest{Username: "user@example.org", MessageType: "email"}, http.StatusForbidden},
+		}
+		for _, c := range cases {
+			rec := postJSON(r, "/otp/generate", c.req)
+			assert.Equal(t, c.status, rec.Code, c.req.Username)
+		}
+	})
+
+	t.Run("Resend To A New Channel", func(t *testing.T) {
+		r := setupDestinationServer()
+
+		rec := postJSON(r, "/otp/generate", models.GenerateRequest{Username: "switcher@example.com", MessageType: "email"})
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		// An email address cannot receive an SMS
+		rec = postJSON(r, "/otp/resend", models.ResendRequest{Username: "switcher@example.com", MessageType: "sms"})
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Contains(t, rec.Body.String(), `"code":"invalid_destination"`)
+
+		// With a number for the new channel, the new code goes there
+		rec = postJSON(r, "/otp/resend", models.ResendRequest{Username: "switcher@example.com", MessageType: "sms", Destination: "+1 415 555 0138"})
+		assert.Equal(t, http.StatusOK, rec.Code)
+		otp := lastSentOTP("+14155550138")
+		assert.NotEmpty(t, otp)
+
+		rec = postJSON(r, "/otp/validate", models.ValidationRequest{Username: "switcher@example.com", OTP: otp})
+		assert.Equal(t, http.StatusOK, rec.Code)
+	})
+}
@@ -0,0 +1,78 @@
+package tests
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+
+	"github.com/RoMalms10/otp-generator/messaging"
+)
+
+func TestEmailService(t *testing.T) {
+	serverTLS, clientTLS, err := newTestTLSConfigs()
+	assert.NoError(t, err, "Failed to create TLS certificate")
+
+	cases := []struct {
+		name     string
+		security string
+		auth     string
+		implicit bool
+		expected string
+	}{
+		{"Plain Without TLS", messaging.EmailSecurityNone, messaging.EmailAuthPlain, false, "PLAIN  mailer secret"},
+		{"Login Without TLS", messaging.EmailSecurityNone, messaging.EmailAuthLogin, false, "LOGIN mailer secret"},
+		{"STARTTLS", messaging.EmailSecuritySTARTTLS, messaging.EmailAuthPlain, false, "PLAIN  mailer secret"},
+		{"Implicit TLS", messaging.EmailSecurityTLS, messaging.EmailAuthLogin, true, "LOGIN mailer secret"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			standInTLS := serverTLS
+			if tc.security == messaging.EmailSecurityNone {
+				standInTLS = nil
+			}
+			standIn, err := newSMTPStandIn(standInTLS, tc.implicit)
+			assert.NoError(t, err, "Failed to start SMTP stand-in")
+			defer standIn.Close()
+
+			emailService := messaging.NewEmailService(messaging.EmailConfig{
+				Host:          "127.0.0.1",
+				Port:          standIn.Port(),
+				Username:      "mailer",
+				Password:      "secret",
+				From:          "OTP Service <otp@example.com>",
+				Security:      tc.security,
+				AuthMechanism: tc.auth,
+				TLSConfig:     clientTLS,
+			})
+
+			err = emailService.SendOTP("user@example.com", "123456")
+			assert.NoError(t, err, "Failed to send email")
+
+			message, ok := standIn.LastMessageTo("user@example.com")
+			assert.True(t, ok, "Expected email to be delivered")
+			assert.Equal(t, "otp@example.com", message.From)
+			assert.Equal(t, tc.expected, message.Auth)
+			assert.Contains(t, message.Data, "Content-Type: multipart/alternative")
+			assert.Contains(t, message.Data, "Content-Type: text/plain; charset=utf-8")
+			assert.Contains(t, message.Data, "Content-Type: text/html; charset=utf-8")
+			assert.Contains(t, message.Data, "<strong>123456</strong>")
+		})
+	}
+
+	t.Run("STARTTLS Not Offered", func(t *testing.T) {
+		standIn, err := newSMTPStandIn(nil, false)
+		assert.NoError(t, err, "Failed to start SMTP stand-in")
+		defer standIn.Close()
+
+		emailService := messaging.NewEmailService(messaging.EmailConfig{
+			Host:     "127.0.0.1",
+			Port:     standIn.Port(),
+			From:     "otp@example.com",
+			Security: messaging.EmailSecuritySTARTTLS,
+		})
+
+		err = emailService.SendOTP("user@example.com", "123456")
+		assert.Error(t, err, "Expected sending to fail without STARTTLS")
+		assert.Empty(t, standIn.Messages())
+	})
+}
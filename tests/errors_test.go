@@ -0,0 +1,71 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/RoMalms10/otp-generator/handler"
+	"github.com/RoMalms10/otp-generator/messaging"
+	"github.com/RoMalms10/otp-generator/models"
+	"github.com/RoMalms10/otp-generator/server"
+	"github.com/RoMalms10/otp-generator/service"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestErrorCodes(t *testing.T) {
+	// Email always fails to deliver, SMS is disabled
+	senders := messaging.NewRegistry()
+	senders.Register(models.MessageTypeEmail, messaging.SenderFunc(func(to, otp string) error {
+		return errors.New("mailbox unavailable")
+	}))
+	senders.Disable(models.MessageTypeSMS)
+	r := server.NewRouter(service.NewMemoryStore(), context.Background(), time.Minute, senders)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+		code   string
+	}{
+		{"Malformed Body", "POST", "/otp/generate", "{", http.StatusBadRequest, handler.CodeInvalidRequest},
+		{"Invalid Format", "POST", "/otp/generate", `{"username":"u@example.com","messageType":"email","format":{"length":2}}`,
+			http.StatusBadRequest, handler.CodeInvalidFormat},
+		{"Unsupported Channel", "POST", "/otp/generate", `{"username":"u@example.com","messageType":"fax"}`,
+			http.StatusBadRequest, handler.CodeUnsupportedChannel},
+		{"Unavailable Channel", "POST", "/otp/generate", `{"username":"u@example.com","messageType":"sms"}`,
+			http.StatusServiceUnavailable, handler.CodeChannelUnavailable},
+		{"Delivery Failed", "POST", "/otp/generate", `{"username":"u@example.com","messageType":"email"}`,
+			http.StatusBadGateway, handler.CodeDeliveryFailed},
+		{"Unknown Session", "GET", "/otp/sessions/nope", "", http.StatusNotFound, handler.CodeSessionNotFound},
+		{"Resend Unknown Session", "POST", "/otp/resend", `{"sessionId":"nope"}`,
+			http.StatusNotFound, handler.CodeSessionNotFound},
+		{"No Pending OTP", "POST", "/otp/validate", `{"username":"nobody","otp":"123456"}`,
+			http.StatusGone, handler.CodeOTPExpired},
+		{"Not Enrolled", "POST", "/totp/verify", `{"username":"nobody","code":"123456"}`,
+			http.StatusNotFound, handler.CodeNotEnrolled},
+		{"Invalid Link", "GET", "/otp/verify/forged.token.value", "", http.StatusUnauthorized, handler.CodeInvalidLink},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tt.method, tt.path, bytes.NewBufferString(tt.body))
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+			assert.Equal(t, tt.status, rec.Code, rec.Body.String())
+
+			var resp handler.ErrResponse
+			assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+			assert.Equal(t, tt.code, resp.Code)
+			assert.Equal(t, http.StatusText(tt.status), resp.StatusText)
+			assert.NotEmpty(t, resp.ErrorText)
+		})
+	}
+}
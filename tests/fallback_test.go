@@ -0,0 +1,175 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/RoMalms10/otp-generator/config"
+	"github.com/RoMalms10/otp-generator/delivery"
+	"github.com/RoMalms10/otp-generator/messaging"
+	"github.com/RoMalms10/otp-generator/models"
+	"github.com/RoMalms10/otp-generator/server"
+	"github.com/RoMalms10/otp-generator/service"
+	"github.com/gorilla/mux"
+)
+
+// setupFallbackServer creates a router whose WhatsApp channel uses whatsapp
+// and whose SMS and email channels deliver to testSink
+func setupFallbackServer(t *testing.T, whatsapp messaging.Sender) *mux.Router {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	senders := newTestSenders()
+	senders.Register(models.MessageTypeSMS, testSink.Sender(models.MessageTypeSMS))
+	senders.Register(models.MessageTypeWhatsApp, whatsapp)
+	return server.NewRouter(service.NewMemoryStore(), ctx, time.Minute, senders)
+}
+
+// lastChannel returns the channel of the most recent message captured for the recipient
+func lastChannel(to string) string {
+	messages := testSink.Messages()
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].To == to {
+			return messages[i].Channel
+		}
+	}
+	return ""
+}
+
+var failingWhatsApp = messaging.SenderFunc(func(to, otp string) error {
+	return errors.New("twilio API returned non-success status code: 503")
+})
+
+func TestChannelFallback(t *testing.T) {
+	t.Run("Falls Back On Failure", func(t *testing.T) {
+		r := setupFallbackServer(t, failingWhatsApp)
+
+		rec := postJSON(r, "/otp/generate", models.GenerateRequest{
+			UserID: "fallback-1", Destination: "+14155550111", MessageType: "whatsapp", Fallback: []string{"sms", "email"},
+		})
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		var resp map[string]string
+		_ = json.Unmarshal(rec.Body.Bytes(), &resp)
+		assert.Equal(t, "sms", resp["channel"], "Expected the response to name the channel that delivered")
+		assert.Equal(t, "sms", lastChannel("+14155550111"))
+
+		_, session := getSession(t, r, resp["sessionId"])
+		assert.Equal(t, "whatsapp", session.Channel)
+		assert.Equal(t, "sms", session.DeliveredVia)
+
+		rec = validateSession(r, resp["sessionId"], lastSentOTP("+14155550111"))
+		assert.Equal(t, http.StatusOK, rec.Code)
+	})
+
+	t.Run("Falls Back After Timeout", func(t *testing.T) {
+		defer func(timeout time.Duration) { config.DeliveryTimeout = timeout }(config.DeliveryTimeout)
+		config.DeliveryTimeout = 50 * time.Millisecond
+		slowWhatsApp := messaging.SenderFunc(func(to, otp string) error {
+			time.Sleep(time.Second)
+			return nil
+		})
+		r := setupFallbackServer(t, slowWhatsApp)
+
+		start := time.Now()
+		rec := postJSON(r, "/otp/generate", models.GenerateRequest{
+			UserID: "fallback-2", Destination: "+14155550112", MessageType: "whatsapp", Fallback: []string{"sms"},
+		})
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Less(t, time.Since(start), 500*time.Millisecond, "Expected the slow channel to be abandoned")
+		assert.Equal(t, "sms", lastChannel("+14155550112"))
+	})
+
+	t.Run("Configured Chain", func(t *testing.T) {
+		defer func(chains []string) { config.DeliveryFallbacks = chains }(config.DeliveryFallbacks)
+		config.DeliveryFallbacks = []string{"whatsapp:sms"}
+		r := setupFallbackServer(t, failingWhatsApp)
+
+		rec := postJSON(r, "/otp/generate", models.GenerateRequest{UserID: "fallback-3", Destination: "+14155550113", MessageType: "whatsapp"})
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "sms", lastChannel("+14155550113"))
+	})
+
+	t.Run("Unsuitable Fallbacks Are Skipped", func(t *testing.T) {
+		r := setupFallbackServer(t, failingWhatsApp)
+
+		// A phone number cannot receive email, and there is no lookup to find an address
+		rec := postJSON(r, "/otp/generate", models.GenerateRequest{
+			UserID: "fallback-4", Destination: "+14155550114", MessageType: "whatsapp", Fallback: []string{"email"},
+		})
+		assert.Equal(t, http.StatusBadGateway, rec.Code)
+		assert.Contains(t, rec.Body.String(), `"code":"delivery_failed"`)
+	})
+
+	t.Run("Invalid Chains", func(t *testing.T) {
+		r := setupFallbackServer(t, failingWhatsApp)
+
+		for _, req := range []models.GenerateRequest{
+			{Username: "+14155550115", MessageType: "whatsapp", Fallback: []string{"fax"}},
+			{Username: "chain@example.com", MessageType: "email", Fallback: []string{"magic_link"}},
+			{Username: "chain@example.com", MessageType: "magic_link", Fallback: []string{"email"}},
+		} {
+			rec := postJSON(r, "/otp/generate", req)
+			assert.Equal(t, http.StatusBadRequest, rec.Code, req.Fallback)
+			assert.Contains(t, rec.Body.String(), `"code":"unsupported_channel"`)
+		}
+	})
+
+	t.Run("Queued", func(t *testing.T) {
+		defer func(queue string, attempts int, base time.Duration) {
+			config.DeliveryQueue, config.DeliveryMaxAttempts, config.DeliveryBackoffBase = queue, attempts, base
+		}(config.DeliveryQueue, config.DeliveryMaxAttempts, config.DeliveryBackoffBase)
+		config.DeliveryQueue = config.DeliveryQueueMemory
+		config.DeliveryMaxAttempts = 2
+		config.DeliveryBackoffBase = 10 * time.Millisecond
+		senders := newTestSenders()
+		senders.Register(models.MessageTypeSMS, testSink.Sender(models.MessageTypeSMS))
+		senders.Register(models.MessageTypeWhatsApp, failingWhatsApp)
+		r := newQueuedRouter(t, senders)
+
+		rec := postJSON(r, "/otp/generate", models.GenerateRequest{
+			UserID: "fallback-5", Destination: "+14155550116", MessageType: "whatsapp", Fallback: []string{"sms"},
+		})
+		assert.Equal(t, http.StatusOK, rec.Code)
+		var resp map[string]string
+		_ = json.Unmarshal(rec.Body.Bytes(), &resp)
+		assert.Equal(t, delivery.StatusQueued, resp["delivery"])
+
+		status := waitForDelivery(t, r, resp["sessionId"])
+		assert.Equal(t, delivery.StatusDelivered, status.Status)
+		assert.Equal(t, "sms", status.Channel)
+		assert.Equal(t, 3, status.Attempts, "Expected WhatsApp to be retried before falling back")
+
+		_, session := getSession(t, r, resp["sessionId"])
+		assert.Equal(t, "sms", session.DeliveredVia)
+	})
+
+	t.Run("Queued Retries The Primary Channel First", func(t *testing.T) {
+		defer func(queue string, base time.Duration) {
+			config.DeliveryQueue, config.DeliveryBackoffBase = queue, base
+		}(config.DeliveryQueue, config.DeliveryBackoffBase)
+		config.DeliveryQueue = config.DeliveryQueueMemory
+		config.DeliveryBackoffBase = 10 * time.Millisecond
+		senders := newTestSenders()
+		senders.Register(models.MessageTypeSMS, testSink.Sender(models.MessageTypeSMS))
+		senders.Register(models.MessageTypeWhatsApp, &flakySender{failures: 1, attempts: make(map[string]int)})
+		r := newQueuedRouter(t, senders)
+
+		rec := postJSON(r, "/otp/generate", models.GenerateRequest{
+			UserID: "fallback-6", Destination: "+14155550117", MessageType: "whatsapp", Fallback: []string{"sms"},
+		})
+		assert.Equal(t, http.StatusOK, rec.Code)
+		var resp map[string]string
+		_ = json.Unmarshal(rec.Body.Bytes(), &resp)
+
+		status := waitForDelivery(t, r, resp["sessionId"])
+		assert.Equal(t, delivery.StatusDelivered, status.Status)
+		assert.Equal(t, "whatsapp", status.Channel)
+		assert.Equal(t, 2, status.Attempts)
+	})
+}
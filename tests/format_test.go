@@ -0,0 +1,72 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RoMalms10/otp-generator/models"
+	"github.com/gorilla/mux"
+)
+
+// generateWithFormat requests an OTP in the given format and returns the response
+func generateWithFormat(r *mux.Router, username string, format *models.OTPFormat) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(models.GenerateRequest{Username: username, MessageType: "email", Format: format})
+	req, _ := http.NewRequest("POST", "/otp/generate", bytes.NewBuffer(body))
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestOTPFormat(t *testing.T) {
+	r, _, _ := setupTestServerWithTTL(time.Minute)
+
+	t.Run("Alphanumeric Grouped", func(t *testing.T) {
+		format := &models.OTPFormat{Length: 8, Alphabet: models.AlphabetAlphanumeric, GroupSize: 4}
+		rec := generateWithFormat(r, "alnumuser@example.com", format)
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		otp := lastSentOTP("alnumuser@example.com")
+		assert.Regexp(t, regexp.MustCompile(`^[2-9A-HJKMNP-Z]{4}-[2-9A-HJKMNP-Z]{4}$`), otp)
+
+		// Typed in lower case with a space instead of the dash
+		typed := strings.ToLower(strings.Replace(otp, "-", " ", 1))
+		rec = validateTestOTP(r, "alnumuser@example.com", typed)
+		assert.Equal(t, http.StatusOK, rec.Code, "Expected normalized input to validate")
+	})
+
+	t.Run("Hex", func(t *testing.T) {
+		rec := generateWithFormat(r, "hexuser@example.com", &models.OTPFormat{Length: 12, Alphabet: models.AlphabetHex})
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		otp := lastSentOTP("hexuser@example.com")
+		assert.Regexp(t, regexp.MustCompile(`^[0-9a-f]{12}$`), otp)
+
+		rec = validateTestOTP(r, "hexuser@example.com", strings.ToUpper(otp))
+		assert.Equal(t, http.StatusOK, rec.Code, "Expected upper case input to validate")
+	})
+
+	t.Run("Numeric Length", func(t *testing.T) {
+		rec := generateWithFormat(r, "shortuser@example.com", &models.OTPFormat{Length: 4, GroupSize: 2})
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Regexp(t, regexp.MustCompile(`^[0-9]{2}-[0-9]{2}$`), lastSentOTP("shortuser@example.com"))
+	})
+
+	t.Run("Invalid Formats", func(t *testing.T) {
+		formats := []*models.OTPFormat{
+			{Length: 3},
+			{Length: 13},
+			{Alphabet: "emoji"},
+		}
+		for _, format := range formats {
+			rec := generateWithFormat(r, "invalidformat", format)
+			assert.Equal(t, http.StatusBadRequest, rec.Code, "Expected status 400 for format %+v", *format)
+		}
+	})
+}
@@ -9,9 +9,10 @@ import (
 	"testing"
 	"time"
 
+	"github.com/RoMalms10/otp-generator/config"
 	"github.com/RoMalms10/otp-generator/models"
 	"github.com/RoMalms10/otp-generator/server"
-	"github.com/go-redis/redis/v8"
+	"github.com/RoMalms10/otp-generator/service"
 	"github.com/gorilla/mux"
 	"golang.org/x/net/context"
 )
@@ -19,24 +20,20 @@ import (
 var defaultOTPTTL = time.Minute // Default OTP expiration time
 
 // Setup reusable test server with configurable OTP TTL
-func setupTestServerWithTTL(ttl time.Duration) (*mux.Router, *redis.Client, context.Context) {
+func setupTestServerWithTTL(ttl time.Duration) (*mux.Router, service.OTPStore, context.Context) {
 	ctx := context.Background()
-	redisClient := redis.NewClient(&redis.Options{
-		Addr: "localhost:6379",
-		DB:   1,
-	})
-	router := server.NewRouter(redisClient, ctx, ttl) // Pass the TTL to the server
-	return router, redisClient, ctx
+	store := service.NewMemoryStore()
+	router := server.NewRouter(store, ctx, ttl, newTestSenders()) // Pass the TTL to the server
+	return router, store, ctx
 }
 
 func TestGenerateOTPEndpoint(t *testing.T) {
 	// Set a short OTP TTL for testing purposes
 	testOTPTTL := 2 * time.Second
-	r, redisClient, ctx := setupTestServerWithTTL(testOTPTTL)
-	defer redisClient.FlushDB(ctx) // Clean up after test
+	r, _, _ := setupTestServerWithTTL(testOTPTTL)
 
 	t.Run("Valid Request", func(t *testing.T) {
-		reqBody, _ := json.Marshal(models.GenerateRequest{Username: "testuser", MessageType: "email"})
+		reqBody, _ := json.Marshal(models.GenerateRequest{Username: "testuser@example.com", MessageType: "email"})
 		req, err := http.NewRequest("POST", "/otp/generate", bytes.NewBuffer(reqBody))
 		assert.NoError(t, err, "Error creating request")
 		req.Header.Set("Content-Type", "application/json")
@@ -50,9 +47,9 @@ func TestGenerateOTPEndpoint(t *testing.T) {
 		err = json.Unmarshal(resp.Body.Bytes(), &generateRespBody)
 		assert.NoError(t, err, "Failed to parse response JSON")
 
-		otp, exists := generateRespBody["otp"]
-		assert.True(t, exists, "Expected 'otp' key in response")
-		assert.Len(t, otp, 6, "Expected OTP to be 6 digits")
+		_, exists := generateRespBody["otp"]
+		assert.False(t, exists, "Expected no 'otp' key in response outside development mode")
+		assert.Len(t, lastSentOTP("testuser@example.com"), 6, "Expected OTP to be 6 digits")
 	})
 
 	t.Run("Missing Username", func(t *testing.T) {
@@ -68,7 +65,7 @@ func TestGenerateOTPEndpoint(t *testing.T) {
 	})
 
 	t.Run("Unsupported MessageType", func(t *testing.T) {
-		reqBody, _ := json.Marshal(models.GenerateRequest{Username: "testuser", MessageType: "unsupported"})
+		reqBody, _ := json.Marshal(models.GenerateRequest{Username: "testuser@example.com", MessageType: "unsupported"})
 		req, err := http.NewRequest("POST", "/otp/generate", bytes.NewBuffer(reqBody))
 		assert.NoError(t, err, "Error creating request")
 		req.Header.Set("Content-Type", "application/json")
@@ -78,16 +75,28 @@ func TestGenerateOTPEndpoint(t *testing.T) {
 
 		assert.Equal(t, http.StatusBadRequest, resp.Code, "Expected status 400 for unsupported message type")
 	})
+
+	t.Run("Disabled MessageType", func(t *testing.T) {
+		reqBody, _ := json.Marshal(models.GenerateRequest{Username: "+15005550006", MessageType: "sms"})
+		req, err := http.NewRequest("POST", "/otp/generate", bytes.NewBuffer(reqBody))
+		assert.NoError(t, err, "Error creating request")
+		req.Header.Set("Content-Type", "application/json")
+
+		resp := httptest.NewRecorder()
+		r.ServeHTTP(resp, req)
+
+		assert.Equal(t, http.StatusServiceUnavailable, resp.Code, "Expected status 503 for disabled message type")
+		assert.Contains(t, resp.Body.String(), "currently unavailable")
+	})
 }
 
 func TestValidateOTPEndpoint(t *testing.T) {
 	// Set a short OTP TTL for testing purposes
 	testOTPTTL := 2 * time.Second
-	r, redisClient, ctx := setupTestServerWithTTL(testOTPTTL)
-	defer redisClient.FlushDB(ctx) // Clean up after test
+	r, _, _ := setupTestServerWithTTL(testOTPTTL)
 
 	// Generate valid OTP first
-	generateBody, _ := json.Marshal(models.GenerateRequest{Username: "testuser", MessageType: "email"})
+	generateBody, _ := json.Marshal(models.GenerateRequest{Username: "testuser@example.com", MessageType: "email"})
 	generateReq, _ := http.NewRequest("POST", "/otp/generate", bytes.NewBuffer(generateBody))
 	generateReq.Header.Set("Content-Type", "application/json")
 	generateResp := httptest.NewRecorder()
@@ -95,14 +104,10 @@ func TestValidateOTPEndpoint(t *testing.T) {
 
 	assert.Equal(t, http.StatusOK, generateResp.Code, "Expected status 200")
 
-	var generateRespBody map[string]string
-	err := json.Unmarshal(generateResp.Body.Bytes(), &generateRespBody)
-	assert.NoError(t, err, "Failed to parse response JSON")
-
-	otp := generateRespBody["otp"]
+	otp := lastSentOTP("testuser@example.com")
 
 	t.Run("Valid OTP", func(t *testing.T) {
-		validateBody, _ := json.Marshal(models.ValidationRequest{Username: "testuser", OTP: otp})
+		validateBody, _ := json.Marshal(models.ValidationRequest{Username: "testuser@example.com", OTP: otp})
 		validateReq, _ := http.NewRequest("POST", "/otp/validate", bytes.NewBuffer(validateBody))
 		validateReq.Header.Set("Content-Type", "application/json")
 		validateResp := httptest.NewRecorder()
@@ -112,26 +117,27 @@ func TestValidateOTPEndpoint(t *testing.T) {
 	})
 
 	t.Run("Invalid OTP", func(t *testing.T) {
-		validateBody, _ := json.Marshal(models.ValidationRequest{Username: "testuser", OTP: "999999"})
+		validateBody, _ := json.Marshal(models.ValidationRequest{Username: "testuser@example.com", OTP: "999999"})
 		validateReq, _ := http.NewRequest("POST", "/otp/validate", bytes.NewBuffer(validateBody))
 		validateReq.Header.Set("Content-Type", "application/json")
 		validateResp := httptest.NewRecorder()
 		r.ServeHTTP(validateResp, validateReq)
 
-		assert.Equal(t, http.StatusUnauthorized, validateResp.Code, "Expected status 401")
+		// The OTP was consumed by the valid request, so no OTP is pending
+		assert.Equal(t, http.StatusGone, validateResp.Code, "Expected status 410")
 	})
 
 	t.Run("Expired OTP", func(t *testing.T) {
 		// Wait for OTP to expire
 		time.Sleep(3 * time.Second)
 
-		validateBody, _ := json.Marshal(models.ValidationRequest{Username: "testuser", OTP: otp})
+		validateBody, _ := json.Marshal(models.ValidationRequest{Username: "testuser@example.com", OTP: otp})
 		validateReq, _ := http.NewRequest("POST", "/otp/validate", bytes.NewBuffer(validateBody))
 		validateReq.Header.Set("Content-Type", "application/json")
 		validateResp := httptest.NewRecorder()
 		r.ServeHTTP(validateResp, validateReq)
 
-		assert.Equal(t, http.StatusUnauthorized, validateResp.Code, "Expected status 401 for expired OTP")
+		assert.Equal(t, http.StatusGone, validateResp.Code, "Expected status 410 for expired OTP")
 	})
 
 }
@@ -139,8 +145,7 @@ func TestValidateOTPEndpoint(t *testing.T) {
 func TestConcurrencyGenerateOTP(t *testing.T) {
 	// Set a short OTP TTL for testing purposes
 	testOTPTTL := 2 * time.Second
-	r, redisClient, ctx := setupTestServerWithTTL(testOTPTTL)
-	defer redisClient.FlushDB(ctx) // Clean up after test
+	r, _, _ := setupTestServerWithTTL(testOTPTTL)
 
 	t.Run("Concurrent Requests", func(t *testing.T) {
 		const parallelCount = 5
@@ -148,7 +153,7 @@ func TestConcurrencyGenerateOTP(t *testing.T) {
 
 		for i := 0; i < parallelCount; i++ {
 			go func(i int) {
-				reqBody, _ := json.Marshal(models.GenerateRequest{Username: "testuser", MessageType: "email"})
+				reqBody, _ := json.Marshal(models.GenerateRequest{Username: "testuser@example.com", MessageType: "email"})
 				req, err := http.NewRequest("POST", "/otp/generate", bytes.NewBuffer(reqBody))
 				if err != nil {
 					errorChannel <- err
@@ -174,3 +179,32 @@ func TestConcurrencyGenerateOTP(t *testing.T) {
 		}
 	})
 }
+
+func TestRunModeOTPExposure(t *testing.T) {
+	runMode := config.RunMode
+	defer func() { config.RunMode = runMode }()
+
+	for _, mode := range []string{config.RunModeProduction, config.RunModeTest, config.RunModeDevelopment} {
+		t.Run(mode, func(t *testing.T) {
+			config.RunMode = mode
+			r, _, _ := setupTestServerWithTTL(defaultOTPTTL)
+
+			reqBody, _ := json.Marshal(models.GenerateRequest{Username: "modeuser@example.com", MessageType: "email"})
+			req, _ := http.NewRequest("POST", "/otp/generate", bytes.NewBuffer(reqBody))
+			resp := httptest.NewRecorder()
+			r.ServeHTTP(resp, req)
+			assert.Equal(t, http.StatusOK, resp.Code, "Expected status 200")
+
+			var generateRespBody map[string]string
+			_ = json.Unmarshal(resp.Body.Bytes(), &generateRespBody)
+
+			otp, exists := generateRespBody["otp"]
+			if mode == config.RunModeDevelopment {
+				assert.True(t, exists, "Expected 'otp' key in response in development mode")
+				assert.Equal(t, lastSentOTP("modeuser@example.com"), otp)
+			} else {
+				assert.False(t, exists, "Expected no 'otp' key in response in %s mode", mode)
+			}
+		})
+	}
+}
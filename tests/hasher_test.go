@@ -0,0 +1,110 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/RoMalms10/otp-generator/models"
+	"github.com/RoMalms10/otp-generator/service"
+)
+
+func TestOTPHasher(t *testing.T) {
+	t.Run("Hash And Verify", func(t *testing.T) {
+		hasher, err := service.ParseOTPHasher("k1:0123456789abcdef0123")
+		assert.NoError(t, err)
+
+		record, err := hasher.Hash("123456")
+		assert.NoError(t, err)
+		assert.NotContains(t, record, "123456", "Expected record not to contain the code")
+		assert.True(t, hasher.Verify(record, "123456"))
+		assert.False(t, hasher.Verify(record, "654321"))
+
+		other, _ := hasher.Hash("123456")
+		assert.NotEqual(t, record, other, "Expected a fresh salt for every record")
+	})
+
+	t.Run("Key Rotation", func(t *testing.T) {
+		oldHasher, err := service.ParseOTPHasher("k1:0123456789abcdef0123")
+		assert.NoError(t, err)
+		record, _ := oldHasher.Hash("123456")
+
+		rotated, err := service.ParseOTPHasher("k2:fedcba9876543210fedc,k1:0123456789abcdef0123")
+		assert.NoError(t, err)
+		assert.True(t, rotated.Verify(record, "123456"), "Expected records from the previous key to verify")
+
+		dropped, err := service.ParseOTPHasher("k2:fedcba9876543210fedc")
+		assert.NoError(t, err)
+		assert.False(t, dropped.Verify(record, "123456"), "Expected records from a removed key to fail")
+	})
+
+	t.Run("Seal And Open", func(t *testing.T) {
+		hasher, err := service.ParseOTPHasher("k1:0123456789abcdef0123")
+		assert.NoError(t, err)
+
+		sealed, err := hasher.Seal("123456")
+		assert.NoError(t, err)
+		assert.NotContains(t, sealed, "123456", "Expected sealed value not to contain the code")
+		code, err := hasher.Open(sealed)
+		assert.NoError(t, err)
+		assert.Equal(t, "123456", code)
+
+		rotated, _ := service.ParseOTPHasher("k2:fedcba9876543210fedc,k1:0123456789abcdef0123")
+		code, err = rotated.Open(sealed)
+		assert.NoError(t, err, "Expected values sealed with the previous key to open")
+		assert.Equal(t, "123456", code)
+
+		dropped, _ := service.ParseOTPHasher("k2:fedcba9876543210fedc")
+		_, err = dropped.Open(sealed)
+		assert.Error(t, err, "Expected values sealed with a removed key not to open")
+	})
+
+	t.Run("Invalid Keyring", func(t *testing.T) {
+		for _, keyring := range []string{"", "nosecret", "k1:short", "k1:0123456789abcdef,k1:0123456789abcdef"} {
+			_, err := service.ParseOTPHasher(keyring)
+			assert.Error(t, err, "Expected keyring %q to be rejected", keyring)
+		}
+	})
+}
+
+func TestHashedStorage(t *testing.T) {
+	r, store, ctx := setupTestServerWithTTL(time.Minute)
+
+	t.Run("Code Is Not Stored", func(t *testing.T) {
+		body, _ := json.Marshal(models.GenerateRequest{Username: "hasheduser@example.com", MessageType: "email"})
+		req, _ := http.NewRequest("POST", "/otp/generate", bytes.NewBuffer(body))
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+
+		var resp map[string]string
+		_ = json.Unmarshal(rec.Body.Bytes(), &resp)
+		otp := lastSentOTP("hasheduser@example.com")
+
+		record, err := store.Get(ctx, "otp:"+resp["sessionId"])
+		assert.NoError(t, err)
+		assert.NotContains(t, record, otp, "Expected store to hold a hash, not the code")
+	})
+
+	t.Run("Resend Issues New Code", func(t *testing.T) {
+		otp := generateTestOTP(t, r, "resenduser@example.com")
+
+		body, _ := json.Marshal(models.GenerateRequest{Username: "resenduser@example.com", MessageType: "email"})
+		req, _ := http.NewRequest("POST", "/otp/resend", bytes.NewBuffer(body))
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code, "Expected status 200 for resend")
+
+		resent := lastSentOTP("resenduser@example.com")
+		assert.NotEqual(t, otp, resent, "Expected a new code to be sent")
+
+		rec = validateTestOTP(r, "resenduser@example.com", otp)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code, "Expected the replaced code to be rejected")
+
+		rec = validateTestOTP(r, "resenduser@example.com", resent)
+		assert.Equal(t, http.StatusOK, rec.Code, "Expected the resent code to be accepted")
+	})
+}
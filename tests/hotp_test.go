@@ -0,0 +1,163 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/base32"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/RoMalms10/otp-generator/models"
+	"github.com/RoMalms10/otp-generator/service"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rfc4226Secret is the test secret from RFC 4226 appendix D
+var rfc4226Secret = base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+
+// postJSON sends a JSON request to the router and returns the recorded response
+func postJSON(r *mux.Router, path string, v interface{}) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(v)
+	req, _ := http.NewRequest("POST", path, bytes.NewBuffer(body))
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	return rec
+}
+
+// registerHOTP registers the RFC 4226 test secret for the user at the counter with a freshly verified session
+func registerHOTP(t *testing.T, r *mux.Router, username string, counter uint64) {
+	sessionID := verifiedSession(t, r, username)
+	rec := postJSON(r, "/hotp/register", models.HOTPRegisterRequest{Username: username, SessionID: sessionID, Secret: rfc4226Secret, Counter: counter})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+}
+
+// rfc4226Code returns the RFC 4226 test token's code for a counter
+func rfc4226Code(counter uint64) string {
+	code, _ := service.HOTPCode(models.HOTPToken{Secret: rfc4226Secret, Algorithm: models.AlgorithmSHA1, Digits: 6}, counter)
+	return code
+}
+
+func TestHOTPCodeRFC4226Vectors(t *testing.T) {
+	expected := []string{"755224", "287082", "359152", "969429", "338314", "254676", "287922", "162583", "399871", "520489"}
+	for counter, code := range expected {
+		assert.Equal(t, code, rfc4226Code(uint64(counter)), "counter %d", counter)
+	}
+}
+
+func TestHOTPVerification(t *testing.T) {
+	r, store, ctx := setupTestServerWithTTL(time.Minute)
+
+	t.Run("Register Rejects Invalid Tokens", func(t *testing.T) {
+		for _, req := range []models.HOTPRegisterRequest{
+			{Username: "bad"},
+			{Username: "bad", Secret: "not base32!"},
+			{Username: "bad", Secret: "GEZDGNBV"}, // too short
+			{Username: "bad", Secret: rfc4226Secret, Algorithm: "MD5"},
+			{Username: "bad", Secret: rfc4226Secret, Digits: 10},
+		} {
+			rec := postJSON(r, "/hotp/register", req)
+			assert.Equal(t, http.StatusBadRequest, rec.Code, "Expected status 400 for %+v", req)
+		}
+	})
+
+	t.Run("Requires A Verified Session", func(t *testing.T) {
+		registerHOTP(t, r, "victim@example.com", 0)
+
+		rec := postJSON(r, "/hotp/register", models.HOTPRegisterRequest{Username: "victim@example.com", Secret: rfc4226Secret})
+		assert.Equal(t, http.StatusForbidden, rec.Code, "Expected replacing a token without a session to be refused")
+		assert.Contains(t, rec.Body.String(), `"code":"verification_required"`)
+
+		other := verifiedSession(t, r, "attacker@example.com")
+		rec = postJSON(r, "/hotp/register", models.HOTPRegisterRequest{Username: "victim@example.com", SessionID: other, Secret: rfc4226Secret})
+		assert.Equal(t, http.StatusForbidden, rec.Code, "Expected another user's session to be refused")
+	})
+
+	t.Run("Secret Stored Sealed", func(t *testing.T) {
+		registerHOTP(t, r, "sealed@example.com", 0)
+		rec := postJSON(r, "/hotp/verify", models.HOTPVerifyRequest{Username: "sealed@example.com", Code: rfc4226Code(0)})
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+		data, err := store.Get(ctx, "hotp:"+service.KeyDigest("sealed@example.com"))
+		require.NoError(t, err)
+		assert.NotContains(t, data, rfc4226Secret, "Expected the secret not to be stored in plaintext")
+		assert.Contains(t, data, `"counter":1`, "Expected the counter to advance")
+	})
+
+	t.Run("Counter Advances", func(t *testing.T) {
+		registerHOTP(t, r, "tokenuser@example.com", 0)
+
+		rec := postJSON(r, "/hotp/verify", models.HOTPVerifyRequest{Username: "tokenuser@example.com", Code: rfc4226Code(0)})
+		assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+		rec = postJSON(r, "/hotp/verify", models.HOTPVerifyRequest{Username: "tokenuser@example.com", Code: rfc4226Code(0)})
+		assert.Equal(t, http.StatusConflict, rec.Code, "Expected a used code to be rejected")
+		assert.Contains(t, rec.Body.String(), `"code":"otp_already_used"`)
+
+		// Codes within the look-ahead window are accepted and skip the counter ahead
+		rec = postJSON(r, "/hotp/verify", models.HOTPVerifyRequest{Username: "tokenuser@example.com", Code: rfc4226Code(5)})
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		rec = postJSON(r, "/hotp/verify", models.HOTPVerifyRequest{Username: "tokenuser@example.com", Code: rfc4226Code(3)})
+		assert.Equal(t, http.StatusUnauthorized, rec.Code, "Expected a skipped code to be rejected")
+	})
+
+	t.Run("Beyond Look-Ahead Window", func(t *testing.T) {
+		registerHOTP(t, r, "farahead@example.com", 0)
+
+		rec := postJSON(r, "/hotp/verify", models.HOTPVerifyRequest{Username: "farahead@example.com", Code: rfc4226Code(50)})
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+		assert.Contains(t, rec.Body.String(), `"code":"otp_mismatch"`)
+	})
+
+	t.Run("Resync", func(t *testing.T) {
+		registerHOTP(t, r, "drifted@example.com", 0)
+
+		rec := postJSON(r, "/hotp/resync", models.HOTPResyncRequest{Username: "drifted@example.com", Code: rfc4226Code(40), NextCode: rfc4226Code(42)})
+		assert.Equal(t, http.StatusUnauthorized, rec.Code, "Expected non-consecutive codes to be rejected")
+
+		rec = postJSON(r, "/hotp/resync", models.HOTPResyncRequest{Username: "drifted@example.com", Code: rfc4226Code(40), NextCode: rfc4226Code(41)})
+		assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+		rec = postJSON(r, "/hotp/verify", models.HOTPVerifyRequest{Username: "drifted@example.com", Code: rfc4226Code(41)})
+		assert.Equal(t, http.StatusConflict, rec.Code, "Expected the resync codes to be consumed")
+
+		rec = postJSON(r, "/hotp/verify", models.HOTPVerifyRequest{Username: "drifted@example.com", Code: rfc4226Code(42)})
+		assert.Equal(t, http.StatusOK, rec.Code, "Expected the counter to continue after the resync")
+	})
+
+	t.Run("Concurrent Use Of One Code", func(t *testing.T) {
+		registerHOTP(t, r, "racer@example.com", 7)
+
+		const parallelCount = 10
+		codes := make(chan int, parallelCount)
+		var wg sync.WaitGroup
+		for i := 0; i < parallelCount; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				codes <- postJSON(r, "/hotp/verify", models.HOTPVerifyRequest{Username: "racer@example.com", Code: rfc4226Code(7)}).Code
+			}()
+		}
+		wg.Wait()
+		close(codes)
+
+		accepted := 0
+		for code := range codes {
+			if code == http.StatusOK {
+				accepted++
+			}
+		}
+		assert.Equal(t, 1, accepted, "Expected exactly one concurrent verification to succeed")
+	})
+
+	t.Run("Not Registered", func(t *testing.T) {
+		rec := postJSON(r, "/hotp/verify", models.HOTPVerifyRequest{Username: "nobody@example.com", Code: "123456"})
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+		assert.Contains(t, rec.Body.String(), `"code":"not_enrolled"`)
+	})
+}
@@ -0,0 +1,120 @@
+package tests
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/RoMalms10/otp-generator/config"
+	"github.com/RoMalms10/otp-generator/models"
+)
+
+// registeredDestinations is what the test lookup service knows, by user ID and channel
+var registeredDestinations = map[string]map[string][]string{
+	"user-42": {
+		models.MessageTypeSMS:   {"+1 415 555 0100", "+1 415 555 0101"},
+		models.MessageTypeEmail: {"owner@example.com"},
+	},
+}
+
+// newLookupServer serves registeredDestinations the way DESTINATION_LOOKUP_URL expects
+func newLookupServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := registeredDestinations[r.URL.Query().Get("userId")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string][]string{"destinations": user[r.URL.Query().Get("channel")]})
+	}))
+}
+
+func TestUserDestinations(t *testing.T) {
+	t.Run("Explicit Destination", func(t *testing.T) {
+		r := setupDestinationServer()
+
+		rec := postJSON(r, "/otp/generate", models.GenerateRequest{UserID: "user-7", Destination: "+1 415 555 0177", MessageType: "sms"})
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		var resp map[string]string
+		_ = json.Unmarshal(rec.Body.Bytes(), &resp)
+		assert.Equal(t, "+*******0177", resp["destination"], "Expected the destination to be masked")
+
+		otp := lastSentOTP("+14155550177")
+		assert.NotEmpty(t, otp)
+
+		// The user ID, not the destination, identifies the session
+		rec = postJSON(r, "/otp/validate", models.ValidationRequest{UserID: "user-7", OTP: otp})
+		assert.Equal(t, http.StatusOK, rec.Code)
+	})
+
+	t.Run("Destination Required Without Lookup", func(t *testing.T) {
+		r := setupDestinationServer()
+
+		rec := postJSON(r, "/otp/generate", models.GenerateRequest{UserID: "user-7", MessageType: "sms"})
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Contains(t, rec.Body.String(), `"code":"invalid_destination"`)
+	})
+
+	t.Run("Resend To A New Channel", func(t *testing.T) {
+		lookup := newLookupServer()
+		defer lookup.Close()
+		defer func(url string) { config.DestinationLookupURL = url }(config.DestinationLookupURL)
+		config.DestinationLookupURL = lookup.URL
+		r := setupDestinationServer()
+
+		rec := postJSON(r, "/otp/generate", models.GenerateRequest{UserID: "user-42", MessageType: "sms", Purpose: "switch"})
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		// The number cannot receive email, so the user's registered address is used
+		rec = postJSON(r, "/otp/resend", models.ResendRequest{UserID: "user-42", Purpose: "switch", MessageType: "email"})
+		assert.Equal(t, http.StatusOK, rec.Code)
+		var resp map[string]string
+		_ = json.Unmarshal(rec.Body.Bytes(), &resp)
+		assert.Equal(t, "email", resp["channel"])
+		otp := lastSentOTP("owner@example.com")
+		assert.NotEmpty(t, otp)
+
+		rec = postJSON(r, "/otp/validate", models.ValidationRequest{UserID: "user-42", Purpose: "switch", OTP: otp})
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		// Destinations that are not registered are refused
+		rec = postJSON(r, "/otp/generate", models.GenerateRequest{UserID: "user-42", MessageType: "sms", Purpose: "switch"})
+		assert.Equal(t, http.StatusOK, rec.Code)
+		rec = postJSON(r, "/otp/resend", models.ResendRequest{UserID: "user-42", Purpose: "switch", MessageType: "email", Destination: "intruder@example.com"})
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+	})
+
+	t.Run("Lookup", func(t *testing.T) {
+		lookup := newLookupServer()
+		defer lookup.Close()
+		defer func(url string) { config.DestinationLookupURL = url }(config.DestinationLookupURL)
+		config.DestinationLookupURL = lookup.URL
+		r := setupDestinationServer()
+
+		// Without a destination the preferred registered one is used
+		rec := postJSON(r, "/otp/generate", models.GenerateRequest{UserID: "user-42", MessageType: "sms", Purpose: "login"})
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.NotEmpty(t, lastSentOTP("+14155550100"))
+
+		// A client can pick another of the user's destinations
+		rec = postJSON(r, "/otp/generate", models.GenerateRequest{UserID: "user-42", Destination: "+14155550101", MessageType: "sms", Purpose: "login"})
+		assert.Equal(t, http.StatusOK, rec.Code)
+		otp := lastSentOTP("+14155550101")
+		assert.NotEmpty(t, otp)
+
+		rec = postJSON(r, "/otp/validate", models.ValidationRequest{UserID: "user-42", Purpose: "login", OTP: otp})
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		// But not one the user never registered
+		rec = postJSON(r, "/otp/generate", models.GenerateRequest{UserID: "user-42", Destination: "+14155550199", MessageType: "sms"})
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+		assert.Contains(t, rec.Body.String(), `"code":"destination_not_allowed"`)
+
+		rec = postJSON(r, "/otp/generate", models.GenerateRequest{UserID: "unknown-user", MessageType: "email"})
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+		assert.Contains(t, rec.Body.String(), `"code":"no_destination"`)
+	})
+}
@@ -0,0 +1,108 @@
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RoMalms10/otp-generator/config"
+	"github.com/RoMalms10/otp-generator/models"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sendMagicLink requests a magic link for the user and returns the link captured by testSink
+func sendMagicLink(t *testing.T, r *mux.Router, username string) string {
+	rec := postJSON(r, "/otp/generate", models.GenerateRequest{Username: username, MessageType: models.MessageTypeMagicLink})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	link := lastSentOTP(username)
+	require.True(t, strings.HasPrefix(link, config.MagicLinkBaseURL+"/otp/verify/"), "Expected a magic link, got %q", link)
+	return link
+}
+
+// openMagicLink requests the path of a magic link
+func openMagicLink(r *mux.Router, link string) *httptest.ResponseRecorder {
+	u, _ := url.Parse(link)
+	req, _ := http.NewRequest("GET", u.Path, nil)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestMagicLinks(t *testing.T) {
+	r, _, _ := setupTestServerWithTTL(time.Second)
+
+	t.Run("Single Use", func(t *testing.T) {
+		link := sendMagicLink(t, r, "link@example.com")
+
+		rec := openMagicLink(r, link)
+		assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		assert.Contains(t, rec.Body.String(), `"status":"valid"`)
+
+		sessionID := strings.SplitN(strings.TrimPrefix(link, config.MagicLinkBaseURL+"/otp/verify/"), ".", 2)[0]
+		_, session := getSession(t, r, sessionID)
+		assert.Equal(t, models.SessionStatusVerified, session.Status)
+
+		rec = openMagicLink(r, link)
+		assert.Equal(t, http.StatusConflict, rec.Code, "Expected a used link to be rejected")
+		assert.Contains(t, rec.Body.String(), `"code":"otp_already_used"`)
+	})
+
+	t.Run("Tampered Token", func(t *testing.T) {
+		link := sendMagicLink(t, r, "tamper@example.com")
+		parts := strings.Split(link, ".")
+		parts[len(parts)-2] = strings.Repeat("A", len(parts[len(parts)-2]))
+
+		rec := openMagicLink(r, strings.Join(parts, "."))
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+		assert.Contains(t, rec.Body.String(), `"code":"invalid_link"`)
+
+		rec = openMagicLink(r, link)
+		assert.Equal(t, http.StatusOK, rec.Code, "Expected the genuine link to still work")
+	})
+
+	t.Run("Not A Code", func(t *testing.T) {
+		link := sendMagicLink(t, r, "nocode@example.com")
+		token := strings.TrimPrefix(link, config.MagicLinkBaseURL+"/otp/verify/")
+		secret := strings.Split(token, ".")[1]
+
+		rec := validateTestOTP(r, "nocode@example.com", secret)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code, "Expected the link secret not to validate as a code")
+	})
+
+	t.Run("Expires With OTP TTL", func(t *testing.T) {
+		link := sendMagicLink(t, r, "late@example.com")
+		time.Sleep(1100 * time.Millisecond)
+
+		rec := openMagicLink(r, link)
+		assert.Equal(t, http.StatusGone, rec.Code)
+		assert.Contains(t, rec.Body.String(), `"code":"otp_expired"`)
+	})
+}
+
+func TestMagicLinkRedirects(t *testing.T) {
+	successURL, failureURL := config.MagicLinkSuccessURL, config.MagicLinkFailureURL
+	config.MagicLinkSuccessURL = "https://app.example.com/welcome?from=email"
+	config.MagicLinkFailureURL = "https://app.example.com/sign-in"
+	defer func() { config.MagicLinkSuccessURL, config.MagicLinkFailureURL = successURL, failureURL }()
+
+	r, _, _ := setupTestServerWithTTL(time.Minute)
+	link := sendMagicLink(t, r, "redirect@example.com")
+
+	rec := openMagicLink(r, link)
+	assert.Equal(t, http.StatusFound, rec.Code)
+	location, _ := url.Parse(rec.Header().Get("Location"))
+	assert.Equal(t, "app.example.com", location.Host)
+	assert.Equal(t, "/welcome", location.Path)
+	assert.Equal(t, "email", location.Query().Get("from"))
+	assert.NotEmpty(t, location.Query().Get("sessionId"))
+
+	rec = openMagicLink(r, link)
+	assert.Equal(t, http.StatusFound, rec.Code)
+	assert.Equal(t, "https://app.example.com/sign-in?error=otp_already_used", rec.Header().Get("Location"))
+}
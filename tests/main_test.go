@@ -0,0 +1,37 @@
+package tests
+
+import (
+	"github.com/RoMalms10/otp-generator/config"
+	"github.com/RoMalms10/otp-generator/messaging"
+	"github.com/RoMalms10/otp-generator/models"
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	// Deliver inline, so codes are in testSink as soon as a request returns.
+	// Tests of the delivery queue switch it on and start it for their own routers.
+	config.DeliveryQueue = config.DeliveryQueueInline
+	os.Exit(m.Run())
+}
+
+// testSink captures every OTP sent by the routers created in this package
+var testSink = messaging.NewCaptureSink()
+
+// newTestSenders creates a sender registry whose email channels deliver to
+// testSink and whose Twilio channels are disabled
+func newTestSenders() *messaging.Registry {
+	senders := messaging.NewRegistry()
+	senders.Register(models.MessageTypeEmail, testSink.Sender(models.MessageTypeEmail))
+	senders.Register(models.MessageTypeMagicLink, testSink.Sender(models.MessageTypeMagicLink))
+	senders.Disable(models.MessageTypeSMS)
+	senders.Disable(models.MessageTypeWhatsApp)
+	senders.Disable(models.MessageTypeVoice)
+	return senders
+}
+
+// lastSentOTP returns the most recent OTP captured for the recipient
+func lastSentOTP(to string) string {
+	otp, _ := testSink.LastOTP(to)
+	return otp
+}
@@ -12,28 +12,24 @@ import (
 
 	"github.com/RoMalms10/otp-generator/models"
 	"github.com/RoMalms10/otp-generator/server"
-	"github.com/go-redis/redis/v8"
+	"github.com/RoMalms10/otp-generator/service"
 	"github.com/gorilla/mux"
 )
 
-func setupRouterWithTestServer(otpTTL time.Duration) (*mux.Router, *redis.Client, context.Context) {
+func setupRouterWithTestServer(otpTTL time.Duration) (*mux.Router, service.OTPStore, context.Context) {
 	ctx := context.Background()
-	redisClient := redis.NewClient(&redis.Options{
-		Addr: "localhost:6379",
-		DB:   1,
-	})
-	router := server.NewRouter(redisClient, ctx, otpTTL)
-	return router, redisClient, ctx
+	store := service.NewMemoryStore()
+	router := server.NewRouter(store, ctx, otpTTL, newTestSenders())
+	return router, store, ctx
 }
 
 func TestOTPService(t *testing.T) {
 	otpTTL := 1 * time.Second // Default OTP TTL for tests
-	router, redisClient, ctx := setupRouterWithTestServer(otpTTL)
-	defer redisClient.FlushDB(ctx)
+	router, _, _ := setupRouterWithTestServer(otpTTL)
 
 	t.Run("Generate OTP", func(t *testing.T) {
 		t.Run("Valid Request", func(t *testing.T) {
-			body, _ := json.Marshal(models.GenerateRequest{Username: "testuser", MessageType: "email"})
+			body, _ := json.Marshal(models.GenerateRequest{Username: "testuser@example.com", MessageType: "email"})
 			req, _ := http.NewRequest("POST", "/otp/generate", bytes.NewBuffer(body))
 			rec := httptest.NewRecorder()
 
@@ -44,9 +40,9 @@ func TestOTPService(t *testing.T) {
 			var resp map[string]string
 			_ = json.Unmarshal(rec.Body.Bytes(), &resp)
 
-			otp, exists := resp["otp"]
-			assert.True(t, exists, "Expected 'otp' key in response")
-			assert.Len(t, otp, 6, "Expected OTP to be 6 digits")
+			_, exists := resp["otp"]
+			assert.False(t, exists, "Expected no 'otp' key in response outside development mode")
+			assert.Len(t, lastSentOTP("testuser@example.com"), 6, "Expected OTP to be 6 digits")
 		})
 
 		t.Run("Missing Username", func(t *testing.T) {
@@ -60,7 +56,7 @@ func TestOTPService(t *testing.T) {
 		})
 
 		t.Run("Invalid MessageType", func(t *testing.T) {
-			body, _ := json.Marshal(models.GenerateRequest{Username: "testuser", MessageType: "unsupported"})
+			body, _ := json.Marshal(models.GenerateRequest{Username: "testuser@example.com", MessageType: "unsupported"})
 			req, _ := http.NewRequest("POST", "/otp/generate", bytes.NewBuffer(body))
 			rec := httptest.NewRecorder()
 
@@ -72,16 +68,14 @@ func TestOTPService(t *testing.T) {
 
 	t.Run("Validate OTP", func(t *testing.T) {
 		// Generate an OTP for validation tests
-		body, _ := json.Marshal(models.GenerateRequest{Username: "testuser", MessageType: "email"})
+		body, _ := json.Marshal(models.GenerateRequest{Username: "testuser@example.com", MessageType: "email"})
 		req, _ := http.NewRequest("POST", "/otp/generate", bytes.NewBuffer(body))
 		rec := httptest.NewRecorder()
 		router.ServeHTTP(rec, req)
-		var resp map[string]string
-		_ = json.Unmarshal(rec.Body.Bytes(), &resp)
-		otp := resp["otp"]
+		otp := lastSentOTP("testuser@example.com")
 
 		t.Run("Valid OTP", func(t *testing.T) {
-			validateBody, _ := json.Marshal(models.ValidationRequest{Username: "testuser", OTP: otp})
+			validateBody, _ := json.Marshal(models.ValidationRequest{Username: "testuser@example.com", OTP: otp})
 			req, _ := http.NewRequest("POST", "/otp/validate", bytes.NewBuffer(validateBody))
 			rec := httptest.NewRecorder()
 
@@ -91,51 +85,48 @@ func TestOTPService(t *testing.T) {
 		})
 
 		t.Run("Invalid OTP", func(t *testing.T) {
-			validateBody, _ := json.Marshal(models.ValidationRequest{Username: "testuser", OTP: "000000"})
+			validateBody, _ := json.Marshal(models.ValidationRequest{Username: "testuser@example.com", OTP: "000000"})
 			req, _ := http.NewRequest("POST", "/otp/validate", bytes.NewBuffer(validateBody))
 			rec := httptest.NewRecorder()
 
 			router.ServeHTTP(rec, req)
 
-			assert.Equal(t, http.StatusUnauthorized, rec.Code, "Expected status 401 for invalid OTP")
+			// The OTP was consumed by the valid request, so no OTP is pending
+			assert.Equal(t, http.StatusGone, rec.Code, "Expected status 410 once no OTP is pending")
 		})
 
 		t.Run("Expired OTP", func(t *testing.T) {
 			time.Sleep(otpTTL + 1*time.Second) // Wait for OTP to expire
 
-			validateBody, _ := json.Marshal(models.ValidationRequest{Username: "testuser", OTP: otp})
+			validateBody, _ := json.Marshal(models.ValidationRequest{Username: "testuser@example.com", OTP: otp})
 			req, _ := http.NewRequest("POST", "/otp/validate", bytes.NewBuffer(validateBody))
 			rec := httptest.NewRecorder()
 
 			router.ServeHTTP(rec, req)
 
-			assert.Equal(t, http.StatusUnauthorized, rec.Code, "Expected status 401 for expired OTP")
+			assert.Equal(t, http.StatusGone, rec.Code, "Expected status 410 for expired OTP")
 		})
 	})
 
 	t.Run("Re-generate OTP Invalidates Previous", func(t *testing.T) {
-		body, _ := json.Marshal(models.GenerateRequest{Username: "testuser", MessageType: "email"})
+		body, _ := json.Marshal(models.GenerateRequest{Username: "testuser@example.com", MessageType: "email"})
 
 		// Generate the first OTP
 		req, _ := http.NewRequest("POST", "/otp/generate", bytes.NewBuffer(body))
 		rec := httptest.NewRecorder()
 		router.ServeHTTP(rec, req)
-		var firstResp map[string]string
-		_ = json.Unmarshal(rec.Body.Bytes(), &firstResp)
-		firstOTP := firstResp["otp"]
+		firstOTP := lastSentOTP("testuser@example.com")
 
 		// Generate a new OTP for the same user
 		req, _ = http.NewRequest("POST", "/otp/generate", bytes.NewBuffer(body))
 		rec = httptest.NewRecorder()
 		router.ServeHTTP(rec, req)
-		var secondResp map[string]string
-		_ = json.Unmarshal(rec.Body.Bytes(), &secondResp)
-		secondOTP := secondResp["otp"]
+		secondOTP := lastSentOTP("testuser@example.com")
 
 		assert.NotEqual(t, firstOTP, secondOTP, "New OTP should replace the previous one")
 
 		// Validate first (old) OTP (should fail)
-		validateBody, _ := json.Marshal(models.ValidationRequest{Username: "testuser", OTP: firstOTP})
+		validateBody, _ := json.Marshal(models.ValidationRequest{Username: "testuser@example.com", OTP: firstOTP})
 		req, _ = http.NewRequest("POST", "/otp/validate", bytes.NewBuffer(validateBody))
 		rec = httptest.NewRecorder()
 
@@ -143,7 +134,7 @@ func TestOTPService(t *testing.T) {
 		assert.Equal(t, http.StatusUnauthorized, rec.Code, "Old OTP should no longer be valid")
 
 		// Validate second (new) OTP (should succeed)
-		validateBody, _ = json.Marshal(models.ValidationRequest{Username: "testuser", OTP: secondOTP})
+		validateBody, _ = json.Marshal(models.ValidationRequest{Username: "testuser@example.com", OTP: secondOTP})
 		req, _ = http.NewRequest("POST", "/otp/validate", bytes.NewBuffer(validateBody))
 		rec = httptest.NewRecorder()
 
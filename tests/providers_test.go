@@ -0,0 +1,321 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/RoMalms10/otp-generator/messaging"
+	"github.com/RoMalms10/otp-generator/models"
+	"github.com/RoMalms10/otp-generator/server"
+	"github.com/RoMalms10/otp-generator/service"
+)
+
+// providerRequest is a request made to fakeProvider
+type providerRequest struct {
+	Method string
+	Path   string
+	Header http.Header
+	Body   []byte
+}
+
+// Form parses the request body as a form
+func (p providerRequest) Form() url.Values {
+	form, _ := url.ParseQuery(string(p.Body))
+	return form
+}
+
+// fakeProvider is a stand-in for a provider API that records each request
+// and answers with a fixed status and body
+type fakeProvider struct {
+	mu       sync.Mutex
+	status   int
+	response string
+	requests []providerRequest
+}
+
+func newFakeProvider(t *testing.T, status int, response string) (*fakeProvider, string) {
+	provider := &fakeProvider{status: status, response: response}
+	apiServer := httptest.NewServer(provider)
+	t.Cleanup(apiServer.Close)
+	return provider, apiServer.URL
+}
+
+func (f *fakeProvider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	f.mu.Lock()
+	f.requests = append(f.requests, providerRequest{Method: r.Method, Path: r.URL.Path, Header: r.Header.Clone(), Body: body})
+	f.mu.Unlock()
+
+	w.WriteHeader(f.status)
+	_, _ = io.WriteString(w, f.response)
+}
+
+// last returns the latest request
+func (f *fakeProvider) last() providerRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests[len(f.requests)-1]
+}
+
+func (f *fakeProvider) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.requests)
+}
+
+func TestVonageService(t *testing.T) {
+	t.Run("Sends SMS", func(t *testing.T) {
+		api, baseURL := newFakeProvider(t, http.StatusOK,
+			`{"message-count":"1","messages":[{"to":"14155550170","message-id":"0A0000001234ABCD","status":"0"}]}`)
+		vonage := messaging.NewVonageService(messaging.VonageConfig{
+			APIKey: "key", APISecret: "secret", From: "Acme", BaseURL: baseURL,
+		})
+
+		id, err := vonage.SendSMS("+14155550170", "Your code is 123456")
+		assert.NoError(t, err)
+		assert.Equal(t, "0A0000001234ABCD", id)
+
+		req := api.last()
+		assert.Equal(t, "POST", req.Method)
+		assert.Equal(t, "/sms/json", req.Path)
+		form := req.Form()
+		assert.Equal(t, "key", form.Get("api_key"))
+		assert.Equal(t, "secret", form.Get("api_secret"))
+		assert.Equal(t, "Acme", form.Get("from"))
+		assert.Equal(t, "14155550170", form.Get("to"), "Expected the number without a leading +")
+		assert.Equal(t, "Your code is 123456", form.Get("text"))
+		assert.Empty(t, form.Get("type"), "Expected GSM-7 text to be sent as text")
+	})
+
+	t.Run("Sends UCS-2 As Unicode", func(t *testing.T) {
+		api, baseURL := newFakeProvider(t, http.StatusOK, `{"messages":[{"message-id":"1","status":"0"}]}`)
+		vonage := messaging.NewVonageService(messaging.VonageConfig{APIKey: "key", APISecret: "secret", From: "Acme", BaseURL: baseURL})
+
+		assert.NoError(t, vonage.SendOTP("+14155550171", "123456 ✓"))
+		assert.Equal(t, "unicode", api.last().Form().Get("type"))
+	})
+
+	t.Run("Reports Rejected Messages", func(t *testing.T) {
+		_, baseURL := newFakeProvider(t, http.StatusOK,
+			`{"message-count":"1","messages":[{"status":"4","error-text":"Bad Credentials"}]}`)
+		vonage := messaging.NewVonageService(messaging.VonageConfig{APIKey: "key", APISecret: "wrong", From: "Acme", BaseURL: baseURL})
+
+		_, err := vonage.SendSMS("+14155550172", "Your code is 123456")
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "Bad Credentials")
+		}
+	})
+
+	t.Run("Treats An Unreadable Response As Sent", func(t *testing.T) {
+		api, baseURL := newFakeProvider(t, http.StatusOK, `{"messages":[{"message-id"`)
+		vonage := messaging.NewVonageService(messaging.VonageConfig{APIKey: "key", APISecret: "secret", From: "Acme", BaseURL: baseURL})
+
+		id, err := vonage.SendSMS("+14155550174", "Your code is 123456")
+		assert.NoError(t, err, "Expected an accepted message not to be sent again")
+		assert.Empty(t, id)
+		assert.Equal(t, 1, api.count())
+	})
+
+	t.Run("Reports Failed Requests", func(t *testing.T) {
+		_, baseURL := newFakeProvider(t, http.StatusInternalServerError, "")
+		vonage := messaging.NewVonageService(messaging.VonageConfig{APIKey: "key", APISecret: "secret", From: "Acme", BaseURL: baseURL})
+
+		_, err := vonage.SendMessage(messaging.Message{To: "+14155550173", Text: "Your code is 123456"})
+		assert.Error(t, err)
+	})
+}
+
+func TestSignAWSRequest(t *testing.T) {
+	// The example request from the AWS Signature Version 4 documentation
+	req, _ := http.NewRequest("GET", "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", nil)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	at := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+
+	messaging.SignAWSRequest(req, nil, messaging.AWSCredentials{
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	}, "us-east-1", "iam", at)
+
+	assert.Equal(t, "20150830T123600Z", req.Header.Get("X-Amz-Date"))
+	assert.Equal(t, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, "+
+		"SignedHeaders=content-type;host;x-amz-date, "+
+		"Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7",
+		req.Header.Get("Authorization"))
+	assert.Empty(t, req.Header.Get("X-Amz-Security-Token"))
+}
+
+func TestSNSService(t *testing.T) {
+	const published = `<PublishResponse xmlns="https://sns.amazonaws.com/doc/2010-03-31/">
+  <PublishResult><MessageId>94f20ce6-13c5-43a0-9a9e-ca52d816e90b</MessageId></PublishResult>
+</PublishResponse>`
+	credentials := messaging.AWSCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "secret", SessionToken: "session"}
+	newSNS := func(baseURL string) *messaging.SNSService {
+		return messaging.NewSNSService(messaging.SNSConfig{
+			AccessKeyID:     credentials.AccessKeyID,
+			SecretAccessKey: credentials.SecretAccessKey,
+			SessionToken:    credentials.SessionToken,
+			Region:          "eu-west-1",
+			SenderID:        "Acme",
+			SMSType:         "Transactional",
+			BaseURL:         baseURL,
+		})
+	}
+
+	t.Run("Publishes SMS", func(t *testing.T) {
+		api, baseURL := newFakeProvider(t, http.StatusOK, published)
+
+		id, err := newSNS(baseURL).SendSMS("+14155550180", "Your code is 123456")
+		assert.NoError(t, err)
+		assert.Equal(t, "94f20ce6-13c5-43a0-9a9e-ca52d816e90b", id)
+
+		req := api.last()
+		assert.Equal(t, "POST", req.Method)
+		assert.Equal(t, "/", req.Path)
+		form := req.Form()
+		assert.Equal(t, "Publish", form.Get("Action"))
+		assert.Equal(t, "2010-03-31", form.Get("Version"))
+		assert.Equal(t, "+14155550180", form.Get("PhoneNumber"))
+		assert.Equal(t, "Your code is 123456", form.Get("Message"))
+		assert.Equal(t, "AWS.SNS.SMS.SenderID", form.Get("MessageAttributes.entry.1.Name"))
+		assert.Equal(t, "Acme", form.Get("MessageAttributes.entry.1.Value.StringValue"))
+		assert.Equal(t, "AWS.SNS.SMS.SMSType", form.Get("MessageAttributes.entry.2.Name"))
+		assert.Equal(t, "Transactional", form.Get("MessageAttributes.entry.2.Value.StringValue"))
+		assert.Equal(t, "session", req.Header.Get("X-Amz-Security-Token"))
+	})
+
+	t.Run("Signs Requests", func(t *testing.T) {
+		api, baseURL := newFakeProvider(t, http.StatusOK, published)
+		assert.NoError(t, newSNS(baseURL).SendOTP("+14155550181", "123456"))
+		req := api.last()
+
+		authorization := req.Header.Get("Authorization")
+		assert.True(t, strings.HasPrefix(authorization, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/"), authorization)
+		assert.Contains(t, authorization, "/eu-west-1/sns/aws4_request")
+		assert.Contains(t, authorization, "SignedHeaders=content-type;host;x-amz-date;x-amz-security-token,")
+
+		// Signing the received request again must give the same signature
+		at, err := time.Parse("20060102T150405Z", req.Header.Get("X-Amz-Date"))
+		assert.NoError(t, err)
+		resigned, _ := http.NewRequest(req.Method, baseURL+req.Path, bytes.NewReader(req.Body))
+		resigned.Header.Set("Content-Type", req.Header.Get("Content-Type"))
+		messaging.SignAWSRequest(resigned, req.Body, credentials, "eu-west-1", "sns", at)
+		assert.Equal(t, resigned.Header.Get("Authorization"), authorization)
+	})
+
+	t.Run("Reports AWS Errors", func(t *testing.T) {
+		_, baseURL := newFakeProvider(t, http.StatusForbidden, `<ErrorResponse><Error><Type>Sender</Type>
+  <Code>SignatureDoesNotMatch</Code><Message>The request signature does not match.</Message></Error></ErrorResponse>`)
+
+		_, err := newSNS(baseURL).SendMessage(messaging.Message{To: "+14155550182", Text: "Your code is 123456"})
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "SignatureDoesNotMatch")
+		}
+	})
+
+	t.Run("Treats An Unreadable Response As Sent", func(t *testing.T) {
+		api, baseURL := newFakeProvider(t, http.StatusOK, "<PublishResponse><PublishResult>")
+
+		id, err := newSNS(baseURL).SendSMS("+14155550183", "Your code is 123456")
+		assert.NoError(t, err, "Expected a published message not to be sent again")
+		assert.Empty(t, id)
+		assert.Equal(t, 1, api.count())
+	})
+
+	t.Run("Defaults To The Regional Endpoint", func(t *testing.T) {
+		sns := messaging.NewSNSService(messaging.SNSConfig{Region: "ap-southeast-2"})
+		assert.Equal(t, "https://sns.ap-southeast-2.amazonaws.com", sns.Config.BaseURL)
+	})
+}
+
+func TestWebhookService(t *testing.T) {
+	t.Run("Posts Signed JSON", func(t *testing.T) {
+		api, baseURL := newFakeProvider(t, http.StatusAccepted, `{"id":"msg-1"}`)
+		webhook := messaging.NewWebhookService(messaging.WebhookConfig{
+			URL:     baseURL + "/send",
+			Channel: "sms",
+			Secret:  "webhook-secret",
+			Headers: map[string]string{"Authorization": "Bearer abc123"},
+		})
+
+		id, err := webhook.Send(messaging.Message{To: "+14155550190", Code: "123456", Text: "Your code is 123456"})
+		assert.NoError(t, err)
+		assert.Equal(t, "msg-1", id)
+
+		req := api.last()
+		assert.Equal(t, "/send", req.Path)
+		assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+		assert.Equal(t, "Bearer abc123", req.Header.Get("Authorization"))
+		assert.Equal(t, messaging.WebhookSignature("webhook-secret", req.Body), req.Header.Get(messaging.WebhookSignatureHeader))
+
+		var payload messaging.WebhookPayload
+		assert.NoError(t, json.Unmarshal(req.Body, &payload))
+		assert.Equal(t, "sms", payload.Channel)
+		assert.Equal(t, "+14155550190", payload.To)
+		assert.Equal(t, "123456", payload.Code)
+		assert.Equal(t, "Your code is 123456", payload.Text)
+		assert.InDelta(t, time.Now().Unix(), payload.Timestamp, 5)
+	})
+
+	t.Run("Needs No Response Body", func(t *testing.T) {
+		api, baseURL := newFakeProvider(t, http.StatusNoContent, "")
+		webhook := messaging.NewWebhookService(messaging.WebhookConfig{URL: baseURL, Channel: "sms"})
+
+		assert.NoError(t, webhook.SendOTP("+14155550191", "123456"))
+		assert.Empty(t, api.last().Header.Get(messaging.WebhookSignatureHeader), "Expected no signature without a secret")
+	})
+
+	t.Run("Reports Failed Requests", func(t *testing.T) {
+		_, baseURL := newFakeProvider(t, http.StatusBadGateway, "")
+		webhook := messaging.NewWebhookService(messaging.WebhookConfig{URL: baseURL, Channel: "sms"})
+
+		assert.Error(t, webhook.SendOTP("+14155550192", "123456"))
+	})
+}
+
+func TestFailoverSender(t *testing.T) {
+	t.Run("Fails Over To The Next Provider", func(t *testing.T) {
+		down, downURL := newFakeProvider(t, http.StatusServiceUnavailable, "")
+		up, upURL := newFakeProvider(t, http.StatusOK, `{"messages":[{"message-id":"1","status":"0"}]}`)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		senders := newTestSenders()
+		senders.Register(models.MessageTypeSMS, messaging.NewFailoverSender(
+			messaging.Provider{Name: "webhook", Sender: messaging.NewWebhookService(messaging.WebhookConfig{URL: downURL, Channel: "sms"})},
+			messaging.Provider{Name: "vonage", Sender: messaging.NewVonageService(messaging.VonageConfig{APIKey: "key", APISecret: "secret", From: "Acme", BaseURL: upURL})},
+		))
+		r := server.NewRouter(service.NewMemoryStore(), ctx, time.Minute, senders)
+
+		rec := postJSON(r, "/otp/generate", models.GenerateRequest{Username: "+14155550195", MessageType: "sms"})
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, 1, down.count())
+		if assert.Equal(t, 1, up.count()) {
+			assert.Regexp(t, `\d{6}`, up.last().Form().Get("text"))
+		}
+	})
+
+	t.Run("Fails When Every Provider Fails", func(t *testing.T) {
+		_, firstURL := newFakeProvider(t, http.StatusInternalServerError, "")
+		_, secondURL := newFakeProvider(t, http.StatusInternalServerError, "")
+		failover := messaging.NewFailoverSender(
+			messaging.Provider{Name: "first", Sender: messaging.NewWebhookService(messaging.WebhookConfig{URL: firstURL})},
+			messaging.Provider{Name: "second", Sender: messaging.NewWebhookService(messaging.WebhookConfig{URL: secondURL})},
+		)
+
+		_, err := failover.SendMessage(messaging.Message{To: "+14155550196", Text: "Your code is 123456"})
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "first: ")
+			assert.Contains(t, err.Error(), "second: ")
+		}
+	})
+}
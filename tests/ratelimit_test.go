@@ -0,0 +1,142 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RoMalms10/otp-generator/config"
+	"github.com/RoMalms10/otp-generator/models"
+	"github.com/gorilla/mux"
+)
+
+// generateFromIP sends a generate request for the user from the given client address
+func generateFromIP(r *mux.Router, username, remoteAddr string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(models.GenerateRequest{Username: username, MessageType: "email"})
+	req, _ := http.NewRequest("POST", "/otp/generate", bytes.NewBuffer(body))
+	req.RemoteAddr = remoteAddr
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestRateLimiting(t *testing.T) {
+	defaults := []int{config.RateLimitPerUsername, config.RateLimitPerIP, config.RateLimitPerDestination, config.RateLimitGlobal}
+	defer func() {
+		config.RateLimitPerUsername, config.RateLimitPerIP = defaults[0], defaults[1]
+		config.RateLimitPerDestination, config.RateLimitGlobal = defaults[2], defaults[3]
+	}()
+	config.RateLimitPerUsername = 2
+	config.RateLimitPerIP = 4
+	config.RateLimitPerDestination = 0
+	config.RateLimitGlobal = 6
+
+	t.Run("Per Username", func(t *testing.T) {
+		r, _, _ := setupTestServerWithTTL(time.Minute)
+
+		for i := 0; i < 2; i++ {
+			rec := generateFromIP(r, "limiteduser@example.com", "192.0.2.1:1234")
+			assert.Equal(t, http.StatusOK, rec.Code, "Expected requests within the budget to succeed")
+		}
+
+		rec := generateFromIP(r, "limiteduser@example.com", "192.0.2.2:1234")
+		assert.Equal(t, http.StatusTooManyRequests, rec.Code, "Expected status 429 over the username budget")
+		assert.Contains(t, rec.Body.String(), `"code":"rate_limited"`)
+
+		retryAfter, err := strconv.Atoi(rec.Header().Get("Retry-After"))
+		assert.NoError(t, err, "Expected a numeric Retry-After header")
+		assert.True(t, retryAfter > 0 && retryAfter <= int(config.RateLimitWindow.Seconds()))
+	})
+
+	t.Run("Per IP", func(t *testing.T) {
+		r, _, _ := setupTestServerWithTTL(time.Minute)
+
+		for i := 0; i < 4; i++ {
+			rec := generateFromIP(r, "ipuser"+strconv.Itoa(i)+"@example.com", "192.0.2.1:1234")
+			assert.Equal(t, http.StatusOK, rec.Code)
+		}
+
+		rec := generateFromIP(r, "ipuser4@example.com", "192.0.2.1:5678")
+		assert.Equal(t, http.StatusTooManyRequests, rec.Code, "Expected status 429 over the IP budget")
+
+		rec = generateFromIP(r, "ipuser4@example.com", "192.0.2.2:1234")
+		assert.Equal(t, http.StatusOK, rec.Code, "Expected other IPs to be unaffected")
+	})
+
+	t.Run("Per IP Behind A Proxy", func(t *testing.T) {
+		defer func(trust bool) { config.TrustForwardedFor = trust }(config.TrustForwardedFor)
+		config.TrustForwardedFor = true
+		r, _, _ := setupTestServerWithTTL(time.Minute)
+
+		// The client prepends a new address each time; the proxy appends the real one
+		for i := 0; i < 5; i++ {
+			body, _ := json.Marshal(models.GenerateRequest{Username: "proxied" + strconv.Itoa(i) + "@example.com", MessageType: "email"})
+			req, _ := http.NewRequest("POST", "/otp/generate", bytes.NewBuffer(body))
+			req.RemoteAddr = "10.0.0.1:1234"
+			req.Header.Set("X-Forwarded-For", "203.0.113."+strconv.Itoa(i)+", 198.51.100.7")
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+
+			if i < 4 {
+				assert.Equal(t, http.StatusOK, rec.Code)
+			} else {
+				assert.Equal(t, http.StatusTooManyRequests, rec.Code, "Expected spoofed addresses not to escape the IP budget")
+			}
+		}
+	})
+
+	t.Run("Global", func(t *testing.T) {
+		r, _, _ := setupTestServerWithTTL(time.Minute)
+
+		for i := 0; i < 6; i++ {
+			rec := generateFromIP(r, "globaluser"+strconv.Itoa(i)+"@example.com", "192.0.2."+strconv.Itoa(i)+":1234")
+			assert.Equal(t, http.StatusOK, rec.Code)
+		}
+
+		rec := generateFromIP(r, "globaluser6@example.com", "192.0.2.6:1234")
+		assert.Equal(t, http.StatusTooManyRequests, rec.Code, "Expected status 429 over the global budget")
+	})
+}
+
+func TestRateLimitDeniedRequestsNotCounted(t *testing.T) {
+	defaults := []int{config.RateLimitPerUsername, config.RateLimitPerIP, config.RateLimitPerDestination, config.RateLimitGlobal}
+	defer func() {
+		config.RateLimitPerUsername, config.RateLimitPerIP = defaults[0], defaults[1]
+		config.RateLimitPerDestination, config.RateLimitGlobal = defaults[2], defaults[3]
+	}()
+	config.RateLimitPerUsername = 2
+	config.RateLimitPerIP = 0
+	config.RateLimitPerDestination = 0
+	config.RateLimitGlobal = 4
+
+	r, _, _ := setupTestServerWithTTL(time.Minute)
+
+	// Flooding one username is denied by its own budget and leaves the global budget alone
+	for i := 0; i < 10; i++ {
+		generateFromIP(r, "flooded@example.com", "192.0.2."+strconv.Itoa(i)+":1234")
+	}
+
+	for i := 0; i < 2; i++ {
+		rec := generateFromIP(r, "bystander"+strconv.Itoa(i)+"@example.com", "198.51.100.1:1234")
+		assert.Equal(t, http.StatusOK, rec.Code, "Expected other users to keep the global budget")
+	}
+	rec := generateFromIP(r, "bystander2@example.com", "198.51.100.1:1234")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code, "Expected status 429 once the global budget is used")
+}
+
+func TestRateLimitBodySize(t *testing.T) {
+	r, _, _ := setupTestServerWithTTL(time.Minute)
+
+	body := `{"username":"big@example.com","messageType":"email","padding":"` + strings.Repeat("x", 1<<20) + `"}`
+	req, _ := http.NewRequest("POST", "/otp/generate", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code, "Expected an oversized body to be refused")
+	assert.Contains(t, rec.Body.String(), `"code":"invalid_request"`)
+}
@@ -0,0 +1,149 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RoMalms10/otp-generator/models"
+	"github.com/RoMalms10/otp-generator/server"
+	"github.com/RoMalms10/otp-generator/service"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// verifiedSession generates and validates an OTP for the user and returns the verified session's ID
+func verifiedSession(t *testing.T, r *mux.Router, username string) string {
+	sessionID, otp := startSession(t, r, username, "")
+	rec := validateSession(r, sessionID, otp)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	return sessionID
+}
+
+// generateRecoveryCodes requests recovery codes from path with a freshly verified session and returns them
+func generateRecoveryCodes(t *testing.T, r *mux.Router, path, username string, count int) []string {
+	sessionID := verifiedSession(t, r, username)
+	rec := postJSON(r, path, models.RecoveryCodesRequest{Username: username, SessionID: sessionID, Count: count})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	var resp struct {
+		Codes []string `json:"codes"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	return resp.Codes
+}
+
+// validateRecoveryCode submits a recovery code and returns the status and remaining count
+func validateRecoveryCode(r *mux.Router, username, code string) (int, int) {
+	rec := postJSON(r, "/otp/validate", models.ValidationRequest{Username: username, OTP: code, Recovery: true})
+
+	var resp struct {
+		Remaining int `json:"remaining"`
+	}
+	_ = json.Unmarshal(rec.Body.Bytes(), &resp)
+	return rec.Code, resp.Remaining
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	r, _, _ := setupTestServerWithTTL(time.Minute)
+
+	t.Run("Generate Once", func(t *testing.T) {
+		codes := generateRecoveryCodes(t, r, "/recovery/generate", "lostphone@example.com", 0)
+		assert.Len(t, codes, 10, "Expected the default number of codes")
+		for _, code := range codes {
+			assert.Regexp(t, `^[2-9A-HJKMNP-Z]{5}-[2-9A-HJKMNP-Z]{5}$`, code)
+		}
+
+		sessionID := verifiedSession(t, r, "lostphone@example.com")
+		rec := postJSON(r, "/recovery/generate", models.RecoveryCodesRequest{Username: "lostphone@example.com", SessionID: sessionID})
+		assert.Equal(t, http.StatusConflict, rec.Code, "Expected existing codes not to be replaced silently")
+		assert.Contains(t, rec.Body.String(), `"code":"recovery_codes_exist"`)
+	})
+
+	t.Run("Consume And Count Down", func(t *testing.T) {
+		codes := generateRecoveryCodes(t, r, "/recovery/generate", "countdown@example.com", 3)
+
+		status, remaining := validateRecoveryCode(r, "countdown@example.com", strings.ToLower(codes[1]))
+		assert.Equal(t, http.StatusOK, status, "Expected case to be ignored")
+		assert.Equal(t, 2, remaining)
+
+		status, _ = validateRecoveryCode(r, "countdown@example.com", codes[1])
+		assert.Equal(t, http.StatusUnauthorized, status, "Expected a used code to be rejected")
+
+		status, remaining = validateRecoveryCode(r, "countdown@example.com", strings.ReplaceAll(codes[0], "-", " "))
+		assert.Equal(t, http.StatusOK, status, "Expected separators to be ignored")
+		assert.Equal(t, 1, remaining)
+	})
+
+	t.Run("Regenerate Invalidates Old Set", func(t *testing.T) {
+		old := generateRecoveryCodes(t, r, "/recovery/generate", "rotate@example.com", 2)
+		fresh := generateRecoveryCodes(t, r, "/recovery/regenerate", "rotate@example.com", 4)
+		assert.Len(t, fresh, 4)
+
+		status, _ := validateRecoveryCode(r, "rotate@example.com", old[0])
+		assert.Equal(t, http.StatusUnauthorized, status, "Expected old codes to be invalid")
+
+		status, remaining := validateRecoveryCode(r, "rotate@example.com", fresh[0])
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, 3, remaining)
+	})
+
+	t.Run("Requires A Verified Session", func(t *testing.T) {
+		codes := generateRecoveryCodes(t, r, "/recovery/generate", "victim@example.com", 2)
+
+		rec := postJSON(r, "/recovery/regenerate", models.RecoveryCodesRequest{Username: "victim@example.com"})
+		assert.Equal(t, http.StatusForbidden, rec.Code, "Expected regenerating without a session to be refused")
+		assert.Contains(t, rec.Body.String(), `"code":"verification_required"`)
+
+		pending, _ := startSession(t, r, "victim@example.com", "")
+		rec = postJSON(r, "/recovery/regenerate", models.RecoveryCodesRequest{Username: "victim@example.com", SessionID: pending})
+		assert.Equal(t, http.StatusForbidden, rec.Code, "Expected an unverified session to be refused")
+
+		other := verifiedSession(t, r, "attacker@example.com")
+		rec = postJSON(r, "/recovery/regenerate", models.RecoveryCodesRequest{Username: "victim@example.com", SessionID: other})
+		assert.Equal(t, http.StatusForbidden, rec.Code, "Expected another user's session to be refused")
+
+		status, remaining := validateRecoveryCode(r, "victim@example.com", codes[0])
+		assert.Equal(t, http.StatusOK, status, "Expected the victim's codes to be kept")
+		assert.Equal(t, 1, remaining)
+
+		sessionID := verifiedSession(t, r, "victim@example.com")
+		rec = postJSON(r, "/recovery/regenerate", models.RecoveryCodesRequest{Username: "victim@example.com", SessionID: sessionID})
+		assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		rec = postJSON(r, "/recovery/regenerate", models.RecoveryCodesRequest{Username: "victim@example.com", SessionID: sessionID})
+		assert.Equal(t, http.StatusForbidden, rec.Code, "Expected a session to authorize only one change")
+	})
+
+	t.Run("No Codes", func(t *testing.T) {
+		status, _ := validateRecoveryCode(r, "nocodes@example.com", "AAAAA-BBBBB")
+		assert.Equal(t, http.StatusNotFound, status)
+	})
+
+	t.Run("Invalid Count", func(t *testing.T) {
+		sessionID := verifiedSession(t, r, "greedy@example.com")
+		rec := postJSON(r, "/recovery/generate", models.RecoveryCodesRequest{Username: "greedy@example.com", SessionID: sessionID, Count: 1000})
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+}
+
+func TestRecoveryCodesStoredHashed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "otp-store.json")
+	store, err := service.NewFileStore(path)
+	require.NoError(t, err)
+	r := server.NewRouter(store, context.Background(), time.Minute, newTestSenders())
+
+	codes := generateRecoveryCodes(t, r, "/recovery/generate", "hashed@example.com", 5)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	for _, code := range codes {
+		assert.NotContains(t, string(data), code)
+		assert.NotContains(t, string(data), strings.ReplaceAll(code, "-", ""))
+	}
+}
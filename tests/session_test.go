@@ -0,0 +1,141 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/RoMalms10/otp-generator/models"
+	"github.com/RoMalms10/otp-generator/server"
+	"github.com/RoMalms10/otp-generator/service"
+	"github.com/gorilla/mux"
+)
+
+// startSession generates an OTP for the user and purpose and returns the session ID and code
+func startSession(t *testing.T, r *mux.Router, username, purpose string) (string, string) {
+	body, _ := json.Marshal(models.GenerateRequest{Username: username, MessageType: "email", Purpose: purpose})
+	req, _ := http.NewRequest("POST", "/otp/generate", bytes.NewBuffer(body))
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code, "Expected status 200 generating OTP")
+
+	var resp map[string]string
+	_ = json.Unmarshal(rec.Body.Bytes(), &resp)
+	assert.NotEmpty(t, resp["sessionId"], "Expected 'sessionId' key in response")
+	return resp["sessionId"], lastSentOTP(username)
+}
+
+// validateSession submits an OTP for a session ID and returns the recorded response
+func validateSession(r *mux.Router, sessionID, otp string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(models.ValidationRequest{SessionID: sessionID, OTP: otp})
+	req, _ := http.NewRequest("POST", "/otp/validate", bytes.NewBuffer(body))
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	return rec
+}
+
+// getSession fetches the status of a session
+func getSession(t *testing.T, r *mux.Router, sessionID string) (int, models.Session) {
+	req, _ := http.NewRequest("GET", "/otp/sessions/"+sessionID, nil)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+
+	var session models.Session
+	_ = json.Unmarshal(rec.Body.Bytes(), &session)
+	return rec.Code, session
+}
+
+func TestVerificationSessions(t *testing.T) {
+	r, _, _ := setupTestServerWithTTL(time.Minute)
+
+	t.Run("Validate By Session ID", func(t *testing.T) {
+		sessionID, otp := startSession(t, r, "sessionuser@example.com", "")
+
+		code, session := getSession(t, r, sessionID)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, models.SessionStatusPending, session.Status)
+		assert.Equal(t, "email", session.Channel)
+		assert.Equal(t, "s***@example.com", session.Destination, "Expected the destination to be masked")
+
+		rec := validateSession(r, sessionID, wrongOTP(otp))
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+		_, session = getSession(t, r, sessionID)
+		assert.Equal(t, 1, session.Attempts, "Expected the failed attempt to be recorded")
+
+		rec = validateSession(r, sessionID, otp)
+		assert.Equal(t, http.StatusOK, rec.Code, "Expected status 200 for valid OTP")
+		_, session = getSession(t, r, sessionID)
+		assert.Equal(t, models.SessionStatusVerified, session.Status)
+		assert.NotNil(t, session.VerifiedAt)
+	})
+
+	t.Run("Concurrent Purposes", func(t *testing.T) {
+		loginID, loginOTP := startSession(t, r, "purposeuser@example.com", "login")
+		resetID, resetOTP := startSession(t, r, "purposeuser@example.com", "password_reset")
+		assert.NotEqual(t, loginID, resetID)
+
+		assert.Equal(t, http.StatusOK, validateSession(r, resetID, resetOTP).Code)
+		assert.Equal(t, http.StatusOK, validateSession(r, loginID, loginOTP).Code)
+	})
+
+	t.Run("Same Purpose Supersedes", func(t *testing.T) {
+		firstID, firstOTP := startSession(t, r, "supersedeuser@example.com", "login")
+		secondID, _ := startSession(t, r, "supersedeuser@example.com", "login")
+
+		_, session := getSession(t, r, firstID)
+		assert.Equal(t, models.SessionStatusSuperseded, session.Status)
+
+		rec := validateSession(r, firstID, firstOTP)
+		assert.Equal(t, http.StatusGone, rec.Code, "Expected superseded session to be rejected")
+
+		_, session = getSession(t, r, secondID)
+		assert.Equal(t, models.SessionStatusPending, session.Status)
+	})
+
+	t.Run("Resend By Session ID", func(t *testing.T) {
+		sessionID, _ := startSession(t, r, "resendsession@example.com", "")
+
+		body, _ := json.Marshal(models.ResendRequest{SessionID: sessionID})
+		req, _ := http.NewRequest("POST", "/otp/resend", bytes.NewBuffer(body))
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code, "Expected status 200 for resend")
+
+		rec = validateSession(r, sessionID, lastSentOTP("resendsession@example.com"))
+		assert.Equal(t, http.StatusOK, rec.Code, "Expected resent code to validate")
+	})
+
+	t.Run("Unknown Session", func(t *testing.T) {
+		code, _ := getSession(t, r, "does-not-exist")
+		assert.Equal(t, http.StatusNotFound, code)
+
+		rec := validateSession(r, "does-not-exist", "123456")
+		assert.Equal(t, http.StatusGone, rec.Code)
+	})
+}
+
+func TestUsernamesNotInStoreKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "otp-store.json")
+	store, err := service.NewFileStore(path)
+	assert.NoError(t, err)
+	r := server.NewRouter(store, context.Background(), time.Minute, newTestSenders())
+
+	startSession(t, r, "secretuser@example.com", "login")
+
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+
+	var entries map[string]json.RawMessage
+	assert.NoError(t, json.Unmarshal(data, &entries))
+	assert.NotEmpty(t, entries)
+	for key := range entries {
+		assert.NotContains(t, key, "secretuser", "Expected username not to appear in store keys")
+	}
+}
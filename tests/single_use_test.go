@@ -0,0 +1,89 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/RoMalms10/otp-generator/server"
+	"github.com/RoMalms10/otp-generator/service"
+)
+
+// failingStore is an OTPStore whose Set fails for keys with a prefix while failing is set
+type failingStore struct {
+	service.OTPStore
+	prefix  string
+	failing atomic.Bool
+}
+
+func (s *failingStore) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	if s.failing.Load() && strings.HasPrefix(key, s.prefix) {
+		return errors.New("store unavailable")
+	}
+	return s.OTPStore.Set(ctx, key, value, ttl)
+}
+
+func TestSingleUseOTP(t *testing.T) {
+	r, _, _ := setupTestServerWithTTL(time.Minute)
+
+	t.Run("Replay Is Rejected", func(t *testing.T) {
+		otp := generateTestOTP(t, r, "singleuse@example.com")
+
+		rec := validateTestOTP(r, "singleuse@example.com", otp)
+		assert.Equal(t, http.StatusOK, rec.Code, "Expected first validation to succeed")
+
+		rec = validateTestOTP(r, "singleuse@example.com", otp)
+		assert.Equal(t, http.StatusConflict, rec.Code, "Expected replay to be rejected")
+		assert.Contains(t, rec.Body.String(), `"code":"otp_already_used"`)
+
+		rec = validateTestOTP(r, "singleuse@example.com", wrongOTP(otp))
+		assert.Contains(t, rec.Body.String(), `"code":"otp_expired"`, "Expected other codes to report expiry")
+	})
+
+	t.Run("Concurrent Validations", func(t *testing.T) {
+		const parallelCount = 10
+		otp := generateTestOTP(t, r, "concurrent@example.com")
+
+		var wg sync.WaitGroup
+		codes := make(chan int, parallelCount)
+		for i := 0; i < parallelCount; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				codes <- validateTestOTP(r, "concurrent@example.com", otp).Code
+			}()
+		}
+		wg.Wait()
+		close(codes)
+
+		successes := 0
+		for code := range codes {
+			if code == http.StatusOK {
+				successes++
+			}
+		}
+		assert.Equal(t, 1, successes, "Expected exactly one concurrent validation to succeed")
+	})
+}
+
+func TestValidationFailsWhenSessionIsNotSaved(t *testing.T) {
+	store := &failingStore{OTPStore: service.NewMemoryStore(), prefix: "session:"}
+	r := server.NewRouter(store, context.Background(), time.Minute, newTestSenders())
+	sessionID, otp := startSession(t, r, "unsaved@example.com", "")
+
+	store.failing.Store(true)
+	rec := validateSession(r, sessionID, otp)
+	store.failing.Store(false)
+	assert.Equal(t, http.StatusInternalServerError, rec.Code, "Expected validation not to succeed unless the session is marked verified")
+	assert.Contains(t, rec.Body.String(), `"code":"internal_error"`)
+	assert.NotContains(t, rec.Body.String(), "store unavailable", "Expected the store error to stay on the server")
+
+	_, session := getSession(t, r, sessionID)
+	assert.NotEqual(t, "verified", session.Status)
+}
@@ -0,0 +1,217 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RoMalms10/otp-generator/config"
+	"github.com/RoMalms10/otp-generator/messaging"
+	"github.com/RoMalms10/otp-generator/models"
+	"github.com/RoMalms10/otp-generator/server"
+	"github.com/RoMalms10/otp-generator/service"
+	"github.com/gorilla/mux"
+)
+
+func TestSMSSize(t *testing.T) {
+	assert.Equal(t, messaging.EncodingGSM7, messaging.SMSEncoding("Your code is 123456 @ £5"))
+	assert.Equal(t, 140, messaging.SMSSize(strings.Repeat("a", 160)), "Expected 160 GSM-7 characters to fill an SMS")
+	assert.Equal(t, 2, messaging.SMSSize("€"), "Expected extension characters to take two septets")
+	assert.Equal(t, messaging.EncodingUCS2, messaging.SMSEncoding("Код 123456"))
+	assert.Equal(t, 20, messaging.SMSSize("Код 123456"))
+	assert.Equal(t, 4, messaging.SMSSize("🔑"), "Expected characters outside the BMP to take a surrogate pair")
+}
+
+func TestAnalyzeSMS(t *testing.T) {
+	cases := []struct {
+		name     string
+		body     string
+		encoding string
+		chars    int
+		segments int
+	}{
+		{"Empty", "", messaging.EncodingGSM7, 0, 0},
+		{"Single GSM-7", strings.Repeat("a", 160), messaging.EncodingGSM7, 160, 1},
+		{"Two GSM-7", strings.Repeat("a", 161), messaging.EncodingGSM7, 161, 2},
+		{"Full Two GSM-7", strings.Repeat("a", 306), messaging.EncodingGSM7, 306, 2},
+		{"Three GSM-7", strings.Repeat("a", 307), messaging.EncodingGSM7, 307, 3},
+		// The escape and the € cannot be split, so the € starts the second segment
+		{"Escape At Boundary", strings.Repeat("a", 152) + "€" + strings.Repeat("a", 152), messaging.EncodingGSM7, 306, 3},
+		{"Single UCS-2", strings.Repeat("я", 70), messaging.EncodingUCS2, 70, 1},
+		{"Two UCS-2", strings.Repeat("я", 71), messaging.EncodingUCS2, 71, 2},
+		{"Surrogate At Boundary", strings.Repeat("я", 66) + "🔑" + strings.Repeat("я", 66), messaging.EncodingUCS2, 134, 3},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			info := messaging.AnalyzeSMS(tc.body)
+			assert.Equal(t, tc.encoding, info.Encoding)
+			assert.Equal(t, tc.chars, info.Characters)
+			assert.Equal(t, tc.segments, info.Segments)
+		})
+	}
+}
+
+func TestEncodeSMS(t *testing.T) {
+	// 72 characters: two UCS-2 segments because of the accents, one in GSM-7
+	body := "Seu código de verificação é 123456. Não o compartilhe — expira em 10 min"
+
+	sent, info := messaging.EncodeSMS(body, false)
+	assert.Equal(t, body, sent, "Expected nothing to change without transliteration")
+	assert.Equal(t, messaging.EncodingUCS2, info.Encoding)
+	assert.Equal(t, 2, info.Segments)
+
+	sent, info = messaging.EncodeSMS(body, true)
+	assert.Equal(t, "Seu codigo de verificacao é 123456. Nao o compartilhe - expira em 10 min", sent)
+	assert.Equal(t, messaging.EncodingGSM7, info.Encoding)
+	assert.Equal(t, 1, info.Segments)
+	assert.True(t, info.Transliterated)
+
+	// Transliterating would not save a segment
+	short := "Código 123456"
+	sent, info = messaging.EncodeSMS(short, true)
+	assert.Equal(t, short, sent)
+	assert.False(t, info.Transliterated)
+
+	// Cyrillic has no GSM-7 replacements
+	cyrillic := strings.Repeat("Ваш код 123456. ", 5)
+	sent, info = messaging.EncodeSMS(cyrillic, true)
+	assert.Equal(t, cyrillic, sent)
+	assert.Equal(t, messaging.EncodingUCS2, info.Encoding)
+}
+
+// setupSegmentServer creates a router that sends SMS to testSink, rendering
+// messages from the templates in dir
+func setupSegmentServer(t *testing.T, dir string, transliterate bool) *mux.Router {
+	defer func(dir string, transliterate bool, token string) {
+		config.TemplateDir, config.SMSTransliterate, config.MetricsToken = dir, transliterate, token
+	}(config.TemplateDir, config.SMSTransliterate, config.MetricsToken)
+	config.TemplateDir = dir
+	config.SMSTransliterate = transliterate
+	config.MetricsToken = testMetricsToken
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	senders := newTestSenders()
+	senders.Register(models.MessageTypeSMS, testSink.Sender(models.MessageTypeSMS))
+	return server.NewRouter(service.NewMemoryStore(), ctx, 10*time.Minute, senders)
+}
+
+const testMetricsToken = "metrics-test-token"
+
+// smsMetrics returns the SMS counters published on /metrics
+func smsMetrics(t *testing.T, r *mux.Router) map[string]int {
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer "+testMetricsToken)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var vars struct {
+		SMS map[string]int `json:"sms"`
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &vars))
+	return vars.SMS
+}
+
+func TestSMSSegments(t *testing.T) {
+	dir := writeTemplates(t, map[string]string{
+		"pt/sms.txt": "Seu código de verificação é {{.Code}}. Não o compartilhe — expira em {{.TTLMinutes}} min",
+	})
+
+	t.Run("Reports Segments", func(t *testing.T) {
+		r := setupSegmentServer(t, dir, false)
+		before := smsMetrics(t, r)
+
+		rec := postJSON(r, "/otp/generate", models.GenerateRequest{Username: "+14155550151", MessageType: "sms", Locale: "pt"})
+		assert.Equal(t, http.StatusOK, rec.Code)
+		var resp map[string]string
+		_ = json.Unmarshal(rec.Body.Bytes(), &resp)
+
+		status := waitForDelivery(t, r, resp["sessionId"])
+		assert.Equal(t, messaging.EncodingUCS2, status.Encoding)
+		assert.Equal(t, 2, status.Segments)
+		assert.False(t, status.Transliterated)
+
+		after := smsMetrics(t, r)
+		assert.Equal(t, before["messages"]+1, after["messages"])
+		assert.Equal(t, before["segments"]+2, after["segments"])
+		assert.Equal(t, before["ucs2_messages"]+1, after["ucs2_messages"])
+	})
+
+	t.Run("Transliterates To Save Segments", func(t *testing.T) {
+		r := setupSegmentServer(t, dir, true)
+		before := smsMetrics(t, r)
+
+		rec := postJSON(r, "/otp/generate", models.GenerateRequest{Username: "+14155550152", MessageType: "sms", Locale: "pt"})
+		assert.Equal(t, http.StatusOK, rec.Code)
+		var resp map[string]string
+		_ = json.Unmarshal(rec.Body.Bytes(), &resp)
+
+		assert.True(t, strings.HasPrefix(lastMessage("+14155550152").Text, "Seu codigo de verificacao é"))
+		status := waitForDelivery(t, r, resp["sessionId"])
+		assert.Equal(t, messaging.EncodingGSM7, status.Encoding)
+		assert.Equal(t, 1, status.Segments)
+		assert.True(t, status.Transliterated)
+		assert.Equal(t, before["transliterated"]+1, smsMetrics(t, r)["transliterated"])
+	})
+
+	t.Run("Other Channels Have No Segments", func(t *testing.T) {
+		r := setupSegmentServer(t, "", false)
+
+		rec := postJSON(r, "/otp/generate", models.GenerateRequest{Username: "segments@example.com", MessageType: "email"})
+		var resp map[string]string
+		_ = json.Unmarshal(rec.Body.Bytes(), &resp)
+
+		status := waitForDelivery(t, r, resp["sessionId"])
+		assert.Empty(t, status.Encoding)
+		assert.Zero(t, status.Segments)
+	})
+}
+
+func TestMetricsAccess(t *testing.T) {
+	get := func(r *mux.Router, authorization string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/metrics", nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("Requires The Token", func(t *testing.T) {
+		r := setupSegmentServer(t, "", false)
+
+		rec := get(r, "")
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+		assert.Contains(t, rec.Body.String(), `"code":"unauthorized"`)
+		assert.Equal(t, http.StatusUnauthorized, get(r, "Bearer wrong-token").Code)
+	})
+
+	t.Run("Serves Only SMS Counters", func(t *testing.T) {
+		r := setupSegmentServer(t, "", false)
+
+		rec := get(r, "Bearer "+testMetricsToken)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		var vars map[string]map[string]int
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &vars))
+		assert.Len(t, vars, 1)
+		assert.Contains(t, vars["sms"], "segments")
+		assert.NotContains(t, rec.Body.String(), "cmdline")
+		assert.NotContains(t, rec.Body.String(), "memstats")
+	})
+
+	t.Run("Not Served Without A Token", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		r := server.NewRouter(service.NewMemoryStore(), ctx, time.Minute, newTestSenders())
+
+		assert.Equal(t, http.StatusNotFound, get(r, "Bearer ").Code)
+	})
+}
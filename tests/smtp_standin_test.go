@@ -0,0 +1,232 @@
+package tests
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// capturedEmail is a message received by the SMTP stand-in
+type capturedEmail struct {
+	From string
+	To   []string
+	Data string
+	Auth string
+}
+
+// smtpStandIn is a minimal SMTP server that records every message it receives
+type smtpStandIn struct {
+	listener  net.Listener
+	tlsConfig *tls.Config
+	implicit  bool
+
+	mu       sync.Mutex
+	messages []capturedEmail
+}
+
+// newSMTPStandIn starts an SMTP stand-in on a random local port. When
+// tlsConfig is set the stand-in offers STARTTLS, or speaks TLS from the
+// first byte if implicit is true.
+func newSMTPStandIn(tlsConfig *tls.Config, implicit bool) (*smtpStandIn, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	if implicit {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+
+	s := &smtpStandIn{listener: listener, tlsConfig: tlsConfig, implicit: implicit}
+	go s.serve()
+	return s, nil
+}
+
+// Port returns the port the stand-in is listening on
+func (s *smtpStandIn) Port() string {
+	_, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	return port
+}
+
+// Close stops the stand-in
+func (s *smtpStandIn) Close() {
+	s.listener.Close()
+}
+
+// Messages returns a copy of the messages received so far
+func (s *smtpStandIn) Messages() []capturedEmail {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]capturedEmail(nil), s.messages...)
+}
+
+// LastMessageTo returns the most recent message sent to the given recipient
+func (s *smtpStandIn) LastMessageTo(to string) (capturedEmail, bool) {
+	messages := s.Messages()
+	for i := len(messages) - 1; i >= 0; i-- {
+		for _, rcpt := range messages[i].To {
+			if rcpt == to {
+				return messages[i], true
+			}
+		}
+	}
+	return capturedEmail{}, false
+}
+
+func (s *smtpStandIn) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *smtpStandIn) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	reply := func(lines ...string) {
+		for _, line := range lines {
+			w.WriteString(line + "\r\n")
+		}
+		w.Flush()
+	}
+	readLine := func() (string, error) {
+		line, err := r.ReadString('\n')
+		return strings.TrimRight(line, "\r\n"), err
+	}
+
+	secure := s.implicit
+	var current capturedEmail
+	reply("220 localhost ESMTP stand-in")
+
+	for {
+		line, err := readLine()
+		if err != nil {
+			return
+		}
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+
+		switch verb {
+		case "EHLO", "HELO":
+			lines := []string{"250-localhost"}
+			if s.tlsConfig != nil && !secure {
+				lines = append(lines, "250-STARTTLS")
+			}
+			reply(append(lines, "250 AUTH PLAIN LOGIN")...)
+
+		case "STARTTLS":
+			reply("220 Ready to start TLS")
+			tlsConn := tls.Server(conn, s.tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn = tlsConn
+			r = bufio.NewReader(conn)
+			w = bufio.NewWriter(conn)
+			secure = true
+
+		case "AUTH":
+			fields := strings.Fields(line)
+			switch strings.ToUpper(fields[1]) {
+			case "PLAIN":
+				decoded, _ := base64.StdEncoding.DecodeString(fields[2])
+				current.Auth = "PLAIN " + strings.ReplaceAll(string(decoded), "\x00", " ")
+			case "LOGIN":
+				reply("334 " + base64.StdEncoding.EncodeToString([]byte("Username:")))
+				username, _ := readLine()
+				reply("334 " + base64.StdEncoding.EncodeToString([]byte("Password:")))
+				password, _ := readLine()
+				u, _ := base64.StdEncoding.DecodeString(username)
+				p, _ := base64.StdEncoding.DecodeString(password)
+				current.Auth = "LOGIN " + string(u) + " " + string(p)
+			}
+			reply("235 Authentication successful")
+
+		case "MAIL":
+			current.From = strings.Trim(strings.TrimPrefix(line[5:], "FROM:"), "<> ")
+			reply("250 OK")
+
+		case "RCPT":
+			current.To = append(current.To, strings.Trim(strings.TrimPrefix(line[5:], "TO:"), "<> "))
+			reply("250 OK")
+
+		case "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			var data strings.Builder
+			for {
+				dataLine, err := readLine()
+				if err != nil {
+					return
+				}
+				if dataLine == "." {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(dataLine, ".") + "\r\n")
+			}
+			current.Data = data.String()
+			s.mu.Lock()
+			s.messages = append(s.messages, current)
+			s.mu.Unlock()
+			current = capturedEmail{Auth: current.Auth}
+			reply("250 OK: queued")
+
+		case "RSET", "NOOP":
+			reply("250 OK")
+
+		case "QUIT":
+			reply("221 Bye")
+			return
+
+		default:
+			reply("502 Command not implemented")
+		}
+	}
+}
+
+// newTestTLSConfigs creates a self-signed certificate for 127.0.0.1 and
+// returns a server TLS config and a client TLS config that trusts it
+func newTestTLSConfigs() (*tls.Config, *tls.Config, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	serverConfig := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	clientConfig := &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"}
+	return serverConfig, clientConfig, nil
+}
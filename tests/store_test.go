@@ -0,0 +1,157 @@
+package tests
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/RoMalms10/otp-generator/service"
+)
+
+func TestOTPStores(t *testing.T) {
+	ctx := context.Background()
+	fileStore, err := service.NewFileStore(filepath.Join(t.TempDir(), "otp-store.json"))
+	assert.NoError(t, err, "Failed to create file store")
+
+	stores := map[string]service.OTPStore{
+		"memory": service.NewMemoryStore(),
+		"file":   fileStore,
+	}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			testOTPStore(t, ctx, store)
+		})
+	}
+
+	t.Run("File Store Survives Reload", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "otp-store.json")
+		store, err := service.NewFileStore(path)
+		assert.NoError(t, err)
+		assert.NoError(t, store.Set(ctx, "otp:testuser", "654321", time.Minute))
+
+		reloaded, err := service.NewFileStore(path)
+		assert.NoError(t, err)
+		value, err := reloaded.Get(ctx, "otp:testuser")
+		assert.NoError(t, err)
+		assert.Equal(t, "654321", value)
+	})
+}
+
+func TestRedisStore(t *testing.T) {
+	ctx := context.Background()
+	testOTPStore(t, ctx, service.NewRedisStore(newTestRedisClient(t, ctx)))
+}
+
+// testOTPStore runs the tests every OTPStore must pass
+func testOTPStore(t *testing.T, ctx context.Context, store service.OTPStore) {
+	t.Run("Set And Get", func(t *testing.T) {
+		assert.NoError(t, store.Set(ctx, "otp:testuser", "123456", time.Minute))
+
+		value, err := store.Get(ctx, "otp:testuser")
+		assert.NoError(t, err)
+		assert.Equal(t, "123456", value)
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		assert.NoError(t, store.Delete(ctx, "otp:testuser"))
+
+		_, err := store.Get(ctx, "otp:testuser")
+		assert.Equal(t, service.ErrNotFound, err)
+	})
+
+	t.Run("CompareAndDelete", func(t *testing.T) {
+		assert.NoError(t, store.Set(ctx, "otp:testuser", "123456", time.Minute))
+
+		deleted, err := store.CompareAndDelete(ctx, "otp:testuser", "654321")
+		assert.NoError(t, err)
+		assert.False(t, deleted, "Expected mismatched value to be kept")
+
+		deleted, err = store.CompareAndDelete(ctx, "otp:testuser", "123456")
+		assert.NoError(t, err)
+		assert.True(t, deleted, "Expected matching value to be deleted")
+
+		deleted, err = store.CompareAndDelete(ctx, "otp:testuser", "123456")
+		assert.NoError(t, err)
+		assert.False(t, deleted, "Expected second delete to report nothing deleted")
+	})
+
+	t.Run("CompareAndSwap", func(t *testing.T) {
+		assert.NoError(t, store.Set(ctx, "hotp:testuser", "1", 0))
+
+		swapped, err := store.CompareAndSwap(ctx, "hotp:testuser", "2", "3", 0)
+		assert.NoError(t, err)
+		assert.False(t, swapped, "Expected mismatched value to be kept")
+
+		swapped, err = store.CompareAndSwap(ctx, "hotp:testuser", "1", "2", 0)
+		assert.NoError(t, err)
+		assert.True(t, swapped, "Expected matching value to be replaced")
+
+		value, _ := store.Get(ctx, "hotp:testuser")
+		assert.Equal(t, "2", value)
+
+		swapped, err = store.CompareAndSwap(ctx, "hotp:missing", "", "1", 0)
+		assert.NoError(t, err)
+		assert.False(t, swapped, "Expected a missing key not to be created")
+	})
+
+	t.Run("SetIfAbsent", func(t *testing.T) {
+		stored, err := store.SetIfAbsent(ctx, "recovery:testuser", "first", 0)
+		assert.NoError(t, err)
+		assert.True(t, stored, "Expected a missing key to be created")
+
+		stored, err = store.SetIfAbsent(ctx, "recovery:testuser", "second", 0)
+		assert.NoError(t, err)
+		assert.False(t, stored, "Expected an existing key to be kept")
+
+		value, _ := store.Get(ctx, "recovery:testuser")
+		assert.Equal(t, "first", value)
+	})
+
+	t.Run("Expiry", func(t *testing.T) {
+		assert.NoError(t, store.Set(ctx, "otp:shortlived", "123456", 50*time.Millisecond))
+		time.Sleep(100 * time.Millisecond)
+
+		_, err := store.Get(ctx, "otp:shortlived")
+		assert.Equal(t, service.ErrNotFound, err, "Expected value to expire")
+	})
+
+	t.Run("Sweep", func(t *testing.T) {
+		sweeper, ok := store.(service.Sweeper)
+		if !ok {
+			t.Skip("The store expires entries itself")
+		}
+		assert.NoError(t, store.Set(ctx, "ratelimit:sweep", "1", 50*time.Millisecond))
+		assert.NoError(t, store.Set(ctx, "session:kept", "1", time.Minute))
+		time.Sleep(100 * time.Millisecond)
+
+		removed, err := sweeper.Sweep()
+		assert.NoError(t, err)
+		assert.Equal(t, 1, removed, "Expected only the expired entry to be removed")
+
+		removed, err = sweeper.Sweep()
+		assert.NoError(t, err)
+		assert.Zero(t, removed)
+
+		_, err = store.Get(ctx, "session:kept")
+		assert.NoError(t, err)
+	})
+
+	t.Run("Incr", func(t *testing.T) {
+		for i := int64(1); i <= 3; i++ {
+			n, err := store.Incr(ctx, "attempts:testuser", time.Minute)
+			assert.NoError(t, err)
+			assert.Equal(t, i, n)
+		}
+	})
+
+	t.Run("Incr Without TTL", func(t *testing.T) {
+		for i := int64(1); i <= 2; i++ {
+			n, err := store.Incr(ctx, "lockouts:forever", 0)
+			assert.NoError(t, err)
+			assert.Equal(t, i, n, "Expected a counter without a TTL to be kept")
+		}
+	})
+}
@@ -0,0 +1,178 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/RoMalms10/otp-generator/config"
+	"github.com/RoMalms10/otp-generator/messaging"
+	"github.com/RoMalms10/otp-generator/models"
+	"github.com/RoMalms10/otp-generator/server"
+	"github.com/RoMalms10/otp-generator/service"
+	"github.com/gorilla/mux"
+)
+
+// writeTemplates writes template files, keyed by their path, to a new directory
+func writeTemplates(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, body := range files {
+		path := filepath.Join(dir, name)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		assert.NoError(t, os.WriteFile(path, []byte(body), 0o644))
+	}
+	return dir
+}
+
+// setupTemplateServer creates a router that renders messages from the
+// templates in dir and delivers SMS and email to testSink
+func setupTemplateServer(t *testing.T, dir string, ttl time.Duration) *mux.Router {
+	defer func(dir, name string) { config.TemplateDir, config.AppName = dir, name }(config.TemplateDir, config.AppName)
+	config.TemplateDir = dir
+	config.AppName = "Acme <Bank>"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	senders := newTestSenders()
+	senders.Register(models.MessageTypeSMS, testSink.Sender(models.MessageTypeSMS))
+	return server.NewRouter(service.NewMemoryStore(), ctx, ttl, senders)
+}
+
+// lastMessage returns the most recent message captured for the recipient
+func lastMessage(to string) messaging.CapturedMessage {
+	messages := testSink.Messages()
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].To == to {
+			return messages[i]
+		}
+	}
+	return messaging.CapturedMessage{}
+}
+
+func TestMessageTemplates(t *testing.T) {
+	dir := writeTemplates(t, map[string]string{
+		"pt/sms.txt":              "Seu código {{.AppName}} é {{.Code}}. Expira em {{.TTLMinutes}} minutos.",
+		"pt-br/sms.login.txt":     "Entre no {{.AppName}} com {{.Code}}",
+		"de/email.subject":        "Ihr {{.AppName}} Code",
+		"de/email.txt":            "Ihr Code lautet {{.Code}}",
+		"en/email.signup.html":    "<p>Welcome to {{.AppName}}! Your code is {{.Code}}</p>",
+		"en/email.signup.txt":     "Welcome to {{.AppName}}! Your code is {{.Code}}",
+		"en/email.signup.subject": "Welcome to {{.AppName}}",
+	})
+
+	t.Run("Built-In Templates Use The Real TTL", func(t *testing.T) {
+		r := setupTemplateServer(t, "", 3*time.Minute)
+
+		rec := postJSON(r, "/otp/generate", models.GenerateRequest{Username: "builtin@example.com", MessageType: "email"})
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		msg := lastMessage("builtin@example.com")
+		assert.Equal(t, "Your Acme <Bank> verification code", msg.Subject)
+		assert.Contains(t, msg.Text, "verification code is: "+msg.OTP)
+		assert.Contains(t, msg.Text, "It expires in 3 minutes.")
+		assert.Contains(t, msg.HTML, "Acme &lt;Bank&gt;", "Expected HTML templates to escape their data")
+		assert.Contains(t, msg.HTML, "<strong>"+msg.OTP+"</strong>")
+	})
+
+	t.Run("Falls Back To The Language", func(t *testing.T) {
+		r := setupTemplateServer(t, dir, 10*time.Minute)
+
+		rec := postJSON(r, "/otp/generate", models.GenerateRequest{Username: "+14155550131", MessageType: "sms", Locale: "pt-BR"})
+		assert.Equal(t, http.StatusOK, rec.Code)
+		msg := lastMessage("+14155550131")
+		assert.Equal(t, "Seu código Acme <Bank> é "+msg.OTP+". Expira em 10 minutos.", msg.Text)
+	})
+
+	t.Run("Prefers The Purpose's Template", func(t *testing.T) {
+		r := setupTemplateServer(t, dir, 10*time.Minute)
+
+		rec := postJSON(r, "/otp/generate", models.GenerateRequest{
+			Username: "+14155550132", MessageType: "sms", Locale: "pt_BR", Purpose: "login",
+		})
+		assert.Equal(t, http.StatusOK, rec.Code)
+		msg := lastMessage("+14155550132")
+		assert.Equal(t, "Entre no Acme <Bank> com "+msg.OTP, msg.Text)
+
+		rec = postJSON(r, "/otp/generate", models.GenerateRequest{Username: "signup@example.com", MessageType: "email", Purpose: "signup"})
+		assert.Equal(t, http.StatusOK, rec.Code)
+		msg = lastMessage("signup@example.com")
+		assert.Equal(t, "Welcome to Acme <Bank>", msg.Subject)
+		assert.Equal(t, "<p>Welcome to Acme &lt;Bank&gt;! Your code is "+msg.OTP+"</p>", msg.HTML)
+	})
+
+	t.Run("Falls Back To The Default Locale", func(t *testing.T) {
+		r := setupTemplateServer(t, dir, 10*time.Minute)
+
+		// There are German email templates but no German SMS template
+		rec := postJSON(r, "/otp/generate", models.GenerateRequest{Username: "+14155550133", MessageType: "sms", Locale: "de-AT"})
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, lastMessage("+14155550133").Text, "Your Acme <Bank> verification code is")
+	})
+
+	t.Run("Resend Switches Locale", func(t *testing.T) {
+		r := setupTemplateServer(t, dir, 10*time.Minute)
+
+		rec := postJSON(r, "/otp/generate", models.GenerateRequest{Username: "resend-locale@example.com", MessageType: "email"})
+		var resp map[string]string
+		_ = json.Unmarshal(rec.Body.Bytes(), &resp)
+
+		rec = postJSON(r, "/otp/resend", models.ResendRequest{SessionID: resp["sessionId"], Locale: "de"})
+		assert.Equal(t, http.StatusOK, rec.Code)
+		msg := lastMessage("resend-locale@example.com")
+		assert.Equal(t, "Ihr Acme <Bank> Code", msg.Subject)
+		assert.Equal(t, "Ihr Code lautet "+msg.OTP, msg.Text)
+
+		_, session := getSession(t, r, resp["sessionId"])
+		assert.Equal(t, "de", session.Locale)
+	})
+
+	t.Run("Invalid Locale", func(t *testing.T) {
+		r := setupTemplateServer(t, dir, 10*time.Minute)
+
+		rec := postJSON(r, "/otp/generate", models.GenerateRequest{Username: "locale@example.com", MessageType: "email", Locale: "../en"})
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Contains(t, rec.Body.String(), `"code":"invalid_format"`)
+	})
+}
+
+func TestLoadTemplates(t *testing.T) {
+	templates, err := messaging.LoadTemplates("", "en-GB")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"pt-br", "pt", "en-gb", "en"}, templates.Locales("pt-BR"))
+	assert.Equal(t, []string{"en-gb", "en"}, templates.Locales(""))
+
+	msg, err := templates.Render("+14155550134", messaging.TemplateData{
+		AppName: "Acme", Code: "123456", Channel: "sms", Purpose: "default", TTL: 61 * time.Second,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "Your Acme verification code is 123456. It expires in 2 minutes.", msg.Text)
+
+	_, err = templates.Render("+14155550134", messaging.TemplateData{Channel: "fax"})
+	assert.ErrorIs(t, err, messaging.ErrNoTemplate)
+
+	_, err = messaging.LoadTemplates(writeTemplates(t, map[string]string{"en/sms.txt": "{{.Code"}), "en")
+	assert.Error(t, err, "Expected invalid templates to be refused")
+	_, err = messaging.LoadTemplates(writeTemplates(t, map[string]string{"sms.txt": "{{.Code}}"}), "en")
+	assert.Error(t, err, "Expected templates outside a locale directory to be refused")
+}
+
+func TestCaptureSinkLimit(t *testing.T) {
+	sink := messaging.NewCaptureSink()
+	sender := sink.Sender(models.MessageTypeEmail)
+	for i := 0; i < messaging.MaxCapturedMessages+5; i++ {
+		assert.NoError(t, sender.SendOTP("user@example.com", strconv.Itoa(i)))
+	}
+
+	messages := sink.Messages()
+	assert.Len(t, messages, messaging.MaxCapturedMessages)
+	assert.Equal(t, "5", messages[0].OTP)
+	otp, _ := sink.LastOTP("user@example.com")
+	assert.Equal(t, strconv.Itoa(messaging.MaxCapturedMessages+4), otp)
+}
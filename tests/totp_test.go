@@ -0,0 +1,312 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/json"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/RoMalms10/otp-generator/config"
+	"github.com/RoMalms10/otp-generator/models"
+	"github.com/RoMalms10/otp-generator/qrcode"
+	"github.com/RoMalms10/otp-generator/service"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startTOTPEnrollment enrolls a pending authenticator for the user with a freshly verified session
+// and returns the decoded response
+func startTOTPEnrollment(t *testing.T, r *mux.Router, req models.TOTPEnrollRequest) map[string]string {
+	req.SessionID = verifiedSession(t, r, req.Username)
+	rec := postJSON(r, "/totp/enroll", req)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	var resp map[string]string
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	return resp
+}
+
+// enrollTOTP enrolls an authenticator for the user and confirms it with the code of the previous
+// time step, leaving the current one unused, and returns the decoded enroll response
+func enrollTOTP(t *testing.T, r *mux.Router, req models.TOTPEnrollRequest) map[string]string {
+	resp := startTOTPEnrollment(t, r, req)
+	enrollment := enrollmentFrom(resp)
+	code, err := service.TOTPCode(enrollment, time.Now().Add(-time.Duration(enrollment.Period)*time.Second))
+	require.NoError(t, err)
+
+	rec := postJSON(r, "/totp/confirm", models.TOTPVerifyRequest{Username: req.Username, Code: code})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	return resp
+}
+
+// verifyTOTP submits an authenticator code for the user and returns the recorded response
+func verifyTOTP(r *mux.Router, username, code string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(models.TOTPVerifyRequest{Username: username, Code: code})
+	req, _ := http.NewRequest("POST", "/totp/verify", bytes.NewBuffer(body))
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	return rec
+}
+
+// enrollmentFrom rebuilds the enrollment an authenticator app would hold from an enroll response
+func enrollmentFrom(resp map[string]string) models.TOTPEnrollment {
+	uri, _ := url.Parse(resp["uri"])
+	enrollment := models.TOTPEnrollment{Secret: resp["secret"], Algorithm: resp["algorithm"]}
+	enrollment.Digits, _ = strconv.Atoi(uri.Query().Get("digits"))
+	enrollment.Period, _ = strconv.Atoi(uri.Query().Get("period"))
+	return enrollment
+}
+
+func TestTOTPCodeRFC6238Vectors(t *testing.T) {
+	secrets := map[string]string{
+		models.AlgorithmSHA1:   "12345678901234567890",
+		models.AlgorithmSHA256: "12345678901234567890123456789012",
+		models.AlgorithmSHA512: "1234567890123456789012345678901234567890123456789012345678901234",
+	}
+	vectors := []struct {
+		unix      int64
+		algorithm string
+		code      string
+	}{
+		{59, models.AlgorithmSHA1, "94287082"},
+		{59, models.AlgorithmSHA256, "46119246"},
+		{59, models.AlgorithmSHA512, "90693936"},
+		{1111111109, models.AlgorithmSHA1, "07081804"},
+		{1111111109, models.AlgorithmSHA256, "68084774"},
+		{1111111109, models.AlgorithmSHA512, "25091201"},
+		{1111111111, models.AlgorithmSHA1, "14050471"},
+		{1111111111, models.AlgorithmSHA256, "67062674"},
+		{1111111111, models.AlgorithmSHA512, "99943326"},
+		{1234567890, models.AlgorithmSHA1, "89005924"},
+		{1234567890, models.AlgorithmSHA256, "91819424"},
+		{1234567890, models.AlgorithmSHA512, "93441116"},
+		{2000000000, models.AlgorithmSHA1, "69279037"},
+		{2000000000, models.AlgorithmSHA256, "90698825"},
+		{2000000000, models.AlgorithmSHA512, "38618901"},
+		{20000000000, models.AlgorithmSHA1, "65353130"},
+		{20000000000, models.AlgorithmSHA256, "77737706"},
+		{20000000000, models.AlgorithmSHA512, "47863826"},
+	}
+
+	for _, v := range vectors {
+		enrollment := models.TOTPEnrollment{
+			Secret:    base32.StdEncoding.EncodeToString([]byte(secrets[v.algorithm])),
+			Algorithm: v.algorithm,
+			Digits:    8,
+			Period:    30,
+		}
+		code, err := service.TOTPCode(enrollment, time.Unix(v.unix, 0))
+		assert.NoError(t, err)
+		assert.Equal(t, v.code, code, "%s at %d", v.algorithm, v.unix)
+	}
+}
+
+func TestTOTPEnrollment(t *testing.T) {
+	r, store, ctx := setupTestServerWithTTL(defaultOTPTTL)
+
+	t.Run("Defaults", func(t *testing.T) {
+		resp := enrollTOTP(t, r, models.TOTPEnrollRequest{Username: "alice@example.com"})
+
+		uri, err := url.Parse(resp["uri"])
+		require.NoError(t, err)
+		assert.Equal(t, "otpauth", uri.Scheme)
+		assert.Equal(t, "totp", uri.Host)
+		assert.Equal(t, "/"+config.TOTPIssuer+":alice@example.com", uri.Path)
+		assert.Equal(t, resp["secret"], uri.Query().Get("secret"))
+		assert.Equal(t, "SHA1", uri.Query().Get("algorithm"))
+		assert.Equal(t, "6", uri.Query().Get("digits"))
+		assert.Equal(t, "30", uri.Query().Get("period"))
+		assert.Len(t, resp["secret"], 32, "Expected a 160-bit secret for SHA1")
+	})
+
+	t.Run("QR Code PNG", func(t *testing.T) {
+		resp := enrollTOTP(t, r, models.TOTPEnrollRequest{Username: "qruser@example.com", Algorithm: "sha512"})
+		require.True(t, strings.HasPrefix(resp["qrCode"], "data:image/png;base64,"))
+
+		data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(resp["qrCode"], "data:image/png;base64,"))
+		require.NoError(t, err)
+		img, err := png.Decode(bytes.NewReader(data))
+		require.NoError(t, err)
+
+		code, err := qrcode.Encode([]byte(resp["uri"]))
+		require.NoError(t, err)
+		width := img.Bounds().Dx()
+		assert.Equal(t, width, img.Bounds().Dy(), "Expected a square image")
+		assert.Zero(t, width%(code.Size+8), "Expected the symbol plus a four-module quiet zone")
+
+		// The top-left finder pattern: a dark ring around a light ring around a dark centre
+		scale := width / (code.Size + 8)
+		dark := func(x, y int) bool {
+			r, _, _, _ := img.At((x+4)*scale, (y+4)*scale).RGBA()
+			return r < 0x8000
+		}
+		for i := 0; i < 7; i++ {
+			assert.True(t, dark(i, 0) && dark(0, i) && dark(i, 6) && dark(6, i), "Expected finder border")
+		}
+		assert.False(t, dark(1, 1), "Expected light finder ring")
+		assert.True(t, dark(3, 3), "Expected dark finder centre")
+		assert.False(t, dark(7, 7), "Expected light separator")
+	})
+
+	t.Run("Secret Stored Sealed", func(t *testing.T) {
+		resp := enrollTOTP(t, r, models.TOTPEnrollRequest{Username: "sealed@example.com"})
+
+		data, err := store.Get(ctx, "totp:"+service.KeyDigest("sealed@example.com"))
+		require.NoError(t, err)
+		assert.NotContains(t, data, resp["secret"], "Expected the secret not to be stored in plaintext")
+
+		code, _ := service.TOTPCode(enrollmentFrom(resp), time.Now())
+		rec := verifyTOTP(r, "sealed@example.com", code)
+		assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	})
+
+	t.Run("Requires A Verified Session", func(t *testing.T) {
+		rec := postJSON(r, "/totp/enroll", models.TOTPEnrollRequest{Username: "victim@example.com"})
+		assert.Equal(t, http.StatusForbidden, rec.Code, "Expected enrolling without a session to be refused")
+		assert.Contains(t, rec.Body.String(), `"code":"verification_required"`)
+
+		other := verifiedSession(t, r, "attacker@example.com")
+		rec = postJSON(r, "/totp/enroll", models.TOTPEnrollRequest{Username: "victim@example.com", SessionID: other})
+		assert.Equal(t, http.StatusForbidden, rec.Code, "Expected another user's session to be refused")
+	})
+
+	t.Run("Pending Until Confirmed", func(t *testing.T) {
+		current := enrollmentFrom(enrollTOTP(t, r, models.TOTPEnrollRequest{Username: "switcher@example.com"}))
+		pending := enrollmentFrom(startTOTPEnrollment(t, r, models.TOTPEnrollRequest{Username: "switcher@example.com"}))
+
+		code, _ := service.TOTPCode(pending, time.Now())
+		rec := verifyTOTP(r, "switcher@example.com", code)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code, "Expected the pending secret not to be active yet")
+
+		code, _ = service.TOTPCode(current, time.Now())
+		rec = verifyTOTP(r, "switcher@example.com", code)
+		assert.Equal(t, http.StatusOK, rec.Code, "Expected the current secret to stay active until the new one is confirmed")
+
+		rec = postJSON(r, "/totp/confirm", models.TOTPVerifyRequest{Username: "switcher@example.com", Code: "00000000"})
+		assert.Equal(t, http.StatusUnauthorized, rec.Code, "Expected a wrong code not to confirm the enrollment")
+
+		code, _ = service.TOTPCode(pending, time.Now())
+		rec = postJSON(r, "/totp/confirm", models.TOTPVerifyRequest{Username: "switcher@example.com", Code: code})
+		assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+		rec = verifyTOTP(r, "switcher@example.com", code)
+		assert.Equal(t, http.StatusConflict, rec.Code, "Expected the confirming code to count as used")
+
+		code, _ = service.TOTPCode(current, time.Now().Add(time.Duration(current.Period)*time.Second))
+		rec = verifyTOTP(r, "switcher@example.com", code)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code, "Expected the replaced secret to stop working")
+
+		rec = postJSON(r, "/totp/confirm", models.TOTPVerifyRequest{Username: "switcher@example.com", Code: code})
+		assert.Equal(t, http.StatusNotFound, rec.Code, "Expected nothing left to confirm")
+	})
+
+	t.Run("Invalid Settings", func(t *testing.T) {
+		for _, req := range []models.TOTPEnrollRequest{
+			{Username: "bad", Algorithm: "MD5"},
+			{Username: "bad", Digits: 4},
+			{Username: "bad", Period: 1},
+		} {
+			body, _ := json.Marshal(req)
+			httpReq, _ := http.NewRequest("POST", "/totp/enroll", bytes.NewBuffer(body))
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, httpReq)
+			assert.Equal(t, http.StatusBadRequest, rec.Code, "Expected status 400 for %+v", req)
+		}
+	})
+}
+
+func TestTOTPVerification(t *testing.T) {
+	r, _, _ := setupTestServerWithTTL(defaultOTPTTL)
+
+	t.Run("Valid Code Then Replay", func(t *testing.T) {
+		enrollment := enrollmentFrom(enrollTOTP(t, r, models.TOTPEnrollRequest{Username: "totpuser@example.com"}))
+		code, err := service.TOTPCode(enrollment, time.Now())
+		require.NoError(t, err)
+
+		rec := verifyTOTP(r, "totpuser@example.com", code)
+		assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+		rec = verifyTOTP(r, "totpuser@example.com", code)
+		assert.Equal(t, http.StatusConflict, rec.Code, "Expected a used time step to be rejected")
+		assert.Contains(t, rec.Body.String(), `"code":"otp_already_used"`)
+
+		// Earlier steps within the drift window are rejected once a later step was used
+		code, _ = service.TOTPCode(enrollment, time.Now().Add(-time.Duration(enrollment.Period)*time.Second))
+		rec = verifyTOTP(r, "totpuser@example.com", code)
+		assert.Equal(t, http.StatusConflict, rec.Code)
+		assert.Contains(t, rec.Body.String(), `"code":"otp_already_used"`)
+	})
+
+	t.Run("Concurrent Use Of One Code", func(t *testing.T) {
+		enrollment := enrollmentFrom(enrollTOTP(t, r, models.TOTPEnrollRequest{Username: "racer@example.com"}))
+		code, _ := service.TOTPCode(enrollment, time.Now())
+
+		const parallelCount = 10
+		codes := make(chan int, parallelCount)
+		var wg sync.WaitGroup
+		for i := 0; i < parallelCount; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				codes <- verifyTOTP(r, "racer@example.com", code).Code
+			}()
+		}
+		wg.Wait()
+		close(codes)
+
+		accepted := 0
+		for code := range codes {
+			if code == http.StatusOK {
+				accepted++
+			}
+		}
+		assert.Equal(t, 1, accepted, "Expected exactly one concurrent verification to succeed")
+	})
+
+	t.Run("Drift Window", func(t *testing.T) {
+		resp := enrollTOTP(t, r, models.TOTPEnrollRequest{Username: "driftuser@example.com", Algorithm: "SHA256", Digits: 8, Period: 60})
+		enrollment := enrollmentFrom(resp)
+		assert.Equal(t, 8, enrollment.Digits)
+		assert.Equal(t, 60, enrollment.Period)
+
+		code, _ := service.TOTPCode(enrollment, time.Now().Add(3*time.Minute))
+		rec := verifyTOTP(r, "driftuser@example.com", code)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code, "Expected a code outside the drift window to be rejected")
+		assert.Contains(t, rec.Body.String(), `"code":"otp_mismatch"`)
+
+		code, _ = service.TOTPCode(enrollment, time.Now().Add(time.Minute))
+		rec = verifyTOTP(r, "driftuser@example.com", code)
+		assert.Equal(t, http.StatusOK, rec.Code, "Expected a code one step ahead to be accepted")
+	})
+
+	t.Run("Not Enrolled", func(t *testing.T) {
+		rec := verifyTOTP(r, "nobody", "123456")
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+		assert.Contains(t, rec.Body.String(), `"code":"not_enrolled"`)
+	})
+
+	t.Run("Failed Attempts Lock Out", func(t *testing.T) {
+		enrollment := enrollmentFrom(enrollTOTP(t, r, models.TOTPEnrollRequest{Username: "guesser@example.com"}))
+		code, _ := service.TOTPCode(enrollment, time.Now())
+
+		var rec *httptest.ResponseRecorder
+		for i := 0; i < config.MaxOTPAttempts; i++ {
+			rec = verifyTOTP(r, "guesser@example.com", "12345678")
+		}
+		assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+		assert.Contains(t, rec.Body.String(), `"code":"otp_attempts_exceeded"`)
+
+		rec = verifyTOTP(r, "guesser@example.com", code)
+		assert.Equal(t, http.StatusTooManyRequests, rec.Code, "Expected a valid code to be rejected while locked")
+	})
+}
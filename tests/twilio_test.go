@@ -0,0 +1,277 @@
+package tests
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/RoMalms10/otp-generator/config"
+	"github.com/RoMalms10/otp-generator/messaging"
+	"github.com/RoMalms10/otp-generator/models"
+	"github.com/RoMalms10/otp-generator/server"
+	"github.com/RoMalms10/otp-generator/service"
+	"github.com/gorilla/mux"
+)
+
+const (
+	testTwilioToken       = "twilio-test-token"
+	testTwilioCallbackURL = "https://otp.example.com/webhooks/twilio/status"
+)
+
+// twilioRequest is a request made to fakeTwilio
+type twilioRequest struct {
+	Path      string
+	Form      url.Values
+	AccountID string
+	Token     string
+}
+
+// fakeTwilio is a stand-in for the Twilio API that accepts every message and call
+type fakeTwilio struct {
+	mu       sync.Mutex
+	requests []twilioRequest
+}
+
+func (f *fakeTwilio) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	_ = r.ParseForm()
+	accountID, token, _ := r.BasicAuth()
+	f.mu.Lock()
+	f.requests = append(f.requests, twilioRequest{Path: r.URL.Path, Form: r.PostForm, AccountID: accountID, Token: token})
+	sid := fmt.Sprintf("SM%032d", len(f.requests))
+	f.mu.Unlock()
+
+	w.WriteHeader(http.StatusCreated)
+	_, _ = fmt.Fprintf(w, `{"sid":%q,"status":"queued"}`, sid)
+}
+
+// last returns the form of the latest request and the SID it was given
+func (f *fakeTwilio) last() (url.Values, string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests[len(f.requests)-1].Form, fmt.Sprintf("SM%032d", len(f.requests))
+}
+
+// lastRequest returns the latest request
+func (f *fakeTwilio) lastRequest() twilioRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests[len(f.requests)-1]
+}
+
+// setupTwilioServer creates a router whose SMS channel sends through a fake Twilio API
+func setupTwilioServer(t *testing.T) (*mux.Router, *fakeTwilio) {
+	defer func(token, callback string) {
+		config.TwilioAuthToken, config.TwilioStatusCallbackURL = token, callback
+	}(config.TwilioAuthToken, config.TwilioStatusCallbackURL)
+	config.TwilioAuthToken = testTwilioToken
+	config.TwilioStatusCallbackURL = testTwilioCallbackURL
+
+	api := &fakeTwilio{}
+	apiServer := httptest.NewServer(api)
+	t.Cleanup(apiServer.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	twilio := messaging.NewTwilioService(messaging.TwilioConfig{
+		AccountSID:        "AC123",
+		AuthToken:         testTwilioToken,
+		PhoneNumber:       "+14155550100",
+		BaseURL:           apiServer.URL,
+		StatusCallbackURL: testTwilioCallbackURL,
+	})
+	senders := newTestSenders()
+	senders.Register(models.MessageTypeSMS, twilio.SMSSender())
+	return server.NewRouter(service.NewMemoryStore(), ctx, time.Minute, senders), api
+}
+
+// twilioSignature signs a request the way Twilio does: HMAC-SHA1 of the URL
+// followed by the sorted param names and values
+func twilioSignature(token, callbackURL string, params url.Values) string {
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	data := callbackURL
+	for _, name := range names {
+		data += name + params.Get(name)
+	}
+	mac := hmac.New(sha1.New, []byte(token))
+	mac.Write([]byte(data))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// postTwilioStatus posts a status callback for the message, signed with signature
+func postTwilioStatus(r *mux.Router, messageID, status, signature string) *httptest.ResponseRecorder {
+	params := url.Values{
+		"MessageSid":    {messageID},
+		"MessageStatus": {status},
+		"AccountSid":    {"AC123"},
+	}
+	if status == "undelivered" {
+		params.Set("ErrorCode", "30003")
+	}
+	if signature == "" {
+		signature = twilioSignature(testTwilioToken, testTwilioCallbackURL, params)
+	}
+
+	req, _ := http.NewRequest("POST", "/webhooks/twilio/status", strings.NewReader(params.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Twilio-Signature", signature)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	return rec
+}
+
+// providerStatus returns what the delivery status endpoint reports from the provider
+func providerStatus(t *testing.T, r *mux.Router, sessionID string) *models.ProviderStatus {
+	req, _ := http.NewRequest("GET", "/otp/sessions/"+sessionID+"/delivery", nil)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var status models.DeliveryStatus
+	_ = json.Unmarshal(rec.Body.Bytes(), &status)
+	return status.Provider
+}
+
+func TestTwilioStatusCallbacks(t *testing.T) {
+	t.Run("Records Reported Status", func(t *testing.T) {
+		r, api := setupTwilioServer(t)
+
+		rec := postJSON(r, "/otp/generate", models.GenerateRequest{Username: "+14155550121", MessageType: "sms"})
+		assert.Equal(t, http.StatusOK, rec.Code)
+		var resp map[string]string
+		_ = json.Unmarshal(rec.Body.Bytes(), &resp)
+
+		form, sid := api.last()
+		assert.Equal(t, testTwilioCallbackURL, form.Get("StatusCallback"), "Expected Twilio to be asked for status callbacks")
+
+		provider := providerStatus(t, r, resp["sessionId"])
+		if assert.NotNil(t, provider) {
+			assert.Equal(t, sid, provider.MessageID)
+			assert.Equal(t, "sms", provider.Channel)
+			assert.Equal(t, "queued", provider.Status)
+		}
+
+		for _, status := range []string{"sent", "delivered"} {
+			rec = postTwilioStatus(r, sid, status, "")
+			assert.Equal(t, http.StatusNoContent, rec.Code)
+		}
+		assert.Equal(t, "delivered", providerStatus(t, r, resp["sessionId"]).Status)
+
+		// A report that arrives late does not move the status back
+		rec = postTwilioStatus(r, sid, "sent", "")
+		assert.Equal(t, http.StatusNoContent, rec.Code)
+		assert.Equal(t, "delivered", providerStatus(t, r, resp["sessionId"]).Status)
+	})
+
+	t.Run("Records Errors", func(t *testing.T) {
+		r, api := setupTwilioServer(t)
+
+		rec := postJSON(r, "/otp/generate", models.GenerateRequest{Username: "+14155550122", MessageType: "sms"})
+		var resp map[string]string
+		_ = json.Unmarshal(rec.Body.Bytes(), &resp)
+		_, sid := api.last()
+
+		rec = postTwilioStatus(r, sid, "undelivered", "")
+		assert.Equal(t, http.StatusNoContent, rec.Code)
+		provider := providerStatus(t, r, resp["sessionId"])
+		assert.Equal(t, "undelivered", provider.Status)
+		assert.Equal(t, "30003", provider.ErrorCode)
+	})
+
+	t.Run("Ignores Replaced Messages", func(t *testing.T) {
+		r, api := setupTwilioServer(t)
+
+		rec := postJSON(r, "/otp/generate", models.GenerateRequest{Username: "+14155550123", MessageType: "sms"})
+		var resp map[string]string
+		_ = json.Unmarshal(rec.Body.Bytes(), &resp)
+		_, oldSID := api.last()
+
+		rec = postJSON(r, "/otp/resend", models.ResendRequest{SessionID: resp["sessionId"]})
+		assert.Equal(t, http.StatusOK, rec.Code)
+		_, newSID := api.last()
+		assert.NotEqual(t, oldSID, newSID)
+
+		rec = postTwilioStatus(r, oldSID, "failed", "")
+		assert.Equal(t, http.StatusNoContent, rec.Code)
+		provider := providerStatus(t, r, resp["sessionId"])
+		assert.Equal(t, newSID, provider.MessageID)
+		assert.Equal(t, "queued", provider.Status, "Expected the report about the replaced message to be ignored")
+	})
+
+	t.Run("Unknown Message", func(t *testing.T) {
+		r, _ := setupTwilioServer(t)
+
+		rec := postTwilioStatus(r, "SMunknown", "delivered", "")
+		assert.Equal(t, http.StatusNoContent, rec.Code)
+	})
+
+	t.Run("Rejects Invalid Signatures", func(t *testing.T) {
+		r, api := setupTwilioServer(t)
+
+		rec := postJSON(r, "/otp/generate", models.GenerateRequest{Username: "+14155550124", MessageType: "sms"})
+		var resp map[string]string
+		_ = json.Unmarshal(rec.Body.Bytes(), &resp)
+		_, sid := api.last()
+
+		forged := twilioSignature("wrong-token", testTwilioCallbackURL, url.Values{"MessageSid": {sid}, "MessageStatus": {"delivered"}})
+		for _, signature := range []string{forged, "not-a-signature"} {
+			rec = postTwilioStatus(r, sid, "delivered", signature)
+			assert.Equal(t, http.StatusForbidden, rec.Code)
+			assert.Contains(t, rec.Body.String(), `"code":"invalid_signature"`)
+		}
+		assert.Equal(t, "queued", providerStatus(t, r, resp["sessionId"]).Status)
+	})
+}
+
+func TestValidateTwilioSignature(t *testing.T) {
+	params := url.Values{"MessageSid": {"SM1"}, "MessageStatus": {"sent"}, "To": {"+14155550125"}}
+	signature := twilioSignature(testTwilioToken, testTwilioCallbackURL, params)
+
+	assert.True(t, messaging.ValidateTwilioSignature(testTwilioToken, testTwilioCallbackURL, params, signature))
+	assert.False(t, messaging.ValidateTwilioSignature(testTwilioToken, testTwilioCallbackURL+"?x=1", params, signature), "Expected the URL to be signed")
+	assert.False(t, messaging.ValidateTwilioSignature("", testTwilioCallbackURL, params, signature), "Expected nothing to be valid without a token")
+
+	params.Set("MessageStatus", "delivered")
+	assert.False(t, messaging.ValidateTwilioSignature(testTwilioToken, testTwilioCallbackURL, params, signature), "Expected the params to be signed")
+}
+
+func TestTwilioUnreadableResponse(t *testing.T) {
+	var mu sync.Mutex
+	requests := 0
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte("<html>not json</html>"))
+	}))
+	defer apiServer.Close()
+	twilio := messaging.NewTwilioService(messaging.TwilioConfig{AccountSID: "AC123", AuthToken: testTwilioToken, PhoneNumber: "+14155550100", BaseURL: apiServer.URL})
+
+	// The message was created, so it counts as sent rather than being sent again
+	sid, err := twilio.SMSSender().SendMessage(messaging.Message{To: "+14155550126", Text: "Your code is 123456"})
+	assert.NoError(t, err)
+	assert.Empty(t, sid)
+	assert.NoError(t, twilio.VoiceSender().SendOTP("+14155550126", "123456"))
+
+	mu.Lock()
+	assert.Equal(t, 2, requests)
+	mu.Unlock()
+}
@@ -0,0 +1,140 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/RoMalms10/otp-generator/config"
+	"github.com/RoMalms10/otp-generator/messaging"
+	"github.com/RoMalms10/otp-generator/models"
+	"github.com/RoMalms10/otp-generator/server"
+	"github.com/RoMalms10/otp-generator/service"
+	"github.com/gorilla/mux"
+)
+
+// twiml is the part of a TwiML document that voice calls use
+type twiml struct {
+	Says []struct {
+		Voice    string `xml:"voice,attr"`
+		Language string `xml:"language,attr"`
+		Text     string `xml:",chardata"`
+	} `xml:"Say"`
+	Pauses []struct {
+		Length int `xml:"length,attr"`
+	} `xml:"Pause"`
+}
+
+// setupVoiceServer creates a router whose voice channel calls through a fake Twilio API
+func setupVoiceServer(t *testing.T, dir string) (*mux.Router, *fakeTwilio) {
+	defer func(dir, name string) { config.TemplateDir, config.AppName = dir, name }(config.TemplateDir, config.AppName)
+	config.TemplateDir = dir
+	config.AppName = "Acme & Co"
+
+	api := &fakeTwilio{}
+	apiServer := httptest.NewServer(api)
+	t.Cleanup(apiServer.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	twilio := messaging.NewTwilioService(messaging.TwilioConfig{
+		AccountSID:    "AC123",
+		AuthToken:     testTwilioToken,
+		PhoneNumber:   "+14155550100",
+		BaseURL:       apiServer.URL,
+		Voice:         "Polly.Joanna",
+		VoiceLanguage: "en-US",
+	})
+	senders := newTestSenders()
+	senders.Register(models.MessageTypeVoice, twilio.VoiceSender())
+	return server.NewRouter(service.NewMemoryStore(), ctx, 5*time.Minute, senders), api
+}
+
+func TestVoiceChannel(t *testing.T) {
+	t.Run("Reads The Code Twice", func(t *testing.T) {
+		r, api := setupVoiceServer(t, "")
+
+		rec := postJSON(r, "/otp/generate", models.GenerateRequest{
+			Username: "+1 (415) 555-0161", MessageType: "voice", Format: &models.OTPFormat{GroupSize: 3},
+		})
+		assert.Equal(t, http.StatusOK, rec.Code)
+		var resp map[string]string
+		_ = json.Unmarshal(rec.Body.Bytes(), &resp)
+		assert.Equal(t, "voice", resp["channel"])
+
+		call := api.lastRequest()
+		assert.Equal(t, "/Accounts/AC123/Calls.json", call.Path)
+		assert.Equal(t, "AC123", call.AccountID)
+		assert.Equal(t, testTwilioToken, call.Token)
+		assert.Equal(t, "+14155550161", call.Form.Get("To"), "Expected the number to be normalized")
+		assert.Equal(t, "+14155550100", call.Form.Get("From"))
+
+		var doc twiml
+		assert.NoError(t, xml.Unmarshal([]byte(call.Form.Get("Twiml")), &doc), "Expected valid TwiML")
+		if assert.Len(t, doc.Says, 2) {
+			assert.Equal(t, doc.Says[0], doc.Says[1], "Expected the code to be read twice")
+			assert.Equal(t, "Polly.Joanna", doc.Says[0].Voice)
+			assert.Equal(t, "en-US", doc.Says[0].Language)
+			assert.Regexp(t, `^Your Acme & Co verification code is: \d, \d, \d, \d, \d, \d\.$`, doc.Says[0].Text)
+		}
+		assert.Len(t, doc.Pauses, 1)
+	})
+
+	t.Run("Validates The Spoken Code", func(t *testing.T) {
+		defer func(mode string) { config.RunMode = mode }(config.RunMode)
+		config.RunMode = config.RunModeDevelopment
+		r, api := setupVoiceServer(t, "")
+
+		rec := postJSON(r, "/otp/generate", models.GenerateRequest{Username: "+14155550162", MessageType: "voice"})
+		var resp map[string]string
+		_ = json.Unmarshal(rec.Body.Bytes(), &resp)
+
+		form, _ := api.last()
+		assert.Contains(t, form.Get("Twiml"), messaging.SpokenCode(resp["otp"]))
+		rec = validateSession(r, resp["sessionId"], resp["otp"])
+		assert.Equal(t, http.StatusOK, rec.Code)
+	})
+
+	t.Run("Uses Templates", func(t *testing.T) {
+		dir := writeTemplates(t, map[string]string{
+			"es/voice.txt": "Su código de {{.AppName}} es: {{.SpokenCode}}.",
+		})
+		r, api := setupVoiceServer(t, dir)
+
+		rec := postJSON(r, "/otp/generate", models.GenerateRequest{Username: "+14155550163", MessageType: "voice", Locale: "es-MX"})
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		form, _ := api.last()
+		var doc twiml
+		assert.NoError(t, xml.Unmarshal([]byte(form.Get("Twiml")), &doc))
+		assert.Regexp(t, `^Su código de Acme & Co es: \d, \d, \d, \d, \d, \d\.$`, doc.Says[0].Text)
+	})
+
+	t.Run("Requires A Phone Number", func(t *testing.T) {
+		r, _ := setupVoiceServer(t, "")
+
+		rec := postJSON(r, "/otp/generate", models.GenerateRequest{Username: "voice@example.com", MessageType: "voice"})
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Contains(t, rec.Body.String(), `"code":"invalid_destination"`)
+	})
+
+	t.Run("Unconfigured", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		r := server.NewRouter(service.NewMemoryStore(), ctx, time.Minute, newTestSenders())
+
+		rec := postJSON(r, "/otp/generate", models.GenerateRequest{Username: "+14155550164", MessageType: "voice"})
+		assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	})
+}
+
+func TestSpokenCode(t *testing.T) {
+	assert.Equal(t, "1, 2, 3, 4, 5, 6", messaging.SpokenCode("123-456"))
+	assert.Equal(t, "A, 7, K, 9", messaging.SpokenCode("A7K9"))
+}